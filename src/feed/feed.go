@@ -1,18 +1,341 @@
 package feed
 
 import (
+	"context"
 	"math"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 	"src/lock"
 )
 
 // Feed represents a user's twitter feed
 // You will add to this interface the implementations as you complete them.
+// No post can have an infinite timestamp, since those are the timestamps of the sentinels at the ends
+// of a feed: adding such a post does nothing and returns id 0, and looking one up finds nothing.
 type Feed interface {
-	Add(body string, timestamp float64)
+	Add(body string, timestamp float64) uint64
+	AddWithEviction(body string, timestamp float64) (id uint64, evicted bool)
+	AddWithAuthor(body string, author string, timestamp float64) (id uint64, evicted bool)
 	Remove(timestamp float64) bool
+	RemoveRange(from float64, to float64) int
+	RemoveIf(timestamp float64, expectedBody string) bool
+	RemoveOldest() ([]byte, bool)
+	RemoveNewest() ([]byte, bool)
+	Pop(timestamp float64) ([]byte, bool)
+	TrimToNewest(n int) int
+	Compact() int
 	Contains(timestamp float64) bool
+	ContainsApprox(timestamp float64, epsilon float64) bool
+	ContainsBodies(bodies []string) map[string]bool
+	ContainsAll(timestamps []float64) map[float64]bool
+	IndexOf(timestamp float64) (int, bool)
 	ShowFeed() [][]byte
+	ShowFeedSince(since float64) [][]byte
+	ShowFeedSnapshot() [][]byte
+	ShowFeedOldestFirst(limit int) [][]byte
+	ShowFeedPosts() []PostView
+	Diff(old [][]byte) (added [][]byte, removed [][]byte)
+	RemoveByID(id uint64) bool
+	GetByID(id uint64) ([]byte, bool)
+	GetNthRecent(n int) ([]byte, bool)
+	Successor(timestamp float64) ([]byte, bool)
+	Predecessor(timestamp float64) ([]byte, bool)
+	Closest(timestamp float64) ([]byte, bool)
+	Reschedule(oldTimestamp float64, newTimestamp float64) bool
+	Like(timestamp float64) bool
+	TopLiked(n int) [][]byte
+	AddIdempotent(body string, author string, timestamp float64, key string) (id uint64, added bool)
+	Upsert(body string, author string, timestamp float64) (created bool)
+	SwapBody(timestamp float64, newBody string) (old string, ok bool)
+	Stats() FeedStats
+	Count() int
+	IsEmpty() bool
+	Version() uint64
+	SetCapacityWarning(threshold int, callback func(current int))
+	CountMatching(substr string) int
+	TotalBodyBytes() int64
+	BucketCounts(bucketSeconds float64) map[int64]int
+	ForEach(order Order, fn func(body string, timestamp float64) bool)
+	Validate() error
+	Merge(other Feed)
+	ReplaceAll(posts []PostView) error
+	Clone() Feed
+	SearchByAuthor(author string) [][]byte
+	WaitFor(timestamp float64, timeout time.Duration) bool
+	Subscribe() <-chan FeedEvent
+	Unsubscribe(events <-chan FeedEvent)
+}
+
+// RankedFeed represents a Feed whose posts also have a score, e.g. for a ranked timeline ordered by a
+// comparator instead of by timestamp. AddWithScore inserts a post with a score like AddWithAuthor.
+type RankedFeed interface {
+	Feed
+	AddWithScore(body string, author string, score float64, timestamp float64) (id uint64, evicted bool)
+}
+
+// SnapshotFeed represents a Feed that can answer reads from a cached snapshot of its posts instead of
+// waiting for its lock, e.g. when the maximum number of readers already hold it under heavy load.
+// SetSnapshotRefresh turns the snapshot on and sets how often it is refreshed, or turns it off if the
+// interval is not positive. ShowFeedPostsNow returns the posts like ShowFeedPosts together with the
+// version they are from, whether they came from the snapshot and if so how old it is.
+type SnapshotFeed interface {
+	Feed
+	SetSnapshotRefresh(interval time.Duration)
+	ShowFeedPostsNow() (posts []PostView, version uint64, cached bool, age time.Duration)
+}
+
+// FeedStats summarizes a feed. Oldest and Newest are 0 if the feed is empty.
+type FeedStats struct {
+	Count      int     `json:"count"`      // number of posts in the feed
+	Oldest     float64 `json:"oldest"`     // timestamp of the oldest post
+	Newest     float64 `json:"newest"`     // timestamp of the newest post
+	TotalLikes int     `json:"totalLikes"` // likes summed over every post
+}
+
+// Order selects which end of the feed a walk over its posts starts from.
+type Order int
+
+const (
+	// NewestFirst starts from the post with the most recent timestamp, the order ShowFeed uses.
+	NewestFirst Order = iota
+	// OldestFirst starts from the post with the oldest timestamp.
+	OldestFirst
+)
+
+// TieBreak selects the order ShowFeed shows posts with the same timestamp in.
+type TieBreak int
+
+const (
+	// TieBreakID shows the most recently added post first.
+	TieBreakID TieBreak = iota
+	// TieBreakBody shows posts in lexicographic order of their bodies, which does not depend on
+	// the order the posts were added in. Posts with the same body fall back to TieBreakID.
+	TieBreakBody
+)
+
+// shownBefore reports whether post a is shown before post b, which has the same timestamp.
+func (tb TieBreak) shownBefore(a *post, b *post) bool {
+	if tb == TieBreakBody && a.body != b.body {
+		return a.body < b.body
+	}
+	return a.id > b.id
+}
+
+// ByScore is a comparator for NewFeedWithComparator that shows the post with the highest score first.
+// Posts with the same score are shown newest first.
+func ByScore(a *post, b *post) bool {
+	return a.score > b.score || (a.score == b.score && a.timestamp > b.timestamp)
+}
+
+// maxKeys is how many ADD keys a feed remembers for AddIdempotent. Once there are more
+// keys the oldest key is forgotten, which bounds the memory used to detect retries.
+const maxKeys = 10000
+
+// capacityWarning is the soft limit on the number of posts in a feed set by SetCapacityWarning.
+type capacityWarning struct {
+	threshold int               // the number of posts the feed can have without a warning
+	callback  func(current int) // called with the number of posts each time an add takes the feed over threshold
+}
+
+// notify calls the callback if an add left the feed with current posts and so took it over the
+// threshold. Posts are added one at a time, so the feed crosses the threshold going up exactly when an
+// add leaves it with one post more than the threshold. notify does nothing on a nil warning.
+func (w *capacityWarning) notify(current int) {
+	if w != nil && current == w.threshold+1 {
+		w.callback(current)
+	}
+}
+
+// newCapacityWarning returns the warning for SetCapacityWarning, or nil to turn the warning off if
+// there is no callback.
+func newCapacityWarning(threshold int, callback func(current int)) *capacityWarning {
+	if callback == nil {
+		return nil
+	}
+	return &capacityWarning{threshold: threshold, callback: callback}
+}
+
+// addedSignal wakes up the goroutines waiting in WaitFor each time a post is added to a feed. The waiters
+// wait for the current channel to be closed, and each signal closes it and replaces it with a new one, so
+// every waiter is woken up at once. Waiters check the feed without holding the mutex, so a feed can signal
+// while it holds its own lock without the two locks ever being taken in the opposite order. The mutex is
+// only taken to signal if there are waiters.
+type addedSignal struct {
+	mutex   sync.Mutex    // guards changed
+	changed chan struct{} // closed once a post is added, then replaced for the next post
+	waiters int32         // number of goroutines in waitFor, only changed atomically
+}
+
+// newAddedSignal creates a signal with no waiters.
+func newAddedSignal() *addedSignal {
+	return &addedSignal{changed: make(chan struct{})}
+}
+
+// signal wakes up the waiters once a post has been added.
+// The post is added before the waiters are counted and a waiter is counted before it checks the feed, so
+// either the waiter finds the post or the signal sees the waiter.
+func (s *addedSignal) signal() {
+	if atomic.LoadInt32(&s.waiters) > 0 {
+		s.mutex.Lock()
+		close(s.changed)
+		s.changed = make(chan struct{})
+		s.mutex.Unlock()
+	}
+}
+
+// current returns the channel closed by the next signal.
+func (s *addedSignal) current() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.changed
+}
+
+// waitFor blocks until found returns true, checking again each time a post is added, or until ctx is done.
+// It returns the last result of found. A waiter takes the channel before it calls found, so a post added
+// after found has looked closes the channel and cannot be missed.
+func (s *addedSignal) waitFor(ctx context.Context, found func() bool) bool {
+	atomic.AddInt32(&s.waiters, 1)
+	defer atomic.AddInt32(&s.waiters, -1)
+
+	for {
+		changed := s.current()
+		if found() {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return found()
+		}
+	}
+}
+
+// waitForTimeout is waitFor with a deadline timeout from now, for the WaitFor method of a feed.
+func (s *addedSignal) waitForTimeout(found func() bool, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.waitFor(ctx, found)
+}
+
+// EventKind is the kind of change to a feed a FeedEvent describes.
+type EventKind int
+
+const (
+	// PostAdded is sent when a post is added to a feed.
+	PostAdded EventKind = iota
+	// PostRemoved is sent when a post is removed from a feed, including when it is evicted.
+	PostRemoved
+	// PostEdited is sent when the body or the likes of a post change.
+	PostEdited
+)
+
+// String returns the name of the kind of change, e.g. for a client streaming the events as JSON.
+func (k EventKind) String() string {
+	switch k {
+	case PostAdded:
+		return "added"
+	case PostRemoved:
+		return "removed"
+	case PostEdited:
+		return "edited"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// FeedEvent describes one change to a feed for the subscribers of the feed. A post moved by Reschedule
+// is sent as the post removed from its old timestamp and added at its new one; the lock-free feed adds
+// the post at its new timestamp first.
+type FeedEvent struct {
+	Kind EventKind
+	Post []byte // the post in the same byte form as ShowFeed, as it is after the change or was before its removal
+}
+
+// subscriberBuffer is the number of events a subscriber can fall behind by before events are dropped for it.
+const subscriberBuffer = 256
+
+// eventHub fans the events of a feed out to its subscribers. Sending an event never blocks: an event is
+// dropped for a subscriber whose channel is full, so a slow subscriber cannot hold up the writers of
+// the feed. The number of subscribers is kept atomically so a feed without any does not build events.
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[<-chan FeedEvent]chan FeedEvent
+	count       atomic.Int32 // number of subscribers
+	held        []FeedEvent  // events held back since hold was called, sent by release
+	holding     bool         // events are held back rather than sent
+}
+
+// newEventHub creates a hub with no subscribers.
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[<-chan FeedEvent]chan FeedEvent)}
+}
+
+// subscribe returns a new channel that every event is sent to until it is unsubscribed.
+func (h *eventHub) subscribe() <-chan FeedEvent {
+	events := make(chan FeedEvent, subscriberBuffer)
+	h.mutex.Lock()
+	h.subscribers[events] = events
+	h.count.Add(1)
+	h.mutex.Unlock()
+	return events
+}
+
+// unsubscribe stops sending events to the channel and closes it. It does nothing if the channel is
+// not subscribed.
+func (h *eventHub) unsubscribe(events <-chan FeedEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if ch, ok := h.subscribers[events]; ok {
+		delete(h.subscribers, events)
+		h.count.Add(-1)
+		close(ch)
+	}
+}
+
+// active reports whether the hub has any subscribers.
+func (h *eventHub) active() bool {
+	return h.count.Load() > 0
+}
+
+// publish sends the event to every subscriber that has room for it, or holds it back until release.
+func (h *eventHub) publish(event FeedEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.holding {
+		h.held = append(h.held, event)
+		return
+	}
+	for _, ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default: // The subscriber is behind, so it misses the event.
+		}
+	}
+}
+
+// hold holds back the events published from now on until release is called, e.g. until the change
+// they describe can be seen by readers.
+func (h *eventHub) hold() {
+	h.mutex.Lock()
+	h.holding = true
+	h.mutex.Unlock()
+}
+
+// release sends the events held back since hold, in the order they were published.
+func (h *eventHub) release() {
+	h.mutex.Lock()
+	held := h.held
+	h.held, h.holding = nil, false
+	h.mutex.Unlock()
+	for _, event := range held {
+		h.publish(event)
+	}
 }
 
 // feed is the internal representation of a user's twitter feed (hidden from outside packages)
@@ -21,6 +344,29 @@ type Feed interface {
 type feed struct {
 	start *post // a pointer to the beginning post
 	lock   lock.RWMutex // a read-write lock on the feed - coarse grained
+	lastID uint64 // the id given to the most recently added post
+	keys   map[string]uint64 // ids of the posts added by AddIdempotent by their keys
+	keyOrder []string // keys in the order they were added so the oldest can be forgotten first
+	tieBreak TieBreak // order of posts with the same timestamp
+	size     atomic.Int64 // number of posts in the feed, only changed under the write lock but read by Count without it
+	maxPosts int // the oldest post is evicted once there are more posts than this, 0 for no limit
+	less     func(a *post, b *post) bool // reports whether post a is shown before post b, nil to order posts by timestamp
+	added    *addedSignal // wakes up goroutines in WaitFor when a post is added
+	warning  *capacityWarning // set by SetCapacityWarning, nil if there is none
+	events   *eventHub // sends the changes to the feed to its subscribers
+	version  atomic.Uint64 // number of changes ever made to posts, only changed under the write lock but read by Version without it
+	snapshot atomic.Value  // the *feedSnapshot served by ShowFeedPostsNow, nil while SetSnapshotRefresh has not turned it on
+	snapshotMutex sync.Mutex // guards stopSnapshot and storing the snapshot
+	stopSnapshot  chan struct{} // closed to stop the goroutine refreshing the snapshot, nil if there is none
+	pool          *postPool     // the posts Add reuses, set by NewFeedWithCapacity, nil to allocate every post
+	exact         bool          // the posts keep exact int64 timestamps in nanos, set by NewFeedInt64
+}
+
+// feedSnapshot is a copy of the posts of a feed taken under its read lock.
+type feedSnapshot struct {
+	posts   []PostView // the posts, newest first
+	version uint64     // the version of the feed the posts are from
+	taken   time.Time  // when the posts were copied, to report the age of the snapshot
 }
 
 // post is the internal representation of a post on a user's twitter feed (hidden from outside packages)
@@ -30,66 +376,395 @@ type post struct {
 	body      string // the text of the post
 	timestamp float64  // Unix timestamp of the post
 	next      *post  // the next post in the feed
-	
+	id        uint64 // unique id of the post, independent of its timestamp
+	likes     int    // number of times the post has been liked
+	author    string // who wrote the post, empty if unknown
+	score     float64 // rank of the post for a feed ordered by score
+	nanos     int64  // exact timestamp of the post in a feed made by NewFeedInt64, e.g. in Unix nanoseconds
+	exact     bool   // whether nanos is the timestamp of the post, so it is written as an exact integer
 }
 
 // postBodyTimestamp is a structure that allows post data for FEED return in twitter.gp.
 type postBodyTimestamp struct {
 	Body      string 
 	Timestamp float64	
+	Likes     int     `json:",omitempty"`
+	Author    string  `json:",omitempty"`
+	Score     float64 `json:",omitempty"`
+}
+
+// postBodyInt64Timestamp is the form ShowFeed returns the posts of a feed with int64 timestamps in. The
+// timestamp is marshalled as an exact integer.
+type postBodyInt64Timestamp struct {
+	Body      string
+	Timestamp int64
+	Likes     int     `json:",omitempty"`
+	Author    string  `json:",omitempty"`
+	Score     float64 `json:",omitempty"`
+}
+
+// marshal puts the post's body, timestamp, likes, author and score in to byte data in the form ShowFeed returns.
+// The timestamp of a post with an exact int64 timestamp is written as that integer.
+func (p *post) marshal() []byte {
+	if p.exact {
+		postByte, _ := json.Marshal(postBodyInt64Timestamp{Body: p.body, Timestamp: p.nanos, Likes: p.likes, Author: p.author, Score: p.score})
+		return postByte
+	}
+	postByte, _ := json.Marshal(postBodyTimestamp{Body: p.body, Timestamp: p.timestamp, Likes: p.likes, Author: p.author, Score: p.score})
+	return postByte
+}
+
+// PostView is a post as ShowFeedPosts returns it. It has the fields ShowFeed marshals, so a caller that
+// builds its own response from the posts does not have to unmarshal them first.
+type PostView struct {
+	Body      string  // the text of the post
+	Timestamp float64 // Unix timestamp of the post
+	Likes     int     // number of times the post has been liked
+	Author    string  // who wrote the post, empty if unknown
+	Score     float64 // rank of the post for a feed ordered by score
+	Nanos     int64   // exact timestamp of the post if Exact is set, e.g. in Unix nanoseconds
+	Exact     bool    // whether the post has the exact int64 timestamp Nanos, as in a feed made by NewFeedInt64
+}
+
+// view copies the post's body, timestamp, likes, author and score in to the form ShowFeedPosts returns.
+func (p *post) view() PostView {
+	return PostView{Body: p.body, Timestamp: p.timestamp, Likes: p.likes, Author: p.author, Score: p.score, Nanos: p.nanos, Exact: p.exact}
 }
 
 // NewPost creates and returns a new post value given its body and timestamp
 func newPost(body string, timestamp float64, next *post) *post {
-	return &post{body, timestamp, next}
+	return &post{body: body, timestamp: timestamp, next: next}
+}
+
+// postPool is a free-list of posts a feed reuses instead of allocating a post for every Add. It is
+// filled from one arena up front and a removed post goes back on it. It is only used under the write
+// lock of the feed, so it has no lock of its own.
+type postPool struct {
+	free []*post // the posts that are not in the feed
+}
+
+// newPostPool creates a pool of size posts allocated in one block.
+func newPostPool(size int) *postPool {
+	arena := make([]post, size)
+	pool := &postPool{free: make([]*post, size)}
+	for i := range arena {
+		pool.free[i] = &arena[i]
+	}
+	return pool
+}
+
+// get takes a post off the free-list, or allocates one if the list is empty, and sets its body,
+// timestamp and next. The other fields of a reused post are cleared.
+func (pool *postPool) get(body string, timestamp float64, next *post) *post {
+	if len(pool.free) == 0 {
+		return newPost(body, timestamp, next)
+	}
+	p := pool.free[len(pool.free)-1]
+	pool.free = pool.free[:len(pool.free)-1]
+	*p = post{body: body, timestamp: timestamp, next: next}
+	return p
+}
+
+// put puts a post that has been unlinked from the feed back on the free-list. Its fields are cleared
+// so the pool does not keep the body and the rest of the feed alive. A nil pool drops the post.
+func (pool *postPool) put(p *post) {
+	if pool == nil {
+		return
+	}
+	*p = post{}
+	pool.free = append(pool.free, p)
 }
 
 //NewFeed creates a empty user feed
 func NewFeed() Feed {
+	return NewFeedWithLock(lock.NewRWMutex())
+}
+
+// NewFeedWithLock creates an empty user feed that is protected by the given lock
+// instead of the default one, e.g. a sync.RWMutex or a mock in tests.
+func NewFeedWithLock(lock lock.RWMutex) Feed {
+	return newFeed(lock, TieBreakID)
+}
+
+// NewFeedWithTieBreak creates an empty user feed that shows posts with the same timestamp
+// in the order given by tieBreak.
+func NewFeedWithTieBreak(tieBreak TieBreak) Feed {
+	return newFeed(lock.NewRWMutex(), tieBreak)
+}
+
+// NewBoundedFeed creates an empty user feed that holds at most maxPosts posts. Once adding
+// a post takes the feed over maxPosts posts the oldest post is evicted.
+func NewBoundedFeed(maxPosts int) Feed {
+	f := newFeed(lock.NewRWMutex(), TieBreakID)
+	f.maxPosts = maxPosts
+	return f
+}
+
+// NewFeedWithComparator creates an empty user feed that is ordered by less instead of by timestamp.
+// less reports whether post a is shown before post b in ShowFeed, e.g. ByScore for a ranked timeline;
+// posts that less does not order are shown most recently added first. A nil less orders posts by
+// timestamp like NewFeed.
+// Posts with a timestamp can be anywhere in a feed with a comparator, so the methods that look for a
+// timestamp walk the whole feed rather than stopping at the first later timestamp. The methods that work
+// on the ends of the feed, e.g. RemoveOldest and GetNthRecent, work on the posts shown last and first.
+func NewFeedWithComparator(less func(a *post, b *post) bool) Feed {
+	f := newFeed(lock.NewRWMutex(), TieBreakID)
+	f.less = less
+	return f
+}
+
+// isSentinel reports whether timestamp is the timestamp of one of the sentinels at the ends of a feed,
+// math.Inf(-1) or math.Inf(1), which no post can have.
+func isSentinel(timestamp float64) bool {
+	return math.IsInf(timestamp, 0)
+}
+
+// NewFeedWithCapacity creates an empty user feed that expects to hold about hint posts. The posts are
+// allocated up front in one block and the posts removed from the feed are reused, so adding up
+// to hint posts does not allocate a post each time. Past hint posts Add allocates like NewFeed.
+func NewFeedWithCapacity(hint int) Feed {
+	f := newFeed(lock.NewRWMutex(), TieBreakID)
+	if hint > 0 {
+		f.pool = newPostPool(hint)
+	}
+	return f
+}
+
+// newPost creates a post for the feed, taken from its pool if it has one. In a feed with int64 timestamps
+// the exact timestamp of the post is the timestamp rounded toward zero. The caller must hold the write lock.
+func (f *feed) newPost(body string, timestamp float64, next *post) *post {
+	var p *post
+	if f.pool != nil {
+		p = f.pool.get(body, timestamp, next)
+	} else {
+		p = newPost(body, timestamp, next)
+	}
+	if f.exact {
+		p.nanos, p.exact = nanosOf(timestamp), true
+	}
+	return p
+}
+
+// nanosOf converts a float64 timestamp to an int64 one, rounding toward zero and clamping timestamps
+// past the range of an int64 to its ends. NaN is 0.
+func nanosOf(timestamp float64) int64 {
+	switch {
+	case math.IsNaN(timestamp):
+		return 0
+	case timestamp >= math.MaxInt64:
+		return math.MaxInt64
+	case timestamp <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(timestamp)
+}
+
+// newFeed creates an empty user feed with the given lock and tie-break.
+func newFeed(lock lock.RWMutex, tieBreak TieBreak) *feed {
 	initFeed := newPost("null", math.Inf(-1), newPost("", math.Inf(1), nil))
-	lock := lock.NewRWMutex()
-	return &feed{start: initFeed, lock: lock}
+	return &feed{start: initFeed, lock: lock, keys: make(map[string]uint64), tieBreak: tieBreak, added: newAddedSignal(), events: newEventHub()}
 }
 
 // Add inserts a new post to the feed. The feed is always ordered by the timestamp where
 // the most recent timestamp is at the beginning of the feed followed by the second most
 // recent timestamp, etc. You may need to insert a new post somewhere in the feed because
 // the given timestamp may not be the most recent.
+// Each post is given a unique id, assigned atomically, which Add returns.
+// Implemented with coarse-grained locking.
+func (f *feed) Add(body string, timestamp float64) uint64 {
+	id, _ := f.AddWithEviction(body, timestamp)
+	return id
+}
+
+// AddWithEviction inserts a new post like Add. If the feed is bounded and the new post takes
+// it over its maximum number of posts then the oldest post is evicted, which may be the new
+// post itself. Return the id of the new post and whether a post was evicted.
+// Implemented with coarse-grained locking.
+func (f *feed) AddWithEviction(body string, timestamp float64) (id uint64, evicted bool) {
+	return f.AddWithAuthor(body, "", timestamp)
+}
+
+// AddWithAuthor inserts a new post written by author like AddWithEviction. The post is still
+// ordered by its timestamp. Return the id of the new post and whether a post was evicted.
 // Implemented with coarse-grained locking.
-func (f *feed) Add(body string, timestamp float64) {
+func (f *feed) AddWithAuthor(body string, author string, timestamp float64) (id uint64, evicted bool) {
+	return f.AddWithScore(body, author, 0, timestamp)
+}
+
+// AddWithScore inserts a new post written by author with the given score like AddWithAuthor. The
+// score only changes where the post goes in a feed with a comparator that uses it, e.g. ByScore.
+// Return the id of the new post and whether a post was evicted.
+// Implemented with coarse-grained locking.
+func (f *feed) AddWithScore(body string, author string, score float64, timestamp float64) (id uint64, evicted bool) {
+	if isSentinel(timestamp) {
+		return 0, false
+	}
 	f.lock.Lock()
+	id, evicted = f.add(body, author, score, timestamp)
+	warning, count := f.warning, f.length()
+	f.lock.Unlock()
+
+	// The callback may call back into the feed so it is called once the lock is released.
+	if !evicted {
+		warning.notify(count)
+	}
+	return id, evicted
+}
 
+// add does the work of AddWithScore. The caller must hold the write lock.
+func (f *feed) add(body string, author string, score float64, timestamp float64) (uint64, bool) {
+	newPost := f.newPost(body, timestamp, nil)
+	newPost.author = author
+	newPost.score = score
+	return f.addPost(newPost)
+}
+
+// addPost gives a new post its id and links it in to the feed, evicting the oldest post if the feed is
+// over its bound. It returns the id of the post and whether a post was evicted. The caller must hold the
+// write lock.
+func (f *feed) addPost(newPost *post) (uint64, bool) {
+	newPost.id = atomic.AddUint64(&f.lastID, 1)
+	f.link(newPost)
+
+	// Evict the oldest post, which is just past the head sentinel, if the feed is over its bound.
+	if f.maxPosts > 0 && f.length() > f.maxPosts {
+		f.unlink(f.start)
+		return newPost.id, true
+	}
+	return newPost.id, false
+}
+
+// shownBefore reports whether post a is shown before post b in ShowFeed. Without a comparator the
+// newer post is shown first. Posts with the same timestamp, or that the comparator does not order,
+// are shown in the order of the feed's tie-break so that ShowFeed always shows them in the same order.
+// Posts whose int64 timestamps are the same float64 are ordered by their int64 timestamps first.
+func (f *feed) shownBefore(a *post, b *post) bool {
+	if f.less != nil {
+		return f.less(a, b) || (!f.less(b, a) && f.tieBreak.shownBefore(a, b))
+	}
+	if a.timestamp != b.timestamp {
+		return a.timestamp > b.timestamp
+	}
+	return a.nanos > b.nanos || (a.nanos == b.nanos && f.tieBreak.shownBefore(a, b))
+}
+
+// link inserts a post at its place in the feed and wakes up the goroutines waiting for a post.
+// The caller must hold the write lock.
+func (f *feed) link(newPost *post) {
 	pred := f.start
+
+	// The feed is shown in reverse so skip the posts shown after the new post.
+	for pred.next.timestamp != math.Inf(1) && f.shownBefore(newPost, pred.next) {
+		pred = pred.next
+	}
+	newPost.next = pred.next
+	pred.next = newPost
+	f.size.Add(1)
+	f.added.signal()
+	f.emit(PostAdded, newPost)
+}
+
+// unlink removes the post after pred from the feed: the count goes down, the removal is emitted and the
+// post goes back on the pool, so the caller must not use it afterwards. The caller must hold the write lock.
+func (f *feed) unlink(pred *post) {
 	curr := pred.next
+	pred.next = curr.next
+	f.size.Add(-1)
+	f.emit(PostRemoved, curr)
+	f.pool.put(curr)
+}
 
-	for (curr.timestamp < timestamp) {
-		pred = curr
+// emit records a change to post p: the version of the feed goes up and an event is sent to the subscribers
+// of the feed. The caller must hold the write lock, so subscribers get the events in the order the changes
+// were made.
+func (f *feed) emit(kind EventKind, p *post) {
+	f.version.Add(1)
+	if f.events.active() {
+		f.events.publish(FeedEvent{Kind: kind, Post: p.marshal()})
+	}
+}
+
+// seek reports whether a walk looking for the first post with the given timestamp must go on past
+// post curr. The feed is sorted by timestamp so the walk stops at the first post that is not older,
+// unless the feed has a comparator: then a post with the timestamp can be anywhere so the walk only
+// stops at one or at the tail sentinel. Either way the walk has found a post with the timestamp if
+// the post it stops at has it.
+func (f *feed) seek(curr *post, timestamp float64) bool {
+	if f.less != nil {
+		return curr.timestamp != timestamp && curr.timestamp != math.Inf(1)
+	}
+	return curr.timestamp < timestamp
+}
+
+// Upsert inserts a new post written by author like AddWithAuthor if no post has the given timestamp,
+// otherwise it replaces the body of the post with the timestamp and keeps its author. Return true if
+// a new post was created and false if an existing post was updated. The check and the change happen
+// under one write lock so two upserts of the same timestamp never both create a post.
+// Implemented with coarse-grained locking.
+func (f *feed) Upsert(body string, author string, timestamp float64) (created bool) {
+	if isSentinel(timestamp) {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	curr := f.start.next
+	for f.seek(curr, timestamp) {
 		curr = curr.next
 	}
-	
-	newPost := newPost(body, timestamp, curr)
-	pred.next = newPost
+	if curr.timestamp == timestamp {
+		curr.body = body
+		f.emit(PostEdited, curr)
+		return false
+	}
+	f.add(body, author, 0, timestamp)
+	return true
+}
 
-	f.lock.Unlock()
+// SwapBody replaces the body of the post with the given timestamp with newBody and returns the
+// body it had, e.g. to record the edit so it can be undone. The body is read and replaced under one
+// write lock so no other edit can come in between. Return false if no post has the timestamp.
+// Implemented with coarse-grained locking.
+func (f *feed) SwapBody(timestamp float64, newBody string) (old string, ok bool) {
+	if isSentinel(timestamp) {
+		return "", false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	curr := f.start.next
+	for f.seek(curr, timestamp) {
+		curr = curr.next
+	}
+	if curr.timestamp != timestamp {
+		return "", false
+	}
+	old, curr.body = curr.body, newBody
+	f.emit(PostEdited, curr)
+	return old, true
 }
 
 // Remove deletes the post with the given timestamp. If the timestamp
 // is not included in a post of the feed then the feed remains
 // unchanged. Return true if the deletion was a success, otherwise return false
+// A walk for math.Inf(1) would stop at the tail sentinel and unlink it, so infinite timestamps are rejected first.
 // Implemented with coarse-grained locking
 func (f *feed) Remove(timestamp float64) bool {
+	if isSentinel(timestamp) {
+		return false
+	}
 	f.lock.Lock()
 
 	pred := f.start
 	curr := pred.next
 
-	for (curr.timestamp < timestamp) {
+	for f.seek(curr, timestamp) {
 		pred = curr
 		curr = curr.next
 	}
 
 	if curr.timestamp == timestamp {
-		pred.next = curr.next
+		f.unlink(pred)
 		f.lock.Unlock()
 		return true
 	}
@@ -97,17 +772,190 @@ func (f *feed) Remove(timestamp float64) bool {
 	return false
 }
 
+// RemoveIf deletes the post with the given timestamp only if its body is still expectedBody,
+// so that a post edited since it was last read is not removed by mistake. Return true if the
+// deletion was a success, otherwise return false.
+// Implemented with coarse-grained locking.
+func (f *feed) RemoveIf(timestamp float64, expectedBody string) bool {
+	if isSentinel(timestamp) {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	pred := f.start
+	curr := pred.next
+	for {
+		for f.seek(curr, timestamp) {
+			pred = curr
+			curr = curr.next
+		}
+		if curr.timestamp != timestamp {
+			return false
+		}
+		if curr.body == expectedBody {
+			f.unlink(pred)
+			return true
+		}
+		pred = curr
+		curr = curr.next
+	}
+}
+
+// Pop deletes the post with the given timestamp like Remove and returns it in the same byte form as
+// ShowFeed. The post is read and unlinked under the write lock, so it is returned exactly as it was
+// removed, even if another goroutine is editing or removing it at the same time.
+// The function returns false if the feed has no post with the timestamp.
+// Implemented with coarse-grained locking.
+func (f *feed) Pop(timestamp float64) ([]byte, bool) {
+	if isSentinel(timestamp) {
+		return nil, false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	pred := f.start
+	curr := pred.next
+	for f.seek(curr, timestamp) {
+		pred = curr
+		curr = curr.next
+	}
+	if curr.timestamp != timestamp {
+		return nil, false
+	}
+	popped := curr.marshal()
+	f.unlink(pred)
+	return popped, true
+}
+
+// RemoveOldest deletes the post with the oldest timestamp and returns it in the same byte
+// form as ShowFeed. The oldest post is just past the head sentinel so it is found straight
+// away. The function returns false if the feed is empty.
+// Implemented with coarse-grained locking.
+func (f *feed) RemoveOldest() ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	oldest := f.start.next
+	if oldest.timestamp == math.Inf(1) {
+		return nil, false
+	}
+	removed := oldest.marshal()
+	f.unlink(f.start)
+	return removed, true
+}
+
+// RemoveNewest deletes the post with the newest timestamp and returns it in the same byte
+// form as ShowFeed. The feed only links posts to newer posts so the whole feed is walked to
+// find the post before the newest one. The function returns false if the feed is empty.
+// Implemented with coarse-grained locking.
+func (f *feed) RemoveNewest() ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	pred := f.start
+	if pred.next.timestamp == math.Inf(1) {
+		return nil, false
+	}
+	for pred.next.next.timestamp != math.Inf(1) {
+		pred = pred.next
+	}
+	removed := pred.next.marshal()
+	f.unlink(pred)
+	return removed, true
+}
+
+// TrimToNewest keeps the n newest posts and deletes the rest, returning the number of posts deleted.
+// The oldest posts are at the start of the feed, so the posts just past the head sentinel are unlinked
+// one at a time until n are left. Nothing is deleted if the feed has n or fewer
+// posts or n is negative, and every post is deleted if n is 0. In a feed with a comparator the posts
+// shown first are kept.
+// Implemented with coarse-grained locking.
+func (f *feed) TrimToNewest(n int) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if n < 0 || f.length() <= n {
+		return 0
+	}
+	removed := f.length() - n
+	for i := 0; i < removed; i++ {
+		f.unlink(f.start)
+	}
+	return removed
+}
+
+// Compact collapses each run of posts next to each other in the feed with the same body into the
+// newest post of the run, e.g. to clean up an ingest that posted the same text several times in a row,
+// and returns the number of posts deleted. The kept post keeps its own timestamp, likes and author.
+// In a feed with a comparator the post of each run shown first is kept.
+// Implemented with coarse-grained locking.
+func (f *feed) Compact() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// The feed is oldest first, so a post is deleted if the post after it has the same body.
+	removed := 0
+	pred := f.start
+	for curr := pred.next; curr.next != nil && curr.next.timestamp != math.Inf(1); curr = pred.next {
+		if curr.body == curr.next.body {
+			f.unlink(pred)
+			removed++
+		} else {
+			pred = curr
+		}
+	}
+	return removed
+}
+
+// RemoveRange deletes every post with a timestamp between from and to, inclusive, and
+// returns the number of posts deleted. Because the feed is sorted the posts in the range
+// are next to each other, so they are unlinked one after another from the post before the
+// range. In a feed with a comparator the posts in the range can be anywhere, so each post
+// is checked on its own.
+// Implemented with coarse-grained locking.
+func (f *feed) RemoveRange(from float64, to float64) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	removed := 0
+	pred := f.start
+	if f.less != nil {
+		for pred.next.timestamp != math.Inf(1) {
+			if curr := pred.next; curr.timestamp >= from && curr.timestamp <= to {
+				f.unlink(pred)
+				removed++
+			} else {
+				pred = curr
+			}
+		}
+		return removed
+	}
+
+	for pred.next.timestamp < from {
+		pred = pred.next
+	}
+	for pred.next.timestamp <= to && pred.next.timestamp != math.Inf(1) {
+		f.unlink(pred)
+		removed++
+	}
+	return removed
+}
+
 // Contains determines whether a post with the given timestamp is
 // inside a feed. The function returns true if there is a post
 // with the timestamp, otherwise, false.
 // Implemented with coarse-grained locking.
 func (f *feed) Contains(timestamp float64) bool {
+	if isSentinel(timestamp) {
+		return false
+	}
 	f.lock.RLock()
 
 	pred := f.start
 	curr := pred.next
 
-	for (curr.timestamp < timestamp) {
+	for f.seek(curr, timestamp) {
 		pred = curr
 		curr = curr.next
 	}
@@ -117,26 +965,2934 @@ func (f *feed) Contains(timestamp float64) bool {
 	return curr.timestamp == timestamp 
 }
 
-// reverseFeed reverses the posts to make the newest posts first.
-func reverseFeed(input [][]byte) [][]byte {
-    if len(input) == 0 {
-        return input
-    }
-    return append(reverseFeed(input[1:]), input[0]) 
-}
+// ContainsApprox determines whether a post with a timestamp within epsilon of the given timestamp
+// is inside a feed, for clients whose timestamps can be off by a rounding error. The feed is sorted
+// so the posts before the window are skipped and only the first post after them needs checking. In
+// a feed with a comparator every post is checked. The function returns false if epsilon is negative.
+// Implemented with coarse-grained locking.
+func (f *feed) ContainsApprox(timestamp float64, epsilon float64) bool {
+	if isSentinel(timestamp) {
+		return false
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
 
-// ShowFeed puts post body and timestamp data in to byte data for FEED to return in twitter.go.
-func (f *feed) ShowFeed() [][]byte {
+	curr := f.start.next
+	if f.less != nil {
+		for ; curr.timestamp != math.Inf(1); curr = curr.next {
+			if math.Abs(curr.timestamp-timestamp) <= epsilon {
+				return true
+			}
+		}
+		return false
+	}
+	for curr.timestamp < timestamp-epsilon {
+		curr = curr.next
+	}
+	return curr.timestamp != math.Inf(1) && curr.timestamp <= timestamp+epsilon
+}
 
-	feedArray := make([][]byte, 0)
+// ContainsBodies determines for each of the given bodies whether a post with exactly that body is
+// inside a feed, e.g. to check many posts at once. Every body is looked up in the same walk of the
+// feed, which stops early once every body has been found. The map returned has an entry for each body.
+// Implemented with coarse-grained locking.
+func (f *feed) ContainsBodies(bodies []string) map[string]bool {
+	found, remaining := requestedBodies(bodies)
 	f.lock.RLock()
-	post := f.start.next
-	for post.timestamp != math.Inf(1) {
-		postByte, _ := json.Marshal(postBodyTimestamp{Body: post.body, Timestamp: post.timestamp})
-		feedArray = append(feedArray, postByte)
-		post = post.next
+	defer f.lock.RUnlock()
+
+	for curr := f.start.next; curr.timestamp != math.Inf(1) && remaining > 0; curr = curr.next {
+		if seen, requested := found[curr.body]; requested && !seen {
+			found[curr.body] = true
+			remaining--
+		}
 	}
-	f.lock.RUnlock()
-	// Reverse feed so that newest posts are first/
-	return reverseFeed(feedArray)
-}
\ No newline at end of file
+	return found
+}
+
+// requestedBodies returns a map with an entry set to false for each of the given bodies, for
+// ContainsBodies to fill in, and the number of entries.
+func requestedBodies(bodies []string) (map[string]bool, int) {
+	found := make(map[string]bool, len(bodies))
+	for _, body := range bodies {
+		found[body] = false
+	}
+	return found, len(found)
+}
+
+// ContainsAll determines for each of the given timestamps whether a post with that timestamp is inside
+// a feed, e.g. to reconcile the feed with a list of posts. The timestamps are sorted, so in one walk of
+// the feed each post only has to be compared with the next timestamp not yet reached, and the walk
+// stops once the last timestamp is passed. In a feed with a comparator posts with a timestamp can be
+// anywhere, so every post is looked up instead. The map returned has an entry for each timestamp
+// except NaN, which no post can have.
+// Implemented with coarse-grained locking.
+func (f *feed) ContainsAll(timestamps []float64) map[float64]bool {
+	found, sorted := requestedTimestamps(timestamps)
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.less != nil {
+		for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+			if _, requested := found[curr.timestamp]; requested {
+				found[curr.timestamp] = true
+			}
+		}
+		return found
+	}
+	curr := f.start.next
+	for _, timestamp := range sorted {
+		// The tail sentinel's timestamp is later than any timestamp so the walk stops at it.
+		for curr.timestamp < timestamp {
+			curr = curr.next
+		}
+		found[timestamp] = curr.timestamp == timestamp
+	}
+	return found
+}
+
+// requestedTimestamps returns a map with an entry set to false for each of the given timestamps, for
+// ContainsAll to fill in, and the timestamps a post can have sorted oldest first without duplicates.
+func requestedTimestamps(timestamps []float64) (map[float64]bool, []float64) {
+	found := make(map[float64]bool, len(timestamps))
+	sorted := make([]float64, 0, len(timestamps))
+	for _, timestamp := range timestamps {
+		if math.IsNaN(timestamp) {
+			continue
+		}
+		if _, seen := found[timestamp]; !seen && !isSentinel(timestamp) {
+			sorted = append(sorted, timestamp)
+		}
+		found[timestamp] = false
+	}
+	sort.Float64s(sorted)
+	return found, sorted
+}
+
+// IndexOf returns the position of the post with the given timestamp counting from the newest,
+// which is post 0, so it is the post's index in ShowFeed. If several posts have the timestamp
+// the position of the one Contains finds, which is the one Remove and Like act on, is returned.
+// The function returns false if no post has the timestamp.
+// Implemented with coarse-grained locking.
+func (f *feed) IndexOf(timestamp float64) (int, bool) {
+	if isSentinel(timestamp) {
+		return 0, false
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	i := 0
+	curr := f.start.next
+	for f.seek(curr, timestamp) {
+		curr = curr.next
+		i++
+	}
+	if curr.timestamp != timestamp {
+		return 0, false
+	}
+	return f.length() - 1 - i, true
+}
+
+// reverseFeed reverses the posts to make the newest posts first.
+func reverseFeed(input [][]byte) [][]byte {
+    if len(input) == 0 {
+        return input
+    }
+    return append(reverseFeed(input[1:]), input[0]) 
+}
+
+// ShowFeed puts post body and timestamp data in to byte data for FEED to return in twitter.go.
+// Posts with the same timestamp are shown in the order given by the feed's tie-break.
+func (f *feed) ShowFeed() [][]byte {
+
+	feedArray := make([][]byte, 0)
+	f.lock.RLock()
+	post := f.start.next
+	for post.timestamp != math.Inf(1) {
+		feedArray = append(feedArray, post.marshal())
+		post = post.next
+	}
+	f.lock.RUnlock()
+	// Reverse feed so that newest posts are first/
+	return reverseFeed(feedArray)
+}
+
+// ShowFeedPosts returns the posts in the same order as ShowFeed, newest first, but as PostViews instead
+// of byte data.
+// Implemented with coarse-grained locking.
+func (f *feed) ShowFeedPosts() []PostView {
+	f.lock.RLock()
+	posts, _ := f.viewPosts()
+	f.lock.RUnlock()
+	return posts
+}
+
+// viewPosts returns the posts of the feed newest first and the version they are from.
+// The caller must hold the read lock.
+func (f *feed) viewPosts() ([]PostView, uint64) {
+	posts := make([]PostView, 0, f.length())
+	for post := f.start.next; post.timestamp != math.Inf(1); post = post.next {
+		posts = append(posts, post.view())
+	}
+	reversePosts(posts)
+	return posts, f.version.Load()
+}
+
+// SetSnapshotRefresh turns on the cached snapshot served by ShowFeedPostsNow and refreshes it every
+// interval from a goroutine, replacing the goroutine of an earlier call. An interval that is not positive
+// turns the snapshot off and stops the goroutine. If the snapshot is off the first snapshot is taken
+// before SetSnapshotRefresh returns, waiting for the read lock. Other refreshes only try the read lock
+// and skip the refresh if it is busy, so they never wait behind the readers the snapshot stands in for.
+// There is no bound on how stale the snapshot gets while the lock stays busy; ShowFeedPostsNow reports
+// its age instead.
+// Implemented with coarse-grained locking.
+func (f *feed) SetSnapshotRefresh(interval time.Duration) {
+	f.snapshotMutex.Lock()
+	defer f.snapshotMutex.Unlock()
+	if f.stopSnapshot != nil {
+		close(f.stopSnapshot)
+		f.stopSnapshot = nil
+	}
+	if interval <= 0 {
+		f.snapshot.Store((*feedSnapshot)(nil))
+		return
+	}
+	current, _ := f.snapshot.Load().(*feedSnapshot)
+	f.refreshSnapshot(current == nil)
+	stop := make(chan struct{})
+	f.stopSnapshot = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			f.snapshotMutex.Lock()
+			select {
+			case <-stop: // turned off or replaced while waiting for the mutex
+			default:
+				f.refreshSnapshot(false)
+			}
+			f.snapshotMutex.Unlock()
+		}
+	}()
+}
+
+// refreshSnapshot replaces the snapshot with the posts of the feed now. Unless wait is set it only tries
+// the read lock and keeps the old snapshot if the lock is busy; a lock that cannot be tried is waited for.
+// The caller must hold snapshotMutex.
+func (f *feed) refreshSnapshot(wait bool) {
+	if tryLock, ok := f.lock.(lock.TryRLocker); ok && !wait {
+		if !tryLock.TryRLock() {
+			return
+		}
+	} else {
+		f.lock.RLock()
+	}
+	posts, version := f.viewPosts()
+	f.lock.RUnlock()
+	f.snapshot.Store(&feedSnapshot{posts: posts, version: version, taken: time.Now()})
+}
+
+// ShowFeedPostsNow returns the posts like ShowFeedPosts and the version they are from, without waiting
+// for the lock while a snapshot is turned on by SetSnapshotRefresh. If the read lock cannot be taken right
+// away, because a writer holds or is waiting for it or the maximum number of readers hold it, a copy of
+// the snapshot is returned instead with cached true and age set to how long ago it was taken; it misses
+// any change made since then. Without a snapshot, or with a lock that cannot be tried, ShowFeedPostsNow
+// waits for the lock like ShowFeedPosts.
+// Implemented with coarse-grained locking.
+func (f *feed) ShowFeedPostsNow() (posts []PostView, version uint64, cached bool, age time.Duration) {
+	snapshot, _ := f.snapshot.Load().(*feedSnapshot)
+	tryLock, ok := f.lock.(lock.TryRLocker)
+	if snapshot == nil || !ok {
+		f.lock.RLock()
+		posts, version = f.viewPosts()
+		f.lock.RUnlock()
+		return posts, version, false, 0
+	}
+	if !tryLock.TryRLock() {
+		return append([]PostView(nil), snapshot.posts...), snapshot.version, true, time.Since(snapshot.taken)
+	}
+	posts, version = f.viewPosts()
+	f.lock.RUnlock()
+	return posts, version, false, 0
+}
+
+// reversePosts reverses posts in place, e.g. to turn a walk from the oldest post in to newest first.
+func reversePosts(posts []PostView) {
+	for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+		posts[i], posts[j] = posts[j], posts[i]
+	}
+}
+
+// ShowFeedSince returns the posts with a timestamp after since in the same byte form as
+// ShowFeed, newest first. Because the feed is sorted the posts up to since are skipped
+// and every post after them is collected. In a feed with a comparator the later posts can
+// be anywhere so every post is checked. Any since is a cursor, 0 and negative timestamps too.
+// Implemented with coarse-grained locking.
+func (f *feed) ShowFeedSince(since float64) [][]byte {
+	feedArray := make([][]byte, 0)
+	f.lock.RLock()
+	post := f.start.next
+	for f.less == nil && post.timestamp <= since && post.timestamp != math.Inf(1) {
+		post = post.next
+	}
+	for post.timestamp != math.Inf(1) {
+		if post.timestamp > since {
+			feedArray = append(feedArray, post.marshal())
+		}
+		post = post.next
+	}
+	f.lock.RUnlock()
+	return reverseFeed(feedArray)
+}
+
+// ShowFeedOldestFirst returns the limit oldest posts in the same byte form as ShowFeed, oldest first,
+// or every post if limit is 0 or less. The feed is sorted oldest first so, unlike ShowFeed, the posts
+// are collected in the order they are linked and need no reversing. In a feed with a comparator the
+// posts are in the reverse of the order ShowFeed shows them in.
+// Implemented with coarse-grained locking.
+func (f *feed) ShowFeedOldestFirst(limit int) [][]byte {
+	feedArray := make([][]byte, 0)
+	f.lock.RLock()
+	for post := f.start.next; post.timestamp != math.Inf(1) && (limit <= 0 || len(feedArray) < limit); post = post.next {
+		feedArray = append(feedArray, post.marshal())
+	}
+	f.lock.RUnlock()
+	return feedArray
+}
+
+// ShowFeedSnapshot returns the same posts as ShowFeed but only holds the read lock while
+// it copies the posts, not while it marshals them, so writers are not blocked for as long
+// on a big feed. The posts are copied rather than just their pointers because the body,
+// timestamp and likes of a post can be changed in place once the lock is released.
+// The trade-off is that the snapshot may be slightly stale: a post added or removed after
+// the copy is made is not reflected even though ShowFeedSnapshot has not returned yet.
+// Implemented with coarse-grained locking.
+func (f *feed) ShowFeedSnapshot() [][]byte {
+	posts := make([]post, 0)
+	f.lock.RLock()
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		posts = append(posts, *curr)
+	}
+	f.lock.RUnlock()
+
+	// Marshal newest first without holding the lock.
+	feedArray := make([][]byte, 0, len(posts))
+	for i := len(posts) - 1; i >= 0; i-- {
+		feedArray = append(feedArray, posts[i].marshal())
+	}
+	return feedArray
+}
+
+// RemoveByID deletes the post with the given id. If no post in the feed has
+// the id then the feed remains unchanged. Return true if the deletion was a
+// success, otherwise return false.
+// Implemented with coarse-grained locking.
+func (f *feed) RemoveByID(id uint64) bool {
+	f.lock.Lock()
+
+	pred := f.start
+	curr := pred.next
+
+	for curr.timestamp != math.Inf(1) {
+		if curr.id == id {
+			f.unlink(pred)
+			f.lock.Unlock()
+			return true
+		}
+		pred = curr
+		curr = curr.next
+	}
+	f.lock.Unlock()
+	return false
+}
+
+// GetByID returns the post body and timestamp data of the post with the given id
+// in the same byte form as ShowFeed. The function returns false if no post in the
+// feed has the id.
+// Implemented with coarse-grained locking.
+func (f *feed) GetByID(id uint64) ([]byte, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	for post := f.start.next; post.timestamp != math.Inf(1); post = post.next {
+		if post.id == id {
+			return post.marshal(), true
+		}
+	}
+	return nil, false
+}
+
+// GetNthRecent returns the nth post counting from the newest, which is post 0, in the same byte
+// form as ShowFeed. The feed is sorted oldest first so the walk goes size-1-n posts past the head
+// sentinel. The function returns false if n is negative or there are not more than n posts.
+// Implemented with coarse-grained locking.
+func (f *feed) GetNthRecent(n int) ([]byte, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if n < 0 || n >= f.length() {
+		return nil, false
+	}
+	post := f.start.next
+	for i := 0; i < f.length()-1-n; i++ {
+		post = post.next
+	}
+	return post.marshal(), true
+}
+
+// Successor returns the oldest post with a timestamp after timestamp, i.e. the next post, in the same
+// byte form as ShowFeed. The feed is sorted oldest first so the walk stops at the first such post; in a
+// feed with a comparator every post is checked. The function returns false if no post is newer.
+// Implemented with coarse-grained locking.
+func (f *feed) Successor(timestamp float64) ([]byte, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var found *post
+	for post := f.start.next; post.timestamp != math.Inf(1); post = post.next {
+		if post.timestamp > timestamp && (found == nil || post.timestamp < found.timestamp) {
+			found = post
+			if f.less == nil {
+				break
+			}
+		}
+	}
+	if found == nil {
+		return nil, false
+	}
+	return found.marshal(), true
+}
+
+// Predecessor returns the newest post with a timestamp before timestamp, i.e. the previous post, in the
+// same byte form as ShowFeed. The feed is sorted oldest first so the walk stops at the first post that is
+// not older; in a feed with a comparator every post is checked. The function returns false if no post is older.
+// Implemented with coarse-grained locking.
+func (f *feed) Predecessor(timestamp float64) ([]byte, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var found *post
+	for post := f.start.next; post.timestamp != math.Inf(1); post = post.next {
+		if f.less == nil && post.timestamp >= timestamp {
+			break
+		}
+		if post.timestamp < timestamp && (found == nil || post.timestamp >= found.timestamp) {
+			found = post
+		}
+	}
+	if found == nil {
+		return nil, false
+	}
+	return found.marshal(), true
+}
+
+// Closest returns the post whose timestamp is nearest to timestamp, e.g. to jump to about a time, in the
+// same byte form as ShowFeed. Of two posts as near as each other, one before and one after timestamp, the
+// newer one is returned. The feed is sorted oldest first so the walk stops once the posts only get further
+// away; in a feed with a comparator every post is checked. The function returns false if the feed is empty
+// or timestamp is NaN.
+// Implemented with coarse-grained locking.
+func (f *feed) Closest(timestamp float64) ([]byte, bool) {
+	if math.IsNaN(timestamp) {
+		return nil, false
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var found *post
+	best := math.Inf(1)
+	for post := f.start.next; post.timestamp != math.Inf(1); post = post.next {
+		diff := math.Abs(post.timestamp - timestamp)
+		if f.less == nil && post.timestamp > timestamp && diff > best {
+			break
+		}
+		if found == nil || diff < best || (diff == best && post.timestamp >= found.timestamp) {
+			found, best = post, diff
+		}
+	}
+	if found == nil {
+		return nil, false
+	}
+	return found.marshal(), true
+}
+
+// Reschedule moves the post with the timestamp oldTimestamp so that it has the
+// timestamp newTimestamp, keeping its body and id. The post is reinserted where
+// newTimestamp belongs so the feed stays ordered. The feed remains unchanged if no
+// post has oldTimestamp or another post already has newTimestamp. Return true if
+// the move was a success, otherwise return false.
+// Implemented with coarse-grained locking.
+func (f *feed) Reschedule(oldTimestamp float64, newTimestamp float64) bool {
+	if isSentinel(oldTimestamp) || isSentinel(newTimestamp) {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	oldPred := f.start
+	moved := oldPred.next
+	for f.seek(moved, oldTimestamp) {
+		oldPred = moved
+		moved = moved.next
+	}
+	if moved.timestamp != oldTimestamp {
+		return false
+	}
+	if oldTimestamp == newTimestamp {
+		return true
+	}
+
+	curr := f.start.next
+	for f.seek(curr, newTimestamp) {
+		curr = curr.next
+	}
+	if curr.timestamp == newTimestamp {
+		return false
+	}
+
+	// Unlink the post and link it back in at its new place.
+	oldPred.next = moved.next
+	f.size.Add(-1)
+	f.emit(PostRemoved, moved)
+	moved.timestamp = newTimestamp
+	if moved.exact {
+		moved.nanos = nanosOf(newTimestamp)
+	}
+	f.link(moved)
+	return true
+}
+
+// Like adds a like to the post with the given timestamp. Return true if the
+// post was found and liked, otherwise return false.
+// Implemented with coarse-grained locking.
+func (f *feed) Like(timestamp float64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	curr := f.start.next
+	for f.seek(curr, timestamp) {
+		curr = curr.next
+	}
+	if curr.timestamp == timestamp && !isSentinel(timestamp) {
+		curr.likes++
+		f.emit(PostEdited, curr)
+		return true
+	}
+	return false
+}
+
+// TopLiked returns the n posts with the most likes, most liked first. Posts with
+// the same number of likes are ordered with the most recent timestamp first. If
+// the feed has fewer than n posts then all of them are returned.
+// The posts are copied under the read lock and sorted once the lock is released.
+func (f *feed) TopLiked(n int) [][]byte {
+	posts := make([]post, 0)
+	f.lock.RLock()
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		posts = append(posts, *curr)
+	}
+	f.lock.RUnlock()
+	return topLiked(posts, n)
+}
+
+// topLiked sorts the copied posts of a feed for TopLiked and returns the first n of them. The
+// posts are copied oldest first and the sort is stable, so posts that tie on both likes and
+// timestamp are in the same order for every feed.
+func topLiked(posts []post, n int) [][]byte {
+	sort.SliceStable(posts, func(i, j int) bool {
+		if posts[i].likes != posts[j].likes {
+			return posts[i].likes > posts[j].likes
+		}
+		return posts[i].timestamp > posts[j].timestamp
+	})
+
+	topArray := make([][]byte, 0)
+	for i := 0; i < n && i < len(posts); i++ {
+		topArray = append(topArray, posts[i].marshal())
+	}
+	return topArray
+}
+
+// AddIdempotent inserts a new post written by author like AddWithAuthor unless a post with the same key was
+// already added, which happens when a client retries an ADD. Return the id of the new post and true
+// if the post was added, otherwise return the id of the post first added with key and false. An empty
+// key is never a duplicate. Only the most recent maxKeys keys are remembered.
+// Implemented with coarse-grained locking.
+func (f *feed) AddIdempotent(body string, author string, timestamp float64, key string) (uint64, bool) {
+	if isSentinel(timestamp) {
+		return 0, false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if id, seen := f.keys[key]; seen && key != "" {
+		return id, false
+	}
+	id, _ := f.add(body, author, 0, timestamp)
+	if key != "" {
+		f.keys[key] = id
+		f.keyOrder = append(f.keyOrder, key)
+		if len(f.keyOrder) > maxKeys {
+			delete(f.keys, f.keyOrder[0])
+			f.keyOrder = f.keyOrder[1:]
+		}
+	}
+	return id, true
+}
+
+// keyID returns the id of the post added by AddIdempotent with key, if the key is still remembered.
+func (f *feed) keyID(key string) (uint64, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	id, seen := f.keys[key]
+	return id, seen
+}
+
+// length returns the number of posts in the feed.
+func (f *feed) length() int {
+	return int(f.size.Load())
+}
+
+// SetCapacityWarning sets a soft limit on the number of posts in the feed. Each time adding a post with
+// Add, AddWithEviction, AddWithAuthor or AddWithScore takes the feed over threshold posts, callback is
+// called with the number of posts, e.g. to raise an alert. No post is evicted. The callback is called
+// once per crossing: it is not called again until posts are removed to bring the feed back down to
+// threshold posts and an add takes it over again. It is called after the lock is released, so it can
+// call back into the feed. A nil callback turns the warning off.
+// Implemented with coarse-grained locking.
+func (f *feed) SetCapacityWarning(threshold int, callback func(current int)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.warning = newCapacityWarning(threshold, callback)
+}
+
+// Count returns the number of posts in the feed without walking it, e.g. for a client polling the
+// length of the feed. Every post added counts, including posts with the same timestamp as another post.
+// The count is changed under the write lock when posts are added and removed and is read atomically, so
+// Count does not take the lock. A change to the feed made by several steps, e.g. an add that evicts the
+// oldest post of a bounded feed, may be seen half done.
+func (f *feed) Count() int {
+	return f.length()
+}
+
+// IsEmpty returns whether the feed has no posts, i.e. the post after the beginning post is the +Inf sentinel
+// at the end. Unlike Count it takes the read lock, so a change made by several steps is never seen half done.
+// Implemented with coarse-grained locking.
+func (f *feed) IsEmpty() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.start.next.timestamp == math.Inf(1)
+}
+
+// Version returns a number that goes up each time a post is added, removed or edited, e.g. for a client
+// caching the feed to tell whether it has changed since it was read. A change that touches several posts,
+// e.g. RemoveRange, raises it once per post. It is read atomically without the lock and raised under the
+// write lock once a change has been made, so a client that reads the version before reading the feed and
+// sees the same version later knows the feed it read is still current.
+func (f *feed) Version() uint64 {
+	return f.version.Load()
+}
+
+// Stats returns the number of posts, the oldest and newest timestamps and the total
+// likes of the feed, all computed in one traversal so they are consistent with each other.
+// The timestamps are compared rather than taken from the ends of the feed so that they are
+// right for a feed with a comparator too.
+// Implemented with coarse-grained locking.
+func (f *feed) Stats() FeedStats {
+	var stats FeedStats
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		if stats.Count == 0 || curr.timestamp < stats.Oldest {
+			stats.Oldest = curr.timestamp
+		}
+		if stats.Count == 0 || curr.timestamp > stats.Newest {
+			stats.Newest = curr.timestamp
+		}
+		stats.Count++
+		stats.TotalLikes += curr.likes
+	}
+	return stats
+}
+
+// CountMatching returns the number of posts whose body contains substr. Only the count is
+// needed so no post is marshalled. An empty substr matches every post.
+// Implemented with coarse-grained locking.
+func (f *feed) CountMatching(substr string) int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	count := 0
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		if strings.Contains(curr.body, substr) {
+			count++
+		}
+	}
+	return count
+}
+
+// TotalBodyBytes returns the sum of the lengths in bytes of the bodies of the posts, e.g. for storage
+// accounting. A body with multibyte characters counts all of their bytes.
+// Implemented with coarse-grained locking.
+func (f *feed) TotalBodyBytes() int64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var total int64
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		total += int64(len(curr.body))
+	}
+	return total
+}
+
+// BucketCounts counts the posts in each time bucket of bucketSeconds seconds, e.g. for a histogram of
+// activity. A post is in bucket floor(timestamp/bucketSeconds), so bucket 0 starts at timestamp 0 and
+// only buckets with posts are in the map. The counts sum to the number of posts. A bucketSeconds that
+// is not positive has no buckets and nil is returned.
+// Implemented with coarse-grained locking.
+func (f *feed) BucketCounts(bucketSeconds float64) map[int64]int {
+	if !(bucketSeconds > 0) {
+		return nil
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	buckets := make(map[int64]int)
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		buckets[bucketOf(curr.timestamp, bucketSeconds)]++
+	}
+	return buckets
+}
+
+// bucketOf returns the number of the time bucket of bucketSeconds seconds that timestamp is in.
+func bucketOf(timestamp float64, bucketSeconds float64) int64 {
+	return int64(math.Floor(timestamp / bucketSeconds))
+}
+
+// ForEach calls fn with the body and timestamp of each post in the given order until fn
+// returns false, without marshalling any post. Walking OldestFirst follows the feed's links
+// so nothing is allocated. The feed only links posts to newer posts, so walking NewestFirst
+// first collects pointers to the posts. fn is called with the read lock held so it must not
+// call any method of the feed.
+// Implemented with coarse-grained locking.
+func (f *feed) ForEach(order Order, fn func(body string, timestamp float64) bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if order == OldestFirst {
+		for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+			if !fn(curr.body, curr.timestamp) {
+				return
+			}
+		}
+		return
+	}
+
+	posts := make([]*post, 0)
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		posts = append(posts, curr)
+	}
+	for i := len(posts) - 1; i >= 0; i-- {
+		if !fn(posts[i].body, posts[i].timestamp) {
+			return
+		}
+	}
+}
+
+// inOrder reports whether post a can come just before post b in the feed, which is shown in
+// reverse: a is shown after b.
+func (f *feed) inOrder(a *post, b *post) bool {
+	return f.shownBefore(b, a)
+}
+
+// isSorted reports whether every post is in order with the post after it. The caller must
+// hold the read lock and the sentinels must be in place.
+func (f *feed) isSorted() bool {
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		if curr.next.timestamp != math.Inf(1) && !f.inOrder(curr, curr.next) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the feed is well formed: the head sentinel is first, the tail sentinel
+// is last, no post in between has an infinite timestamp, the posts are sorted and the feed's
+// count of its posts is right. It returns an error describing the first problem found. It is a
+// debugging aid for changes to the locking. A post linked back to an earlier post is out of
+// order, so Validate returns even if the posts loop back on themselves.
+// Implemented with coarse-grained locking.
+func (f *feed) Validate() error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.start == nil || f.start.timestamp != math.Inf(-1) {
+		return errors.New("feed: the head sentinel is missing")
+	}
+	count := 0
+	pred := f.start
+	for curr := f.start.next; ; curr = curr.next {
+		if curr == nil {
+			return errors.New("feed: the tail sentinel is missing")
+		}
+		if curr.timestamp == math.Inf(1) {
+			if curr.next != nil {
+				return errors.New("feed: the tail sentinel is not the last post")
+			}
+			break
+		}
+		if curr.timestamp == math.Inf(-1) {
+			return fmt.Errorf("feed: post id:%v has the head sentinel's timestamp", curr.id)
+		}
+		if pred != f.start && !f.inOrder(pred, curr) {
+			return fmt.Errorf("feed: post id:%v with timestamp:%v is before post id:%v with timestamp:%v",
+				pred.id, pred.timestamp, curr.id, curr.timestamp)
+		}
+		count++
+		pred = curr
+	}
+	if count != f.length() {
+		return fmt.Errorf("feed: counted %v posts but the feed's size is %v", count, f.length())
+	}
+	return nil
+}
+
+// Merge adds every post of other to the feed, e.g. to combine a user's feeds from two devices.
+// A post with the same timestamp and body as a post already in the feed is the same post, so
+// it is skipped. Posts that only share a timestamp are both kept and ordered by the feed's
+// tie-break. Merged posts keep their likes and are given new ids. The posts of other are
+// copied first so the two feeds are never locked at the same time, then, because both feeds
+// are sorted, they are merged in one pass over the feed instead of one traversal per post.
+// A feed with a comparator is not sorted by timestamp, so each post is looked for and linked
+// in with its own traversal. A bounded feed evicts its oldest posts once the merge is done.
+// Implemented with coarse-grained locking.
+func (f *feed) Merge(other Feed) {
+	posts := copyPosts(other)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.mergePosts(posts, true)
+}
+
+// mergePosts links posts, which are sorted oldest first, in to the feed for Merge and ReplaceAll,
+// skipping a post that has the same timestamp and body as a post already in the feed if skipDuplicates
+// is set. A bounded feed evicts its oldest posts once they are all linked in. The caller must hold the
+// write lock.
+func (f *feed) mergePosts(posts []post, skipDuplicates bool) {
+	pred := f.start
+	for i := range posts {
+		// Move up to the first post with the same or a later timestamp.
+		for f.less == nil && pred.next.timestamp < posts[i].timestamp {
+			pred = pred.next
+		}
+		if skipDuplicates && f.hasPost(pred.next, posts[i].timestamp, posts[i].body) {
+			continue
+		}
+
+		newPost := f.newPost(posts[i].body, posts[i].timestamp, nil)
+		newPost.id = atomic.AddUint64(&f.lastID, 1)
+		newPost.likes = posts[i].likes
+		newPost.author = posts[i].author
+		newPost.score = posts[i].score
+		if posts[i].exact {
+			newPost.nanos, newPost.exact = posts[i].nanos, true
+		}
+		if f.less != nil {
+			f.link(newPost)
+			continue
+		}
+		insert := pred
+		for insert.next.timestamp == newPost.timestamp && f.shownBefore(newPost, insert.next) {
+			insert = insert.next
+		}
+		newPost.next = insert.next
+		insert.next = newPost
+		f.size.Add(1)
+		f.added.signal()
+		f.emit(PostAdded, newPost)
+	}
+
+	for f.maxPosts > 0 && f.length() > f.maxPosts {
+		f.unlink(f.start)
+	}
+}
+
+// ReplaceAll replaces every post of the feed with posts, e.g. for a full sync from an authoritative
+// source. The posts can be in any order: they are sorted by timestamp, and posts with the same timestamp
+// are ordered by the feed's tie-break as if they were added in the order given. A post with an infinite
+// or NaN timestamp is skipped. The posts keep their likes, authors and scores and are given new ids.
+// The old posts are removed and the new posts linked in under the write lock in one critical section,
+// so a reader sees either the old posts or the new posts, never some of each or a partly built feed.
+// A bounded feed keeps only its newest posts.
+// Implemented with coarse-grained locking.
+func (f *feed) ReplaceAll(posts []PostView) error {
+	sorted := sortedPosts(posts)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for f.start.next.timestamp != math.Inf(1) {
+		f.unlink(f.start)
+	}
+	f.mergePosts(sorted, false)
+	return nil
+}
+
+// sortedPosts converts posts for ReplaceAll in to posts of the coarse-grained feed sorted oldest first,
+// keeping the order of posts with the same timestamp and skipping posts with an infinite or NaN timestamp.
+// Posts with exact int64 timestamps that are the same float64 are sorted by their int64 timestamps.
+func sortedPosts(posts []PostView) []post {
+	sorted := make([]post, 0, len(posts))
+	for _, p := range posts {
+		if isSentinel(p.Timestamp) || math.IsNaN(p.Timestamp) {
+			continue
+		}
+		sorted = append(sorted, post{body: p.Body, timestamp: p.Timestamp, likes: p.Likes, author: p.Author, score: p.Score, nanos: p.Nanos, exact: p.Exact})
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].timestamp != sorted[j].timestamp {
+			return sorted[i].timestamp < sorted[j].timestamp
+		}
+		return sorted[i].nanos < sorted[j].nanos
+	})
+	return sorted
+}
+
+// copyPosts copies the posts of a feed, oldest first, for Merge. The likes and authors of the
+// posts are only known for the feeds of this package; any other Feed is copied with ForEach.
+func copyPosts(other Feed) []post {
+	posts := make([]post, 0)
+	switch o := other.(type) {
+	case *feed:
+		o.lock.RLock()
+		for curr := o.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+			posts = append(posts, *curr)
+		}
+		o.lock.RUnlock()
+	case *int64Feed:
+		return copyPosts(o.feed)
+	case *rcuFeed:
+		return copyPosts(o.load())
+	case *lockFreeFeed:
+		o.walk(func(p *lockFreePost, state *postState) bool {
+			posts = append(posts, p.value(state))
+			return true
+		})
+	default:
+		other.ForEach(OldestFirst, func(body string, timestamp float64) bool {
+			posts = append(posts, post{body: body, timestamp: timestamp})
+			return true
+		})
+	}
+	return posts
+}
+
+// hasPost reports whether one of the posts with the given timestamp, starting from first, has
+// the given body. The caller must hold the read lock.
+func (f *feed) hasPost(first *post, timestamp float64, body string) bool {
+	for curr := first; ; curr = curr.next {
+		for f.seek(curr, timestamp) {
+			curr = curr.next
+		}
+		if curr.timestamp != timestamp {
+			return false
+		}
+		if curr.body == body {
+			return true
+		}
+	}
+}
+
+// WaitFor blocks until a post with the given timestamp is in the feed and returns true, or returns
+// false once timeout has passed without one, e.g. for a test to wait for a post added by another
+// goroutine. The feed is checked again each time a post is added or moved.
+// Implemented with coarse-grained locking.
+func (f *feed) WaitFor(timestamp float64, timeout time.Duration) bool {
+	return f.added.waitForTimeout(func() bool { return f.Contains(timestamp) }, timeout)
+}
+
+// Subscribe returns a channel that an event is sent to for every post added to, removed from or edited
+// in the feed from now on, e.g. for a UI to update itself. Events are sent under the write lock, so they
+// come in the order the changes were made. A subscriber that falls more than a few hundred events behind
+// misses events rather than holding up the writers. The channel is closed by Unsubscribe.
+// Implemented with coarse-grained locking.
+func (f *feed) Subscribe() <-chan FeedEvent {
+	return f.events.subscribe()
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe and closes it.
+// Implemented with coarse-grained locking.
+func (f *feed) Unsubscribe(events <-chan FeedEvent) {
+	f.events.unsubscribe(events)
+}
+
+// Clone returns a new feed with a copy of every post, key and setting of the feed, e.g. to try out changes
+// without changing the feed. The clone has its own lock, a plain read-write lock even if the feed was made
+// with another lock, and none of the feed's subscribers or capacity warning, so changing either feed does
+// not change the other.
+// Implemented with coarse-grained locking.
+func (f *feed) Clone() Feed {
+	f.lock.RLock()
+	clone := f.clone()
+	f.lock.RUnlock()
+	clone.lock = lock.NewRWMutex()
+	clone.added = newAddedSignal()
+	clone.events = newEventHub()
+	return clone
+}
+
+// SearchByAuthor returns the posts written by author in the same byte form as ShowFeed,
+// newest first.
+// Implemented with coarse-grained locking.
+func (f *feed) SearchByAuthor(author string) [][]byte {
+	feedArray := make([][]byte, 0)
+	f.lock.RLock()
+	for curr := f.start.next; curr.timestamp != math.Inf(1); curr = curr.next {
+		if curr.author == author {
+			feedArray = append(feedArray, curr.marshal())
+		}
+	}
+	f.lock.RUnlock()
+	return reverseFeed(feedArray)
+}
+
+// Diff compares the feed with old, a feed previously returned by ShowFeed, and returns the posts added
+// since, newest first, and the posts removed since, in the order they are in old.
+// Implemented with coarse-grained locking.
+func (f *feed) Diff(old [][]byte) (added [][]byte, removed [][]byte) {
+	return diffPosts(f.ShowFeed(), old)
+}
+
+// diffPosts compares the posts of current with the posts of old, both in the byte form ShowFeed returns.
+// A post's timestamp is its identity, so a post whose body or likes changed is neither added nor removed,
+// and a post moved to a new timestamp is both removed and added. The posts of current whose timestamp is
+// not in old are added and the posts of old whose timestamp is not in current are removed. A post of old
+// that cannot be unmarshaled is ignored.
+func diffPosts(current [][]byte, old [][]byte) (added [][]byte, removed [][]byte) {
+	timestamps := func(posts [][]byte) ([]float64, map[float64]bool) {
+		list := make([]float64, len(posts))
+		set := make(map[float64]bool, len(posts))
+		for i, postByte := range posts {
+			var post postBodyTimestamp
+			if err := json.Unmarshal(postByte, &post); err != nil {
+				list[i] = math.NaN() // Marks the post to be ignored.
+				continue
+			}
+			list[i] = post.Timestamp
+			set[post.Timestamp] = true
+		}
+		return list, set
+	}
+	currentList, currentSet := timestamps(current)
+	oldList, oldSet := timestamps(old)
+
+	added, removed = make([][]byte, 0), make([][]byte, 0)
+	for i, timestamp := range currentList {
+		if !oldSet[timestamp] {
+			added = append(added, current[i])
+		}
+	}
+	for i, timestamp := range oldList {
+		if !math.IsNaN(timestamp) && !currentSet[timestamp] {
+			removed = append(removed, old[i])
+		}
+	}
+	return added, removed
+}
+
+// Int64Feed represents a Feed whose posts have exact int64 timestamps, e.g. Unix nanoseconds. A float64
+// only holds integers exactly up to 2^53, so two such timestamps can be the same float64 and their posts
+// would collide in a Feed. AddInt64, RemoveInt64 and ContainsInt64 use the exact timestamps. The methods of
+// Feed take float64 timestamps, which are exact up to 2^53: past it they work on the first post whose
+// timestamp is the same float64, and a post they add or move gets the timestamp rounded toward zero.
+// The posts are always returned with their exact timestamps.
+type Int64Feed interface {
+	Feed
+	AddInt64(body string, author string, timestamp int64) (id uint64, evicted bool)
+	RemoveInt64(timestamp int64) bool
+	ContainsInt64(timestamp int64) bool
+}
+
+// int64Feed is a coarse-grained feed whose posts have exact int64 timestamps. It is the same feed with the
+// methods of Int64Feed added, so only a feed made by NewFeedInt64 is an Int64Feed.
+type int64Feed struct {
+	*feed
+}
+
+// NewFeedInt64 creates an empty user feed whose posts have exact int64 timestamps and that shows posts with
+// the same timestamp in the order given by tieBreak. Posts whose timestamps are the same float64 are
+// ordered by their int64 timestamps.
+func NewFeedInt64(tieBreak TieBreak) Int64Feed {
+	f := newFeed(lock.NewRWMutex(), tieBreak)
+	f.exact = true
+	return &int64Feed{f}
+}
+
+// Clone returns a deep copy of the feed like the coarse-grained feed, which also has int64 timestamps.
+func (f *int64Feed) Clone() Feed {
+	return &int64Feed{f.feed.Clone().(*feed)}
+}
+
+// AddInt64 inserts a new post written by author like AddWithAuthor, at its place by its exact timestamp.
+// Return the id of the new post and whether a post was evicted.
+// Implemented with coarse-grained locking.
+func (f *int64Feed) AddInt64(body string, author string, timestamp int64) (id uint64, evicted bool) {
+	f.lock.Lock()
+	newPost := f.newPost(body, float64(timestamp), nil)
+	newPost.nanos, newPost.exact = timestamp, true
+	newPost.author = author
+	id, evicted = f.addPost(newPost)
+	warning, count := f.warning, f.length()
+	f.lock.Unlock()
+
+	// The callback may call back into the feed so it is called once the lock is released.
+	if !evicted {
+		warning.notify(count)
+	}
+	return id, evicted
+}
+
+// seekInt64 is seek for an exact int64 timestamp: the walk goes on past posts that are older, including
+// posts whose timestamps are the same float64 but a smaller int64.
+func (f *feed) seekInt64(curr *post, timestamp int64) bool {
+	if f.less != nil {
+		return !curr.hasInt64(timestamp) && curr.timestamp != math.Inf(1)
+	}
+	t := float64(timestamp)
+	return curr.timestamp < t || (curr.timestamp == t && curr.nanos < timestamp)
+}
+
+// hasInt64 reports whether the post has the exact int64 timestamp.
+func (p *post) hasInt64(timestamp int64) bool {
+	return p.timestamp == float64(timestamp) && p.nanos == timestamp
+}
+
+// RemoveInt64 deletes the post with the given exact timestamp like Remove. Return true if the deletion
+// was a success.
+// Implemented with coarse-grained locking.
+func (f *int64Feed) RemoveInt64(timestamp int64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	pred := f.start
+	curr := pred.next
+	for f.seekInt64(curr, timestamp) {
+		pred = curr
+		curr = curr.next
+	}
+	if !curr.hasInt64(timestamp) {
+		return false
+	}
+	f.unlink(pred)
+	return true
+}
+
+// ContainsInt64 determines whether a post with the given exact timestamp is inside the feed.
+// Implemented with coarse-grained locking.
+func (f *int64Feed) ContainsInt64(timestamp int64) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	curr := f.start.next
+	for f.seekInt64(curr, timestamp) {
+		curr = curr.next
+	}
+	return curr.hasInt64(timestamp)
+}
+
+// lockFreeFeed is a user's twitter feed that none of the methods take a lock on. It is a
+// Harris-style sorted linked list, as in "The Art of Multiprocessor Programming," pp. 213-218:
+// a post is removed by first marking it, which logically deletes it, and then unlinking it,
+// which any goroutine that comes across a marked post helps with. Posts are ordered by
+// timestamp and then by id, the same order as a feed with TieBreakID, so every post has one
+// place in the list and posts with the same timestamp do not need to be compared.
+// Every method that changes one post is linearizable. Methods that change several posts, such
+// as RemoveRange and Merge, are a series of such changes, and methods that read several posts,
+// such as ShowFeed and Stats, see each post as it is when they reach it rather than a snapshot.
+type lockFreeFeed struct {
+	head     *lockFreePost    // sentinel before the oldest post, never removed
+	tail     *lockFreePost    // sentinel after the newest post, never removed
+	lastID   uint64           // the id given to the most recently added post
+	keys     sync.Map         // ids of the posts added by AddIdempotent by their keys
+	keyRing  []unsafe.Pointer // the last maxKeys keys, each a *string, so the oldest can be forgotten
+	keyCount uint64           // number of keys ever added; the next slot of keyRing is keyCount % maxKeys
+	added    *addedSignal     // wakes up goroutines in WaitFor when a post is added
+	events   *eventHub        // sends the changes to the feed to its subscribers
+	version  atomic.Uint64    // number of changes ever made to posts
+	size     atomic.Int64     // number of posts linked in and not marked
+	warning  atomic.Value     // the *capacityWarning set by SetCapacityWarning
+}
+
+// lockFreePost is a post of a lockFreeFeed. The timestamp, id and author of a post never change,
+// so they can be read without synchronization. Everything that changes is in its state.
+type lockFreePost struct {
+	timestamp float64    // Unix timestamp of the post
+	id        uint64     // unique id of the post, independent of its timestamp
+	author    string     // who wrote the post, empty if unknown
+	state     *postState // the current state of the post, only loaded and replaced atomically
+}
+
+// postState is the part of a lockFreePost that changes. A state is never changed once it is
+// stored in a post; instead a new state is swapped in with CAS. Keeping the mark with the next
+// pointer, like the book's AtomicMarkableReference, means no post can be linked in after a
+// removed post. Keeping the body and likes with them too means a removed post cannot be edited
+// or liked, and RemoveIf checks the body of exactly the post it removes.
+type postState struct {
+	next   *lockFreePost // the next post in the feed
+	marked bool          // the post has been removed
+	body   string        // the text of the post
+	likes  int           // number of times the post has been liked
+}
+
+// NewLockFreeFeed creates an empty user feed that is safe for concurrent use without locks.
+// It shows posts with the same timestamp in the order of TieBreakID and is not bounded.
+func NewLockFreeFeed() Feed {
+	tail := &lockFreePost{timestamp: math.Inf(1), id: math.MaxUint64, state: &postState{}}
+	head := &lockFreePost{timestamp: math.Inf(-1), state: &postState{next: tail, body: "null"}}
+	return &lockFreeFeed{head: head, tail: tail, keyRing: make([]unsafe.Pointer, maxKeys), added: newAddedSignal(), events: newEventHub()}
+}
+
+// load atomically loads the state of the post. States are swapped in with CAS by other
+// goroutines so they are always read atomically too.
+func (p *lockFreePost) load() *postState {
+	return (*postState)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&p.state))))
+}
+
+// cas swaps in the update for the state of the post if the state is still expect.
+func (p *lockFreePost) cas(expect *postState, update *postState) bool {
+	return atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&p.state)), unsafe.Pointer(expect), unsafe.Pointer(update))
+}
+
+// before reports whether the post comes before the place of a post with the given timestamp
+// and id. No post has id 0 so the place of timestamp and id 0 is before every post with the timestamp.
+func (p *lockFreePost) before(timestamp float64, id uint64) bool {
+	return p.timestamp < timestamp || (p.timestamp == timestamp && p.id < id)
+}
+
+// value copies the post with the given state into a post of the coarse-grained feed.
+func (p *lockFreePost) value(state *postState) post {
+	return post{body: state.body, timestamp: p.timestamp, id: p.id, likes: state.likes, author: p.author}
+}
+
+// marshal puts the post with the given state in to byte data in the form ShowFeed returns.
+func (p *lockFreePost) marshal(state *postState) []byte {
+	value := p.value(state)
+	return value.marshal()
+}
+
+// find returns the last post before the place of a post with the given timestamp and id, the
+// state of that post, and the first post at or after the place, which is the tail if there is
+// none. The state's next post is the returned post, so linking in a new post with CAS on the
+// state succeeds only if nothing changed between the two. Marked posts on the way are unlinked.
+// If unlinking fails because the post before changed then find starts again from the head.
+func (f *lockFreeFeed) find(timestamp float64, id uint64) (*lockFreePost, *postState, *lockFreePost) {
+retry:
+	for {
+		pred := f.head
+		predState := pred.load()
+		curr := predState.next
+		for {
+			currState := curr.load()
+			for currState.marked {
+				unlinked := &postState{next: currState.next, body: predState.body, likes: predState.likes}
+				if !pred.cas(predState, unlinked) {
+					continue retry
+				}
+				predState = unlinked
+				curr = currState.next
+				currState = curr.load()
+			}
+			if !curr.before(timestamp, id) {
+				return pred, predState, curr
+			}
+			pred, predState, curr = curr, currState, currState.next
+		}
+	}
+}
+
+// at returns the first post with the given timestamp, or nil if there is none.
+func (f *lockFreeFeed) at(timestamp float64) *lockFreePost {
+	_, _, curr := f.find(timestamp, 0)
+	if curr == f.tail || curr.timestamp != timestamp {
+		return nil
+	}
+	return curr
+}
+
+// tryLink tries to link newPost in, with the given body and likes, just after pred, whose state
+// was predState when it was found. It fails if pred has changed since. Once the post is linked in
+// the goroutines waiting for a post are woken up. Return whether the post was linked in and the
+// number of posts in the feed it left, which no other post linked in sees.
+func (f *lockFreeFeed) tryLink(pred *lockFreePost, predState *postState, newPost *lockFreePost, body string, likes int) (linked bool, count int) {
+	// No other goroutine can see the new post until it is linked in.
+	state := &postState{next: predState.next, body: body, likes: likes}
+	newPost.state = state
+	if !pred.cas(predState, &postState{next: newPost, body: predState.body, likes: predState.likes}) {
+		return false, 0
+	}
+	count = int(f.size.Add(1))
+	f.added.signal()
+	f.emit(PostAdded, newPost, state)
+	return true, count
+}
+
+// emit records a change to post p, which left it with the given state, once the change has been made:
+// the version of the feed goes up and an event is sent to the subscribers of the feed. Changes made by
+// different goroutines at once may be sent in either order.
+func (f *lockFreeFeed) emit(kind EventKind, p *lockFreePost, state *postState) {
+	f.version.Add(1)
+	if f.events.active() {
+		f.events.publish(FeedEvent{Kind: kind, Post: p.marshal(state)})
+	}
+}
+
+// add links a new post in at its place and returns its id and the number of posts in the feed it
+// left, or returns 0 without adding a post if the timestamp is infinite.
+func (f *lockFreeFeed) add(body string, author string, timestamp float64, likes int) (uint64, int) {
+	if isSentinel(timestamp) {
+		return 0, 0
+	}
+	return f.addWithID(atomic.AddUint64(&f.lastID, 1), body, author, timestamp, likes)
+}
+
+// addWithID links in a new post like add with an id already taken from lastID.
+func (f *lockFreeFeed) addWithID(id uint64, body string, author string, timestamp float64, likes int) (uint64, int) {
+	newPost := &lockFreePost{timestamp: timestamp, id: id, author: author}
+	for {
+		pred, predState, _ := f.find(timestamp, newPost.id)
+		if linked, count := f.tryLink(pred, predState, newPost, body, likes); linked {
+			return newPost.id, count
+		}
+	}
+}
+
+// addWithWarning adds a post like add and calls the capacity warning's callback if the post took the
+// feed over its threshold.
+func (f *lockFreeFeed) addWithWarning(body string, author string, timestamp float64) uint64 {
+	id, count := f.add(body, author, timestamp, 0)
+	if id != 0 {
+		warning, _ := f.warning.Load().(*capacityWarning)
+		warning.notify(count)
+	}
+	return id
+}
+
+// update swaps in the state change returns for the state of p. Return false if p is removed.
+func (f *lockFreeFeed) update(p *lockFreePost, change func(state *postState) *postState) bool {
+	for {
+		state := p.load()
+		if state.marked {
+			return false
+		}
+		if changed := change(state); p.cas(state, changed) {
+			f.emit(PostEdited, p, changed)
+			return true
+		}
+	}
+}
+
+// mark logically removes p if check, which may be nil, passes for its state and returns the
+// state p had. It returns false if p was already removed or failed the check. The caller must
+// unlink p, e.g. with remove or find.
+func (f *lockFreeFeed) mark(p *lockFreePost, check func(state *postState) bool) (*postState, bool) {
+	for {
+		state := p.load()
+		if state.marked || (check != nil && !check(state)) {
+			return state, false
+		}
+		if p.cas(state, &postState{next: state.next, marked: true, body: state.body, likes: state.likes}) {
+			f.size.Add(-1)
+			f.emit(PostRemoved, p, state)
+			return state, true
+		}
+	}
+}
+
+// remove marks p like mark and then unlinks it.
+func (f *lockFreeFeed) remove(p *lockFreePost, check func(state *postState) bool) (*postState, bool) {
+	state, ok := f.mark(p, check)
+	if ok {
+		f.find(p.timestamp, p.id)
+	}
+	return state, ok
+}
+
+// walk calls fn with each post that is not removed and its state, oldest first, until fn returns
+// false. It never retries, so a post added or removed during the walk may or may not be seen.
+func (f *lockFreeFeed) walk(fn func(p *lockFreePost, state *postState) bool) {
+	for curr := f.head.load().next; curr != f.tail; {
+		state := curr.load()
+		if !state.marked && !fn(curr, state) {
+			return
+		}
+		curr = state.next
+	}
+}
+
+// scan reports whether match is true for the state of a post with the given timestamp that is
+// not removed. Like walk it never retries or unlinks posts, so it does not write to the feed.
+func (f *lockFreeFeed) scan(timestamp float64, match func(state *postState) bool) bool {
+	curr := f.head.load().next
+	for curr.before(timestamp, 0) {
+		curr = curr.load().next
+	}
+	for curr != f.tail && curr.timestamp == timestamp {
+		state := curr.load()
+		if !state.marked && match(state) {
+			return true
+		}
+		curr = state.next
+	}
+	return false
+}
+
+// Add inserts a new post to the feed at its place by timestamp and returns its id.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Add(body string, timestamp float64) uint64 {
+	return f.addWithWarning(body, "", timestamp)
+}
+
+// AddWithEviction inserts a new post like Add. The feed is not bounded so no post is evicted.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) AddWithEviction(body string, timestamp float64) (id uint64, evicted bool) {
+	return f.addWithWarning(body, "", timestamp), false
+}
+
+// AddWithAuthor inserts a new post written by author like Add. No post is evicted.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) AddWithAuthor(body string, author string, timestamp float64) (id uint64, evicted bool) {
+	return f.addWithWarning(body, author, timestamp), false
+}
+
+// Upsert inserts a new post written by author like AddWithAuthor if no post has the given timestamp,
+// otherwise it replaces the body of the first post with the timestamp and keeps its author. Return
+// true if a new post was created. The new post is only linked in if the posts around its place have
+// not changed since no post with the timestamp was found, so two upserts of the same timestamp never
+// both create a post.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Upsert(body string, author string, timestamp float64) (created bool) {
+	if isSentinel(timestamp) {
+		return false
+	}
+	var newPost *lockFreePost
+	for {
+		pred, predState, curr := f.find(timestamp, 0)
+		if curr != f.tail && curr.timestamp == timestamp {
+			if f.update(curr, func(state *postState) *postState {
+				return &postState{next: state.next, body: body, likes: state.likes}
+			}) {
+				return false
+			}
+			continue
+		}
+		if newPost == nil {
+			newPost = &lockFreePost{timestamp: timestamp, id: atomic.AddUint64(&f.lastID, 1), author: author}
+		}
+		if linked, _ := f.tryLink(pred, predState, newPost, body, 0); linked {
+			return true
+		}
+	}
+}
+
+// SwapBody replaces the body of the first post with the given timestamp with newBody and returns
+// the body it had. The body is read from the state the CAS replaces, so no other edit can come in
+// between. If the post is removed first the next post with the timestamp is tried. Return false if
+// no post has the timestamp.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) SwapBody(timestamp float64, newBody string) (old string, ok bool) {
+	if isSentinel(timestamp) {
+		return "", false
+	}
+	for {
+		curr := f.at(timestamp)
+		if curr == nil {
+			return "", false
+		}
+		if f.update(curr, func(state *postState) *postState {
+			old = state.body
+			return &postState{next: state.next, body: newBody, likes: state.likes}
+		}) {
+			return old, true
+		}
+	}
+}
+
+// Remove deletes the first post with the given timestamp. If another goroutine removes the
+// post first then the next post with the timestamp is tried. Return true if a post was deleted.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Remove(timestamp float64) bool {
+	if isSentinel(timestamp) {
+		return false
+	}
+	for {
+		curr := f.at(timestamp)
+		if curr == nil {
+			return false
+		}
+		if _, ok := f.remove(curr, nil); ok {
+			return true
+		}
+	}
+}
+
+// RemoveIf deletes the first post with the given timestamp whose body is still expectedBody.
+// The body is checked in the same CAS that removes the post. Return true if a post was deleted.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) RemoveIf(timestamp float64, expectedBody string) bool {
+	for curr := f.at(timestamp); curr != nil && curr != f.tail && curr.timestamp == timestamp; {
+		state, ok := f.remove(curr, func(state *postState) bool { return state.body == expectedBody })
+		if ok {
+			return true
+		}
+		curr = state.next
+	}
+	return false
+}
+
+// Pop deletes the first post with the given timestamp like Remove and returns it in the same byte form
+// as ShowFeed. The post is returned with the state it was marked with, so it is exactly the post that was
+// removed. The function returns false if the feed has no post with the timestamp.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Pop(timestamp float64) ([]byte, bool) {
+	if isSentinel(timestamp) {
+		return nil, false
+	}
+	for {
+		curr := f.at(timestamp)
+		if curr == nil {
+			return nil, false
+		}
+		if state, ok := f.remove(curr, nil); ok {
+			return curr.marshal(state), true
+		}
+	}
+}
+
+// RemoveOldest deletes the post with the oldest timestamp and returns it in the same byte form
+// as ShowFeed. The function returns false if the feed is empty.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) RemoveOldest() ([]byte, bool) {
+	for {
+		_, _, oldest := f.find(math.Inf(-1), 0)
+		if oldest == f.tail {
+			return nil, false
+		}
+		if state, ok := f.remove(oldest, nil); ok {
+			return oldest.marshal(state), true
+		}
+	}
+}
+
+// RemoveNewest deletes the post with the newest timestamp and returns it in the same byte form
+// as ShowFeed. The whole feed is walked to find the newest post. A post added after the walk
+// passes its place is not newer than the post removed, because the walk saw it last.
+// The function returns false if the feed is empty.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) RemoveNewest() ([]byte, bool) {
+	for {
+		var newest *lockFreePost
+		f.walk(func(p *lockFreePost, state *postState) bool {
+			newest = p
+			return true
+		})
+		if newest == nil {
+			return nil, false
+		}
+		if state, ok := f.remove(newest, nil); ok {
+			return newest.marshal(state), true
+		}
+	}
+}
+
+// TrimToNewest keeps the n newest posts and deletes the rest, returning the number of posts deleted.
+// A feed whose count is already at most n is left without walking it. Otherwise the posts seen by one
+// walk are collected, since the count can change during the walk, and all but the newest n are marked
+// one at a time and then unlinked together. A post added while the feed is trimmed may be kept even if
+// it is older than the posts kept. Nothing is deleted if n is negative, and every post seen is deleted
+// if n is 0.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) TrimToNewest(n int) int {
+	if n < 0 || int(f.size.Load()) <= n {
+		return 0
+	}
+	posts := make([]*lockFreePost, 0, f.size.Load())
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		posts = append(posts, p)
+		return true
+	})
+	if len(posts) <= n {
+		return 0
+	}
+	removed := 0
+	trimmed := posts[:len(posts)-n]
+	for _, p := range trimmed {
+		if _, ok := f.mark(p, nil); ok {
+			removed++
+		}
+	}
+	last := trimmed[len(trimmed)-1]
+	f.find(last.timestamp, last.id)
+	return removed
+}
+
+// Compact collapses each run of posts next to each other with the same body into the newest post of
+// the run like the coarse-grained feed. The runs are found with one walk and then each post is removed
+// on its own, only if its body has not changed since, so the compaction is not atomic: a post added
+// or edited during it may leave a run that is not collapsed.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Compact() int {
+	posts := make([]*lockFreePost, 0)
+	bodies := make([]string, 0)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		posts = append(posts, p)
+		bodies = append(bodies, state.body)
+		return true
+	})
+	removed := 0
+	for i := 0; i+1 < len(posts); i++ {
+		if bodies[i] != bodies[i+1] {
+			continue
+		}
+		body := bodies[i]
+		if _, ok := f.remove(posts[i], func(state *postState) bool { return state.body == body }); ok {
+			removed++
+		}
+	}
+	return removed
+}
+
+// RemoveRange deletes every post with a timestamp between from and to, inclusive, and returns
+// the number of posts deleted. The posts are marked one at a time and then unlinked together,
+// so a post added to the range while it is being removed may be kept.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) RemoveRange(from float64, to float64) int {
+	removed := 0
+	_, _, curr := f.find(from, 0)
+	for curr != f.tail && curr.timestamp <= to {
+		state, ok := f.mark(curr, nil)
+		if ok {
+			removed++
+		}
+		curr = state.next
+	}
+	f.find(curr.timestamp, curr.id)
+	return removed
+}
+
+// ContainsApprox determines whether a post with a timestamp within epsilon of the given timestamp
+// is inside the feed. Like Contains it only reads the feed, skipping the posts before the window and
+// checking the posts in it until one is not removed, so it is wait-free. The function returns false
+// if epsilon is negative.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ContainsApprox(timestamp float64, epsilon float64) bool {
+	if isSentinel(timestamp) {
+		return false
+	}
+	curr := f.head.load().next
+	for curr.before(timestamp-epsilon, 0) {
+		curr = curr.load().next
+	}
+	for curr != f.tail && curr.timestamp <= timestamp+epsilon {
+		state := curr.load()
+		if !state.marked {
+			return true
+		}
+		curr = state.next
+	}
+	return false
+}
+
+// ContainsBodies determines for each of the given bodies whether a post with exactly that body is
+// inside the feed. Every body is looked up in one walk of the feed, which stops early once every
+// body has been found, so a post added or removed during the walk may or may not be seen.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ContainsBodies(bodies []string) map[string]bool {
+	found, remaining := requestedBodies(bodies)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if seen, requested := found[state.body]; requested && !seen {
+			found[state.body] = true
+			remaining--
+		}
+		return remaining > 0
+	})
+	return found
+}
+
+// ContainsAll determines for each of the given timestamps whether a post with that timestamp is
+// inside the feed. Like the coarse-grained feed the timestamps are sorted and compared with the posts
+// in one walk, which stops once the last timestamp is passed, so a post added or removed during the
+// walk may or may not be seen.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ContainsAll(timestamps []float64) map[float64]bool {
+	found, sorted := requestedTimestamps(timestamps)
+	next := 0
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		for next < len(sorted) && sorted[next] < p.timestamp {
+			next++
+		}
+		if next < len(sorted) && sorted[next] == p.timestamp {
+			found[p.timestamp] = true
+			next++
+		}
+		return next < len(sorted)
+	})
+	return found
+}
+
+// Contains determines whether a post with the given timestamp is inside the feed. Like the
+// book's contains it only reads the feed, so it is wait-free.
+func (f *lockFreeFeed) Contains(timestamp float64) bool {
+	if isSentinel(timestamp) {
+		return false
+	}
+	return f.scan(timestamp, func(state *postState) bool { return true })
+}
+
+// IndexOf returns the position of the post with the given timestamp counting from the newest,
+// which is post 0, or false if no post has the timestamp. If several posts have the timestamp the
+// position of the first one in the list is returned, like for the coarse-grained feed. The walk stops
+// at the post and the posts after it are counted with the feed's count rather than walked, so a post
+// added or removed at the same time may or may not be counted.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) IndexOf(timestamp float64) (int, bool) {
+	i, found := 0, false
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if p.timestamp == timestamp {
+			found = true
+			return false
+		}
+		i++
+		return true
+	})
+	if !found {
+		return 0, false
+	}
+	if index := int(f.size.Load()) - 1 - i; index > 0 {
+		return index, true
+	}
+	return 0, true
+}
+
+// ShowFeed puts post body and timestamp data in to byte data for FEED to return in twitter.go,
+// newest first.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ShowFeed() [][]byte {
+	feedArray := make([][]byte, 0)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		feedArray = append(feedArray, p.marshal(state))
+		return true
+	})
+	return reverseFeed(feedArray)
+}
+
+// ShowFeedPosts returns the posts newest first like ShowFeed, but as PostViews instead of byte data.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ShowFeedPosts() []PostView {
+	posts := make([]PostView, 0, f.Count())
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		value := p.value(state)
+		posts = append(posts, value.view())
+		return true
+	})
+	reversePosts(posts)
+	return posts
+}
+
+// ShowFeedSince returns the posts with a timestamp after since like the coarse-grained feed.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ShowFeedSince(since float64) [][]byte {
+	feedArray := make([][]byte, 0)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if p.timestamp > since {
+			feedArray = append(feedArray, p.marshal(state))
+		}
+		return true
+	})
+	return reverseFeed(feedArray)
+}
+
+// ShowFeedOldestFirst returns the limit oldest posts, oldest first, like the coarse-grained feed.
+// The walk stops once it has limit posts.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ShowFeedOldestFirst(limit int) [][]byte {
+	feedArray := make([][]byte, 0)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		feedArray = append(feedArray, p.marshal(state))
+		return limit <= 0 || len(feedArray) < limit
+	})
+	return feedArray
+}
+
+// ShowFeedSnapshot is the same as ShowFeed. No lock is ever held, and the states read by the
+// walk never change, so there is nothing to copy before marshalling.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ShowFeedSnapshot() [][]byte {
+	return f.ShowFeed()
+}
+
+// RemoveByID deletes the post with the given id. Return true if the deletion was a success.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) RemoveByID(id uint64) bool {
+	for {
+		var found *lockFreePost
+		f.walk(func(p *lockFreePost, state *postState) bool {
+			if p.id == id {
+				found = p
+				return false
+			}
+			return true
+		})
+		if found == nil {
+			return false
+		}
+		// Reschedule briefly has a copy of the post with the same id, so look again on failure.
+		if _, ok := f.remove(found, nil); ok {
+			return true
+		}
+	}
+}
+
+// GetByID returns the post with the given id in the same byte form as ShowFeed. The function
+// returns false if no post in the feed has the id.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) GetByID(id uint64) ([]byte, bool) {
+	var found []byte
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if p.id == id {
+			found = p.marshal(state)
+			return false
+		}
+		return true
+	})
+	return found, found != nil
+}
+
+// GetNthRecent returns the nth post counting from the newest, which is post 0, in the same byte
+// form as ShowFeed. The feed's count says how far from the oldest post the nth post is, so the walk
+// stops there. The function returns false if n is negative or there are not more than n posts. A post
+// added or removed at the same time may shift which post is returned by one.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) GetNthRecent(n int) ([]byte, bool) {
+	target := int(f.size.Load()) - 1 - n
+	if n < 0 || target < 0 {
+		return nil, false
+	}
+	var postByte []byte
+	i := 0
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if i == target {
+			postByte = p.marshal(state)
+			return false
+		}
+		i++
+		return true
+	})
+	return postByte, postByte != nil
+}
+
+// Successor returns the oldest post with a timestamp after timestamp like the coarse-grained feed.
+// The walk stops at the first such post.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Successor(timestamp float64) ([]byte, bool) {
+	var postByte []byte
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if p.timestamp > timestamp {
+			postByte = p.marshal(state)
+			return false
+		}
+		return true
+	})
+	return postByte, postByte != nil
+}
+
+// Predecessor returns the newest post with a timestamp before timestamp like the coarse-grained feed.
+// The walk stops at the first post that is not older.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Predecessor(timestamp float64) ([]byte, bool) {
+	var postByte []byte
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if p.timestamp >= timestamp {
+			return false
+		}
+		postByte = p.marshal(state)
+		return true
+	})
+	return postByte, postByte != nil
+}
+
+// Closest returns the post whose timestamp is nearest to timestamp like the coarse-grained feed, the
+// newer one of two posts as near as each other. The walk stops once the posts only get further away.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Closest(timestamp float64) ([]byte, bool) {
+	if math.IsNaN(timestamp) {
+		return nil, false
+	}
+	var postByte []byte
+	best := math.Inf(1)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		diff := math.Abs(p.timestamp - timestamp)
+		if p.timestamp > timestamp && diff > best {
+			return false
+		}
+		if postByte == nil || diff <= best {
+			postByte, best = p.marshal(state), diff
+		}
+		return true
+	})
+	return postByte, postByte != nil
+}
+
+// Reschedule moves the first post with oldTimestamp so that it has newTimestamp, keeping its
+// body, likes and id. The timestamp is the post's place in the list so it cannot change in
+// place: a copy is linked in at newTimestamp, unless a post already has it, and then the
+// original is removed. Changes made to the original in between are carried over to the copy.
+// The move is not atomic: a concurrent reader may see the post at both timestamps. If the
+// original is removed by another goroutine first then the copy is removed too and the next
+// post with oldTimestamp is tried. Return true if the move was a success.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Reschedule(oldTimestamp float64, newTimestamp float64) bool {
+	if isSentinel(oldTimestamp) || isSentinel(newTimestamp) {
+		return false
+	}
+	for {
+		moved := f.at(oldTimestamp)
+		if moved == nil {
+			return false
+		}
+		if oldTimestamp == newTimestamp {
+			return true
+		}
+		state := moved.load()
+		if state.marked {
+			continue
+		}
+
+		pred, predState, curr := f.find(newTimestamp, 0)
+		if curr != f.tail && curr.timestamp == newTimestamp {
+			return false
+		}
+		copied := &lockFreePost{timestamp: newTimestamp, id: moved.id, author: moved.author}
+		if linked, _ := f.tryLink(pred, predState, copied, state.body, state.likes); !linked {
+			continue
+		}
+
+		final, ok := f.remove(moved, nil)
+		if !ok {
+			f.remove(copied, nil)
+			continue
+		}
+		if final != state {
+			f.update(copied, func(s *postState) *postState {
+				body := s.body
+				if final.body != state.body {
+					body = final.body
+				}
+				return &postState{next: s.next, body: body, likes: s.likes + final.likes - state.likes}
+			})
+		}
+		return true
+	}
+}
+
+// Like adds a like to the first post with the given timestamp. Return true if the post was
+// found and liked.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Like(timestamp float64) bool {
+	for {
+		curr := f.at(timestamp)
+		if curr == nil {
+			return false
+		}
+		if f.update(curr, func(state *postState) *postState {
+			return &postState{next: state.next, body: state.body, likes: state.likes + 1}
+		}) {
+			return true
+		}
+	}
+}
+
+// TopLiked returns the n posts with the most likes like the coarse-grained feed.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) TopLiked(n int) [][]byte {
+	posts := make([]post, 0)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		posts = append(posts, p.value(state))
+		return true
+	})
+	return topLiked(posts, n)
+}
+
+// AddIdempotent inserts a new post written by author like AddWithAuthor unless a post with the
+// same key was already added. Return the id of the new post and true if the post was added,
+// otherwise return the id of the post first added with key and false. An empty key is never a
+// duplicate. The id is taken before the key is claimed with LoadOrStore, so two adds with the same
+// key never both add a post and both see the same id. A known key is looked up first so that a
+// retry does not use up an id. Each key is also stored in a ring of maxKeys
+// slots, and the key it replaces is forgotten.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) AddIdempotent(body string, author string, timestamp float64, key string) (uint64, bool) {
+	if isSentinel(timestamp) {
+		return 0, false
+	}
+	if first, seen := f.keys.Load(key); seen && key != "" {
+		return first.(uint64), false
+	}
+	id := atomic.AddUint64(&f.lastID, 1)
+	if key != "" {
+		if first, seen := f.keys.LoadOrStore(key, id); seen {
+			return first.(uint64), false
+		}
+		slot := (atomic.AddUint64(&f.keyCount, 1) - 1) % maxKeys
+		if forgotten := atomic.SwapPointer(&f.keyRing[slot], unsafe.Pointer(&key)); forgotten != nil {
+			f.keys.Delete(*(*string)(forgotten))
+		}
+	}
+	f.addWithID(id, body, author, timestamp, 0)
+	return id, true
+}
+
+// keyID returns the id of the post added by AddIdempotent with key, if the key is still remembered.
+func (f *lockFreeFeed) keyID(key string) (uint64, bool) {
+	if id, seen := f.keys.Load(key); seen {
+		return id.(uint64), true
+	}
+	return 0, false
+}
+
+// SetCapacityWarning sets a soft limit on the number of posts in the feed like the coarse-grained
+// feed. Each post linked in by Add, AddWithEviction or AddWithAuthor is given its own count, so exactly
+// one add sees the count go over threshold and calls callback for each crossing, even when several
+// goroutines add at once. The callback is called by the goroutine that made the add, after the post is
+// linked in.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) SetCapacityWarning(threshold int, callback func(current int)) {
+	f.warning.Store(newCapacityWarning(threshold, callback))
+}
+
+// Count returns the number of posts in the feed without walking it. The count goes up when a post is
+// linked in and down when a post is marked, which are the points where a post is added and removed,
+// so it is read with one atomic load. A post moved by Reschedule is briefly counted twice.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Count() int {
+	return int(f.size.Load())
+}
+
+// IsEmpty returns whether the feed has no posts, i.e. the count read by Count is 0, so it is one atomic load.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) IsEmpty() bool {
+	return f.size.Load() == 0
+}
+
+// Version returns a number that goes up each time a post is added, removed or edited, like the
+// coarse-grained feed. It is raised just after each change is made, so a client that reads the
+// version before reading the feed and sees the same version later knows the feed it read is current.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Version() uint64 {
+	return f.version.Load()
+}
+
+// Stats returns the number of posts, the oldest and newest timestamps and the total likes of
+// the feed, computed in one walk.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Stats() FeedStats {
+	var stats FeedStats
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if stats.Count == 0 {
+			stats.Oldest = p.timestamp
+		}
+		stats.Newest = p.timestamp
+		stats.Count++
+		stats.TotalLikes += state.likes
+		return true
+	})
+	return stats
+}
+
+// CountMatching returns the number of posts whose body contains substr.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) CountMatching(substr string) int {
+	count := 0
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if strings.Contains(state.body, substr) {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// TotalBodyBytes returns the sum of the lengths in bytes of the bodies of the posts like the coarse-grained feed.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) TotalBodyBytes() int64 {
+	var total int64
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		total += int64(len(state.body))
+		return true
+	})
+	return total
+}
+
+// BucketCounts counts the posts in each time bucket of bucketSeconds seconds like the coarse-grained feed.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) BucketCounts(bucketSeconds float64) map[int64]int {
+	if !(bucketSeconds > 0) {
+		return nil
+	}
+	buckets := make(map[int64]int)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		buckets[bucketOf(p.timestamp, bucketSeconds)]++
+		return true
+	})
+	return buckets
+}
+
+// ForEach calls fn with the body and timestamp of each post in the given order until fn returns
+// false. No lock is held so, unlike the coarse-grained feed, fn may call methods of the feed.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ForEach(order Order, fn func(body string, timestamp float64) bool) {
+	if order == OldestFirst {
+		f.walk(func(p *lockFreePost, state *postState) bool {
+			return fn(state.body, p.timestamp)
+		})
+		return
+	}
+
+	posts := make([]post, 0)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		posts = append(posts, p.value(state))
+		return true
+	})
+	for i := len(posts) - 1; i >= 0; i-- {
+		if !fn(posts[i].body, posts[i].timestamp) {
+			return
+		}
+	}
+}
+
+// Validate checks that the feed is well formed: the head sentinel is first, the tail sentinel
+// is last, no post in between has an infinite timestamp and the posts, removed or not, are in
+// order. Posts are only ever linked in at their place, so the feed stays sorted even while it
+// is being changed and Validate can be called at any time.
+func (f *lockFreeFeed) Validate() error {
+	if f.head == nil || f.head.timestamp != math.Inf(-1) || f.head.load().marked {
+		return errors.New("feed: the head sentinel is missing")
+	}
+	if state := f.tail.load(); state.next != nil || state.marked {
+		return errors.New("feed: the tail sentinel is not the last post")
+	}
+	pred := f.head
+	for curr := f.head.load().next; curr != f.tail; curr = curr.load().next {
+		if curr == nil {
+			return errors.New("feed: the tail sentinel is missing")
+		}
+		if math.IsInf(curr.timestamp, 0) {
+			return fmt.Errorf("feed: post id:%v has a sentinel's timestamp", curr.id)
+		}
+		if pred != f.head && !pred.before(curr.timestamp, curr.id) {
+			return fmt.Errorf("feed: post id:%v with timestamp:%v is before post id:%v with timestamp:%v",
+				pred.id, pred.timestamp, curr.id, curr.timestamp)
+		}
+		pred = curr
+	}
+	return nil
+}
+
+// Merge adds every post of other that the feed does not have yet, like the coarse-grained feed.
+// Each post is looked up and added on its own, so the merge is not atomic.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Merge(other Feed) {
+	for _, p := range copyPosts(other) {
+		body := p.body
+		if !f.scan(p.timestamp, func(state *postState) bool { return state.body == body }) {
+			f.add(p.body, p.author, p.timestamp, p.likes)
+		}
+	}
+}
+
+// ReplaceAll returns ErrReplaceUnsupported and leaves the feed unchanged. Swapping a new list in after
+// the head with one CAS is not enough: a reader already walking the old posts sees them change under
+// it as they are removed, and an add that found its place among the old posts links its post in to a
+// list that is no longer reachable, so the post is lost.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) ReplaceAll(posts []PostView) error {
+	return ErrReplaceUnsupported
+}
+
+// WaitFor blocks until a post with the given timestamp is in the feed and returns true, or returns
+// false once timeout has passed without one. The feed is checked again each time a post is linked in.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) WaitFor(timestamp float64, timeout time.Duration) bool {
+	return f.added.waitForTimeout(func() bool { return f.Contains(timestamp) }, timeout)
+}
+
+// Subscribe returns a channel that an event is sent to for every post added to, removed from or edited
+// in the feed from now on, like the coarse-grained feed. Each event is sent once its change has taken
+// effect, but events for changes made at once by different goroutines may come in either order.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Subscribe() <-chan FeedEvent {
+	return f.events.subscribe()
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe and closes it.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Unsubscribe(events <-chan FeedEvent) {
+	f.events.unsubscribe(events)
+}
+
+// Diff compares the feed with old, a feed previously returned by ShowFeed, and returns the posts added
+// since, newest first, and the posts removed since, in the order they are in old. The feed is read with
+// one walk, like ShowFeed.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Diff(old [][]byte) (added [][]byte, removed [][]byte) {
+	return diffPosts(f.ShowFeed(), old)
+}
+
+// Clone returns a new feed with a copy of every post and key of the feed like the coarse-grained feed.
+// Like ShowFeed the posts are copied by a walk, so a post added or removed during Clone may or may not
+// be in the clone.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) Clone() Feed {
+	clone := NewLockFreeFeed().(*lockFreeFeed)
+	last := clone.head
+	var count int64
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		copied := &lockFreePost{timestamp: p.timestamp, id: p.id, author: p.author,
+			state: &postState{next: clone.tail, body: state.body, likes: state.likes}}
+		last.state.next = copied
+		last = copied
+		count++
+		return true
+	})
+	clone.lastID = atomic.LoadUint64(&f.lastID)
+	clone.size.Store(count)
+	clone.version.Store(f.version.Load())
+	clone.keyCount = atomic.LoadUint64(&f.keyCount)
+	for i := range f.keyRing {
+		if key := atomic.LoadPointer(&f.keyRing[i]); key != nil {
+			clone.keyRing[i] = key
+			if id, ok := f.keys.Load(*(*string)(key)); ok {
+				clone.keys.Store(*(*string)(key), id)
+			}
+		}
+	}
+	return clone
+}
+
+// SearchByAuthor returns the posts written by author in the same byte form as ShowFeed,
+// newest first.
+// This is a lock-free implementation.
+func (f *lockFreeFeed) SearchByAuthor(author string) [][]byte {
+	feedArray := make([][]byte, 0)
+	f.walk(func(p *lockFreePost, state *postState) bool {
+		if p.author == author {
+			feedArray = append(feedArray, p.marshal(state))
+		}
+		return true
+	})
+	return reverseFeed(feedArray)
+}
+
+// noLock is a lock.RWMutex that does nothing. The versions of an rcuFeed are never changed once they
+// are published, so they are read without a lock, and a new version is only changed by the writer
+// that builds it before it is published.
+type noLock struct{}
+
+// Lock does nothing.
+func (noLock) Lock() {}
+
+// Unlock does nothing.
+func (noLock) Unlock() {}
+
+// RLock does nothing.
+func (noLock) RLock() {}
+
+// RUnlock does nothing.
+func (noLock) RUnlock() {}
+
+// rcuFeed is a read-copy-update (RCU) feed for read-heavy workloads. The posts are kept in a version,
+// a coarse-grained feed with no lock, that is never changed once it is published. A reader loads the
+// current version atomically and reads it without taking any lock, so it always sees a consistent
+// snapshot of the feed however long it takes and never waits for a writer. Writers are serialized by
+// a mutex; each one builds a new version and swaps it in atomically. Add and Remove only copy the
+// posts from the head sentinel to the place of the change, which is at the newest end of the feed for
+// the usual new post, and share the rest of the list with the old version. The other methods that
+// change the feed copy the whole version and change the copy, so they cost a walk of the feed.
+// An old version is freed by the garbage collector once no reader has it.
+// It shows posts with the same timestamp in the order of TieBreakID and is not bounded.
+type rcuFeed struct {
+	mutex   sync.Mutex       // serializes writers; readers never take it
+	current unsafe.Pointer   // the *feed version readers see, only loaded and replaced atomically
+	added   *addedSignal     // wakes up goroutines in WaitFor when a post is added
+	warning *capacityWarning // set by SetCapacityWarning, nil if there is none; guarded by mutex
+	events  *eventHub        // sends the changes to the feed to its subscribers, shared by every version
+}
+
+// NewRCUFeed creates an empty user feed whose readers never take a lock and always see a snapshot
+// of the feed, at the cost of copying posts on every change. See rcuFeed.
+func NewRCUFeed() Feed {
+	version := newFeed(noLock{}, TieBreakID)
+	f := &rcuFeed{added: newAddedSignal(), events: version.events}
+	f.publish(version)
+	return f
+}
+
+// load atomically loads the current version of the feed.
+func (f *rcuFeed) load() *feed {
+	return (*feed)(atomic.LoadPointer(&f.current))
+}
+
+// publish atomically replaces the current version of the feed with version. The caller must hold
+// the mutex, and version must not be changed afterwards.
+func (f *rcuFeed) publish(version *feed) {
+	atomic.StorePointer(&f.current, unsafe.Pointer(version))
+}
+
+// newVersion returns a new version with the same settings, keys and count as the version f but no
+// posts, for a writer to fill in. The keys are shared, so the new version must not change them.
+func (f *feed) newVersion() *feed {
+	version := &feed{start: f.start, lock: noLock{}, lastID: f.lastID, keys: f.keys, keyOrder: f.keyOrder,
+		tieBreak: f.tieBreak, maxPosts: f.maxPosts, less: f.less, exact: f.exact, added: f.added, events: f.events}
+	version.size.Store(f.size.Load())
+	version.version.Store(f.version.Load())
+	return version
+}
+
+// copyPath returns a new version that shares the posts of the version f after post last, and a copy of
+// last in it. The posts from the head sentinel to last are copied, so the caller can relink the copy
+// of last without changing f. A nil last copies every post up to the tail sentinel.
+func (f *feed) copyPath(last *post) (*feed, *post) {
+	version := f.newVersion()
+	version.start = &post{}
+	copied := version.start
+	for curr := f.start; ; curr = curr.next {
+		*copied = *curr
+		if curr == last || curr.next == nil {
+			return version, copied
+		}
+		copied.next = &post{}
+		copied = copied.next
+	}
+}
+
+// clone returns a new version with a copy of every post and key of the version f, which can be changed
+// without changing f.
+func (f *feed) clone() *feed {
+	version, _ := f.copyPath(nil)
+	version.keys = make(map[string]uint64, len(f.keys))
+	for key, id := range f.keys {
+		version.keys[key] = id
+	}
+	version.keyOrder = append([]string(nil), f.keyOrder...)
+	return version
+}
+
+// update copies the current version, changes the copy with change and publishes it. The events for the
+// changes are held back until then, so a subscriber that reads the feed for an event sees the change.
+// Posts may have been added, so the goroutines in WaitFor are woken up.
+func (f *rcuFeed) update(change func(version *feed)) {
+	f.mutex.Lock()
+	version := f.load().clone()
+	f.events.hold()
+	change(version)
+	f.publish(version)
+	f.events.release()
+	f.mutex.Unlock()
+	f.added.signal()
+}
+
+// Add inserts a new post like the coarse-grained feed and returns its id.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Add(body string, timestamp float64) uint64 {
+	id, _ := f.AddWithAuthor(body, "", timestamp)
+	return id
+}
+
+// AddWithEviction inserts a new post like Add. The feed is not bounded so no post is ever evicted.
+// Implemented with read-copy-update.
+func (f *rcuFeed) AddWithEviction(body string, timestamp float64) (id uint64, evicted bool) {
+	return f.AddWithAuthor(body, "", timestamp)
+}
+
+// AddWithAuthor inserts a new post written by author like AddWithEviction. Only the posts shown after
+// the new post are copied, so adding a post newer than the rest copies the whole feed.
+// Implemented with read-copy-update.
+func (f *rcuFeed) AddWithAuthor(body string, author string, timestamp float64) (id uint64, evicted bool) {
+	if isSentinel(timestamp) {
+		return 0, false
+	}
+	f.mutex.Lock()
+	old := f.load()
+	newPost := &post{body: body, timestamp: timestamp, id: old.lastID + 1, author: author}
+
+	// Find the post the new post goes after, as link does, then copy the path to it.
+	pred := old.start
+	for pred.next.timestamp != math.Inf(1) && old.shownBefore(newPost, pred.next) {
+		pred = pred.next
+	}
+	version, pred := old.copyPath(pred)
+	newPost.next = pred.next
+	pred.next = newPost
+	version.lastID = newPost.id
+	version.size.Add(1)
+	f.publish(version)
+	version.emit(PostAdded, newPost)
+	warning, count := f.warning, version.length()
+	f.mutex.Unlock()
+
+	// The callback may call back into the feed so it is called once the mutex is released.
+	f.added.signal()
+	warning.notify(count)
+	return newPost.id, false
+}
+
+// Remove deletes the post with the given timestamp like the coarse-grained feed. Only the posts up to
+// the removed post are copied.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Remove(timestamp float64) bool {
+	if isSentinel(timestamp) {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	old := f.load()
+	pred := old.start
+	curr := pred.next
+	for old.seek(curr, timestamp) {
+		pred = curr
+		curr = curr.next
+	}
+	if curr.timestamp != timestamp {
+		return false
+	}
+	version, pred := old.copyPath(pred)
+	pred.next = curr.next
+	version.size.Add(-1)
+	f.publish(version)
+	version.emit(PostRemoved, curr)
+	return true
+}
+
+// RemoveRange deletes every post with a timestamp from from to to like the coarse-grained feed.
+// Implemented with read-copy-update.
+func (f *rcuFeed) RemoveRange(from float64, to float64) (removed int) {
+	f.update(func(version *feed) { removed = version.RemoveRange(from, to) })
+	return removed
+}
+
+// RemoveIf deletes the post with the given timestamp only if its body is still expectedBody.
+// Implemented with read-copy-update.
+func (f *rcuFeed) RemoveIf(timestamp float64, expectedBody string) (removed bool) {
+	f.update(func(version *feed) { removed = version.RemoveIf(timestamp, expectedBody) })
+	return removed
+}
+
+// Pop removes the post with the given timestamp and returns it in the form ShowFeed returns.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Pop(timestamp float64) (removed []byte, ok bool) {
+	if isSentinel(timestamp) {
+		return nil, false
+	}
+	f.update(func(version *feed) { removed, ok = version.Pop(timestamp) })
+	return removed, ok
+}
+
+// RemoveOldest removes the oldest post and returns it in the form ShowFeed returns.
+// Implemented with read-copy-update.
+func (f *rcuFeed) RemoveOldest() (removed []byte, ok bool) {
+	f.update(func(version *feed) { removed, ok = version.RemoveOldest() })
+	return removed, ok
+}
+
+// RemoveNewest removes the newest post and returns it in the form ShowFeed returns.
+// Implemented with read-copy-update.
+func (f *rcuFeed) RemoveNewest() (removed []byte, ok bool) {
+	f.update(func(version *feed) { removed, ok = version.RemoveNewest() })
+	return removed, ok
+}
+
+// TrimToNewest removes all but the n newest posts and returns how many were removed.
+// Implemented with read-copy-update.
+func (f *rcuFeed) TrimToNewest(n int) (removed int) {
+	f.update(func(version *feed) { removed = version.TrimToNewest(n) })
+	return removed
+}
+
+// Compact collapses each run of posts next to each other with the same body into the newest post of
+// the run.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Compact() (removed int) {
+	f.update(func(version *feed) { removed = version.Compact() })
+	return removed
+}
+
+// Contains determines whether a post with the given timestamp is inside the current version.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Contains(timestamp float64) bool {
+	return f.load().Contains(timestamp)
+}
+
+// ContainsApprox reports whether a post has a timestamp within epsilon of the given timestamp.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ContainsApprox(timestamp float64, epsilon float64) bool {
+	return f.load().ContainsApprox(timestamp, epsilon)
+}
+
+// ContainsBodies reports for each of bodies whether a post has it, all from one version.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ContainsBodies(bodies []string) map[string]bool {
+	return f.load().ContainsBodies(bodies)
+}
+
+// ContainsAll reports for each of timestamps whether a post has it, all from one version.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ContainsAll(timestamps []float64) map[float64]bool {
+	return f.load().ContainsAll(timestamps)
+}
+
+// IndexOf returns the position in ShowFeed of the first post with the given timestamp.
+// Implemented with read-copy-update.
+func (f *rcuFeed) IndexOf(timestamp float64) (int, bool) {
+	return f.load().IndexOf(timestamp)
+}
+
+// ShowFeed returns the posts of the current version, newest first.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ShowFeed() [][]byte {
+	return f.load().ShowFeed()
+}
+
+// ShowFeedPosts returns the posts of the current version, newest first, as PostViews.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ShowFeedPosts() []PostView {
+	return f.load().ShowFeedPosts()
+}
+
+// ShowFeedSince returns the posts of the current version newer than since, newest first.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ShowFeedSince(since float64) [][]byte {
+	return f.load().ShowFeedSince(since)
+}
+
+// ShowFeedOldestFirst returns the limit oldest posts of the current version, oldest first.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ShowFeedOldestFirst(limit int) [][]byte {
+	return f.load().ShowFeedOldestFirst(limit)
+}
+
+// ShowFeedSnapshot is the same as ShowFeed: every read of the feed already reads a snapshot.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ShowFeedSnapshot() [][]byte {
+	return f.ShowFeed()
+}
+
+// Diff compares the current version with old, a feed previously returned by ShowFeed.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Diff(old [][]byte) (added [][]byte, removed [][]byte) {
+	return f.load().Diff(old)
+}
+
+// RemoveByID deletes the post with the given id.
+// Implemented with read-copy-update.
+func (f *rcuFeed) RemoveByID(id uint64) (removed bool) {
+	f.update(func(version *feed) { removed = version.RemoveByID(id) })
+	return removed
+}
+
+// GetByID returns the post with the given id in the form ShowFeed returns.
+// Implemented with read-copy-update.
+func (f *rcuFeed) GetByID(id uint64) ([]byte, bool) {
+	return f.load().GetByID(id)
+}
+
+// GetNthRecent returns the nth most recent post in the form ShowFeed returns.
+// Implemented with read-copy-update.
+func (f *rcuFeed) GetNthRecent(n int) ([]byte, bool) {
+	return f.load().GetNthRecent(n)
+}
+
+// Successor returns the oldest post of the current version with a timestamp after timestamp.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Successor(timestamp float64) ([]byte, bool) {
+	return f.load().Successor(timestamp)
+}
+
+// Predecessor returns the newest post of the current version with a timestamp before timestamp.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Predecessor(timestamp float64) ([]byte, bool) {
+	return f.load().Predecessor(timestamp)
+}
+
+// Closest returns the post of the current version whose timestamp is nearest to timestamp.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Closest(timestamp float64) ([]byte, bool) {
+	return f.load().Closest(timestamp)
+}
+
+// Reschedule moves the post with oldTimestamp to newTimestamp.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Reschedule(oldTimestamp float64, newTimestamp float64) (moved bool) {
+	f.update(func(version *feed) { moved = version.Reschedule(oldTimestamp, newTimestamp) })
+	return moved
+}
+
+// Like adds a like to the post with the given timestamp.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Like(timestamp float64) (liked bool) {
+	f.update(func(version *feed) { liked = version.Like(timestamp) })
+	return liked
+}
+
+// TopLiked returns the n most liked posts of the current version.
+// Implemented with read-copy-update.
+func (f *rcuFeed) TopLiked(n int) [][]byte {
+	return f.load().TopLiked(n)
+}
+
+// AddIdempotent adds a post like AddWithAuthor unless a post was already added with key.
+// Implemented with read-copy-update.
+func (f *rcuFeed) AddIdempotent(body string, author string, timestamp float64, key string) (id uint64, added bool) {
+	f.update(func(version *feed) { id, added = version.AddIdempotent(body, author, timestamp, key) })
+	return id, added
+}
+
+// keyID returns the id of the post added by AddIdempotent with key in the current version, if the key is
+// still remembered.
+func (f *rcuFeed) keyID(key string) (uint64, bool) {
+	return f.load().keyID(key)
+}
+
+// Upsert inserts a new post written by author if no post has the given timestamp, otherwise it
+// replaces its body and keeps its author.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Upsert(body string, author string, timestamp float64) (created bool) {
+	f.update(func(version *feed) { created = version.Upsert(body, author, timestamp) })
+	return created
+}
+
+// SwapBody replaces the body of the post with the given timestamp and returns the body it had.
+// Implemented with read-copy-update.
+func (f *rcuFeed) SwapBody(timestamp float64, newBody string) (old string, ok bool) {
+	f.update(func(version *feed) { old, ok = version.SwapBody(timestamp, newBody) })
+	return old, ok
+}
+
+// Stats returns the number of posts, the oldest and newest timestamps and the total likes of the
+// current version.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Stats() FeedStats {
+	return f.load().Stats()
+}
+
+// Count returns the number of posts in the current version.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Count() int {
+	return f.load().Count()
+}
+
+// IsEmpty returns whether the current version has no posts.
+// Implemented with read-copy-update.
+func (f *rcuFeed) IsEmpty() bool {
+	return f.load().IsEmpty()
+}
+
+// Version returns a number that goes up each time a post is added, removed or edited, like the
+// coarse-grained feed. Each version of the feed carries the number on from the one it was copied from.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Version() uint64 {
+	return f.load().Version()
+}
+
+// SetCapacityWarning sets a soft limit on the number of posts in the feed like the coarse-grained feed.
+// It is checked by Add, AddWithEviction and AddWithAuthor.
+// Implemented with read-copy-update.
+func (f *rcuFeed) SetCapacityWarning(threshold int, callback func(current int)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.warning = newCapacityWarning(threshold, callback)
+}
+
+// CountMatching returns the number of posts of the current version whose body contains substr.
+// Implemented with read-copy-update.
+func (f *rcuFeed) CountMatching(substr string) int {
+	return f.load().CountMatching(substr)
+}
+
+// TotalBodyBytes returns the sum of the lengths in bytes of the bodies of the posts of the current version.
+// Implemented with read-copy-update.
+func (f *rcuFeed) TotalBodyBytes() int64 {
+	return f.load().TotalBodyBytes()
+}
+
+// BucketCounts counts the posts of the current version in each time bucket of bucketSeconds seconds.
+// Implemented with read-copy-update.
+func (f *rcuFeed) BucketCounts(bucketSeconds float64) map[int64]int {
+	return f.load().BucketCounts(bucketSeconds)
+}
+
+// ForEach calls fn with the body and timestamp of each post of the current version in the given order
+// until fn returns false. The version never changes, so fn may call methods of the feed.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ForEach(order Order, fn func(body string, timestamp float64) bool) {
+	f.load().ForEach(order, fn)
+}
+
+// Validate checks that the current version is well formed.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Validate() error {
+	return f.load().Validate()
+}
+
+// Merge adds every post of other that the feed does not have yet, as one new version.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Merge(other Feed) {
+	f.update(func(version *feed) { version.Merge(other) })
+}
+
+// ReplaceAll replaces every post with posts as one new version, so readers see either the old posts
+// or the new posts.
+// Implemented with read-copy-update.
+func (f *rcuFeed) ReplaceAll(posts []PostView) (err error) {
+	f.update(func(version *feed) { err = version.ReplaceAll(posts) })
+	return err
+}
+
+// Clone returns a new feed with a copy of the current version, which has none of the feed's subscribers
+// or capacity warning.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Clone() Feed {
+	version := f.load().clone()
+	version.events = newEventHub()
+	clone := &rcuFeed{added: newAddedSignal(), events: version.events}
+	clone.publish(version)
+	return clone
+}
+
+// SearchByAuthor returns the posts of the current version written by author, newest first.
+// Implemented with read-copy-update.
+func (f *rcuFeed) SearchByAuthor(author string) [][]byte {
+	return f.load().SearchByAuthor(author)
+}
+
+// WaitFor blocks until a post with the given timestamp is in the feed and returns true, or returns
+// false once timeout has passed without one. The feed is checked again each time a version is published.
+// Implemented with read-copy-update.
+func (f *rcuFeed) WaitFor(timestamp float64, timeout time.Duration) bool {
+	return f.added.waitForTimeout(func() bool { return f.Contains(timestamp) }, timeout)
+}
+
+// Subscribe returns a channel that an event is sent to for every post added to, removed from or edited
+// in the feed from now on, like the coarse-grained feed. Each event is sent once the version with its
+// change has been published.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Subscribe() <-chan FeedEvent {
+	return f.events.subscribe()
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe and closes it.
+// Implemented with read-copy-update.
+func (f *rcuFeed) Unsubscribe(events <-chan FeedEvent) {
+	f.events.unsubscribe(events)
+}
+
+// ErrReplaceUnsupported is returned by ReplaceAll for a lock-free feed, which cannot replace all of its
+// posts in one step.
+var ErrReplaceUnsupported = errors.New("replacing every post is not supported by the lock-free feed")
+
+// ErrQuotaExceeded is returned by FeedStore.Add for a user whose feed already has the most posts a user may have.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// FeedStore holds a feed for each user. A user's feed is created the first time it is asked for.
+// A store can cap the number of posts each user has, see Add.
+type FeedStore struct {
+	mutex           sync.RWMutex        // guards feeds
+	feeds           map[int]*storedFeed // the feed of each user seen so far
+	newFeed         func() Feed         // creates the feed of a new user
+	maxPostsPerUser int                 // the most posts Add lets a user have, 0 for no limit
+}
+
+// storedFeed is a user's feed in a FeedStore along with the lock that makes checking the user's quota and
+// adding a post one step.
+type storedFeed struct {
+	feed Feed
+	adds sync.Mutex // held while the quota is checked and the post added
+}
+
+// NewFeedStore creates an empty store whose users' feeds are created with newFeed, e.g. NewFeed or NewLockFreeFeed.
+// Add rejects a post once a user has maxPostsPerUser posts. A maxPostsPerUser of 0 or less sets no limit.
+func NewFeedStore(newFeed func() Feed, maxPostsPerUser int) *FeedStore {
+	if maxPostsPerUser < 0 {
+		maxPostsPerUser = 0
+	}
+	return &FeedStore{feeds: make(map[int]*storedFeed), newFeed: newFeed, maxPostsPerUser: maxPostsPerUser}
+}
+
+// Get returns the feed of the user with the given id, creating it if the user is new. If the store has a
+// limit, posts added to the feed are checked against the user's quota like with Add, but an add over the
+// quota does nothing and returns id 0, like adding a post with an infinite timestamp. Add tells why.
+func (s *FeedStore) Get(userID int) Feed {
+	stored := s.get(userID)
+	if s.maxPostsPerUser == 0 {
+		return stored.feed
+	}
+	return &quotaFeed{Feed: stored.feed, stored: stored, maxPosts: s.maxPostsPerUser}
+}
+
+// get returns the stored feed of the user with the given id, creating it if the user is new.
+// The feed is looked up under the read lock first, and only if it is missing is the write lock taken
+// and the map checked again, so goroutines racing for the same new user all get the one feed created.
+func (s *FeedStore) get(userID int) *storedFeed {
+	s.mutex.RLock()
+	stored, ok := s.feeds[userID]
+	s.mutex.RUnlock()
+	if ok {
+		return stored
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if stored, ok := s.feeds[userID]; ok {
+		return stored
+	}
+	stored = &storedFeed{feed: s.newFeed()}
+	s.feeds[userID] = stored
+	return stored
+}
+
+// Add adds a post by author to the feed of the user with the given id and returns the post's id like
+// Feed.AddWithAuthor. If the store has a limit and the user's feed already has that many posts, nothing is
+// added and ErrQuotaExceeded is returned. The number of posts is the feed's own count, so removing posts
+// frees up the quota again. The adds of one user are made one at a time so that two adds racing for the
+// last slot cannot both succeed, while other users add to their own feeds at the same time.
+func (s *FeedStore) Add(userID int, body string, author string, timestamp float64) (uint64, error) {
+	stored := s.get(userID)
+	if s.maxPostsPerUser == 0 {
+		id, _ := stored.feed.AddWithAuthor(body, author, timestamp)
+		return id, nil
+	}
+	stored.adds.Lock()
+	defer stored.adds.Unlock()
+	if stored.feed.Count() >= s.maxPostsPerUser {
+		return 0, ErrQuotaExceeded
+	}
+	id, _ := stored.feed.AddWithAuthor(body, author, timestamp)
+	return id, nil
+}
+
+// AddIdempotent adds a post by author to the feed of the user with the given id like Feed.AddIdempotent,
+// checking the user's quota like Add. A key that was already used returns the id of the post first added
+// with it and false even if the user is at the quota, so a retry gets the same answer as the first add.
+// Otherwise ErrQuotaExceeded is returned and nothing is added once the user is at the quota.
+func (s *FeedStore) AddIdempotent(userID int, body string, author string, timestamp float64, key string) (uint64, bool, error) {
+	return s.get(userID).addIdempotent(s.maxPostsPerUser, body, author, timestamp, key)
+}
+
+// keyedFeed is a feed that remembers the keys of the posts added with AddIdempotent.
+type keyedFeed interface {
+	keyID(key string) (uint64, bool)
+}
+
+// addIdempotent does the work of FeedStore.AddIdempotent for a store whose users may have maxPosts posts,
+// 0 for no limit.
+func (stored *storedFeed) addIdempotent(maxPosts int, body string, author string, timestamp float64, key string) (uint64, bool, error) {
+	if maxPosts == 0 {
+		id, added := stored.feed.AddIdempotent(body, author, timestamp, key)
+		return id, added, nil
+	}
+	stored.adds.Lock()
+	defer stored.adds.Unlock()
+	if keyed, ok := stored.feed.(keyedFeed); ok && key != "" {
+		if id, seen := keyed.keyID(key); seen { // A retry is answered whether or not the user is at the quota.
+			return id, false, nil
+		}
+	}
+	if stored.feed.Count() >= maxPosts {
+		return 0, false, ErrQuotaExceeded
+	}
+	id, added := stored.feed.AddIdempotent(body, author, timestamp, key)
+	return id, added, nil
+}
+
+// quotaFeed is the feed of a user in a FeedStore with a limit, as returned by Get. The methods that add
+// posts check the quota first under the same lock as FeedStore.Add and do nothing once the user is at it.
+type quotaFeed struct {
+	Feed
+	stored   *storedFeed // the user's feed and the lock the quota is checked under
+	maxPosts int         // the most posts the user may have
+}
+
+// full reports whether adding n posts would take the user over the quota. The caller must hold stored.adds.
+func (f *quotaFeed) full(n int) bool {
+	return f.Feed.Count()+n > f.maxPosts
+}
+
+// Add adds a post like Feed.Add unless the user is at the quota, in which case it returns 0.
+func (f *quotaFeed) Add(body string, timestamp float64) uint64 {
+	id, _ := f.AddWithEviction(body, timestamp)
+	return id
+}
+
+// AddWithEviction adds a post like Feed.AddWithEviction unless the user is at the quota, in which case it returns 0.
+func (f *quotaFeed) AddWithEviction(body string, timestamp float64) (uint64, bool) {
+	f.stored.adds.Lock()
+	defer f.stored.adds.Unlock()
+	if f.full(1) {
+		return 0, false
+	}
+	return f.Feed.AddWithEviction(body, timestamp)
+}
+
+// AddWithAuthor adds a post like Feed.AddWithAuthor unless the user is at the quota, in which case it returns 0.
+func (f *quotaFeed) AddWithAuthor(body string, author string, timestamp float64) (uint64, bool) {
+	f.stored.adds.Lock()
+	defer f.stored.adds.Unlock()
+	if f.full(1) {
+		return 0, false
+	}
+	return f.Feed.AddWithAuthor(body, author, timestamp)
+}
+
+// AddIdempotent adds a post like FeedStore.AddIdempotent, returning 0 and false instead of an error if
+// the user is at the quota.
+func (f *quotaFeed) AddIdempotent(body string, author string, timestamp float64, key string) (uint64, bool) {
+	id, added, _ := f.stored.addIdempotent(f.maxPosts, body, author, timestamp, key)
+	return id, added
+}
+
+// Upsert updates the body of the post with the timestamp like Feed.Upsert, but only adds a post if the
+// user is not at the quota. It returns whether a post was created.
+func (f *quotaFeed) Upsert(body string, author string, timestamp float64) bool {
+	f.stored.adds.Lock()
+	defer f.stored.adds.Unlock()
+	if f.full(1) && !f.Feed.Contains(timestamp) {
+		return false
+	}
+	return f.Feed.Upsert(body, author, timestamp)
+}
+
+// Merge adds the posts of other like Feed.Merge unless that would take the user over the quota, in which
+// case nothing is added.
+func (f *quotaFeed) Merge(other Feed) {
+	f.stored.adds.Lock()
+	defer f.stored.adds.Unlock()
+	if f.full(other.Count()) {
+		return
+	}
+	f.Feed.Merge(other)
+}
+
+// ReplaceAll replaces the posts like Feed.ReplaceAll, or returns ErrQuotaExceeded if there are more posts
+// than the user may have.
+func (f *quotaFeed) ReplaceAll(posts []PostView) error {
+	f.stored.adds.Lock()
+	defer f.stored.adds.Unlock()
+	if len(posts) > f.maxPosts {
+		return ErrQuotaExceeded
+	}
+	return f.Feed.ReplaceAll(posts)
+}
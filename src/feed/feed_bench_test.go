@@ -0,0 +1,120 @@
+package feed
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// benchFeedSize is the number of posts a feed is populated with before it is benchmarked.
+const benchFeedSize = 1000
+
+// benchFeeds are the feed implementations the benchmarks compare. Add a fine-grained
+// implementation here to compare it against the coarse-grained and lock-free ones.
+var benchFeeds = []struct {
+	name    string
+	newFeed func() Feed
+}{
+	{"coarse", NewFeed},
+	{"coarse-sync.RWMutex", func() Feed { return NewFeedWithLock(&sync.RWMutex{}) }},
+	{"lock-free", NewLockFreeFeed},
+	{"rcu", NewRCUFeed},
+}
+
+// benchParallelism are the multiples of GOMAXPROCS goroutines the benchmarks run with.
+var benchParallelism = []int{1, 2, 4, 8}
+
+// populateFeed adds size posts to the feed with the even timestamps 0, 2, 4, ... so that
+// the odd timestamps are free for the benchmarks to add and remove posts at.
+func populateFeed(feed Feed, size int) Feed {
+	for i := 0; i < size; i++ {
+		feed.Add(strconv.Itoa(i), float64(2*i))
+	}
+	return feed
+}
+
+// runParallel runs op in parallel for every feed implementation and number of goroutines.
+// Each goroutine gets its own random number generator so that they do not contend on one.
+func runParallel(b *testing.B, op func(feed Feed, r *rand.Rand)) {
+	for _, impl := range benchFeeds {
+		for _, parallelism := range benchParallelism {
+			goroutines := parallelism * runtime.GOMAXPROCS(0)
+			b.Run(fmt.Sprintf("%v/goroutines=%v", impl.name, goroutines), func(b *testing.B) {
+				feed := populateFeed(impl.newFeed(), benchFeedSize)
+				var seed int64
+				b.SetParallelism(parallelism)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+					for pb.Next() {
+						op(feed, r)
+					}
+				})
+			})
+		}
+	}
+}
+
+// write adds a post at a random odd timestamp and then removes it so that the size of the
+// feed stays the same however many operations are run.
+func write(feed Feed, r *rand.Rand) {
+	timestamp := float64(2*r.Intn(benchFeedSize) + 1)
+	feed.Add("bench", timestamp)
+	feed.Remove(timestamp)
+}
+
+// read checks if the feed contains a random timestamp, which is in the feed half of the time.
+func read(feed Feed, r *rand.Rand) {
+	feed.Contains(float64(r.Intn(2 * benchFeedSize)))
+}
+
+// BenchmarkAdd measures concurrent writes. Each Add is followed by a Remove of the same post.
+func BenchmarkAdd(b *testing.B) {
+	runParallel(b, write)
+}
+
+// BenchmarkContains measures concurrent reads.
+func BenchmarkContains(b *testing.B) {
+	runParallel(b, read)
+}
+
+// BenchmarkShowFeed measures concurrent reads of the whole feed.
+func BenchmarkShowFeed(b *testing.B) {
+	runParallel(b, func(feed Feed, r *rand.Rand) {
+		feed.ShowFeed()
+	})
+}
+
+// BenchmarkMixed measures a workload of 90% reads and 10% writes.
+func BenchmarkMixed(b *testing.B) {
+	runParallel(b, func(feed Feed, r *rand.Rand) {
+		if r.Intn(10) == 0 {
+			write(feed, r)
+		} else {
+			read(feed, r)
+		}
+	})
+}
+
+// BenchmarkBulkLoad measures the allocations of adding benchFeedSize posts to an empty feed, with and
+// without a capacity hint. Run it with -benchmem to compare the allocations per load.
+func BenchmarkBulkLoad(b *testing.B) {
+	for _, impl := range []struct {
+		name    string
+		newFeed func() Feed
+	}{
+		{"coarse", NewFeed},
+		{"coarse-capacity", func() Feed { return NewFeedWithCapacity(benchFeedSize) }},
+	} {
+		b.Run(impl.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				populateFeed(impl.newFeed(), benchFeedSize)
+			}
+		})
+	}
+}
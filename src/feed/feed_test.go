@@ -1,10 +1,15 @@
 package feed
 
 import (
+	"encoding/json"
+	"math"
 	"math/rand"
+	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func addGoroutine(amount int, feed Feed, localCount int, wg *sync.WaitGroup) {
@@ -318,4 +323,2997 @@ func TestRemove(t *testing.T) {
 			t.Errorf("Removed all items but not all were removed:\n"+ "(Got):%v\n", i)
 		}
 	}
-}
\ No newline at end of file
+}
+func TestParallelAddUniqueIDs(t *testing.T) {
+
+	const totalSize = 5000
+	const threadCount = 100
+	const localCount = totalSize / threadCount
+	feed := NewFeed()
+	ids := make([]uint64, totalSize)
+
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(amount int) {
+			for j := 0; j < localCount; j++ {
+				num := amount + j
+				ids[num] = feed.Add(strconv.Itoa(num), float64(num))
+			}
+			wg.Done()
+		}(i * localCount)
+	}
+	wg.Wait()
+
+	//Check to make sure no two posts were given the same id
+	seen := make(map[uint64]bool)
+	for i, id := range ids {
+		if seen[id] {
+			t.Errorf("Post with timestamp:%v was given an id that is already in use:%v", i, id)
+		}
+		seen[id] = true
+	}
+}
+func TestRemoveByID(t *testing.T) {
+
+	postInfo := [20]int{1, 2, 18, 9, 8, 20, 16, 10, 6, 14, 17, 15, 19, 5, 13, 11, 7, 4, 3, 12}
+	feed := NewFeed()
+	ids := make(map[int]uint64)
+
+	//Add 20 posts to the feed
+	for _, num := range postInfo {
+		body := strconv.Itoa(num)
+		ids[num] = feed.Add(body, float64(num))
+	}
+
+	//Remove the even posts by id
+	for i := 2; i <= 20; i += 2 {
+		if !feed.RemoveByID(ids[i]) {
+			t.Errorf("Tried to remove id:%v of timestamp:%v but it was not found", ids[i], i)
+		}
+		if feed.RemoveByID(ids[i]) {
+			t.Errorf("Removed id:%v of timestamp:%v twice", ids[i], i)
+		}
+	}
+	//Adding more posts does not change the ids of the posts already in the feed
+	for i := 21; i <= 30; i++ {
+		ids[i] = feed.Add(strconv.Itoa(i), float64(i))
+	}
+
+	//Check to make sure only the right nodes were removed and the rest can still be found by id
+	for i := 1; i <= 30; i++ {
+		postByte, ok := feed.GetByID(ids[i])
+		if i%2 == 0 && i <= 20 {
+			if ok || feed.Contains(float64(i)) {
+				t.Errorf("Removed id:%v of timestamp:%v but it's still there.", ids[i], i)
+			}
+			continue
+		}
+		var post postBodyTimestamp
+		json.Unmarshal(postByte, &post)
+		if !ok || post.Timestamp != float64(i) || post.Body != strconv.Itoa(i) {
+			t.Errorf("Did not get back timestamp:%v with id:%v. Got:%v", i, ids[i], post)
+		}
+	}
+}
+func TestReschedule(t *testing.T) {
+
+	feed := NewFeed()
+
+	//Add posts 10, 20, ..., 50
+	ids := make(map[float64]uint64)
+	for i := 10; i <= 50; i += 10 {
+		ids[float64(i)] = feed.Add(strconv.Itoa(i), float64(i))
+	}
+
+	//Move 40 to an earlier slot, 30 to a later slot and 20 to just after itself
+	moves := [][2]float64{{40, 5}, {30, 55}, {20, 21}}
+	for _, move := range moves {
+		if !feed.Reschedule(move[0], move[1]) {
+			t.Errorf("Could not move timestamp:%v to timestamp:%v", move[0], move[1])
+		}
+		if feed.Contains(move[0]) || !feed.Contains(move[1]) {
+			t.Errorf("Moved timestamp:%v to timestamp:%v but the feed was not updated", move[0], move[1])
+		}
+	}
+
+	//Check the order of the feed and that bodies and ids moved with the posts
+	order := []postBodyTimestamp{{"30", 55, 0, "", 0}, {"50", 50, 0, "", 0}, {"20", 21, 0, "", 0}, {"10", 10, 0, "", 0}, {"40", 5, 0, "", 0}}
+	posts := feed.ShowFeed()
+	if len(posts) != len(order) {
+		t.Fatalf("Expected %v posts after moving. Got:%v", len(order), len(posts))
+	}
+	for i, postByte := range posts {
+		var post postBodyTimestamp
+		json.Unmarshal(postByte, &post)
+		if post != order[i] {
+			t.Errorf("Expected post:%v at position:%v. Got:%v", order[i], i, post)
+		}
+	}
+	var moved postBodyTimestamp
+	postByte, ok := feed.GetByID(ids[40])
+	json.Unmarshal(postByte, &moved)
+	if !ok || moved != (postBodyTimestamp{"40", 5, 0, "", 0}) {
+		t.Errorf("The id of a moved post should not change. Got:%v", moved)
+	}
+
+	//Moving a missing post or onto an existing post does nothing
+	if feed.Reschedule(40, 60) {
+		t.Errorf("Moved timestamp:40 but it is not in the feed")
+	}
+	if feed.Reschedule(55, 10) || !feed.Contains(55) {
+		t.Errorf("Moved timestamp:55 onto timestamp:10 which is already in the feed")
+	}
+}
+func TestTopLiked(t *testing.T) {
+
+	feed := NewFeed()
+
+	//Check to make sure TopLiked returns nothing on an empty feed
+	if top := feed.TopLiked(3); len(top) != 0 {
+		t.Errorf("Feed is empty but TopLiked returned %v posts", len(top))
+	}
+
+	//Add posts 1 to 6 and like them so that 2 and 5 tie for the most likes and 1, 3 and 6 tie with none
+	likes := map[int]int{1: 0, 2: 3, 3: 0, 4: 1, 5: 3, 6: 0}
+	for i := 1; i <= 6; i++ {
+		feed.Add(strconv.Itoa(i), float64(i))
+		for j := 0; j < likes[i]; j++ {
+			if !feed.Like(float64(i)) {
+				t.Errorf("Could not like timestamp:%v", i)
+			}
+		}
+	}
+	if feed.Like(7) {
+		t.Errorf("Liked timestamp:7 but it is not in the feed")
+	}
+
+	//Most liked first with ties broken by the most recent timestamp
+	order := []postBodyTimestamp{{"5", 5, 3, "", 0}, {"2", 2, 3, "", 0}, {"4", 4, 1, "", 0}, {"6", 6, 0, "", 0}, {"3", 3, 0, "", 0}, {"1", 1, 0, "", 0}}
+	for n := 0; n <= len(order)+1; n++ {
+		top := feed.TopLiked(n)
+		expected := order
+		if n < len(order) {
+			expected = order[:n]
+		}
+		if len(top) != len(expected) {
+			t.Errorf("TopLiked(%v) expected %v posts. Got:%v", n, len(expected), len(top))
+			continue
+		}
+		for i, postByte := range top {
+			var post postBodyTimestamp
+			json.Unmarshal(postByte, &post)
+			if post != expected[i] {
+				t.Errorf("TopLiked(%v) expected post:%v at position:%v. Got:%v", n, expected[i], i, post)
+			}
+		}
+	}
+}
+func TestShowFeedSince(t *testing.T) {
+
+	feed := NewFeed()
+	for i := 1; i <= 5; i++ {
+		feed.Add(strconv.Itoa(i), float64(i))
+	}
+
+	//Cursors at, before, after and between the existing posts
+	tests := []struct {
+		since    float64
+		expected []string
+	}{
+		{0, []string{"5", "4", "3", "2", "1"}},
+		{-1, []string{"5", "4", "3", "2", "1"}},
+		{0.5, []string{"5", "4", "3", "2", "1"}},
+		{1, []string{"5", "4", "3", "2"}},
+		{3, []string{"5", "4"}},
+		{3.5, []string{"5", "4"}},
+		{5, []string{}},
+		{10, []string{}},
+		{math.Inf(1), []string{}},
+	}
+	for _, test := range tests {
+		posts := feed.ShowFeedSince(test.since)
+		if len(posts) != len(test.expected) {
+			t.Errorf("ShowFeedSince(%v) expected %v posts. Got:%v", test.since, len(test.expected), len(posts))
+			continue
+		}
+		for i, postByte := range posts {
+			var post postBodyTimestamp
+			json.Unmarshal(postByte, &post)
+			if post.Body != test.expected[i] {
+				t.Errorf("ShowFeedSince(%v) expected post:%v at position:%v. Got:%v", test.since, test.expected[i], i, post.Body)
+			}
+		}
+	}
+
+	//A since of 0 is a cursor like any other, not the whole feed
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		feed.Add("-1", -1)
+		feed.Add("0", 0)
+		feed.Add("1", 1)
+		if posts := feed.ShowFeedSince(0); len(posts) != 1 {
+			t.Errorf("ShowFeedSince(0) expected only the post after 0. Got:%v posts", len(posts))
+		}
+		if posts := feed.ShowFeedSince(-1); len(posts) != 2 {
+			t.Errorf("ShowFeedSince(-1) expected the 2 posts after -1. Got:%v posts", len(posts))
+		}
+	}
+}
+
+func TestShowFeedOldestFirst(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		for _, i := range []int{3, 1, 5, 2, 4} {
+			feed.Add(strconv.Itoa(i), float64(i))
+		}
+
+		//Every post, then limits under, at and over the number of posts
+		tests := []struct {
+			limit    int
+			expected []string
+		}{
+			{0, []string{"1", "2", "3", "4", "5"}},
+			{-1, []string{"1", "2", "3", "4", "5"}},
+			{1, []string{"1"}},
+			{3, []string{"1", "2", "3"}},
+			{5, []string{"1", "2", "3", "4", "5"}},
+			{10, []string{"1", "2", "3", "4", "5"}},
+		}
+		for _, test := range tests {
+			posts := feed.ShowFeedOldestFirst(test.limit)
+			if len(posts) != len(test.expected) {
+				t.Errorf("ShowFeedOldestFirst(%v) expected %v posts. Got:%v", test.limit, len(test.expected), len(posts))
+				continue
+			}
+			for i, postByte := range posts {
+				var post postBodyTimestamp
+				json.Unmarshal(postByte, &post)
+				if post.Body != test.expected[i] {
+					t.Errorf("ShowFeedOldestFirst(%v) expected post:%v at position:%v. Got:%v", test.limit, test.expected[i], i, post.Body)
+				}
+			}
+		}
+
+		//With no limit it is ShowFeed the other way round
+		all, newest := feed.ShowFeedOldestFirst(0), feed.ShowFeed()
+		for i := range all {
+			if string(all[i]) != string(newest[len(newest)-1-i]) {
+				t.Errorf("Expected ShowFeedOldestFirst to be the reverse of ShowFeed. Got:%v", all)
+				break
+			}
+		}
+	}
+}
+
+func TestSuccessorPredecessor(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		for i := 1; i <= 3; i++ {
+			feed.Add(strconv.Itoa(i), float64(i))
+		}
+
+		//Before the first post, at each post, between posts and after the last post
+		tests := []struct {
+			timestamp   float64
+			successor   string
+			predecessor string
+		}{
+			{0, "1", ""},
+			{1, "2", ""},
+			{1.5, "2", "1"},
+			{2, "3", "1"},
+			{3, "", "2"},
+			{4, "", "3"},
+		}
+		for _, test := range tests {
+			for _, check := range []struct {
+				name     string
+				find     func(float64) ([]byte, bool)
+				expected string
+			}{{"Successor", feed.Successor, test.successor}, {"Predecessor", feed.Predecessor, test.predecessor}} {
+				postByte, ok := check.find(test.timestamp)
+				var post postBodyTimestamp
+				json.Unmarshal(postByte, &post)
+				if ok != (check.expected != "") || post.Body != check.expected {
+					t.Errorf("%v(%v) expected post:%q. Got:%q %v", check.name, test.timestamp, check.expected, post.Body, ok)
+				}
+			}
+		}
+	}
+
+	//An empty feed has no posts either side
+	feed := NewFeed()
+	if _, ok := feed.Successor(0); ok {
+		t.Errorf("Expected no successor in an empty feed")
+	}
+	if _, ok := feed.Predecessor(0); ok {
+		t.Errorf("Expected no predecessor in an empty feed")
+	}
+}
+
+func TestClosest(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed(), NewFeedWithComparator(ByScore)} {
+		if _, ok := feed.Closest(1); ok {
+			t.Errorf("Expected no closest post in an empty feed")
+		}
+		for _, timestamp := range []float64{10, 20, 30} {
+			feed.Add(strconv.FormatFloat(timestamp, 'f', -1, 64), timestamp)
+		}
+
+		//Below the oldest, above the newest, at a post, between posts and a tie between two posts
+		tests := []struct {
+			timestamp float64
+			expected  string
+		}{
+			{-100, "10"},
+			{100, "30"},
+			{20, "20"},
+			{12, "10"},
+			{18, "20"},
+			{25, "30"}, //Equally near 20 and 30, so the newer post
+			{15, "20"}, //Equally near 10 and 20, so the newer post
+		}
+		for _, test := range tests {
+			postByte, ok := feed.Closest(test.timestamp)
+			var post postBodyTimestamp
+			json.Unmarshal(postByte, &post)
+			if !ok || post.Body != test.expected {
+				t.Errorf("Closest(%v) expected post:%q. Got:%q %v", test.timestamp, test.expected, post.Body, ok)
+			}
+		}
+		if _, ok := feed.Closest(math.NaN()); ok {
+			t.Errorf("Expected no closest post to NaN")
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		for i := 1; i <= 3; i++ {
+			feed.Add(strconv.Itoa(i), float64(i))
+		}
+		feed.Like(2)
+		feed.AddIdempotent("keyed", "", 4, "key")
+
+		//The clone starts with the same posts, likes and keys
+		clone := feed.Clone()
+		if !reflect.DeepEqual(clone.ShowFeed(), feed.ShowFeed()) || clone.Count() != feed.Count() {
+			t.Errorf("Expected the clone to have the same posts. Got:%v Expected:%v", clone.ShowFeed(), feed.ShowFeed())
+		}
+		if _, added := clone.AddIdempotent("keyed", "", 5, "key"); added {
+			t.Errorf("Expected the clone to keep the keys of the feed")
+		}
+
+		//Changing the clone does not change the feed
+		clone.Add("clone only", 10)
+		clone.Remove(1)
+		clone.SwapBody(3, "changed")
+		if feed.Contains(10) || !feed.Contains(1) || feed.Count() != 4 {
+			t.Errorf("Expected changing the clone not to change the feed. Got:%v", feed.ShowFeed())
+		}
+		if body, _ := feed.SwapBody(3, "3"); body != "3" {
+			t.Errorf("Expected the feed to keep its body. Got:%v", body)
+		}
+
+		//Changing the feed does not change the clone
+		feed.Add("feed only", 20)
+		feed.Remove(2)
+		if clone.Contains(20) || !clone.Contains(2) || clone.Count() != 4 {
+			t.Errorf("Expected changing the feed not to change the clone. Got:%v", clone.ShowFeed())
+		}
+		if err := clone.Validate(); err != nil {
+			t.Errorf("Expected the clone to be valid. Got:%v", err)
+		}
+
+		//New posts in the clone get ids after the ids of the feed's posts
+		if id := clone.Add("later", 30); id <= 4 {
+			t.Errorf("Expected a new post in the clone to get a new id. Got:%v", id)
+		}
+	}
+}
+
+func TestBucketCounts(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		//Posts spanning several 60 second buckets, including bucket edges and a negative timestamp
+		for _, timestamp := range []float64{-1, 0, 1, 59.5, 60, 61, 150, 3600} {
+			feed.Add("post", timestamp)
+		}
+		expected := map[int64]int{-1: 1, 0: 3, 1: 2, 2: 1, 60: 1}
+		buckets := feed.BucketCounts(60)
+		if !reflect.DeepEqual(buckets, expected) {
+			t.Errorf("Expected the posts in buckets %v. Got:%v", expected, buckets)
+		}
+		sum := 0
+		for _, count := range buckets {
+			sum += count
+		}
+		if sum != feed.Count() {
+			t.Errorf("Expected the counts to sum to the %v posts. Got:%v", feed.Count(), sum)
+		}
+
+		//One bucket wide enough for every post, and buckets too small to share
+		if buckets := feed.BucketCounts(1e6); !reflect.DeepEqual(buckets, map[int64]int{-1: 1, 0: 7}) {
+			t.Errorf("Expected a bucket for the negative timestamp and one for the rest. Got:%v", buckets)
+		}
+		if buckets := feed.BucketCounts(0.25); len(buckets) != 8 {
+			t.Errorf("Expected every post in its own bucket. Got:%v", buckets)
+		}
+
+		//A bucket size that is not positive has no buckets
+		for _, bucketSeconds := range []float64{0, -60, math.NaN()} {
+			if buckets := feed.BucketCounts(bucketSeconds); buckets != nil {
+				t.Errorf("Expected no buckets for a bucket size of %v. Got:%v", bucketSeconds, buckets)
+			}
+		}
+	}
+
+	//An empty feed has no buckets
+	if buckets := NewFeed().BucketCounts(60); len(buckets) != 0 {
+		t.Errorf("Expected no buckets for an empty feed. Got:%v", buckets)
+	}
+}
+
+// recordingLock is a lock that records the calls made to it.
+type recordingLock struct {
+	mutex sync.RWMutex
+	calls []string
+}
+
+func (l *recordingLock) record(call string) {
+	l.calls = append(l.calls, call)
+}
+
+func (l *recordingLock) Lock()    { l.mutex.Lock(); l.record("Lock") }
+func (l *recordingLock) Unlock()  { l.record("Unlock"); l.mutex.Unlock() }
+func (l *recordingLock) RLock()   { l.mutex.RLock(); l.record("RLock") }
+func (l *recordingLock) RUnlock() { l.record("RUnlock"); l.mutex.RUnlock() }
+
+func TestNewFeedWithLock(t *testing.T) {
+
+	lock := &recordingLock{}
+	feed := NewFeedWithLock(lock)
+
+	//Add takes the write lock
+	feed.Add("1", 1)
+	if len(lock.calls) != 2 || lock.calls[0] != "Lock" || lock.calls[1] != "Unlock" {
+		t.Errorf("Expected Add to take and release the write lock. Got:%v", lock.calls)
+	}
+
+	//Contains takes the read lock
+	lock.calls = nil
+	if !feed.Contains(1) {
+		t.Errorf("Added timestamp:1 but Contains returned false")
+	}
+	if len(lock.calls) != 2 || lock.calls[0] != "RLock" || lock.calls[1] != "RUnlock" {
+		t.Errorf("Expected Contains to take and release the read lock. Got:%v", lock.calls)
+	}
+
+	//The feed works the same with the standard library lock
+	feed = NewFeedWithLock(&sync.RWMutex{})
+	feed.Add("1", 1)
+	if !feed.Contains(1) || !feed.Remove(1) || feed.Contains(1) {
+		t.Errorf("Feed with a sync.RWMutex did not add and remove timestamp:1")
+	}
+}
+
+func TestAddIdempotent(t *testing.T) {
+
+	feed := NewFeed()
+
+	//Adding with the same key twice only adds the first post
+	id, added := feed.AddIdempotent("first", "", 1, "key")
+	if !added || id == 0 {
+		t.Errorf("Could not add the first post with key:key. Got id:%v", id)
+	}
+	//The retry is given the id of the first post
+	if retryId, added := feed.AddIdempotent("retry", "", 2, "key"); added || retryId != id || feed.Contains(2) {
+		t.Errorf("Added a second post with key:key. Got id:%v Expected:%v", retryId, id)
+	}
+	//Other keys and empty keys are not duplicates
+	_, other := feed.AddIdempotent("other", "", 3, "other")
+	_, a := feed.AddIdempotent("a", "", 4, "")
+	_, b := feed.AddIdempotent("b", "", 5, "")
+	if !other || !a || !b {
+		t.Errorf("Could not add posts with a new key or an empty key")
+	}
+	if len(feed.ShowFeed()) != 4 {
+		t.Errorf("Expected 4 posts in the feed. Got:%v", len(feed.ShowFeed()))
+	}
+
+	//Only the most recent keys are remembered
+	for i := 0; i < maxKeys; i++ {
+		feed.AddIdempotent("", "", float64(10+i), "key"+strconv.Itoa(i))
+	}
+	if _, added := feed.AddIdempotent("forgotten", "", 5000000, "key"); !added {
+		t.Errorf("The oldest key should have been forgotten once more than %v keys were added", maxKeys)
+	}
+	if _, added := feed.AddIdempotent("remembered", "", 5000001, "key"+strconv.Itoa(maxKeys-1)); added {
+		t.Errorf("The most recent key should still be remembered")
+	}
+}
+func TestParallelAddIdempotent(t *testing.T) {
+
+	const threadCount = 50
+	feed := NewFeed()
+
+	//Many goroutines retry the same ADD at once but only one post is added
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			if _, ok := feed.AddIdempotent("post", "", float64(i), "key"); ok {
+				atomic.AddInt32(&added, 1)
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	if added != 1 || len(feed.ShowFeed()) != 1 {
+		t.Errorf("Expected exactly one post to be added. Got:%v", added)
+	}
+}
+
+func TestStats(t *testing.T) {
+
+	feed := NewFeed()
+
+	//Check the stats of an empty feed
+	if stats := feed.Stats(); stats != (FeedStats{}) {
+		t.Errorf("Feed is empty but Stats returned %v", stats)
+	}
+
+	//Add posts out of order and like some of them
+	for _, timestamp := range []float64{3, 1, 5, 2, 4} {
+		feed.Add(strconv.Itoa(int(timestamp)), timestamp)
+	}
+	feed.Like(1)
+	feed.Like(5)
+	feed.Like(5)
+	expected := FeedStats{Count: 5, Oldest: 1, Newest: 5, TotalLikes: 3}
+	if stats := feed.Stats(); stats != expected {
+		t.Errorf("Expected stats:%v. Got:%v", expected, stats)
+	}
+
+	//Stats follow removes
+	feed.Remove(5)
+	expected = FeedStats{Count: 4, Oldest: 1, Newest: 4, TotalLikes: 1}
+	if stats := feed.Stats(); stats != expected {
+		t.Errorf("Expected stats:%v after removing timestamp:5. Got:%v", expected, stats)
+	}
+}
+
+func TestRemoveRange(t *testing.T) {
+
+	tests := []struct {
+		from, to  float64
+		removed   int
+		remaining []float64
+	}{
+		{3, 6, 4, []float64{1, 2, 7, 8, 9, 10}},                 //Partial range in the middle
+		{0.5, 2.5, 2, []float64{3, 4, 5, 6, 7, 8, 9, 10}},       //Partial range at the oldest end
+		{9, 20, 2, []float64{1, 2, 3, 4, 5, 6, 7, 8}},           //Partial range at the newest end
+		{1, 10, 10, []float64{}},                                //Full range
+		{math.Inf(-1), math.Inf(1), 10, []float64{}},            //Full range to infinity
+		{11, 20, 0, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},   //No match after the feed
+		{4.2, 4.8, 0, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}, //No match between posts
+		{6, 3, 0, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},     //Empty range
+	}
+	for _, test := range tests {
+		feed := NewFeed()
+		for i := 1; i <= 10; i++ {
+			feed.Add(strconv.Itoa(i), float64(i))
+		}
+		if removed := feed.RemoveRange(test.from, test.to); removed != test.removed {
+			t.Errorf("RemoveRange(%v, %v) expected to remove %v posts. Got:%v", test.from, test.to, test.removed, removed)
+		}
+		posts := feed.ShowFeed()
+		if len(posts) != len(test.remaining) {
+			t.Errorf("RemoveRange(%v, %v) expected %v posts to remain. Got:%v", test.from, test.to, len(test.remaining), len(posts))
+			continue
+		}
+		for i, postByte := range posts {
+			var post postBodyTimestamp
+			json.Unmarshal(postByte, &post)
+			if expected := test.remaining[len(test.remaining)-1-i]; post.Timestamp != expected {
+				t.Errorf("RemoveRange(%v, %v) expected timestamp:%v at position:%v. Got:%v", test.from, test.to, expected, i, post.Timestamp)
+			}
+		}
+	}
+
+	//Removing from an empty feed removes nothing
+	if removed := NewFeed().RemoveRange(math.Inf(-1), math.Inf(1)); removed != 0 {
+		t.Errorf("Feed is empty but RemoveRange removed %v posts", removed)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		//Upserting a new timestamp creates a post written by the author
+		if !feed.Upsert("first", "alice", 1) || !feed.Upsert("third", "", 3) {
+			t.Errorf("Upserted new timestamps but Upsert did not create posts")
+		}
+
+		//Upserting an existing timestamp updates the body without adding a post or changing its author
+		if feed.Upsert("updated", "bob", 1) {
+			t.Errorf("Upserted timestamp:1 again but Upsert created a post")
+		}
+		posts := feed.ShowFeed()
+		if len(posts) != 2 {
+			t.Errorf("Expected 2 posts after upserting 2 timestamps. Got:%v", len(posts))
+		}
+		var post postBodyTimestamp
+		json.Unmarshal(posts[len(posts)-1], &post)
+		if post.Body != "updated" || post.Timestamp != 1 || post.Author != "alice" {
+			t.Errorf("Expected the body of timestamp:1 to be updated and its author kept. Got:%v", post)
+		}
+		if len(feed.SearchByAuthor("bob")) != 0 {
+			t.Errorf("Expected the author of an upsert that updates a post to be ignored")
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		if version := feed.Version(); version != 0 {
+			t.Errorf("Expected a new feed to have version 0. Got:%v", version)
+		}
+
+		//Every change goes up from the last version
+		changes := []func(){
+			func() { feed.Add("first", 1) },
+			func() { feed.Add("second", 2) },
+			func() { feed.Like(1) },
+			func() { feed.SwapBody(2, "edited") },
+			func() { feed.Upsert("upserted", "", 3) },
+			func() { feed.Remove(1) },
+		}
+		last := feed.Version()
+		for i, change := range changes {
+			change()
+			if version := feed.Version(); version <= last {
+				t.Errorf("Expected change %v to raise the version above %v. Got:%v", i, last, version)
+			} else {
+				last = version
+			}
+		}
+
+		//Reads and changes that find nothing to change leave the version as it is
+		feed.ShowFeed()
+		feed.Contains(2)
+		feed.Stats()
+		feed.Remove(10)
+		feed.Like(10)
+		if version := feed.Version(); version != last {
+			t.Errorf("Expected the version to stay at %v. Got:%v", last, version)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+
+		//Compacting an empty feed does nothing
+		if removed := feed.Compact(); removed != 0 {
+			t.Errorf("Expected nothing to compact in an empty feed. Got:%v", removed)
+		}
+
+		//Each run of posts with the same body is collapsed into its newest post
+		for i, body := range []string{"a", "a", "b", "a", "a", "a", "c"} {
+			feed.Add(body, float64(i+1))
+		}
+		feed.Like(6)
+		if removed := feed.Compact(); removed != 3 {
+			t.Errorf("Expected 3 posts to be compacted. Got:%v", removed)
+		}
+		expected := []string{
+			`{"Body":"c","Timestamp":7}`,
+			`{"Body":"a","Timestamp":6,"Likes":1}`,
+			`{"Body":"b","Timestamp":3}`,
+			`{"Body":"a","Timestamp":2}`,
+		}
+		posts := feed.ShowFeed()
+		if len(posts) != len(expected) || feed.Count() != len(expected) {
+			t.Fatalf("Expected %v posts after compacting. Got:%v", len(expected), len(posts))
+		}
+		for i := range expected {
+			if string(posts[i]) != expected[i] {
+				t.Errorf("Expected post %v to be %v. Got:%v", i, expected[i], string(posts[i]))
+			}
+		}
+
+		//A feed without runs is left as it is
+		if removed := feed.Compact(); removed != 0 || feed.Count() != len(expected) {
+			t.Errorf("Expected nothing to compact a second time. Got:%v", removed)
+		}
+		if err := feed.Validate(); err != nil {
+			t.Errorf("Expected the feed to be valid. Got:%v", err)
+		}
+	}
+}
+
+func TestSwapBody(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed()} {
+		feed.Add("first", 1)
+		feed.Add("second", 2)
+
+		//Swapping the body of a post returns the body it had
+		if old, ok := feed.SwapBody(1, "edited"); !ok || old != "first" {
+			t.Errorf("Expected to swap out the body first. Got:%v, %v", old, ok)
+		}
+		if old, ok := feed.SwapBody(1, "edited again"); !ok || old != "edited" {
+			t.Errorf("Expected to swap out the body edited. Got:%v, %v", old, ok)
+		}
+		var post postBodyTimestamp
+		json.Unmarshal(feed.ShowFeed()[1], &post)
+		if post.Body != "edited again" || feed.Count() != 2 {
+			t.Errorf("Expected the body of timestamp:1 to be swapped without adding a post. Got:%v", post)
+		}
+
+		//Swapping the body of a missing post changes nothing
+		for _, ts := range []float64{3, math.Inf(1), math.Inf(-1)} {
+			if old, ok := feed.SwapBody(ts, "missing"); ok || old != "" {
+				t.Errorf("Expected no post to swap at timestamp:%v. Got:%v, %v", ts, old, ok)
+			}
+		}
+		if feed.Count() != 2 {
+			t.Errorf("Expected swapping a missing post not to add one. Got:%v posts", feed.Count())
+		}
+	}
+}
+
+//Goroutines swap the body of the same post at once. Each swap must return the body the swap before it put
+//in, so every body is returned exactly once except the body left in the post at the end.
+func TestParallelSwapBody(t *testing.T) {
+
+	const threadCount = 50
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed()} {
+		feed.Add("initial", 1)
+		var wg sync.WaitGroup
+		olds := make(chan string, threadCount)
+		for i := 0; i < threadCount; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if old, ok := feed.SwapBody(1, strconv.Itoa(i)); ok {
+					olds <- old
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(olds)
+
+		seen := make(map[string]bool)
+		for old := range olds {
+			if seen[old] {
+				t.Errorf("Expected the body:%v to be swapped out once", old)
+			}
+			seen[old] = true
+		}
+		var post postBodyTimestamp
+		json.Unmarshal(feed.ShowFeed()[0], &post)
+		if len(seen) != threadCount || !seen["initial"] || seen[post.Body] {
+			t.Errorf("Expected every body but the last:%v to be swapped out once. Got:%v", post.Body, seen)
+		}
+	}
+}
+
+func TestParallelUpsert(t *testing.T) {
+
+	const threadCount = 50
+	feed := NewFeed()
+
+	//Many goroutines upsert the same timestamp at once but only one creates the post
+	var wg sync.WaitGroup
+	var created int32
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			if feed.Upsert(strconv.Itoa(i), "", 1) {
+				atomic.AddInt32(&created, 1)
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	if created != 1 || len(feed.ShowFeed()) != 1 {
+		t.Errorf("Expected exactly one post to be created. Got:%v", created)
+	}
+}
+
+func TestTieBreak(t *testing.T) {
+
+	//Posts with the same timestamp are added in different orders
+	orders := [][]string{{"b", "d", "a", "c"}, {"c", "a", "d", "b"}, {"a", "b", "c", "d"}}
+	for _, order := range orders {
+		for _, tieBreak := range []TieBreak{TieBreakID, TieBreakBody} {
+			feed := NewFeedWithTieBreak(tieBreak)
+			feed.Add("older", 1)
+			feed.Add("newer", 3)
+			for _, body := range order {
+				feed.Add(body, 2)
+			}
+
+			//The most recently added post is first unless the bodies break the tie
+			expected := []string{"newer"}
+			if tieBreak == TieBreakBody {
+				expected = append(expected, "a", "b", "c", "d")
+			} else {
+				for i := len(order) - 1; i >= 0; i-- {
+					expected = append(expected, order[i])
+				}
+			}
+			expected = append(expected, "older")
+
+			posts := feed.ShowFeed()
+			if len(posts) != len(expected) {
+				t.Errorf("Expected %v posts. Got:%v", len(expected), len(posts))
+				continue
+			}
+			for i, postByte := range posts {
+				var post postBodyTimestamp
+				json.Unmarshal(postByte, &post)
+				if post.Body != expected[i] {
+					t.Errorf("Tie-break:%v after adding %v expected post:%v at position:%v. Got:%v", tieBreak, order, expected[i], i, post.Body)
+				}
+			}
+		}
+	}
+
+	//Posts with the same timestamp and body fall back to the most recently added first, which
+	//is last in the list as the feed is shown in reverse
+	feed := NewFeedWithTieBreak(TieBreakBody).(*feed)
+	first := feed.Add("a", 1)
+	second := feed.Add("a", 1)
+	if feed.start.next.id != first || feed.start.next.next.id != second {
+		t.Errorf("Expected post id:%v to be shown before post id:%v", second, first)
+	}
+}
+
+func TestRemoveIf(t *testing.T) {
+
+	feed := NewFeed()
+	feed.Add("first", 1)
+	feed.Add("second", 2)
+
+	//The timestamp matches but the body has changed since it was read
+	feed.Upsert("edited", "", 2)
+	if feed.RemoveIf(2, "second") || !feed.Contains(2) {
+		t.Errorf("Removed timestamp:2 even though its body no longer matches")
+	}
+
+	//No post has the timestamp
+	if feed.RemoveIf(3, "second") {
+		t.Errorf("Removed timestamp:3 but it is not in the feed")
+	}
+
+	//Both the timestamp and the body match
+	if !feed.RemoveIf(2, "edited") || feed.Contains(2) {
+		t.Errorf("Could not remove timestamp:2 with its current body")
+	}
+	if !feed.RemoveIf(1, "first") || len(feed.ShowFeed()) != 0 {
+		t.Errorf("Could not remove timestamp:1 with its current body")
+	}
+}
+
+// hookLock is a lock that calls afterRUnlock once a read lock has been released.
+type hookLock struct {
+	sync.RWMutex
+	afterRUnlock func()
+}
+
+func (l *hookLock) RUnlock() {
+	l.RWMutex.RUnlock()
+	if l.afterRUnlock != nil {
+		l.afterRUnlock()
+	}
+}
+
+func TestShowFeedSnapshot(t *testing.T) {
+
+	lock := &hookLock{}
+	feed := NewFeedWithLock(lock)
+	for i := 1; i <= 5; i++ {
+		feed.Add(strconv.Itoa(i), float64(i))
+	}
+
+	//An Add once the posts have been copied does not wait for them to be marshalled and is not in the snapshot
+	added := false
+	lock.afterRUnlock = func() {
+		lock.afterRUnlock = nil
+		feed.Add("6", 6)
+		added = true
+	}
+	posts := feed.ShowFeedSnapshot()
+	if !added {
+		t.Errorf("Expected the Add to finish before the snapshot was returned")
+	}
+	if len(posts) != 5 {
+		t.Errorf("Expected the 5 posts copied before the Add. Got:%v", len(posts))
+	}
+	for i, postByte := range posts {
+		var post postBodyTimestamp
+		json.Unmarshal(postByte, &post)
+		if expected := (postBodyTimestamp{strconv.Itoa(5 - i), float64(5 - i), 0, "", 0}); post != expected {
+			t.Errorf("Expected post:%v at position:%v. Got:%v", expected, i, post)
+		}
+	}
+	if len(feed.ShowFeedSnapshot()) != 6 {
+		t.Errorf("Expected the post added after the first snapshot to be in the next one")
+	}
+}
+
+func TestParallelShowFeedSnapshot(t *testing.T) {
+
+	const threadCount = 10
+	const postCount = 500
+	feed := NewFeed()
+
+	//Take snapshots while posts are added, liked and edited and check every snapshot is sorted newest first
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			for j := i; j < postCount; j += threadCount {
+				feed.Add(strconv.Itoa(j), float64(j))
+				feed.Like(float64(j))
+				feed.Upsert("edited", "", float64(j))
+			}
+			wg.Done()
+		}(i)
+	}
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 20; j++ {
+				last := math.Inf(1)
+				for _, postByte := range feed.ShowFeedSnapshot() {
+					var post postBodyTimestamp
+					if err := json.Unmarshal(postByte, &post); err != nil || post.Timestamp >= last {
+						t.Errorf("Expected a valid post older than timestamp:%v. Got:%s", last, postByte)
+					}
+					last = post.Timestamp
+				}
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if len(feed.ShowFeedSnapshot()) != postCount {
+		t.Errorf("Expected %v posts. Got:%v", postCount, len(feed.ShowFeedSnapshot()))
+	}
+	if err := feed.Validate(); err != nil {
+		t.Errorf("Expected a valid feed after the parallel updates. Got:%v", err)
+	}
+}
+
+func TestCountMatching(t *testing.T) {
+
+	feed := NewFeed()
+
+	//Check to make sure nothing matches in an empty feed
+	if count := feed.CountMatching(""); count != 0 {
+		t.Errorf("Feed is empty but CountMatching returned %v", count)
+	}
+
+	bodies := []string{"go is fun", "parallel go", "locks", "Go channels", "lock-free queue"}
+	for i, body := range bodies {
+		feed.Add(body, float64(i))
+	}
+	tests := []struct {
+		substr   string
+		expected int
+	}{
+		{"go", 2},        //Matching is case sensitive
+		{"lock", 2},      //Matches anywhere in the body
+		{"go is fun", 1}, //Matches the whole body
+		{"rust", 0},      //No match
+		{"", 5},          //Empty substring counts all posts
+	}
+	for _, test := range tests {
+		if count := feed.CountMatching(test.substr); count != test.expected {
+			t.Errorf("CountMatching(%q) expected %v. Got:%v", test.substr, test.expected, count)
+		}
+	}
+}
+
+func TestTotalBodyBytes(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		if total := feed.TotalBodyBytes(); total != 0 {
+			t.Errorf("Feed is empty but TotalBodyBytes returned %v", total)
+		}
+
+		//Multibyte characters count every byte: "héllo" is 6 bytes and "日本" is 6 bytes
+		feed.Add("go", 1)
+		feed.Add("héllo", 2)
+		feed.Add("日本", 3)
+		feed.Add("", 4)
+		if total := feed.TotalBodyBytes(); total != 14 {
+			t.Errorf("Expected 14 bytes after the adds. Got:%v", total)
+		}
+
+		//Edits count the new body instead of the old one
+		feed.SwapBody(1, "gopher")
+		feed.Upsert("日", "", 3)
+		feed.Upsert("new", "", 5)
+		if total := feed.TotalBodyBytes(); total != 18 {
+			t.Errorf("Expected 18 bytes after the edits. Got:%v", total)
+		}
+
+		//Removed posts no longer count
+		feed.Remove(2)
+		feed.Remove(5)
+		if total := feed.TotalBodyBytes(); total != 9 {
+			t.Errorf("Expected 9 bytes after the removes. Got:%v", total)
+		}
+	}
+}
+
+func TestFeedWithCapacity(t *testing.T) {
+
+	feed := NewFeedWithCapacity(2)
+	feed.AddWithAuthor("first", "alice", 1)
+	feed.Add("second", 2)
+	feed.Like(1)
+
+	//A removed post is reused by the next Add without its old likes or author
+	if !feed.Remove(1) {
+		t.Fatal("Expected the post at timestamp 1 to be removed")
+	}
+	feed.Add("third", 3)
+	posts := feed.ShowFeed()
+	if len(posts) != 2 || string(posts[0]) != `{"Body":"third","Timestamp":3}` || string(posts[1]) != `{"Body":"second","Timestamp":2}` {
+		t.Errorf("Expected the reused post to only have its new body and timestamp. Got:%q", posts)
+	}
+
+	//Past the hint the feed allocates posts like NewFeed
+	for i := 4; i < 10; i++ {
+		feed.Add(strconv.Itoa(i), float64(i))
+	}
+	if count := feed.Count(); count != 8 {
+		t.Errorf("Expected 8 posts past the hint. Got:%v", count)
+	}
+
+	//A hint of 0 gives a feed without a pool
+	feed = NewFeedWithCapacity(0)
+	feed.Add("first", 1)
+	feed.Remove(1)
+	if count := feed.Count(); count != 0 {
+		t.Errorf("Expected an empty feed. Got %v posts", count)
+	}
+}
+
+func TestFeedWithCapacityReusesRemovedPosts(t *testing.T) {
+
+	f := NewFeedWithCapacity(6).(*feed)
+	f.maxPosts = 5
+	for i := 1; i <= 6; i++ {
+		f.Add(strconv.Itoa(i), float64(i))
+	}
+	if free := len(f.pool.free); free != 1 {
+		t.Errorf("Expected the evicted post back on the pool. Got %v free posts", free)
+	}
+
+	//Every way of removing a post puts it back on the pool
+	f.Pop(2)
+	f.RemoveOldest()
+	f.RemoveNewest()
+	f.RemoveRange(4, 4)
+	f.RemoveByID(5)
+	if free := len(f.pool.free); free != 6 || f.Count() != 0 {
+		t.Errorf("Expected every post back on the pool and an empty feed. Got %v free posts and %v posts", free, f.Count())
+	}
+	for i := 1; i <= 4; i++ {
+		f.Add("same", float64(i))
+	}
+	f.Compact()
+	f.TrimToNewest(0)
+	if free := len(f.pool.free); free != 6 || f.Count() != 0 {
+		t.Errorf("Expected every post back on the pool after Compact and TrimToNewest. Got %v free posts and %v posts", free, f.Count())
+	}
+	f.Add("kept", 1)
+	f.ReplaceAll([]PostView{{Body: "new", Timestamp: 2}})
+	if free := len(f.pool.free); free != 5 {
+		t.Errorf("Expected the post replaced by ReplaceAll back on the pool. Got %v free posts", free)
+	}
+}
+
+func TestForEach(t *testing.T) {
+
+	feed := NewFeed()
+
+	//Check to make sure fn is never called on an empty feed
+	feed.ForEach(NewestFirst, func(body string, timestamp float64) bool {
+		t.Errorf("Feed is empty but ForEach called fn with timestamp:%v", timestamp)
+		return true
+	})
+
+	for _, timestamp := range []float64{3, 1, 5, 2, 4} {
+		feed.Add(strconv.Itoa(int(timestamp)), timestamp)
+	}
+
+	//Each order visits every post
+	expected := map[Order][]float64{NewestFirst: {5, 4, 3, 2, 1}, OldestFirst: {1, 2, 3, 4, 5}}
+	for order, timestamps := range expected {
+		visited := make([]float64, 0)
+		feed.ForEach(order, func(body string, timestamp float64) bool {
+			if body != strconv.Itoa(int(timestamp)) {
+				t.Errorf("Expected body:%v for timestamp:%v. Got:%v", int(timestamp), timestamp, body)
+			}
+			visited = append(visited, timestamp)
+			return true
+		})
+		if !reflect.DeepEqual(visited, timestamps) {
+			t.Errorf("Order:%v expected timestamps:%v. Got:%v", order, timestamps, visited)
+		}
+	}
+
+	//Returning false stops the walk at the first post that matches
+	for order, first := range map[Order]float64{NewestFirst: 4, OldestFirst: 2} {
+		visited := 0
+		var found float64
+		feed.ForEach(order, func(body string, timestamp float64) bool {
+			visited++
+			if int(timestamp)%2 == 0 {
+				found = timestamp
+				return false
+			}
+			return true
+		})
+		if found != first || visited != 2 {
+			t.Errorf("Order:%v expected to stop at timestamp:%v after 2 posts. Got:%v after %v posts", order, first, found, visited)
+		}
+	}
+}
+
+func TestBoundedFeed(t *testing.T) {
+
+	const maxPosts = 5
+	feed := NewBoundedFeed(maxPosts)
+
+	//Adding up to maxPosts posts evicts nothing
+	for i := 1; i <= maxPosts; i++ {
+		if _, evicted := feed.AddWithEviction(strconv.Itoa(i), float64(i)); evicted {
+			t.Errorf("Added post:%v of %v but a post was evicted", i, maxPosts)
+		}
+	}
+
+	//Each post over maxPosts evicts the oldest post
+	for i := maxPosts + 1; i <= 2*maxPosts; i++ {
+		if _, evicted := feed.AddWithEviction(strconv.Itoa(i), float64(i)); !evicted {
+			t.Errorf("Added post:%v of %v but no post was evicted", i, maxPosts)
+		}
+		if feed.Contains(float64(i - maxPosts)) {
+			t.Errorf("Expected the oldest timestamp:%v to be evicted", i-maxPosts)
+		}
+	}
+
+	//A post older than every other post is evicted straight away
+	feed.Add("0", 0)
+	if feed.Contains(0) {
+		t.Errorf("Expected timestamp:0 to be evicted as the oldest post")
+	}
+
+	//Removing a post makes room for another one and the order is intact
+	feed.Remove(8)
+	if _, evicted := feed.AddWithEviction("7.5", 7.5); evicted {
+		t.Errorf("Added a post after a remove but a post was evicted")
+	}
+	expected := []float64{10, 9, 7.5, 7, 6}
+	posts := feed.ShowFeed()
+	if len(posts) != len(expected) {
+		t.Errorf("Expected %v posts. Got:%v", len(expected), len(posts))
+	}
+	for i, postByte := range posts {
+		var post postBodyTimestamp
+		json.Unmarshal(postByte, &post)
+		if i < len(expected) && post.Timestamp != expected[i] {
+			t.Errorf("Expected timestamp:%v at position:%v. Got:%v", expected[i], i, post.Timestamp)
+		}
+	}
+}
+
+func TestRemoveOldestAndNewest(t *testing.T) {
+
+	remove := map[string]func(Feed) ([]byte, bool){
+		"RemoveOldest": Feed.RemoveOldest,
+		"RemoveNewest": Feed.RemoveNewest,
+	}
+	for name, remove := range remove {
+
+		//Check to make sure nothing is removed from an empty feed
+		feed := NewFeed()
+		if _, ok := remove(feed); ok {
+			t.Errorf("Feed is empty but %v returned a post", name)
+		}
+
+		//A single post is both the oldest and the newest
+		feed.Add("1", 1)
+		postByte, ok := remove(feed)
+		var post postBodyTimestamp
+		json.Unmarshal(postByte, &post)
+		if !ok || post != (postBodyTimestamp{"1", 1, 0, "", 0}) || len(feed.ShowFeed()) != 0 {
+			t.Errorf("%v expected to remove the only post. Got:%v, %v", name, post, ok)
+		}
+		if _, ok := remove(feed); ok {
+			t.Errorf("%v returned a post from a feed that was emptied", name)
+		}
+	}
+
+	//Posts are removed from the right end of a feed with many posts
+	feed := NewFeed()
+	for _, timestamp := range []float64{3, 1, 5, 2, 4} {
+		feed.Add(strconv.Itoa(int(timestamp)), timestamp)
+	}
+	expected := []struct {
+		remove    func() ([]byte, bool)
+		timestamp float64
+	}{{feed.RemoveOldest, 1}, {feed.RemoveNewest, 5}, {feed.RemoveNewest, 4}, {feed.RemoveOldest, 2}, {feed.RemoveNewest, 3}}
+	for i, next := range expected {
+		postByte, ok := next.remove()
+		var post postBodyTimestamp
+		json.Unmarshal(postByte, &post)
+		if !ok || post.Timestamp != next.timestamp || len(feed.ShowFeed()) != len(expected)-1-i {
+			t.Errorf("Expected to remove timestamp:%v. Got:%v, %v", next.timestamp, post.Timestamp, ok)
+		}
+	}
+	if _, ok := feed.RemoveOldest(); ok {
+		t.Errorf("RemoveOldest returned a post after every post was removed")
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	//newValidFeed returns a feed with posts 1 to 5 that passes validation
+	newValidFeed := func() *feed {
+		feed := NewFeed().(*feed)
+		for _, timestamp := range []float64{3, 1, 5, 2, 4} {
+			feed.Add(strconv.Itoa(int(timestamp)), timestamp)
+		}
+		feed.Add("tie", 3)
+		if err := feed.Validate(); err != nil || !feed.isSorted() {
+			t.Errorf("Expected a valid feed. Got:%v", err)
+		}
+		return feed
+	}
+	if err := NewFeed().Validate(); err != nil {
+		t.Errorf("Expected an empty feed to be valid. Got:%v", err)
+	}
+
+	//Each corruption is caught by Validate
+	corruptions := map[string]func(f *feed){
+		"swapped timestamps":   func(f *feed) { f.start.next.timestamp, f.start.next.next.timestamp = 2, 1 },
+		"tie out of order":     func(f *feed) { p := f.start.next.next.next; p.id, p.next.id = p.next.id, p.id },
+		"cycle":                func(f *feed) { f.start.next.next.next = f.start.next },
+		"self loop":            func(f *feed) { f.start.next.next = f.start.next },
+		"head sentinel moved":  func(f *feed) { f.start.timestamp = 0 },
+		"head timestamp":       func(f *feed) { f.start.next.timestamp = math.Inf(-1) },
+		"tail sentinel lost":   func(f *feed) { f.start.next.next = nil },
+		"tail sentinel linked": func(f *feed) { p := f.start; for p.next != nil { p = p.next }; p.next = f.start.next },
+		"size":                 func(f *feed) { f.size.Add(1) },
+	}
+	for name, corrupt := range corruptions {
+		feed := newValidFeed()
+		corrupt(feed)
+		if err := feed.Validate(); err == nil {
+			t.Errorf("Expected Validate to catch the corruption:%v", name)
+		}
+	}
+
+	//isSorted catches posts out of order
+	feed := newValidFeed()
+	feed.start.next.next.next.timestamp = 10
+	if feed.isSorted() {
+		t.Errorf("Expected isSorted to catch a post out of order")
+	}
+}
+
+// onlyFeed hides the implementation of a Feed so Merge cannot copy its posts directly.
+type onlyFeed struct {
+	Feed
+}
+
+func TestReplaceAll(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewRCUFeed()} {
+		for i := 1; i <= 5; i++ {
+			feed.Add("old"+strconv.Itoa(i), float64(i))
+		}
+
+		//The posts are sorted however they are given and keep their likes and authors
+		err := feed.ReplaceAll([]PostView{
+			{Body: "b", Timestamp: 2, Likes: 3},
+			{Body: "c", Timestamp: 3, Author: "alice"},
+			{Body: "a", Timestamp: 1},
+			{Body: "skipped", Timestamp: math.Inf(1)},
+			{Body: "skipped", Timestamp: math.NaN()},
+			{Body: "d", Timestamp: 3},
+		})
+		if err != nil {
+			t.Errorf("Could not replace the posts:%v", err)
+		}
+		//Posts with the same timestamp are shown as if added in the order given, the last one first
+		if bodies := showBodies(feed); !reflect.DeepEqual(bodies, []string{"d", "c", "b", "a"}) {
+			t.Errorf("Expected the new posts in order. Got:%v", bodies)
+		}
+		if stats := feed.Stats(); stats.Count != 4 || stats.TotalLikes != 3 || feed.Count() != 4 {
+			t.Errorf("Expected 4 posts and 3 likes. Got:%v, count:%v", stats, feed.Count())
+		}
+		if len(feed.SearchByAuthor("alice")) != 1 {
+			t.Errorf("Expected the author to be kept")
+		}
+		if feed.Contains(5) {
+			t.Errorf("Expected the old posts to be removed")
+		}
+		if err := feed.Validate(); err != nil {
+			t.Errorf("Replacing the posts left the feed invalid:%v", err)
+		}
+
+		//The replaced feed can be changed as usual and replaced with nothing
+		feed.Add("e", 4)
+		feed.Remove(1)
+		if bodies := showBodies(feed); !reflect.DeepEqual(bodies, []string{"e", "d", "c", "b"}) {
+			t.Errorf("Expected to add to and remove from the new posts. Got:%v", bodies)
+		}
+		feed.ReplaceAll(nil)
+		if !feed.IsEmpty() || feed.Count() != 0 {
+			t.Errorf("Expected an empty feed. Got:%v", showBodies(feed))
+		}
+	}
+
+	//A bounded feed keeps only its newest posts
+	bounded := NewBoundedFeed(2)
+	bounded.ReplaceAll([]PostView{{Body: "a", Timestamp: 1}, {Body: "b", Timestamp: 2}, {Body: "c", Timestamp: 3}})
+	if bodies := showBodies(bounded); !reflect.DeepEqual(bodies, []string{"c", "b"}) {
+		t.Errorf("Expected the 2 newest posts. Got:%v", bodies)
+	}
+
+	//A lock-free feed cannot replace its posts in one step so it refuses and keeps its posts
+	lockFree := NewLockFreeFeed()
+	lockFree.Add("old", 1)
+	if err := lockFree.ReplaceAll([]PostView{{Body: "new", Timestamp: 2}}); err != ErrReplaceUnsupported {
+		t.Errorf("Expected ErrReplaceUnsupported from a lock-free feed. Got:%v", err)
+	}
+	if bodies := showBodies(lockFree); !reflect.DeepEqual(bodies, []string{"old"}) {
+		t.Errorf("Expected a refused replace to leave the feed unchanged. Got:%v", bodies)
+	}
+}
+
+func TestReplaceAllAtomic(t *testing.T) {
+
+	const postCount = 50
+	feeds := []struct {
+		name string
+		feed Feed
+	}{{"coarse", NewFeed()}, {"rcu", NewRCUFeed()}}
+	for _, test := range feeds {
+		generations := make([][]PostView, 2)
+		for g := range generations {
+			for i := 0; i < postCount; i++ {
+				generations[g] = append(generations[g], PostView{Body: strconv.Itoa(g), Timestamp: float64(i)})
+			}
+		}
+		test.feed.ReplaceAll(generations[0])
+
+		//Readers check that every feed they see is all of one generation while a writer swaps between them
+		var stop int32
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for atomic.LoadInt32(&stop) == 0 {
+					bodies := showBodies(test.feed)
+					for _, body := range bodies {
+						if body != bodies[0] {
+							t.Errorf("%v: Expected the posts of one generation. Got:%v", test.name, bodies)
+							return
+						}
+					}
+					if len(bodies) != postCount {
+						t.Errorf("%v: Expected all %v posts of a generation. Got:%v", test.name, postCount, len(bodies))
+						return
+					}
+				}
+			}()
+		}
+		for i := 0; i < 200; i++ {
+			test.feed.ReplaceAll(generations[i%2])
+		}
+		atomic.StoreInt32(&stop, 1)
+		wg.Wait()
+		if test.feed.Count() != postCount {
+			t.Errorf("%v: Expected %v posts. Got:%v", test.name, postCount, test.feed.Count())
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+
+	//newFeed returns a feed with a post at each timestamp
+	newFeed := func(timestamps ...float64) Feed {
+		feed := NewFeed()
+		for _, timestamp := range timestamps {
+			feed.Add(strconv.Itoa(int(timestamp)), timestamp)
+		}
+		return feed
+	}
+
+	tests := []struct {
+		name     string
+		primary  []float64
+		other    []float64
+		expected []float64
+	}{
+		{"disjoint", []float64{1, 3, 5}, []float64{2, 4, 6}, []float64{6, 5, 4, 3, 2, 1}},
+		{"disjoint ranges", []float64{4, 5}, []float64{1, 2}, []float64{5, 4, 2, 1}},
+		{"overlapping", []float64{1, 2, 3, 4}, []float64{3, 4, 5, 6}, []float64{6, 5, 4, 3, 2, 1}},
+		{"same", []float64{1, 2, 3}, []float64{1, 2, 3}, []float64{3, 2, 1}},
+		{"empty other", []float64{1, 2}, []float64{}, []float64{2, 1}},
+		{"empty primary", []float64{}, []float64{1, 2}, []float64{2, 1}},
+	}
+	for _, test := range tests {
+		for _, wrap := range []bool{false, true} {
+			primary := newFeed(test.primary...)
+			other := newFeed(test.other...)
+			if wrap {
+				other = onlyFeed{other}
+			}
+			primary.Merge(other)
+
+			posts := primary.ShowFeed()
+			if len(posts) != len(test.expected) {
+				t.Errorf("Merging %v feeds expected %v posts. Got:%v", test.name, len(test.expected), len(posts))
+				continue
+			}
+			for i, postByte := range posts {
+				var post postBodyTimestamp
+				json.Unmarshal(postByte, &post)
+				expected := postBodyTimestamp{strconv.Itoa(int(test.expected[i])), test.expected[i], 0, "", 0}
+				if post.Body != expected.Body || post.Timestamp != expected.Timestamp {
+					t.Errorf("Merging %v feeds expected post:%v at position:%v. Got:%v", test.name, expected, i, post)
+				}
+			}
+			if err := primary.Validate(); err != nil {
+				t.Errorf("Merging %v feeds left the feed invalid:%v", test.name, err)
+			}
+			if len(other.ShowFeed()) != len(test.other) {
+				t.Errorf("Merging %v feeds changed the other feed", test.name)
+			}
+		}
+	}
+
+	//Posts that only share a timestamp are both kept and merged posts keep their likes
+	primary := NewFeed()
+	primary.Add("phone", 1)
+	other := NewFeed()
+	other.Add("laptop", 1)
+	other.Like(1)
+	primary.Merge(other)
+	if stats := primary.Stats(); stats.Count != 2 || stats.TotalLikes != 1 {
+		t.Errorf("Expected both posts at timestamp:1 and the like to be merged. Got:%v", stats)
+	}
+}
+
+func TestSearchByAuthor(t *testing.T) {
+
+	feed := NewFeed()
+
+	//Check to make sure nothing is found in an empty feed
+	if posts := feed.SearchByAuthor("alice"); len(posts) != 0 {
+		t.Errorf("Feed is empty but SearchByAuthor returned %v posts", len(posts))
+	}
+
+	authors := []string{"alice", "bob", "alice", "", "bob", "alice"}
+	for i, author := range authors {
+		feed.AddWithAuthor(strconv.Itoa(i), author, float64(i))
+	}
+	feed.AddIdempotent("6", "bob", 6, "key")
+
+	expected := map[string][]float64{"alice": {5, 2, 0}, "bob": {6, 4, 1}, "": {3}, "carol": {}}
+	for author, timestamps := range expected {
+		posts := feed.SearchByAuthor(author)
+		if len(posts) != len(timestamps) {
+			t.Errorf("SearchByAuthor(%q) expected %v posts. Got:%v", author, len(timestamps), len(posts))
+			continue
+		}
+		for i, postByte := range posts {
+			var post postBodyTimestamp
+			json.Unmarshal(postByte, &post)
+			if post.Timestamp != timestamps[i] || post.Author != author {
+				t.Errorf("SearchByAuthor(%q) expected timestamp:%v at position:%v. Got:%v", author, timestamps[i], i, post)
+			}
+		}
+	}
+}
+
+func TestGetNthRecent(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed()} {
+
+		//Check that nothing is found in an empty feed
+		if _, found := feed.GetNthRecent(0); found {
+			t.Errorf("Feed is empty but GetNthRecent(0) found a post")
+		}
+
+		for i := 1; i <= 5; i++ {
+			feed.Add(strconv.Itoa(i), float64(i))
+		}
+		for n := 0; n < 5; n++ {
+			postByte, found := feed.GetNthRecent(n)
+			var post postBodyTimestamp
+			json.Unmarshal(postByte, &post)
+			if !found || post.Timestamp != float64(5-n) {
+				t.Errorf("GetNthRecent(%v) expected the post with timestamp:%v. Got:%v, %v", n, 5-n, found, post)
+			}
+		}
+
+		//Check positions past either end of the feed
+		for _, n := range []int{5, 100, -1} {
+			if _, found := feed.GetNthRecent(n); found {
+				t.Errorf("GetNthRecent(%v) is out of range but found a post", n)
+			}
+		}
+	}
+}
+
+func TestContainsApprox(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewFeedWithComparator(ByScore)} {
+
+		//Check that nothing is found in an empty feed
+		if feed.ContainsApprox(1, 1) {
+			t.Errorf("Feed is empty but ContainsApprox(1, 1) found a post")
+		}
+
+		tenth, fifth := 0.1, 0.2
+		feed.Add("0.1+0.2", tenth+fifth) //Computed at run time it is not exactly 0.3
+		feed.Add("10", 10)
+		feed.Add("20", 20)
+
+		for _, test := range []struct {
+			timestamp float64
+			epsilon   float64
+			found     bool
+		}{
+			{0.3, 1e-9, true},        //Near miss that Contains does not find
+			{0.3, 0, false},          //Exact match only
+			{10, 0, true},            //Exact match
+			{10.4, 0.5, true},        //Within epsilon above the post
+			{9.6, 0.5, true},         //Within epsilon below the post
+			{10.6, 0.5, false},       //Outside epsilon above the post
+			{9.4, 0.5, false},        //Outside epsilon below the post
+			{15, 4.9, false},         //Between two posts
+			{15, 5, true},            //Exactly epsilon away from both posts
+			{20.5, 0.25, false},      //Past the newest post
+			{10, -1, false},          //Negative epsilon
+			{math.Inf(1), 1, false},  //Sentinel timestamp
+			{math.Inf(-1), 1, false}, //Sentinel timestamp
+		} {
+			if found := feed.ContainsApprox(test.timestamp, test.epsilon); found != test.found {
+				t.Errorf("ContainsApprox(%v, %v) expected:%v. Got:%v", test.timestamp, test.epsilon, test.found, found)
+			}
+		}
+		if feed.Contains(0.3) {
+			t.Errorf("Expected Contains(0.3) not to find the post at 0.1+0.2")
+		}
+
+		//Check that a removed post is not found
+		feed.Remove(10)
+		if feed.ContainsApprox(10, 0.5) {
+			t.Errorf("Post 10 was removed but ContainsApprox(10, 0.5) found it")
+		}
+	}
+}
+
+func TestContainsAll(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewFeedWithComparator(ByScore)} {
+		if found := feed.ContainsAll([]float64{1}); !reflect.DeepEqual(found, map[float64]bool{1: false}) {
+			t.Errorf("Expected nothing to be found in an empty feed. Got:%v", found)
+		}
+		for i, ts := range []float64{2, 4, 4, 6, 8} {
+			feed.AddWithAuthor(strconv.Itoa(i), "", ts)
+		}
+		feed.Add("top", 5)
+
+		tests := []struct {
+			name       string
+			timestamps []float64
+			expected   map[float64]bool
+		}{
+			{"sorted", []float64{1, 2, 3, 4, 5, 9},
+				map[float64]bool{1: false, 2: true, 3: false, 4: true, 5: true, 9: false}},
+			{"unsorted with duplicates", []float64{9, 4, 8, 0.5, 4, 2, 7},
+				map[float64]bool{9: false, 4: true, 8: true, 0.5: false, 2: true, 7: false}},
+			{"all past the newest post", []float64{10, 20},
+				map[float64]bool{10: false, 20: false}},
+			{"sentinels", []float64{math.Inf(1), math.Inf(-1), 6, math.NaN()},
+				map[float64]bool{math.Inf(1): false, math.Inf(-1): false, 6: true}},
+			{"none", nil, map[float64]bool{}},
+		}
+		for _, test := range tests {
+			if found := feed.ContainsAll(test.timestamps); !reflect.DeepEqual(found, test.expected) {
+				t.Errorf("Expected ContainsAll of %v timestamps to find %v. Got:%v", test.name, test.expected, found)
+			}
+		}
+	}
+}
+
+func TestContainsBodies(t *testing.T) {
+
+	lock := &recordingLock{}
+	for i, feed := range []Feed{NewFeedWithLock(lock), NewLockFreeFeed()} {
+
+		//Check that nothing is found in an empty feed and that no bodies gives an empty map
+		if found := feed.ContainsBodies([]string{"a"}); !reflect.DeepEqual(found, map[string]bool{"a": false}) {
+			t.Errorf("Feed is empty but ContainsBodies found:%v", found)
+		}
+		if found := feed.ContainsBodies(nil); len(found) != 0 {
+			t.Errorf("Expected no results for no bodies. Got:%v", found)
+		}
+
+		feed.Add("first", 1)
+		feed.Add("second", 2)
+		feed.Add("third", 3)
+		feed.Remove(2)
+
+		//Check a mix of present, absent, removed and repeated bodies
+		expected := map[string]bool{"first": true, "third": true, "second": false, "fourth": false, "": false}
+		lock.calls = nil
+		found := feed.ContainsBodies([]string{"first", "second", "fourth", "third", "first", ""})
+		if !reflect.DeepEqual(found, expected) {
+			t.Errorf("ContainsBodies expected:%v. Got:%v", expected, found)
+		}
+
+		//Check that the coarse-grained feed looks up every body with a single read-locked walk
+		if i == 0 && (len(lock.calls) != 2 || lock.calls[0] != "RLock" || lock.calls[1] != "RUnlock") {
+			t.Errorf("Expected ContainsBodies to take the read lock once. Got:%v", lock.calls)
+		}
+	}
+}
+
+func TestCapacityWarning(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewBoundedFeed(5)} {
+		var calls []int
+		feed.SetCapacityWarning(3, func(current int) {
+			//The callback can call back into the feed
+			if !feed.Contains(float64(current)) {
+				t.Errorf("Expected the post that crossed the threshold to be in the feed")
+			}
+			calls = append(calls, current)
+		})
+
+		//Adding up to the threshold does not warn
+		for i := 1; i <= 3; i++ {
+			feed.Add("post", float64(i))
+		}
+		if len(calls) != 0 {
+			t.Errorf("Expected no warning at the threshold. Got:%v", calls)
+		}
+
+		//The warning is given once when the feed goes over the threshold and no post is evicted
+		feed.Add("post", 4)
+		feed.Add("post", 5)
+		if len(calls) != 1 || calls[0] != 4 || feed.Count() != 5 {
+			t.Errorf("Expected one warning with 4 posts and no eviction. Got:%v with %v posts", calls, feed.Count())
+		}
+
+		//Going back down to the threshold and over it again warns again
+		feed.Remove(5)
+		feed.Remove(4)
+		feed.Add("post", 4)
+		feed.Add("post", 5)
+		if len(calls) != 2 || calls[1] != 4 {
+			t.Errorf("Expected a second warning after crossing the threshold again. Got:%v", calls)
+		}
+
+		//A nil callback turns the warning off
+		feed.SetCapacityWarning(3, nil)
+		feed.TrimToNewest(3)
+		feed.Add("post", 6)
+		if len(calls) != 2 {
+			t.Errorf("Expected no warning once it is turned off. Got:%v", calls)
+		}
+	}
+
+	//Goroutines adding at the same time get one warning per crossing between them
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed()} {
+		var calls int32
+		feed.SetCapacityWarning(100, func(current int) { atomic.AddInt32(&calls, 1) })
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					feed.Add("post", float64(i*50+j))
+				}
+			}(i)
+		}
+		wg.Wait()
+		if calls != 1 {
+			t.Errorf("Expected one warning for 8 goroutines adding past the threshold. Got:%v", calls)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewBoundedFeed(3)} {
+		if feed.Count() != 0 {
+			t.Errorf("Expected an empty feed to have count 0. Got:%v", feed.Count())
+		}
+
+		//Posts with the same timestamp each count
+		feed.Add("1", 1)
+		feed.Add("1 again", 1)
+		feed.Add("2", 2)
+		if feed.Count() != 3 {
+			t.Errorf("Expected count 3 after adding 3 posts. Got:%v", feed.Count())
+		}
+
+		//Only successful removes count
+		feed.Remove(1)
+		feed.Remove(5)
+		feed.RemoveRange(10, 20)
+		if feed.Count() != 2 {
+			t.Errorf("Expected count 2 after removing 1 post. Got:%v", feed.Count())
+		}
+
+		//The count stays in step with every other way of adding and removing posts
+		feed.Upsert("3", "", 3)
+		feed.Upsert("3 edited", "", 3)
+		feed.Reschedule(3, 4)
+		feed.Add("5", 5)
+		feed.RemoveOldest()
+		feed.RemoveRange(4, 4)
+		feed.TrimToNewest(5)
+		if count := len(feed.ShowFeed()); feed.Count() != count {
+			t.Errorf("Expected the count to match the %v posts in the feed. Got:%v", count, feed.Count())
+		}
+		feed.TrimToNewest(0)
+		if feed.Count() != 0 {
+			t.Errorf("Expected count 0 after trimming every post. Got:%v", feed.Count())
+		}
+	}
+}
+
+//This test is run with -race. Goroutines add and remove posts, some with the same timestamps, while another goroutine
+//polls Count, and then the count is checked against a full traversal of the feed.
+func TestParallelCount(t *testing.T) {
+
+	const threadCount = 8
+	const opsPerThread = 2000
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed()} {
+		var wg sync.WaitGroup
+		var stop int32
+		polled := make(chan bool)
+		go func() {
+			for atomic.LoadInt32(&stop) == 0 {
+				if count := feed.Count(); count < 0 {
+					t.Errorf("Expected the count never to be negative. Got:%v", count)
+				}
+			}
+			polled <- true
+		}()
+		for i := 0; i < threadCount; i++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for j := 0; j < opsPerThread; j++ {
+					ts := float64(r.Intn(100))
+					switch r.Intn(5) {
+					case 0:
+						feed.Remove(ts)
+					case 1:
+						feed.RemoveRange(ts, ts+2)
+					default:
+						feed.Add("post", ts)
+					}
+				}
+			}(int64(i))
+		}
+		wg.Wait()
+		atomic.StoreInt32(&stop, 1)
+		<-polled
+
+		if count := len(feed.ShowFeed()); feed.Count() != count || feed.Stats().Count != count {
+			t.Errorf("Expected the count to match the %v posts in the feed. Got:%v", count, feed.Count())
+		}
+		if err := feed.Validate(); err != nil {
+			t.Errorf("Expected the feed to be valid. Got:%v", err)
+		}
+	}
+}
+
+func TestIndexOf(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed()} {
+
+		//Check that nothing is found in an empty feed
+		if _, found := feed.IndexOf(1); found {
+			t.Errorf("Feed is empty but IndexOf(1) found a post")
+		}
+
+		for i := 1; i <= 5; i++ {
+			feed.Add(strconv.Itoa(i), float64(i))
+		}
+
+		//Check the newest, a middle and the oldest post
+		for _, test := range []struct {
+			timestamp float64
+			index     int
+		}{{5, 0}, {3, 2}, {1, 4}} {
+			if index, found := feed.IndexOf(test.timestamp); !found || index != test.index {
+				t.Errorf("IndexOf(%v) expected index:%v. Got:%v, %v", test.timestamp, test.index, index, found)
+			}
+		}
+
+		//Check timestamps that are not in the feed
+		for _, timestamp := range []float64{0, 2.5, 6} {
+			if _, found := feed.IndexOf(timestamp); found {
+				t.Errorf("IndexOf(%v) found a post that is not in the feed", timestamp)
+			}
+		}
+	}
+}
+
+func TestTrimToNewest(t *testing.T) {
+
+	for _, newFeed := range []func() Feed{NewFeed, NewLockFreeFeed} {
+
+		//Check that trimming an empty feed removes nothing
+		if removed := newFeed().TrimToNewest(0); removed != 0 {
+			t.Errorf("Feed is empty but TrimToNewest(0) removed %v posts", removed)
+		}
+
+		for _, test := range []struct {
+			n       int
+			removed int
+			bodies  []string
+		}{
+			{-1, 0, []string{"5", "4", "3", "2", "1"}},
+			{6, 0, []string{"5", "4", "3", "2", "1"}},
+			{5, 0, []string{"5", "4", "3", "2", "1"}},
+			{4, 1, []string{"5", "4", "3", "2"}},
+			{2, 3, []string{"5", "4"}},
+			{1, 4, []string{"5"}},
+			{0, 5, []string{}},
+		} {
+			feed := newFeed()
+			for i := 1; i <= 5; i++ {
+				feed.Add(strconv.Itoa(i), float64(i))
+			}
+			if removed := feed.TrimToNewest(test.n); removed != test.removed {
+				t.Errorf("TrimToNewest(%v) expected to remove %v posts. Got:%v", test.n, test.removed, removed)
+			}
+			if bodies := showBodies(feed); !reflect.DeepEqual(bodies, test.bodies) {
+				t.Errorf("TrimToNewest(%v) expected feed:%v. Got:%v", test.n, test.bodies, bodies)
+			}
+			if err := feed.Validate(); err != nil {
+				t.Errorf("Expected the feed to be valid after TrimToNewest(%v). Got:%v", test.n, err)
+			}
+
+			//Check that the trimmed feed can still be added to
+			feed.Add("0", 0)
+			if stats := feed.Stats(); stats.Count != len(test.bodies)+1 {
+				t.Errorf("Expected %v posts after adding to the trimmed feed. Got:%v", len(test.bodies)+1, stats.Count)
+			}
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+
+	bodies := func(posts [][]byte) []string {
+		result := []string{}
+		for _, postByte := range posts {
+			var post postBodyTimestamp
+			json.Unmarshal(postByte, &post)
+			result = append(result, post.Body)
+		}
+		return result
+	}
+
+	for _, newFeed := range []func() Feed{NewFeed, NewLockFreeFeed} {
+		for _, test := range []struct {
+			name    string
+			change  func(feed Feed)
+			added   []string
+			removed []string
+		}{
+			{"no changes", func(feed Feed) {}, []string{}, []string{}},
+			{"pure additions", func(feed Feed) { feed.Add("4", 4); feed.Add("0", 0) }, []string{"4", "0"}, []string{}},
+			{"pure removals", func(feed Feed) { feed.Remove(1); feed.Remove(3) }, []string{}, []string{"3", "1"}},
+			{"mixed changes", func(feed Feed) { feed.Add("5", 5); feed.Remove(2); feed.Reschedule(1, 1.5) }, []string{"5", "1"}, []string{"2", "1"}},
+			{"edits are not changes", func(feed Feed) { feed.Upsert("edited", "", 2); feed.Like(3) }, []string{}, []string{}},
+		} {
+			feed := newFeed()
+			for i := 1; i <= 3; i++ {
+				feed.Add(strconv.Itoa(i), float64(i))
+			}
+			old := feed.ShowFeed()
+			test.change(feed)
+
+			added, removed := feed.Diff(old)
+			if !reflect.DeepEqual(bodies(added), test.added) || !reflect.DeepEqual(bodies(removed), test.removed) {
+				t.Errorf("Diff after %v expected added:%v and removed:%v. Got:%v and %v", test.name, test.added, test.removed, bodies(added), bodies(removed))
+			}
+		}
+
+		//Check that an empty snapshot has every post added and posts that cannot be unmarshaled are ignored
+		feed := newFeed()
+		feed.Add("1", 1)
+		if added, removed := feed.Diff([][]byte{[]byte("not json")}); len(added) != 1 || len(removed) != 0 {
+			t.Errorf("Diff against a bad snapshot expected 1 added and 0 removed. Got:%s and %s", added, removed)
+		}
+	}
+}
+
+func TestSentinelTimestamps(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewBoundedFeed(2)} {
+		feed.Add("1", 1)
+
+		//Check that the sentinel timestamps are rejected by every method that takes a timestamp
+		for _, timestamp := range []float64{math.Inf(1), math.Inf(-1)} {
+			if id := feed.Add("", timestamp); id != 0 {
+				t.Errorf("Add(%v) expected to add nothing. Got id:%v", timestamp, id)
+			}
+			if id, evicted := feed.AddWithAuthor("", "alice", timestamp); id != 0 || evicted {
+				t.Errorf("AddWithAuthor(%v) expected to add nothing. Got id:%v", timestamp, id)
+			}
+			if id, added := feed.AddIdempotent("", "", timestamp, "key"); id != 0 || added {
+				t.Errorf("AddIdempotent(%v) expected to add nothing. Got id:%v", timestamp, id)
+			}
+			if feed.Upsert("", "", timestamp) {
+				t.Errorf("Upsert(%v) expected to add nothing", timestamp)
+			}
+			if feed.Remove(timestamp) || feed.RemoveIf(timestamp, "") || feed.RemoveIf(timestamp, "null") {
+				t.Errorf("Remove(%v) expected to remove nothing", timestamp)
+			}
+			if feed.Contains(timestamp) || feed.Like(timestamp) || feed.WaitFor(timestamp, 0) {
+				t.Errorf("Contains(%v) expected to find nothing", timestamp)
+			}
+			if _, found := feed.IndexOf(timestamp); found {
+				t.Errorf("IndexOf(%v) expected to find nothing", timestamp)
+			}
+			if feed.Reschedule(timestamp, 2) || feed.Reschedule(1, timestamp) {
+				t.Errorf("Reschedule with %v expected to move nothing", timestamp)
+			}
+		}
+
+		//Check that the feed is unchanged and still works
+		if err := feed.Validate(); err != nil {
+			t.Errorf("Expected the feed to be valid. Got:%v", err)
+		}
+		feed.Add("2", 2)
+		if bodies := showBodies(feed); !reflect.DeepEqual(bodies, []string{"2", "1"}) {
+			t.Errorf("Expected feed:[2 1]. Got:%v", bodies)
+		}
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed()} {
+
+		//Check that a post already in the feed is found without waiting
+		feed.Add("1", 1)
+		if !feed.WaitFor(1, 0) {
+			t.Errorf("Feed contains post 1 but WaitFor(1) returned false")
+		}
+
+		//Check that waiting for a post that is never added times out
+		start := time.Now()
+		if feed.WaitFor(2, 50*time.Millisecond) {
+			t.Errorf("Post 2 was never added but WaitFor(2) returned true")
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Expected WaitFor to wait for the whole timeout. Got:%v", elapsed)
+		}
+
+		//Check that a goroutine waiting for a post wakes up when another goroutine adds it,
+		//including when other posts are added first
+		done := make(chan bool)
+		go func() {
+			done <- feed.WaitFor(3, 5*time.Second)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		feed.Add("4", 4)
+		feed.Add("3", 3)
+		select {
+		case found := <-done:
+			if !found {
+				t.Errorf("Post 3 was added but WaitFor(3) returned false")
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Post 3 was added but WaitFor(3) did not return")
+		}
+	}
+}
+
+//showBodies returns the bodies of the posts in the feed in the order ShowFeed shows them
+func showBodies(feed Feed) []string {
+	bodies := []string{}
+	for _, postByte := range feed.ShowFeed() {
+		var post postBodyTimestamp
+		json.Unmarshal(postByte, &post)
+		bodies = append(bodies, post.Body)
+	}
+	return bodies
+}
+
+func TestFeedWithComparator(t *testing.T) {
+
+	//Posts are shown by score, highest first, however they were added
+	byScore := func(a *post, b *post) bool { return a.score > b.score }
+	feed := NewFeedWithComparator(byScore).(RankedFeed)
+	for _, p := range []struct {
+		body             string
+		score, timestamp float64
+	}{{"b", 20, 1}, {"d", 5, 2}, {"a", 30, 3}, {"c", 10, 4}, {"e", 1, 5}} {
+		feed.AddWithScore(p.body, "", p.score, p.timestamp)
+	}
+	if bodies := showBodies(feed); !reflect.DeepEqual(bodies, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("Expected the posts in order of score. Got:%v", bodies)
+	}
+	if err := feed.Validate(); err != nil {
+		t.Errorf("Expected a valid feed. Got:%v", err)
+	}
+
+	//A post with the same score as another is shown before it, like with TieBreakID
+	feed.AddWithScore("tie", "", 10, 6)
+	if bodies := showBodies(feed); !reflect.DeepEqual(bodies, []string{"a", "b", "tie", "c", "d", "e"}) {
+		t.Errorf("Expected the newer post with the same score first. Got:%v", bodies)
+	}
+
+	//Posts are found by timestamp wherever they are in the feed
+	for _, timestamp := range []float64{1, 2, 3, 4, 5, 6} {
+		if !feed.Contains(timestamp) {
+			t.Errorf("Expected the feed to contain timestamp:%v", timestamp)
+		}
+	}
+	if feed.Contains(7) || feed.Like(7) || feed.Remove(7) {
+		t.Errorf("Expected the feed not to contain timestamp:7")
+	}
+	if index, found := feed.IndexOf(4); !found || index != 3 {
+		t.Errorf("Expected the post with timestamp:4 at index:3. Got:%v, %v", index, found)
+	}
+	if !feed.Like(2) || feed.Stats() != (FeedStats{Count: 6, Oldest: 1, Newest: 6, TotalLikes: 1}) {
+		t.Errorf("Expected stats of the whole feed. Got:%v", feed.Stats())
+	}
+	if created := feed.Upsert("edited", "", 3); created || !feed.RemoveIf(3, "edited") || feed.RemoveIf(1, "a") {
+		t.Errorf("Expected the post with timestamp:3 to be edited and then removed")
+	}
+	if !feed.Remove(6) || feed.Contains(6) {
+		t.Errorf("Expected the post with timestamp:6 to be removed")
+	}
+
+	//Moving a post keeps its place by score
+	if !feed.Reschedule(5, 10) || feed.Reschedule(1, 10) {
+		t.Errorf("Expected only the move to a free timestamp to succeed")
+	}
+	if bodies := showBodies(feed); !reflect.DeepEqual(bodies, []string{"b", "c", "d", "e"}) {
+		t.Errorf("Expected a move not to change the order by score. Got:%v", bodies)
+	}
+	if since := feed.ShowFeedSince(3); len(since) != 2 {
+		t.Errorf("Expected the 2 posts after timestamp:3. Got:%s", since)
+	}
+
+	//Merged posts keep their score
+	other := NewFeed().(RankedFeed)
+	other.AddWithScore("f", "", 15, 7)
+	other.AddWithScore("d", "", 5, 2)
+	feed.Merge(other)
+	if bodies := showBodies(feed); !reflect.DeepEqual(bodies, []string{"b", "f", "c", "d", "e"}) {
+		t.Errorf("Expected the merged post in order of score. Got:%v", bodies)
+	}
+	if removed := feed.RemoveRange(2, 7); removed != 3 || !reflect.DeepEqual(showBodies(feed), []string{"b", "e"}) {
+		t.Errorf("Expected 3 posts to be removed by timestamp. Got:%v, %v", removed, showBodies(feed))
+	}
+	if err := feed.Validate(); err != nil {
+		t.Errorf("Expected a valid feed. Got:%v", err)
+	}
+
+	//A feed without a comparator is still ordered by timestamp
+	if bodies := showBodies(other); !reflect.DeepEqual(bodies, []string{"f", "d"}) {
+		t.Errorf("Expected the posts newest first. Got:%v", bodies)
+	}
+}
+
+func TestFeedInt64(t *testing.T) {
+
+	//The two timestamps are the same float64 but different int64s
+	const first, second = int64(1 << 53), int64(1<<53 + 1)
+	if float64(first) != float64(second) {
+		t.Fatalf("Expected the timestamps to be equal as float64")
+	}
+
+	feed := NewFeedInt64(TieBreakID)
+	if feed.ContainsInt64(first) || feed.RemoveInt64(first) || len(feed.ShowFeed()) != 0 {
+		t.Errorf("Feed is empty but has a post")
+	}
+	feed.AddInt64("first", "", first)
+	feed.AddInt64("second", "bob", second)
+	feed.AddInt64("oldest", "", math.MinInt64)
+	feed.AddInt64("newest", "", math.MaxInt64)
+
+	expected := []string{
+		`{"Body":"newest","Timestamp":9223372036854775807}`,
+		`{"Body":"second","Timestamp":9007199254740993,"Author":"bob"}`,
+		`{"Body":"first","Timestamp":9007199254740992}`,
+		`{"Body":"oldest","Timestamp":-9223372036854775808}`,
+	}
+	for i, postByte := range feed.ShowFeed() {
+		if i >= len(expected) || string(postByte) != expected[i] {
+			t.Errorf("Expected the post at position:%v to keep its exact timestamp. Got:%s", i, postByte)
+		}
+	}
+	if views := feed.ShowFeedPosts(); len(views) != 4 || !views[1].Exact || views[1].Nanos != second {
+		t.Errorf("Expected the posts to be viewed with their exact timestamps. Got:%v", views)
+	}
+
+	//The other methods of the feed work on the posts too, with float64 timestamps
+	feed.Add("small", 5)
+	if since := feed.ShowFeedSince(4); !feed.Like(5) || !feed.ContainsInt64(5) || len(since) != 4 || string(since[3]) != `{"Body":"small","Timestamp":5}` {
+		t.Errorf("Expected a post added with a float64 timestamp to get the int64 timestamp")
+	}
+	if !feed.Reschedule(5, 7) || !feed.ContainsInt64(7) || feed.ContainsInt64(5) {
+		t.Errorf("Expected a moved post to get the new int64 timestamp")
+	}
+	if err := feed.Validate(); err != nil || feed.Count() != 5 {
+		t.Errorf("Expected a valid feed of 5 posts. Got:%v %v", err, feed.Count())
+	}
+
+	//Removing one of the posts leaves the other
+	if !feed.RemoveInt64(second) || feed.ContainsInt64(second) || !feed.ContainsInt64(first) {
+		t.Errorf("Expected only the post with timestamp:%v to be removed", second)
+	}
+	if feed.RemoveInt64(second) || feed.ContainsInt64(first + 2) {
+		t.Errorf("Expected no post with timestamp:%v", second)
+	}
+
+	//A clone, and a feed the posts are merged in to, keep the exact timestamps
+	feed.AddInt64("second", "", second)
+	merged := NewFeed()
+	merged.Merge(feed)
+	for _, f := range []Feed{feed.Clone(), merged} {
+		if posts := f.ShowFeed(); len(posts) != 5 || string(posts[1]) != `{"Body":"second","Timestamp":9007199254740993}` || string(posts[2]) != `{"Body":"first","Timestamp":9007199254740992}` {
+			t.Errorf("Expected the copied posts to keep their exact timestamps. Got:%s", posts)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		feed.Add("before", 1)
+		events := feed.Subscribe()
+		other := feed.Subscribe()
+
+		//Every change made after subscribing is sent, in order, to every subscriber
+		feed.Add("first", 2)
+		feed.Like(2)
+		feed.SwapBody(2, "edited")
+		feed.Remove(1)
+		feed.Remove(4)
+		expected := []string{
+			`added {"Body":"first","Timestamp":2}`,
+			`edited {"Body":"first","Timestamp":2,"Likes":1}`,
+			`edited {"Body":"edited","Timestamp":2,"Likes":1}`,
+			`removed {"Body":"before","Timestamp":1}`,
+		}
+		for _, ch := range []<-chan FeedEvent{events, other} {
+			for i := range expected {
+				select {
+				case event := <-ch:
+					if got := event.Kind.String() + " " + string(event.Post); got != expected[i] {
+						t.Errorf("Expected event %v to be %v. Got:%v", i, expected[i], got)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Expected event %v to be %v. Got no event", i, expected[i])
+				}
+			}
+		}
+
+		//Unsubscribing closes the channel and stops the events
+		feed.Unsubscribe(events)
+		feed.Add("after", 5)
+		if _, ok := <-events; ok {
+			t.Errorf("Expected the channel to be closed once unsubscribed")
+		}
+		if event := <-other; event.Kind != PostAdded {
+			t.Errorf("Expected the other subscriber to still get events. Got:%v", event.Kind)
+		}
+		feed.Unsubscribe(other)
+		feed.Unsubscribe(other)
+	}
+}
+
+//A subscriber that does not keep up misses events instead of blocking the writers.
+func TestSubscribeSlow(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		events := feed.Subscribe()
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 2*subscriberBuffer; i++ {
+				feed.Add("post", float64(i))
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected adding posts not to wait for the subscriber")
+		}
+		if len(events) != subscriberBuffer {
+			t.Errorf("Expected the subscriber to have %v events. Got:%v", subscriberBuffer, len(events))
+		}
+		feed.Unsubscribe(events)
+	}
+}
+
+//This test is run with -race. Posts are changed from several goroutines while a subscriber reads the events, and every
+//change is sent. There are fewer changes than the subscriber can fall behind by, so no event is missed.
+func TestParallelSubscribe(t *testing.T) {
+
+	const threadCount = 8
+	const postCount = 10
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		events := feed.Subscribe()
+		kinds := make(map[EventKind]int)
+		received := make(chan struct{})
+		go func() {
+			for event := range events {
+				kinds[event.Kind]++
+			}
+			close(received)
+		}()
+
+		var wg sync.WaitGroup
+		for g := 0; g < threadCount; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < postCount; i++ {
+					ts := float64(g*postCount + i)
+					feed.Add("post", ts)
+					feed.Like(ts)
+					feed.Remove(ts)
+				}
+			}(g)
+		}
+		wg.Wait()
+		feed.Unsubscribe(events)
+		<-received
+
+		for _, kind := range []EventKind{PostAdded, PostEdited, PostRemoved} {
+			if kinds[kind] != threadCount*postCount {
+				t.Errorf("Expected %v %v events. Got:%v", threadCount*postCount, kind, kinds[kind])
+			}
+		}
+	}
+}
+
+//sameResult performs op on the locked feed and on the other feed and checks that both return the same result.
+func sameResult(t *testing.T, name string, locked Feed, other Feed, op func(feed Feed) interface{}) bool {
+	expected := op(locked)
+	got := op(other)
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("%v returned %v on the locked feed but not on the other feed. Got:%v", name, expected, got)
+		return false
+	}
+	return true
+}
+
+//results collects all the values a method returns so that they can be compared.
+func results(values ...interface{}) []interface{} {
+	return values
+}
+
+func TestLockFreeFeed(t *testing.T) {
+
+	sameAsLocked(t, NewLockFreeFeed())
+}
+
+func TestRCUFeed(t *testing.T) {
+
+	sameAsLocked(t, NewRCUFeed())
+}
+
+//sameAsLocked performs the same random operations on the feed and on a locked feed and checks that they return the same
+//results.
+func sameAsLocked(t *testing.T, other Feed) {
+
+	locked := NewFeed()
+	r := rand.New(rand.NewSource(1))
+
+	//Perform the same random operations on both feeds. A few timestamps are used so that posts often share one.
+	for i := 0; i < 3000; i++ {
+		ts := float64(r.Intn(20))
+		body := strconv.Itoa(r.Intn(3))
+		author := []string{"", "alice", "bob"}[r.Intn(3)]
+		var name string
+		var op func(feed Feed) interface{}
+		switch r.Intn(30) {
+		case 0:
+			name, op = "AddWithAuthor", func(feed Feed) interface{} { return results(feed.AddWithAuthor(body, author, ts)) }
+		case 1:
+			name, op = "Remove", func(feed Feed) interface{} { return feed.Remove(ts) }
+		case 2:
+			name, op = "RemoveIf", func(feed Feed) interface{} { return feed.RemoveIf(ts, body) }
+		case 3:
+			to := ts + float64(r.Intn(4))
+			name, op = "RemoveRange", func(feed Feed) interface{} { return feed.RemoveRange(ts, to) }
+		case 4:
+			name, op = "RemoveOldest", func(feed Feed) interface{} { return results(feed.RemoveOldest()) }
+		case 5:
+			name, op = "RemoveNewest", func(feed Feed) interface{} { return results(feed.RemoveNewest()) }
+		case 6:
+			name, op = "Contains", func(feed Feed) interface{} { return feed.Contains(ts) }
+		case 7:
+			name, op = "ShowFeedSince", func(feed Feed) interface{} { return feed.ShowFeedSince(ts) }
+		case 8:
+			id := uint64(r.Intn(i + 1))
+			name, op = "RemoveByID", func(feed Feed) interface{} { return feed.RemoveByID(id) }
+		case 9:
+			id := uint64(r.Intn(i + 1))
+			name, op = "GetByID", func(feed Feed) interface{} { return results(feed.GetByID(id)) }
+		case 10:
+			newTs := float64(r.Intn(20))
+			name, op = "Reschedule", func(feed Feed) interface{} { return feed.Reschedule(ts, newTs) }
+		case 11:
+			name, op = "Like", func(feed Feed) interface{} { return feed.Like(ts) }
+		case 12:
+			n := r.Intn(5)
+			name, op = "TopLiked", func(feed Feed) interface{} { return feed.TopLiked(n) }
+		case 13:
+			key := strconv.Itoa(r.Intn(100))
+			name, op = "AddIdempotent", func(feed Feed) interface{} { return results(feed.AddIdempotent(body, author, ts, key)) }
+		case 14:
+			name, op = "Upsert", func(feed Feed) interface{} { return feed.Upsert(body, "", ts) }
+		case 15:
+			name, op = "Stats", func(feed Feed) interface{} { return feed.Stats() }
+		case 16:
+			name, op = "CountMatching", func(feed Feed) interface{} { return feed.CountMatching(body) }
+		case 17:
+			name, op = "SearchByAuthor", func(feed Feed) interface{} { return feed.SearchByAuthor(author) }
+		case 18:
+			other := NewFeed()
+			other.AddWithAuthor(body, author, ts)
+			other.Add("merged", ts+0.5)
+			other.Like(ts + 0.5)
+			name, op = "Merge", func(feed Feed) interface{} { feed.Merge(other); return nil }
+		case 19:
+			order := Order(r.Intn(2))
+			name, op = "ForEach", func(feed Feed) interface{} {
+				var timestamps []float64
+				feed.ForEach(order, func(body string, timestamp float64) bool {
+					timestamps = append(timestamps, timestamp)
+					return len(timestamps) < 10
+				})
+				return timestamps
+			}
+		case 20:
+			n := r.Intn(10) - 1
+			name, op = "GetNthRecent", func(feed Feed) interface{} { return results(feed.GetNthRecent(n)) }
+		case 21:
+			name, op = "IndexOf", func(feed Feed) interface{} { return results(feed.IndexOf(ts)) }
+		case 22:
+			n := r.Intn(30) - 1
+			name, op = "TrimToNewest", func(feed Feed) interface{} { return feed.TrimToNewest(n) }
+		case 23:
+			epsilon := r.Float64() * 2
+			name, op = "ContainsApprox", func(feed Feed) interface{} { return feed.ContainsApprox(ts+0.5, epsilon) }
+		case 24:
+			name, op = "Count", func(feed Feed) interface{} { return feed.Count() }
+		case 25:
+			name, op = "SwapBody", func(feed Feed) interface{} { return results(feed.SwapBody(ts, body)) }
+		case 26:
+			name, op = "ContainsAll", func(feed Feed) interface{} { return feed.ContainsAll([]float64{ts + 1, ts, 3, ts + 0.5}) }
+		case 27:
+			name, op = "Compact", func(feed Feed) interface{} { return feed.Compact() }
+		case 28:
+			name, op = "Pop", func(feed Feed) interface{} { return results(feed.Pop(ts)) }
+		default:
+			name, op = "Add", func(feed Feed) interface{} { return feed.Add(body, ts) }
+		}
+		if !sameResult(t, name, locked, other, op) || !sameResult(t, "ShowFeed after "+name, locked, other, func(feed Feed) interface{} { return feed.ShowFeed() }) {
+			break
+		}
+	}
+
+	if err := other.Validate(); err != nil {
+		t.Errorf("Expected the feed to be valid. Got:%v", err)
+	}
+}
+
+//This test is run with -race. Each goroutine only uses its own timestamps, so its operations return the same results on
+//both feeds however they are interleaved with the operations of the other goroutines, even though the goroutines change
+//posts right next to each other in the feed.
+func TestParallelLockFreeFeed(t *testing.T) {
+
+	parallelSameAsLocked(t, NewLockFreeFeed())
+}
+
+func TestParallelRCUFeed(t *testing.T) {
+
+	parallelSameAsLocked(t, NewRCUFeed())
+}
+
+//parallelSameAsLocked performs random operations on the feed and on a locked feed from several goroutines and checks that
+//they return the same results, while other goroutines read the feed.
+func parallelSameAsLocked(t *testing.T, other Feed) {
+
+	const threadCount = 8
+	const stepCount = 2000
+	const timestampCount = 160
+	locked := NewFeed()
+
+	var wg sync.WaitGroup
+	for g := 0; g < threadCount; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			timestamp := func() float64 { return float64(r.Intn(timestampCount/threadCount)*threadCount + g) }
+			for i := 0; i < stepCount; i++ {
+				ts := timestamp()
+				body := strconv.Itoa(r.Intn(3))
+				var name string
+				var op func(feed Feed) interface{}
+				switch r.Intn(12) {
+				case 0:
+					name, op = "Remove", func(feed Feed) interface{} { return feed.Remove(ts) }
+				case 1:
+					name, op = "RemoveIf", func(feed Feed) interface{} { return feed.RemoveIf(ts, body) }
+				case 2:
+					name, op = "RemoveRange", func(feed Feed) interface{} { return feed.RemoveRange(ts, ts) }
+				case 3:
+					name, op = "Contains", func(feed Feed) interface{} { return feed.Contains(ts) }
+				case 4:
+					name, op = "Like", func(feed Feed) interface{} { return feed.Like(ts) }
+				case 5:
+					name, op = "Upsert", func(feed Feed) interface{} { return feed.Upsert(body, "", ts) }
+				case 6:
+					newTs := timestamp()
+					name, op = "Reschedule", func(feed Feed) interface{} { return feed.Reschedule(ts, newTs) }
+				case 7:
+					key := strconv.Itoa(g) + "-" + strconv.Itoa(r.Intn(50))
+					name, op = "AddIdempotent", func(feed Feed) interface{} {
+						_, added := feed.AddIdempotent(body, "", ts, key)
+						return added
+					}
+				default:
+					name, op = "AddWithAuthor", func(feed Feed) interface{} {
+						_, evicted := feed.AddWithAuthor(body, strconv.Itoa(g), ts)
+						return evicted
+					}
+				}
+				if !sameResult(t, name, locked, other, op) {
+					return
+				}
+			}
+		}(g)
+	}
+
+	//Read the feed while it is being changed.
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := other.Validate(); err != nil {
+					t.Errorf("Expected the feed to be valid while it is changed. Got:%v", err)
+					return
+				}
+				other.ShowFeed()
+				other.Stats()
+				other.TopLiked(3)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	sameResult(t, "ShowFeed", locked, other, func(feed Feed) interface{} { return feed.ShowFeed() })
+	sameResult(t, "Stats", locked, other, func(feed Feed) interface{} { return feed.Stats() })
+	if err := other.Validate(); err != nil {
+		t.Errorf("Expected the feed to be valid. Got:%v", err)
+	}
+}
+
+//This test is run with -race. Every change the writer makes adds or removes two posts at once, so a reader that sees a
+//consistent snapshot of the RCU feed always sees an even number of posts.
+func TestRCUFeedSnapshot(t *testing.T) {
+
+	feed := NewRCUFeed()
+	pair := NewFeed()
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if posts := feed.ShowFeed(); len(posts)%2 != 0 {
+					t.Errorf("Expected an even number of posts. Got:%v", len(posts))
+					return
+				}
+				if stats := feed.Stats(); stats.Count%2 != 0 {
+					t.Errorf("Expected an even number of posts in the stats. Got:%v", stats.Count)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 500; i++ {
+		ts := float64(i % 50)
+		pair.Upsert("first", "", ts)
+		pair.Upsert("second", "", ts+0.5)
+		feed.Merge(pair)
+		if i%3 == 0 {
+			feed.RemoveRange(ts, ts+0.5)
+		}
+		pair.RemoveRange(ts, ts+0.5)
+	}
+	close(stop)
+	readers.Wait()
+
+	if err := feed.Validate(); err != nil {
+		t.Errorf("Expected the RCU feed to be valid. Got:%v", err)
+	}
+}
+
+//Readers of the RCU feed keep the version they loaded, so a change made while ForEach runs is not seen by it.
+func TestRCUFeedForEach(t *testing.T) {
+
+	feed := NewRCUFeed()
+	feed.Add("first", 1)
+	feed.Add("second", 2)
+	seen := 0
+	feed.ForEach(OldestFirst, func(body string, timestamp float64) bool {
+		seen++
+		if seen == 1 {
+			feed.Remove(2)
+			feed.Add("third", 3)
+		}
+		return true
+	})
+	if seen != 2 {
+		t.Errorf("Expected ForEach to see the 2 posts of the feed when it started. Got:%v", seen)
+	}
+	if !feed.Contains(3) || feed.Contains(2) || feed.Count() != 2 {
+		t.Errorf("Expected the changes made during ForEach to be in the feed. Got:%v", feed.ShowFeed())
+	}
+	if err := feed.Validate(); err != nil {
+		t.Errorf("Expected the RCU feed to be valid. Got:%v", err)
+	}
+}
+
+//This test has every goroutine change the same post of the lock-free feed at once.
+func TestParallelLockFreeFeedSamePost(t *testing.T) {
+
+	const threadCount = 50
+	feed := NewLockFreeFeed()
+
+	//Count how many goroutines op returns true for
+	count := func(op func(i int) bool) int {
+		var wg sync.WaitGroup
+		var count int64
+		for i := 0; i < threadCount; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if op(i) {
+					atomic.AddInt64(&count, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		return int(count)
+	}
+
+	if created := count(func(i int) bool { return feed.Upsert(strconv.Itoa(i), "", 1) }); created != 1 {
+		t.Errorf("Expected one upsert of the same timestamp to create a post. Got:%v", created)
+	}
+	if liked := count(func(i int) bool { return feed.Like(1) }); liked != threadCount {
+		t.Errorf("Expected every like to succeed. Got:%v", liked)
+	}
+	if stats := feed.Stats(); stats.Count != 1 || stats.TotalLikes != threadCount {
+		t.Errorf("Expected 1 post with %v likes. Got:%v", threadCount, stats)
+	}
+	if added := count(func(i int) bool {
+		_, added := feed.AddIdempotent("retry", "", 2, "key")
+		return added
+	}); added != 1 {
+		t.Errorf("Expected one add with the same key to add a post. Got:%v", added)
+	}
+	if moved := count(func(i int) bool { return feed.Reschedule(2, float64(3+i)) }); moved != 1 {
+		t.Errorf("Expected the post to be moved once. Got:%v", moved)
+	}
+	if removed := count(func(i int) bool { return feed.Remove(1) }); removed != 1 {
+		t.Errorf("Expected one remove of the same post to succeed. Got:%v", removed)
+	}
+	if stats := feed.Stats(); stats.Count != 1 {
+		t.Errorf("Expected only the moved post to be left. Got:%v", feed.ShowFeed())
+	}
+	if err := feed.Validate(); err != nil {
+		t.Errorf("Expected the lock-free feed to be valid. Got:%v", err)
+	}
+}
+
+func TestFeedStore(t *testing.T) {
+
+	const threadCount = 100
+	created := int32(0)
+	store := NewFeedStore(func() Feed {
+		atomic.AddInt32(&created, 1)
+		return NewFeed()
+	}, 0)
+
+	//Many goroutines ask for the same new user at once.
+	feeds := make([]Feed, threadCount)
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			feeds[i] = store.Get(1)
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Errorf("Expected a single feed to be created for the user. Got:%v", created)
+	}
+	for i, f := range feeds {
+		if f != feeds[0] {
+			t.Errorf("Expected every goroutine to get the same feed. Got a different feed for goroutine %v", i)
+		}
+	}
+
+	//A post added through one lookup is seen through the next, and other users get their own feed.
+	store.Get(1).Add("hello", 1)
+	if !store.Get(1).Contains(1) {
+		t.Errorf("Expected the user's feed to keep its posts between lookups. Got:%v", store.Get(1).ShowFeed())
+	}
+	if store.Get(2) == store.Get(1) || store.Get(2).Contains(1) {
+		t.Errorf("Expected a new user to get a new empty feed. Got:%v", store.Get(2).ShowFeed())
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed(), NewBoundedFeed(1)} {
+		//A new feed is empty.
+		if !feed.IsEmpty() {
+			t.Errorf("Expected a new feed to be empty. Got:%v", feed.ShowFeed())
+		}
+
+		//Adding a post makes it non-empty, even once the post is evicted for a newer one.
+		feed.Add("first", 1)
+		feed.Add("second", 2)
+		if feed.IsEmpty() {
+			t.Errorf("Expected a feed with posts not to be empty")
+		}
+
+		//Removing every post makes it empty again.
+		feed.Remove(1)
+		feed.Remove(2)
+		if !feed.IsEmpty() || feed.Count() != 0 {
+			t.Errorf("Expected the feed to be empty once its posts were removed. Got:%v", feed.ShowFeed())
+		}
+	}
+}
+
+func TestShowFeedPosts(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		if posts := feed.ShowFeedPosts(); posts == nil || len(posts) != 0 {
+			t.Errorf("Expected an empty feed to show no posts. Got:%v", posts)
+		}
+		for _, i := range []int{3, 1, 5, 2, 4} {
+			feed.AddWithAuthor(strconv.Itoa(i), "author"+strconv.Itoa(i), float64(i)/10)
+		}
+		feed.Like(0.2)
+
+		//The posts are the ones ShowFeed marshals, in the same order.
+		posts := feed.ShowFeedPosts()
+		shown := feed.ShowFeed()
+		if len(posts) != len(shown) {
+			t.Fatalf("Expected the %v posts ShowFeed shows. Got:%v", len(shown), posts)
+		}
+		for i, postByte := range shown {
+			var post postBodyTimestamp
+			json.Unmarshal(postByte, &post)
+			view := posts[i]
+			if view.Body != post.Body || view.Timestamp != post.Timestamp || view.Likes != post.Likes || view.Author != post.Author {
+				t.Errorf("Expected post:%+v at position:%v. Got:%+v", post, i, view)
+			}
+		}
+	}
+}
+
+func TestShowFeedPostsNow(t *testing.T) {
+
+	snapshotFeed := NewFeed().(SnapshotFeed)
+	for i := 1; i <= 3; i++ {
+		snapshotFeed.Add(strconv.Itoa(i), float64(i))
+	}
+	snapshotFeed.SetSnapshotRefresh(10 * time.Millisecond)
+	defer snapshotFeed.SetSnapshotRefresh(0)
+
+	//Readers hold the read lock until release is closed, one more than the lock lets in without waiting.
+	saturate := func() chan bool {
+		release := make(chan bool)
+		var wg sync.WaitGroup
+		for i := 0; i <= 64; i++ {
+			wg.Add(1)
+			go func() {
+				snapshotFeed.(*feed).lock.RLock()
+				wg.Done()
+				<-release
+				snapshotFeed.(*feed).lock.RUnlock()
+			}()
+		}
+		wg.Wait()
+		return release
+	}
+	showNow := func() ([]PostView, uint64, bool, time.Duration) {
+		type result struct {
+			posts   []PostView
+			version uint64
+			cached  bool
+			age     time.Duration
+		}
+		done := make(chan result, 1)
+		go func() {
+			posts, version, cached, age := snapshotFeed.ShowFeedPostsNow()
+			done <- result{posts, version, cached, age}
+		}()
+		select {
+		case r := <-done:
+			return r.posts, r.version, r.cached, r.age
+		case <-time.After(time.Second):
+			t.Fatalf("ShowFeedPostsNow did not return while the readers were saturated")
+		}
+		return nil, 0, false, 0
+	}
+
+	//While the readers are saturated a plain read waits but ShowFeedPostsNow returns the snapshot.
+	release := saturate()
+	blocked := make(chan bool)
+	go func() {
+		snapshotFeed.ShowFeedPosts()
+		blocked <- true
+	}()
+	select {
+	case <-blocked:
+		t.Errorf("Expected ShowFeedPosts to wait while the readers are saturated")
+	case <-time.After(100 * time.Millisecond):
+	}
+	posts, version, cached, age := showNow()
+	if !cached || len(posts) != 3 || posts[0].Body != "3" || version != snapshotFeed.Version() {
+		t.Errorf("Expected the 3 posts of version:%v from the snapshot. Got:%v, %v, %v", snapshotFeed.Version(), posts, version, cached)
+	}
+	//The refresh skips a busy lock rather than wait for it, so the snapshot ages while the readers are saturated.
+	if age < 100*time.Millisecond {
+		t.Errorf("Expected the snapshot to be at least 100ms old after 100ms of saturated readers. Got:%v", age)
+	}
+	turnedOff := make(chan bool)
+	go func() {
+		snapshotFeed.SetSnapshotRefresh(10 * time.Millisecond)
+		turnedOff <- true
+	}()
+	select {
+	case <-turnedOff:
+	case <-time.After(time.Second):
+		t.Fatalf("SetSnapshotRefresh waited for a refresh stuck behind the saturated readers")
+	}
+	close(release)
+	<-blocked
+
+	//Once the lock is free again the posts are read from the feed.
+	snapshotFeed.Add("4", 4)
+	if posts, _, cached, _ := snapshotFeed.ShowFeedPostsNow(); cached || len(posts) != 4 {
+		t.Errorf("Expected the 4 posts read under the lock. Got:%v, %v", posts, cached)
+	}
+
+	//The snapshot catches up with the feed within the refresh interval.
+	time.Sleep(50 * time.Millisecond)
+	release = saturate()
+	if posts, version, cached, _ := showNow(); !cached || len(posts) != 4 || version != snapshotFeed.Version() {
+		t.Errorf("Expected the refreshed snapshot with 4 posts. Got:%v, %v, %v", posts, version, cached)
+	}
+	close(release)
+
+	//Without a snapshot ShowFeedPostsNow reads under the lock.
+	snapshotFeed.SetSnapshotRefresh(0)
+	if posts, _, cached, _ := snapshotFeed.ShowFeedPostsNow(); cached || len(posts) != 4 {
+		t.Errorf("Expected the posts read under the lock once the snapshot is off. Got:%v, %v", posts, cached)
+	}
+}
+
+func TestFeedStoreQuota(t *testing.T) {
+
+	const quota = 5
+	const threadCount = 20
+	store := NewFeedStore(NewLockFreeFeed, quota)
+
+	//Many goroutines race to add posts for user 1 while user 2 adds a few posts of their own.
+	var accepted, rejected int32
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := store.Add(1, "spam", "", float64(i)); err == ErrQuotaExceeded {
+				atomic.AddInt32(&rejected, 1)
+			} else if err == nil {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}(i)
+	}
+	for i := 0; i < quota-1; i++ {
+		if _, err := store.Add(2, "hello", "", float64(i)); err != nil {
+			t.Errorf("Expected user 2 to post while user 1 is at the quota. Got:%v", err)
+		}
+	}
+	wg.Wait()
+	if accepted != quota || rejected != threadCount-quota || store.Get(1).Count() != quota {
+		t.Errorf("Expected %v posts accepted and %v rejected for user 1. Got:%v accepted, %v rejected, %v posts", quota, threadCount-quota, accepted, rejected, store.Get(1).Count())
+	}
+
+	//User 2 can post up to their own quota, and user 1 can post again once a post is removed.
+	if _, err := store.Add(2, "hello", "", 100); err != nil || store.Get(2).Count() != quota {
+		t.Errorf("Expected user 2 to reach the quota. Got:%v with %v posts", err, store.Get(2).Count())
+	}
+	if _, err := store.Add(2, "hello", "", 101); err != ErrQuotaExceeded {
+		t.Errorf("Expected user 2 to be over the quota. Got:%v", err)
+	}
+	store.Get(1).RemoveOldest()
+	if _, err := store.Add(1, "again", "", 200); err != nil || !store.Get(1).Contains(200) {
+		t.Errorf("Expected user 1 to post again after removing a post. Got:%v", err)
+	}
+
+	//The feed of a user at the quota does not take posts added to it directly either.
+	if id := store.Get(2).Add("direct", 102); id != 0 || store.Get(2).Contains(102) {
+		t.Errorf("Expected adding to the feed of a user at the quota to do nothing. Got:id %v", id)
+	}
+	if created := store.Get(2).Upsert("edited", "", 100); created || store.Get(2).Count() != quota {
+		t.Errorf("Expected an upsert to still update a post of a user at the quota. Got:%v with %v posts", created, store.Get(2).Count())
+	}
+	if err := store.Get(2).ReplaceAll(make([]PostView, quota+1)); err != ErrQuotaExceeded {
+		t.Errorf("Expected replacing the posts with more than the quota to be rejected. Got:%v", err)
+	}
+
+	//A keyed add over the quota is rejected, but a retry of a key already used still gets its post's id.
+	keyed := NewFeedStore(NewLockFreeFeed, 1)
+	first, added, err := keyed.AddIdempotent(3, "once", "", 1, "k1")
+	if err != nil || !added || first == 0 {
+		t.Errorf("Expected the first keyed add to be added. Got:%v %v %v", first, added, err)
+	}
+	if id, added, err := keyed.AddIdempotent(3, "once", "", 1, "k1"); err != nil || added || id != first {
+		t.Errorf("Expected the retry at the quota to get post id %v. Got:%v %v %v", first, id, added, err)
+	}
+	if _, _, err := keyed.AddIdempotent(3, "twice", "", 2, "k2"); err != ErrQuotaExceeded {
+		t.Errorf("Expected a new key over the quota to be rejected. Got:%v", err)
+	}
+	if id, added := keyed.Get(3).AddIdempotent("once", "", 1, "k1"); added || id != first {
+		t.Errorf("Expected the retry through the user's feed to get post id %v. Got:%v %v", first, id, added)
+	}
+
+	//A store without a limit accepts every post.
+	unlimited := NewFeedStore(NewFeed, 0)
+	for i := 0; i < threadCount; i++ {
+		if _, err := unlimited.Add(1, "post", "", float64(i)); err != nil {
+			t.Errorf("Expected a store without a quota to accept every post. Got:%v", err)
+		}
+	}
+}
+
+func TestPop(t *testing.T) {
+
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		feed.AddWithAuthor("first", "ann", 1)
+		feed.Add("second", 2)
+		feed.Like(1)
+
+		//A present post is returned as ShowFeed shows it and removed, an absent one is not found.
+		shown := feed.ShowFeed()[1]
+		if popped, ok := feed.Pop(1); !ok || string(popped) != string(shown) || feed.Contains(1) || feed.Count() != 1 {
+			t.Errorf("Expected to pop post:%s. Got:%s %v", shown, popped, ok)
+		}
+		for _, timestamp := range []float64{1, 3, math.Inf(1), math.Inf(-1)} {
+			if popped, ok := feed.Pop(timestamp); ok || popped != nil || feed.Count() != 1 {
+				t.Errorf("Expected nothing to pop at timestamp:%v. Got:%s", timestamp, popped)
+			}
+		}
+	}
+}
+
+func TestParallelPop(t *testing.T) {
+
+	const postCount = 200
+	const threadCount = 8
+	for _, feed := range []Feed{NewFeed(), NewLockFreeFeed(), NewRCUFeed()} {
+		for i := 0; i < postCount; i++ {
+			feed.Add("original", float64(i))
+		}
+
+		//Every goroutine pops every post while another edits them. Each post is popped by exactly one goroutine,
+		//and a post edited before it was popped is popped with the edit.
+		var popped [postCount]int32
+		var edited [postCount]int32
+		var bodies [postCount]string
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < postCount; i++ {
+				if _, ok := feed.SwapBody(float64(i), "edited"); ok {
+					atomic.StoreInt32(&edited[i], 1)
+				}
+			}
+		}()
+		for i := 0; i < threadCount; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < postCount; j++ {
+					postByte, ok := feed.Pop(float64(j))
+					if !ok {
+						continue
+					}
+					atomic.AddInt32(&popped[j], 1)
+					var post postBodyTimestamp
+					json.Unmarshal(postByte, &post)
+					bodies[j] = post.Body
+					if post.Timestamp != float64(j) || (post.Body != "original" && post.Body != "edited") {
+						t.Errorf("Expected to pop the post at timestamp:%v. Got:%s", j, postByte)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		for i, count := range popped {
+			if count != 1 {
+				t.Errorf("Expected the post at timestamp:%v to be popped once. Got:%v", i, count)
+			} else if edited[i] == 1 && bodies[i] != "edited" {
+				t.Errorf("Expected the post at timestamp:%v to be popped with its edit. Got:%v", i, bodies[i])
+			}
+		}
+		if feed.Count() != 0 {
+			t.Errorf("Expected every post to be popped. Got:%v", feed.ShowFeed())
+		}
+	}
+}
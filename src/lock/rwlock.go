@@ -3,7 +3,11 @@
 package lock
 
 import (
+	"bytes"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 // RWMutex represents the functionality of a Read-Write lock.
@@ -14,11 +18,21 @@ type RWMutex interface {
 	RUnlock()
 }
 
+// TryRLocker is implemented by locks that can try to lock for reading without blocking.
+type TryRLocker interface {
+	TryRLock() bool
+}
+
+// maxReaders is the number of readers above which RLock waits for a reader to leave.
+const maxReaders = 64
+
 // rwmutex  is an internal representation of a Read-Write lock. It is not accessible
-// to outside programs.
+// to outside programs. Readers only use the atomic readCount and writer flag while no
+// writer is present, and fall back to the mutex and condition variable when one is.
 type rwmutex struct {
-	cond       	 *sync.Cond	// sync.Cond has a mutex in it
-	readCount  	 int	
+	cond       	 *sync.Cond	// sync.Cond has a mutex in it, which a writer holds until Unlock
+	readCount  	 atomic.Int32	// number of readers holding the lock
+	writer     	 atomic.Int32	// set to 1 while a writer holds or is waiting for the lock
 }
 
 // NewRWMutex initializes a new Read-Write lock with a conditional synchronization
@@ -26,8 +40,7 @@ type rwmutex struct {
 // of readers currently reading the data.
 func NewRWMutex() *rwmutex {
 	condVar := sync.NewCond(new(sync.Mutex))
-	var readCount int
-	return &rwmutex{condVar, readCount} 
+	return &rwmutex{cond: condVar}
 }
 
 // Lock locks rw for writing. If the lock is already locked for reading or writing
@@ -35,46 +48,282 @@ func NewRWMutex() *rwmutex {
 // is available (i.e. there are no more goroutines reading). 
 func (rw *rwmutex) Lock() {
 	rw.cond.L.Lock()
-	for rw.readCount != 0 {
+	rw.waitForReaders()
+}
+
+// waitForReaders sets the writer flag and waits until there are no readers. It returns
+// whether it had to wait. The caller must hold the mutex. The flag is set before readCount
+// is checked, and a reader adds itself to readCount before it checks the flag, so either
+// the writer sees the reader or the reader sees the writer and backs out. The flag is set
+// again after every wait because another writer's Unlock may have cleared it meanwhile.
+func (rw *rwmutex) waitForReaders() bool {
+	waited := false
+	for {
+		rw.writer.Store(1)
+		if rw.readCount.Load() == 0 {
+			return waited
+		}
+		waited = true
 		rw.cond.Wait()
 	}
 }
 
 // Unlock unlocks rw for writing. It is a run-time error if rw is not locked for
-// writing on entry to Unlock. It signals waiting readers and writers that it is 
-// done and they can wake up.
+// writing on entry to Unlock. It clears the writer flag so readers can take the fast
+// path again and wakes up waiting readers and writers that it is done.
 func (rw *rwmutex) Unlock() {
-	rw.cond.Signal()
+	rw.writer.Store(0)
+	rw.cond.Broadcast()
 	rw.cond.L.Unlock()
 }
 
-// RLock locks for reading. It should not be used for recursive read locking. RLock
-// first locks the mutex when it can and checks that there are not more than 64 readers
-// already. If there are, the thread must Wait until that is no longer true. Then 
-// the readCount is incremented and the mutex unlocked so that other readers can read at
-// the same time.
+// tryAddReader adds the caller to readCount unless there are more than maxReaders readers.
+func (rw *rwmutex) tryAddReader() bool {
+	for {
+		n := rw.readCount.Load()
+		if n > maxReaders {
+			return false
+		}
+		if rw.readCount.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// RLock locks for reading. It should not be used for recursive read locking. While
+// there is no writer RLock only adds itself to readCount with CAS, without the mutex.
+// It then checks the writer flag again and backs out if a writer arrived in between.
+// Otherwise, or if there are already more than 64 readers, it locks the mutex and waits
+// until there is no writer and fewer readers, then adds itself to readCount. A writer only
+// sets its flag while holding the mutex, so no writer can arrive while the mutex is held.
 func (rw *rwmutex) RLock() {
+	if rw.writer.Load() == 0 && rw.tryAddReader() {
+		if rw.writer.Load() == 0 {
+			return
+		}
+		rw.RUnlock()
+	}
+
 	rw.cond.L.Lock()
-	for rw.readCount > 64 {
+	for rw.writer.Load() != 0 || !rw.tryAddReader() {
 		rw.cond.Wait()
 	}
-	rw.readCount++
 	rw.cond.L.Unlock()
 }
 
+// TryRLock tries to lock rw for reading and reports whether it succeeded. It only takes
+// the fast path of RLock, so it fails instead of waiting when a writer holds or is waiting
+// for the lock or there are already more than 64 readers.
+func (rw *rwmutex) TryRLock() bool {
+	if rw.writer.Load() == 0 && rw.tryAddReader() {
+		if rw.writer.Load() == 0 {
+			return true
+		}
+		rw.RUnlock()
+	}
+	return false
+}
+
 // Unlock unlocks rw for reading. It is a run-time error if rw is not locked for
-// reading on entry to RUnlock. RUnlock first locks the mutex and decrements the
-// readCount. It signals if the count is now equal to 0 such that any waiting
-// writer could try to acquire the lock. It also wakes up any reader waiting on
-// the readCount to be no more than 64. It then unlocks the mutex.
+// reading on entry to RUnlock. RUnlock decrements the readCount atomically. Only if
+// a writer may be waiting for the readers to leave, or a reader may be waiting for
+// the readCount to be no more than 64, does it lock the mutex to wake them up.
 func (rw *rwmutex) RUnlock() {
+	n := rw.readCount.Add(-1)
+	if rw.writer.Load() != 0 || n == maxReaders {
+		rw.cond.L.Lock()
+		rw.cond.Broadcast() // A woken writer or reader checks again and goes back to sleep if it cannot go yet.
+		rw.cond.L.Unlock()
+	}
+}
+
+// Reset returns rw to the state NewRWMutex creates it in, with a new mutex and condition variable, so
+// that it can be reused, e.g. by a pool of feeds. It must only be called when no goroutine holds or is
+// waiting for the lock and none will use it until Reset returns: such a goroutine would still have the
+// old condition variable. Calling it on a lock that is held is a programming error, so Reset panics if
+// there are readers or a writer, as far as it can tell without the mutex.
+func (rw *rwmutex) Reset() {
+	if rw.readCount.Load() != 0 || rw.writer.Load() != 0 {
+		panic("lock: Reset of RWMutex that is held")
+	}
+	rw.readCount.Store(0)
+	rw.writer.Store(0)
+	rw.cond = sync.NewCond(new(sync.Mutex))
+}
+
+// reentrantRWMutex is an internal representation of a Read-Write lock whose read side
+// may be locked recursively by the same goroutine. The recursion depth of each reader is
+// tracked by goroutine id so only a goroutine's outermost RLock and RUnlock touch the
+// underlying lock. The write side is not reentrant.
+type reentrantRWMutex struct {
+	rw      *rwmutex
+	mutex   sync.Mutex       // guards readers
+	readers map[uint64]int   // read recursion depth keyed by goroutine id
+}
+
+// NewReentrantRWMutex initializes a new Read-Write lock that allows nested RLock and
+// RUnlock pairs on the same goroutine.
+func NewReentrantRWMutex() *reentrantRWMutex {
+	return &reentrantRWMutex{rw: NewRWMutex(), readers: make(map[uint64]int)}
+}
+
+// Lock locks rw for writing. It behaves exactly like the Lock of a rwmutex and must
+// not be called by a goroutine that holds the read lock.
+func (rw *reentrantRWMutex) Lock() {
+	rw.rw.Lock()
+}
+
+// Unlock unlocks rw for writing. It behaves exactly like the Unlock of a rwmutex.
+func (rw *reentrantRWMutex) Unlock() {
+	rw.rw.Unlock()
+}
+
+// RLock locks for reading. If the calling goroutine already holds the read lock then
+// its recursion depth is incremented and RLock returns immediately. Otherwise it waits
+// for the underlying read lock and records a depth of 1.
+func (rw *reentrantRWMutex) RLock() {
+	id := goroutineID()
+
+	rw.mutex.Lock()
+	if rw.readers[id] > 0 {
+		rw.readers[id]++
+		rw.mutex.Unlock()
+		return
+	}
+	rw.mutex.Unlock()
+
+	rw.rw.RLock()
+
+	rw.mutex.Lock()
+	rw.readers[id] = 1
+	rw.mutex.Unlock()
+}
+
+// RUnlock unlocks for reading. It decrements the calling goroutine's recursion depth
+// and only releases the underlying read lock when the depth reaches 0. It panics if the
+// calling goroutine does not hold the read lock, which catches a mismatched RUnlock.
+func (rw *reentrantRWMutex) RUnlock() {
+	id := goroutineID()
+
+	rw.mutex.Lock()
+	depth := rw.readers[id]
+	if depth == 0 {
+		rw.mutex.Unlock()
+		panic("lock: RUnlock of reentrant RWMutex not read locked by this goroutine")
+	}
+	if depth > 1 {
+		rw.readers[id]--
+		rw.mutex.Unlock()
+		return
+	}
+	delete(rw.readers, id)
+	rw.mutex.Unlock()
+
+	rw.rw.RUnlock()
+}
+
+// goroutineID returns the id of the calling goroutine. Go does not expose the id so it
+// is parsed from the first line of the goroutine's stack trace ("goroutine 18 [running]:").
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	buf = buf[:bytes.IndexByte(buf, ' ')]
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+// LockStats reports how a Read-Write lock has been used.
+type LockStats struct {
+	Acquisitions uint64 // number of times the lock was acquired for reading or writing
+	WriterWaits  uint64 // number of times a writer could not get the lock right away in Lock
+	MaxReaders   int64  // highest number of readers that held the lock at the same time
+}
+
+// instrumentedRWMutex is an internal representation of a Read-Write lock that counts
+// acquisitions and writer waits and tracks the high-water mark of readCount. The counters
+// are only ever added to, so Stats can read them atomically without taking the lock.
+// Use NewRWMutex when the statistics are not needed so the lock has no extra overhead.
+type instrumentedRWMutex struct {
+	rwmutex
+	acquisitions uint64
+	writerWaits  uint64
+	maxReaders   int64
+	writers      int32 // number of writers holding or waiting for the lock, only changed atomically
+}
+
+// NewInstrumentedRWMutex initializes a new Read-Write lock that keeps statistics on how
+// it is used. It behaves exactly like a lock from NewRWMutex.
+func NewInstrumentedRWMutex() *instrumentedRWMutex {
+	return &instrumentedRWMutex{rwmutex: rwmutex{cond: sync.NewCond(new(sync.Mutex))}}
+}
+
+// Lock locks rw for writing like the Lock of a rwmutex. It counts a writer wait if another writer
+// holds or is waiting for the lock, which it tells from the number of writers counted around Lock and
+// Unlock, or there are readers the writer has to wait for.
+func (rw *instrumentedRWMutex) Lock() {
+	waited := atomic.AddInt32(&rw.writers, 1) > 1
 	rw.cond.L.Lock()
-	rw.readCount--
-	if rw.readCount == 0 {
-		rw.cond.Signal()
+	if rw.waitForReaders() {
+		waited = true
 	}
-	if rw.readCount <= 64 { // Even if a sleeping writer is signaled with this and readCount > 0, the writer
-		rw.cond.Signal()    // will go back to sleep because it is in a for-loop checking readCount.
-	}                       
-	rw.cond.L.Unlock()
-}
\ No newline at end of file
+	if waited {
+		atomic.AddUint64(&rw.writerWaits, 1)
+	}
+	atomic.AddUint64(&rw.acquisitions, 1)
+}
+
+// Unlock unlocks rw for writing like the Unlock of a rwmutex and stops counting the writer.
+func (rw *instrumentedRWMutex) Unlock() {
+	atomic.AddInt32(&rw.writers, -1)
+	rw.rwmutex.Unlock()
+}
+
+// RLock locks for reading like the RLock of a rwmutex and raises the high-water mark of
+// readCount if there are now more readers than ever before. Readers do not take the mutex
+// while there is no writer, so the high-water mark is raised with CAS.
+func (rw *instrumentedRWMutex) RLock() {
+	rw.rwmutex.RLock()
+	rw.addReader()
+}
+
+// TryRLock tries to lock for reading like the TryRLock of a rwmutex and, if it succeeds,
+// counts the acquisition like RLock.
+func (rw *instrumentedRWMutex) TryRLock() bool {
+	if !rw.rwmutex.TryRLock() {
+		return false
+	}
+	rw.addReader()
+	return true
+}
+
+// addReader counts a read acquisition and raises the high-water mark of readCount if there
+// are now more readers than ever before.
+func (rw *instrumentedRWMutex) addReader() {
+	readers := int64(rw.readCount.Load())
+	for max := atomic.LoadInt64(&rw.maxReaders); readers > max; max = atomic.LoadInt64(&rw.maxReaders) {
+		if atomic.CompareAndSwapInt64(&rw.maxReaders, max, readers) {
+			break
+		}
+	}
+	atomic.AddUint64(&rw.acquisitions, 1)
+}
+
+// Reset returns rw to the state NewInstrumentedRWMutex creates it in like the Reset of a rwmutex,
+// including its statistics, with the same contract.
+func (rw *instrumentedRWMutex) Reset() {
+	rw.rwmutex.Reset()
+	atomic.StoreUint64(&rw.acquisitions, 0)
+	atomic.StoreUint64(&rw.writerWaits, 0)
+	atomic.StoreInt64(&rw.maxReaders, 0)
+	atomic.StoreInt32(&rw.writers, 0)
+}
+
+// Stats returns the statistics collected so far. It does not take the lock.
+func (rw *instrumentedRWMutex) Stats() LockStats {
+	return LockStats{
+		Acquisitions: atomic.LoadUint64(&rw.acquisitions),
+		WriterWaits:  atomic.LoadUint64(&rw.writerWaits),
+		MaxReaders:   atomic.LoadInt64(&rw.maxReaders),
+	}
+}
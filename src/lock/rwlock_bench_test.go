@@ -0,0 +1,103 @@
+package lock
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// condRWMutex is the read side of rwmutex before the atomic fast path was added: every
+// RLock and RUnlock takes the mutex of the condition variable. It is only kept so that the
+// benchmarks can compare the two.
+type condRWMutex struct {
+	cond      *sync.Cond
+	readCount int
+}
+
+// Lock locks rw for writing, waiting for the readers to leave.
+func (rw *condRWMutex) Lock() {
+	rw.cond.L.Lock()
+	for rw.readCount != 0 {
+		rw.cond.Wait()
+	}
+}
+
+// Unlock unlocks rw for writing.
+func (rw *condRWMutex) Unlock() {
+	rw.cond.Signal()
+	rw.cond.L.Unlock()
+}
+
+// RLock locks for reading under the mutex.
+func (rw *condRWMutex) RLock() {
+	rw.cond.L.Lock()
+	for rw.readCount > maxReaders {
+		rw.cond.Wait()
+	}
+	rw.readCount++
+	rw.cond.L.Unlock()
+}
+
+// RUnlock unlocks for reading under the mutex.
+func (rw *condRWMutex) RUnlock() {
+	rw.cond.L.Lock()
+	rw.readCount--
+	if rw.readCount == 0 {
+		rw.cond.Signal()
+	}
+	if rw.readCount <= maxReaders {
+		rw.cond.Signal()
+	}
+	rw.cond.L.Unlock()
+}
+
+// benchLocks are the lock implementations the benchmarks compare.
+var benchLocks = []struct {
+	name    string
+	newLock func() RWMutex
+}{
+	{"cond", func() RWMutex { return &condRWMutex{cond: sync.NewCond(new(sync.Mutex))} }},
+	{"fast-path", func() RWMutex { return NewRWMutex() }},
+	{"sync.RWMutex", func() RWMutex { return &sync.RWMutex{} }},
+}
+
+// runReaders runs op in parallel for every lock implementation with 1 to 64 times GOMAXPROCS goroutines.
+func runReaders(b *testing.B, op func(rw RWMutex, pb *testing.PB)) {
+	for _, impl := range benchLocks {
+		for _, parallelism := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("%v/goroutines=%v", impl.name, parallelism*runtime.GOMAXPROCS(0)), func(b *testing.B) {
+				rw := impl.newLock()
+				b.SetParallelism(parallelism)
+				b.RunParallel(func(pb *testing.PB) {
+					op(rw, pb)
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkRLock measures read-lock throughput with only readers, like a FEED-heavy workload.
+func BenchmarkRLock(b *testing.B) {
+	runReaders(b, func(rw RWMutex, pb *testing.PB) {
+		for pb.Next() {
+			rw.RLock()
+			rw.RUnlock()
+		}
+	})
+}
+
+// BenchmarkRLockWithWriter measures read-lock throughput when one operation in 100 is a write.
+func BenchmarkRLockWithWriter(b *testing.B) {
+	runReaders(b, func(rw RWMutex, pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%100 == 0 {
+				rw.Lock()
+				rw.Unlock()
+			} else {
+				rw.RLock()
+				rw.RUnlock()
+			}
+		}
+	})
+}
@@ -0,0 +1,357 @@
+package lock
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func nestedReads(rw RWMutex, depth int, wg *sync.WaitGroup) {
+	for i := 0; i < depth; i++ {
+		rw.RLock()
+	}
+	for i := 0; i < depth; i++ {
+		rw.RUnlock()
+	}
+	wg.Done()
+}
+
+func TestReentrantNestedRLock(t *testing.T) {
+
+	rw := NewReentrantRWMutex()
+
+	// Nested RLock calls on the same goroutine only take the underlying read lock once.
+	rw.RLock()
+	rw.RLock()
+	rw.RLock()
+	if rw.rw.readCount.Load() != 1 {
+		t.Errorf("Nested RLock should hold the underlying read lock once. Got readCount:%v", rw.rw.readCount.Load())
+	}
+	rw.RUnlock()
+	rw.RUnlock()
+	if rw.rw.readCount.Load() != 1 {
+		t.Errorf("Inner RUnlock should not release the underlying read lock. Got readCount:%v", rw.rw.readCount.Load())
+	}
+	rw.RUnlock()
+	if rw.rw.readCount.Load() != 0 {
+		t.Errorf("Outermost RUnlock should release the underlying read lock. Got readCount:%v", rw.rw.readCount.Load())
+	}
+
+	// A writer can get the lock once every nested reader is done.
+	done := make(chan bool)
+	go func() {
+		rw.Lock()
+		rw.Unlock()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Writer could not get the lock after all nested readers unlocked")
+	}
+}
+
+func TestReentrantParallelNestedRLock(t *testing.T) {
+
+	const threadCount = 100
+	rw := NewReentrantRWMutex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go nestedReads(rw, 5, &wg)
+	}
+	wg.Wait()
+
+	if rw.rw.readCount.Load() != 0 || len(rw.readers) != 0 {
+		t.Errorf("All readers finished but the lock is still read locked. Got readCount:%v, readers:%v",
+			rw.rw.readCount.Load(), len(rw.readers))
+	}
+}
+
+func TestReentrantMismatchedRUnlockPanics(t *testing.T) {
+
+	rw := NewReentrantRWMutex()
+	rw.RLock()
+	rw.RUnlock()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("RUnlock without a matching RLock should panic")
+		}
+	}()
+	rw.RUnlock()
+}
+
+func TestInstrumentedStats(t *testing.T) {
+
+	const threadCount = 20
+	rw := NewInstrumentedRWMutex()
+
+	// Hold the read lock with many readers, then have a writer wait on them.
+	var readers sync.WaitGroup
+	release := make(chan bool)
+	for i := 0; i < threadCount; i++ {
+		readers.Add(1)
+		go func() {
+			rw.RLock()
+			readers.Done()
+			<-release
+			rw.RUnlock()
+		}()
+	}
+	readers.Wait()
+
+	locked := make(chan bool)
+	go func() {
+		rw.Lock()
+		rw.Unlock()
+		locked <- true
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	<-locked
+
+	stats := rw.Stats()
+	if stats.Acquisitions != threadCount+1 {
+		t.Errorf("Expected %v acquisitions. Got:%v", threadCount+1, stats.Acquisitions)
+	}
+	if stats.WriterWaits == 0 {
+		t.Errorf("The writer had to wait for the readers but no writer waits were counted")
+	}
+	if stats.MaxReaders != threadCount {
+		t.Errorf("Expected a high-water mark of %v readers. Got:%v", threadCount, stats.MaxReaders)
+	}
+
+	// An uncontended writer does not count as a wait.
+	rw.Lock()
+	rw.Unlock()
+	if waits := rw.Stats().WriterWaits; waits != stats.WriterWaits {
+		t.Errorf("An uncontended Lock was counted as a writer wait. Got:%v, Expected:%v", waits, stats.WriterWaits)
+	}
+
+	// A writer waiting for another writer counts as a wait.
+	rw.Lock()
+	go func() {
+		rw.Lock()
+		rw.Unlock()
+		locked <- true
+	}()
+	time.Sleep(100 * time.Millisecond)
+	rw.Unlock()
+	<-locked
+	if waits := rw.Stats().WriterWaits; waits != stats.WriterWaits+1 {
+		t.Errorf("A writer waiting for another writer was not counted as a writer wait. Got:%v, Expected:%v", waits, stats.WriterWaits+1)
+	}
+}
+
+func TestRWMutexExclusion(t *testing.T) {
+
+	const threadCount = 50
+	const iterations = 200
+	rw := NewRWMutex()
+
+	// Writers keep the two values equal. A reader that sees them differ overlapped a writer.
+	var a, b int
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if i%10 == 0 {
+					rw.Lock()
+					a++
+					b++
+					rw.Unlock()
+				} else {
+					rw.RLock()
+					if a != b {
+						t.Errorf("A reader held the lock at the same time as a writer. Got:%v, %v", a, b)
+					}
+					rw.RUnlock()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if a != threadCount/10*iterations || rw.readCount.Load() != 0 || rw.writer.Load() != 0 {
+		t.Errorf("Expected %v writes and an unlocked lock. Got writes:%v, readCount:%v, writer:%v",
+			threadCount/10*iterations, a, rw.readCount.Load(), rw.writer.Load())
+	}
+}
+
+func TestRLockWaitsOverMaxReaders(t *testing.T) {
+
+	rw := NewRWMutex()
+	for i := 0; i <= maxReaders; i++ {
+		rw.RLock()
+	}
+
+	// One more reader than maxReaders already hold the lock, so the next reader waits.
+	locked := make(chan bool)
+	go func() {
+		rw.RLock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+		t.Errorf("Expected RLock to wait while %v readers hold the lock", maxReaders+1)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	rw.RUnlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Errorf("A reader left but the waiting reader did not get the lock")
+	}
+	if rw.readCount.Load() != maxReaders+1 {
+		t.Errorf("Expected %v readers. Got:%v", maxReaders+1, rw.readCount.Load())
+	}
+}
+
+func TestLockWaitsForFastPathReaders(t *testing.T) {
+
+	rw := NewRWMutex()
+	rw.RLock()
+
+	locked := make(chan bool)
+	go func() {
+		rw.Lock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+		t.Errorf("Expected Lock to wait for the reader")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A new reader does not take the fast path past the waiting writer.
+	read := make(chan bool)
+	go func() {
+		rw.RLock()
+		read <- true
+		rw.RUnlock()
+	}()
+	rw.RUnlock()
+	<-locked
+	select {
+	case <-read:
+		t.Errorf("A reader got the lock while the writer held it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	rw.Unlock()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The writer unlocked but the waiting reader did not get the lock")
+	}
+}
+
+func TestTryRLock(t *testing.T) {
+
+	rw := NewRWMutex()
+	for i := 0; i <= maxReaders; i++ {
+		if !rw.TryRLock() {
+			t.Fatalf("Expected TryRLock to succeed with %v readers", i)
+		}
+	}
+
+	// TryRLock fails instead of waiting while too many readers hold the lock.
+	if rw.TryRLock() {
+		t.Errorf("Expected TryRLock to fail while %v readers hold the lock", maxReaders+1)
+	}
+	if rw.readCount.Load() != maxReaders+1 {
+		t.Errorf("A failed TryRLock should not change readCount. Got:%v", rw.readCount.Load())
+	}
+	for i := 0; i <= maxReaders; i++ {
+		rw.RUnlock()
+	}
+
+	// TryRLock fails while a writer holds the lock.
+	rw.Lock()
+	if rw.TryRLock() {
+		t.Errorf("Expected TryRLock to fail while a writer holds the lock")
+	}
+	rw.Unlock()
+	if !rw.TryRLock() {
+		t.Errorf("Expected TryRLock to succeed on an unlocked lock")
+	}
+	rw.RUnlock()
+}
+
+func TestReset(t *testing.T) {
+
+	rw := NewRWMutex()
+	oldCond := rw.cond
+	rw.Lock()
+	rw.Unlock()
+	for i := 0; i <= maxReaders; i++ {
+		rw.RLock()
+	}
+	for i := 0; i <= maxReaders; i++ {
+		rw.RUnlock()
+	}
+
+	// A reset lock is unlocked with a new condition variable.
+	rw.Reset()
+	if rw.readCount.Load() != 0 || rw.writer.Load() != 0 || rw.cond == oldCond {
+		t.Errorf("Expected a clean lock after Reset. Got readCount:%v, writer:%v, new cond:%v",
+			rw.readCount.Load(), rw.writer.Load(), rw.cond != oldCond)
+	}
+
+	// The reset lock can be used again by readers and writers.
+	var wg sync.WaitGroup
+	var a int
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			rw.Lock()
+			a++
+			rw.Unlock()
+			wg.Done()
+		}()
+		go func() {
+			rw.RLock()
+			_ = a
+			rw.RUnlock()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if a != 10 || rw.readCount.Load() != 0 || rw.writer.Load() != 0 {
+		t.Errorf("Expected 10 writes and an unlocked lock. Got writes:%v, readCount:%v, writer:%v", a, rw.readCount.Load(), rw.writer.Load())
+	}
+
+	// An instrumented lock starts its statistics again.
+	instrumented := NewInstrumentedRWMutex()
+	instrumented.RLock()
+	instrumented.RUnlock()
+	instrumented.Reset()
+	if stats := instrumented.Stats(); stats != (LockStats{}) {
+		t.Errorf("Expected no statistics after Reset. Got:%+v", stats)
+	}
+}
+
+// Resetting a lock that is held is a programming error: the holder would release a lock it no
+// longer holds. Reset panics rather than leave the lock in a corrupt state.
+func TestResetHeldPanics(t *testing.T) {
+
+	for _, lock := range []struct {
+		name   string
+		locked func(rw *rwmutex)
+	}{{"read locked", (*rwmutex).RLock}, {"write locked", (*rwmutex).Lock}} {
+		rw := NewRWMutex()
+		lock.locked(rw)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Reset of a %v lock should panic", lock.name)
+				}
+			}()
+			rw.Reset()
+		}()
+	}
+}
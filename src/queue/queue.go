@@ -2,7 +2,10 @@ package queue
 
 import (
 	"encoding/json"
+	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -14,21 +17,89 @@ import (
 type Queue interface {
 	Enqueue(byteTask []byte)
 	Dequeue() []byte
+	DequeueWait(timeout time.Duration) ([]byte, bool)
+	Wait()
+	Close()
+	Len() int
+	IsEmpty() bool
+	Snapshot() [][]byte
+}
+
+// PriorityQueue interface represents a Queue where high priority tasks are always dequeued
+// before low priority tasks. Enqueue adds a low priority task.
+type PriorityQueue interface {
+	Queue
+	EnqueueHigh(byteTask []byte)
+}
+
+// Deque interface represents a Queue where tasks can also be added to the front, e.g. for urgent tasks,
+// so that they are dequeued before the tasks already in the queue.
+type Deque interface {
+	Queue
+	EnqueueFront(byteTask []byte)
 }
 
 // queue is the internal representation of the requests/tasks that need to be processed.
 // It is initialized with a sentinel task as thge head and tail.
 // This is a lock-free, unbounded queue.
 type queue struct {
-	head *task
-	tail *task
+	head    *task
+	tail    *task
+	closed  int32      // set to 1 once the queue has been closed
+	length  int64      // number of tasks in the queue
+	cond    *sync.Cond // wakes up goroutines blocked in Wait
+	backoff Backoff    // how a goroutine backs off when it has to retry a CAS
+}
+
+// Backoff says how a goroutine backs off when another goroutine keeps changing the queue under it, so that
+// under heavy contention goroutines stop bouncing the head and the tail between their caches.
+// After Spins retries a goroutine yields the processor once, then it sleeps before each further retry,
+// starting at MinSleep and doubling up to MaxSleep. If MinSleep or MaxSleep is 0 it only yields.
+// The zero Backoff never backs off, i.e. goroutines retry in a tight spin.
+type Backoff struct {
+	Spins    int           // retries at full speed before backing off, 0 to never back off
+	MinSleep time.Duration // the first sleep
+	MaxSleep time.Duration // the longest sleep
+}
+
+// DefaultBackoff is the backoff of a queue made by NewQueue.
+var DefaultBackoff = Backoff{Spins: 8, MinSleep: time.Microsecond, MaxSleep: 100 * time.Microsecond}
+
+// wait backs off before the given retry of a CAS loop, where retry 0 is the first attempt.
+func (b Backoff) wait(retry int) {
+    if b.Spins <= 0 || retry <= b.Spins {
+        return
+    }
+    if sleep := b.sleep(retry - b.Spins); sleep > 0 {
+        time.Sleep(sleep)
+    } else {
+        runtime.Gosched()
+    }
+}
+
+// sleep returns how long to sleep the nth time a goroutine backs off, counting from 1, or 0 to yield instead.
+func (b Backoff) sleep(n int) time.Duration {
+    if n <= 1 || b.MinSleep <= 0 || b.MaxSleep <= 0 {
+        return 0
+    }
+    sleep := b.MinSleep
+    for i := 2; i < n && sleep < b.MaxSleep; i++ {
+        sleep *= 2
+    }
+    if sleep > b.MaxSleep {
+        sleep = b.MaxSleep
+    }
+    return sleep
 }
 
 // task is the internal representation of a request.
 // It includes data represented by a slice of bytes and next which points to the next task.
+// A task that has been the sentinel is marked as skipped once a task is added to the front of the queue
+// ahead of it, see EnqueueFront.
 type task struct {
 	byteTask []byte
 	next	 *task
+	skip     int32 // set to 1 once the task is only a placeholder that Dequeue passes over
 }
 
 // Data is used to unmarshall the JSON data when returning the sentinel node.
@@ -44,15 +115,29 @@ type Data struct {
 // a pointer to the next task.
 // It is not publically accessible.
 func newTask(byteTask []byte, next *task) *task {
-    return &task{byteTask, next}
+    return &task{byteTask: byteTask, next: next}
+}
+
+// loadTask atomically loads a task pointer. The head, the tail and the next pointers are updated
+// with CAS by other goroutines so they are always read atomically too.
+func loadTask(p **task) *task {
+    return (*task)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(p))))
 }
 
 // NewQueue initializes a new empty queue with a sentinel value as the head and tail.
-// The sentinel value's next value is nil
+// The sentinel value's next value is nil. The queue backs off with DefaultBackoff.
 func NewQueue() *queue {
+    return NewQueueWithBackoff(DefaultBackoff)
+}
+
+// NewQueueWithBackoff initializes a new empty queue like NewQueue that backs off with backoff when
+// it has to retry a CAS, e.g. Backoff{} for a tight spin.
+func NewQueueWithBackoff(backoff Backoff) *queue {
     q := new(queue)
     q.head = new(task)
     q.tail = q.head
+    q.cond = sync.NewCond(new(sync.Mutex))
+    q.backoff = backoff
 	return q
 }
 
@@ -60,19 +145,30 @@ func NewQueue() *queue {
 // The added task points to nil.
 // The current tail points to the new task (done atomically) and the now previous tail
 // points to the new tail (done non-atomically with updating the tail's next pointer).
-// This is a lock-free implementation of enqueue.
+// This is a lock-free implementation of enqueue. A goroutine that has to retry backs off, see Backoff.
+// Enqueue panics if the queue has been closed.
+// Once the task is linked in, a goroutine blocked in Wait is woken up. The mutex is only taken to
+// signal so that a waiter cannot miss the wake up between checking the queue and going to sleep.
 func (q *queue) Enqueue(byteTask []byte) {
+    if atomic.LoadInt32(&q.closed) == 1 {
+        panic("queue: enqueue on closed queue")
+    }
+
     var expectTail, expectTailNext *task
     newTask := newTask(byteTask, nil)
 
+    // Count the task before it is linked in so that the length never goes negative
+    atomic.AddInt64(&q.length, 1)
+
     success := false
-    for !success {
+    for retry := 0; !success; retry++ {
+        q.backoff.wait(retry)
 
-        expectTail = q.tail
-        expectTailNext = expectTail.next
+        expectTail = loadTask(&q.tail)
+        expectTailNext = loadTask(&expectTail.next)
 
         // If not at the tail then try again
-        if q.tail != expectTail {
+        if loadTask(&q.tail) != expectTail {
             continue
         }
 
@@ -83,41 +179,106 @@ func (q *queue) Enqueue(byteTask []byte) {
         }
         
         // Logical enqueue
-        success = atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&q.tail.next)), unsafe.Pointer(expectTailNext), unsafe.Pointer(newTask))
+        success = atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&expectTail.next)), unsafe.Pointer(expectTailNext), unsafe.Pointer(newTask))
     }
 
     // Physical enqueue
     atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&q.tail)), unsafe.Pointer(expectTail), unsafe.Pointer(newTask))
+
+    // Wake up a waiting dequeuer
+    q.cond.L.Lock()
+    q.cond.Signal()
+    q.cond.L.Unlock()
+}
+
+// EnqueueFront adds a task to the front of the queue so that it is the next task dequeued.
+// The head is the sentinel and its next pointer may be changed by an Enqueue at the same time, so the
+// task cannot be linked in after the sentinel. Instead the task is linked in before the sentinel and a new
+// sentinel before the task, and the head is swung to the new sentinel with CAS. The old sentinel stays in
+// the queue after the task so that a task being enqueued after it is not lost. The old sentinel is marked
+// as skipped first so that Dequeue passes over it rather than returning its old task again. Marking it
+// even if the CAS fails is safe because a task that has been the sentinel has already been dequeued.
+// The tail never points before the old sentinel so it does not need to change.
+// This is a lock-free implementation of enqueue front.
+// EnqueueFront panics if the queue has been closed.
+func (q *queue) EnqueueFront(byteTask []byte) {
+    if atomic.LoadInt32(&q.closed) == 1 {
+        panic("queue: enqueue on closed queue")
+    }
+
+    // Count the task before it is linked in so that the length never goes negative
+    atomic.AddInt64(&q.length, 1)
+
+    success := false
+    for retry := 0; !success; retry++ {
+        q.backoff.wait(retry)
+        expectSentinel := loadTask(&q.head)
+        atomic.StoreInt32(&expectSentinel.skip, 1)
+        frontTask := newTask(byteTask, expectSentinel)
+        newSentinel := newTask(nil, frontTask)
+        success = atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&q.head)), unsafe.Pointer(expectSentinel), unsafe.Pointer(newSentinel))
+    }
+
+    // Wake up a waiting dequeuer
+    q.cond.L.Lock()
+    q.cond.Signal()
+    q.cond.L.Unlock()
 }
 
 // Dequeue removes a task from the head of the queue.
 // The head then points to what the removed task pointed to.
 // Dequeue returns the task that was dequeued from the head.
 // If there are no tasks to dequeue, then the sentinel value is returned to indicate this to the calling routine. 
+// If there are no tasks to dequeue and the queue has been closed, then the closed value is returned instead
+// so that the calling routine knows no more tasks will ever arrive.
 // Slight catch is that sometimes the head and tail point to the same task because the tail
 // has updated the next pointer from the previous tail in enqueue but has not updated tail to be the new tail.
 // When this happens the function "helps" the tail get to where it is supposed to be. If we did not do that
 // then the tail pointer would be deleted and mess up the program.
-// This is a lock-free implementation of dequeue.
+// This is a lock-free implementation of dequeue. A goroutine that has to retry backs off, see Backoff.
 func (q *queue) Dequeue() []byte {
+    dequeued, ok := q.dequeue()
+
+    // Signal that queue is empty when the sentinel node is reached
+    if !ok {
+        return emptyValue(atomic.LoadInt32(&q.closed) == 1)
+    }
+
+    return dequeued
+}
+
+// emptyValue returns the JSON data handed back by Dequeue when there is nothing to dequeue:
+// the closed value if the queue has been closed, otherwise the sentinel value.
+func emptyValue(closed bool) []byte {
+    if closed {
+        d, _ := json.Marshal(Data{Value: "closed"})
+        return d
+    }
+    d, _ := json.Marshal(Data{Value: "sentinel"})
+    return d
+}
+
+// dequeue does the lock-free work of Dequeue. It returns false instead of a sentinel value
+// when there are no tasks to dequeue so that other queues in this package can build on it.
+func (q *queue) dequeue() ([]byte, bool) {
     var dequeued []byte
     var expectSentinel, expectRemoved, expectTail *task
 
     success := false
-    for !success {
-        expectSentinel = q.head
-        expectRemoved = expectSentinel.next
-        expectTail = q.tail
+    for retry := 0; !success; retry++ {
+        q.backoff.wait(retry)
+        expectSentinel = loadTask(&q.head)
+        expectRemoved = loadTask(&expectSentinel.next)
+        expectTail = loadTask(&q.tail)
 
         // If not at the head then try again
-        if q.head != expectSentinel {
+        if loadTask(&q.head) != expectSentinel {
             continue 
         }
 
-        // Signal that queue is empty when the sentinel node is reached
+        // Nothing to dequeue when the sentinel node is reached
         if expectRemoved == nil {
-            d, _ := json.Marshal(Data{Value: "sentinel"})
-            return d 
+            return nil, false
         }
 
         // Help tail along if it is behind and try again
@@ -126,11 +287,243 @@ func (q *queue) Dequeue() []byte {
             continue
         }
 
+        // Pass over a skipped task by making it the sentinel and try again
+        if atomic.LoadInt32(&expectRemoved.skip) == 1 {
+            atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&q.head)), unsafe.Pointer(expectSentinel), unsafe.Pointer(expectRemoved))
+            continue
+        }
+
         // Otherwise, dequeue and return the byte task
         dequeued = expectRemoved.byteTask
         success = atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&q.head)), unsafe.Pointer(expectSentinel), unsafe.Pointer(expectRemoved)) // dequeue
     }
 
-    return dequeued
+    atomic.AddInt64(&q.length, -1)
+    return dequeued, true
+}
+
+// empty indicates if there is no task after the sentinel at the head of the queue, other than skipped tasks.
+func (q *queue) empty() bool {
+    return q.first() == nil
+}
 
-}
\ No newline at end of file
+// first returns the first task after the sentinel at the head of the queue that is not skipped, nil if there is none.
+func (q *queue) first() *task {
+    curr := loadTask(&loadTask(&q.head).next)
+    for curr != nil && atomic.LoadInt32(&curr.skip) == 1 {
+        curr = loadTask(&curr.next)
+    }
+    return curr
+}
+
+// Len returns the number of tasks in the queue. Other goroutines may enqueue and dequeue at the
+// same time so the length is only a snapshot. A task being enqueued is counted slightly before
+// it can be dequeued.
+func (q *queue) Len() int {
+    return int(atomic.LoadInt64(&q.length))
+}
+
+// IsEmpty indicates if there is no task to dequeue, without removing anything from the queue like
+// Dequeue does. The next task after the head is loaded atomically, so unlike Len a task being enqueued
+// is only seen once it can be dequeued. Other goroutines may enqueue and dequeue at the same time so
+// the result is only a snapshot.
+func (q *queue) IsEmpty() bool {
+    return q.empty()
+}
+
+// Snapshot returns a copy of the tasks in the queue from the head to the tail without removing them,
+// e.g. to see what is left in the queue when a run hangs.
+// Other goroutines may enqueue and dequeue while the queue is walked so the snapshot is only best-effort:
+// a task dequeued during the walk may still be in it and a task enqueued during the walk may be missing.
+// Every task in it was in the queue at some point during the walk and tasks are in the order they were enqueued.
+// This is a lock-free implementation of snapshot.
+func (q *queue) Snapshot() [][]byte {
+    snapshot := [][]byte{}
+    for curr := q.first(); curr != nil; curr = loadTask(&curr.next) {
+        if atomic.LoadInt32(&curr.skip) == 0 {
+            snapshot = append(snapshot, append([]byte(nil), curr.byteTask...))
+        }
+    }
+    return snapshot
+}
+
+// DequeueWait removes a task from the head of the queue, blocking the calling goroutine until there is
+// a task to dequeue or the timeout elapses. It returns false on timeout along with the sentinel value,
+// or along with the closed value if the queue has been closed and there are no tasks left.
+// A timeout of zero only tries to dequeue once and Forever waits until there is a task or the queue is closed.
+func (q *queue) DequeueWait(timeout time.Duration) ([]byte, bool) {
+    return dequeueWait(q.cond, timeout, q.dequeue, &q.closed)
+}
+
+// Forever is the timeout for DequeueWait to wait until there is a task or the queue is closed.
+const Forever time.Duration = -1
+
+// dequeueWait does the work of DequeueWait for the queues in this package. It tries dequeue without the lock
+// and only takes it when there is nothing to dequeue and the caller may wait, to wait on cond, which is
+// signalled by Enqueue and broadcast by Close. A timer broadcasts on cond when the timeout elapses so that
+// the waiting goroutine can give up.
+// Whether the queue is closed is read before trying dequeue: no task is enqueued once the queue is closed,
+// so nothing is left behind when the closed value is returned.
+func dequeueWait(cond *sync.Cond, timeout time.Duration, dequeue func() ([]byte, bool), closed *int32) ([]byte, bool) {
+    wasClosed := atomic.LoadInt32(closed) == 1
+    if dequeued, ok := dequeue(); ok || wasClosed || timeout == 0 {
+        if !ok {
+            return emptyValue(wasClosed), false
+        }
+        return dequeued, true
+    }
+
+    expired := false
+    if timeout > 0 {
+        timer := time.AfterFunc(timeout, func() {
+            cond.L.Lock()
+            expired = true
+            cond.Broadcast()
+            cond.L.Unlock()
+        })
+        defer timer.Stop()
+    }
+
+    cond.L.Lock()
+    defer cond.L.Unlock()
+    for {
+        wasClosed = atomic.LoadInt32(closed) == 1
+        if dequeued, ok := dequeue(); ok {
+            return dequeued, true
+        }
+        if wasClosed || expired {
+            return emptyValue(wasClosed), false
+        }
+        cond.Wait()
+    }
+}
+
+// Wait blocks the calling goroutine until there is a task to dequeue or the queue has been closed.
+// Wait does not remove anything from the queue so the task may already be gone by the time
+// the caller goes to dequeue it; the caller should handle the sentinel value returned by Dequeue.
+func (q *queue) Wait() {
+    q.cond.L.Lock()
+    for q.empty() && atomic.LoadInt32(&q.closed) == 0 {
+        q.cond.Wait()
+    }
+    q.cond.L.Unlock()
+}
+
+// Close marks the queue as closed and wakes up every goroutine blocked in Wait.
+// Tasks already in the queue can still be dequeued. Once they are gone, Dequeue returns the
+// closed value rather than the sentinel value. Enqueueing on a closed queue panics.
+// Closing an already closed queue does nothing.
+func (q *queue) Close() {
+    q.cond.L.Lock()
+    atomic.StoreInt32(&q.closed, 1)
+    q.cond.Broadcast()
+    q.cond.L.Unlock()
+}
+
+// priorityQueue is the internal representation of a queue with two priority levels.
+// It is made up of two lock-free queues, one for high priority tasks and one for low priority tasks.
+// Tasks within the same priority level are dequeued in the order they were enqueued.
+type priorityQueue struct {
+	high   *queue
+	low    *queue
+	closed int32      // set to 1 once the queue has been closed
+	cond   *sync.Cond // wakes up goroutines blocked in Wait
+}
+
+// NewPriorityQueue initializes a new empty priority queue made up of an empty high priority
+// queue and an empty low priority queue.
+func NewPriorityQueue() *priorityQueue {
+    pq := new(priorityQueue)
+    pq.high = NewQueue()
+    pq.low = NewQueue()
+    pq.cond = sync.NewCond(new(sync.Mutex))
+    return pq
+}
+
+// Enqueue adds a low priority task to the end of the low priority queue.
+// Enqueue panics if the queue has been closed.
+func (pq *priorityQueue) Enqueue(byteTask []byte) {
+    pq.enqueue(pq.low, byteTask)
+}
+
+// EnqueueHigh adds a high priority task to the end of the high priority queue.
+// EnqueueHigh panics if the queue has been closed.
+func (pq *priorityQueue) EnqueueHigh(byteTask []byte) {
+    pq.enqueue(pq.high, byteTask)
+}
+
+// enqueue adds a task to one of the internal queues and then wakes up a goroutine blocked in Wait.
+func (pq *priorityQueue) enqueue(q *queue, byteTask []byte) {
+    if atomic.LoadInt32(&pq.closed) == 1 {
+        panic("queue: enqueue on closed queue")
+    }
+    q.Enqueue(byteTask)
+
+    pq.cond.L.Lock()
+    pq.cond.Signal()
+    pq.cond.L.Unlock()
+}
+
+// Dequeue removes a task from the head of the high priority queue. Only if there are no high priority
+// tasks is a task removed from the head of the low priority queue.
+// If there are no tasks to dequeue, then the sentinel value is returned, or the closed value if the queue
+// has been closed.
+func (pq *priorityQueue) Dequeue() []byte {
+    if dequeued, ok := pq.dequeue(); ok {
+        return dequeued
+    }
+    return emptyValue(atomic.LoadInt32(&pq.closed) == 1)
+}
+
+// DequeueWait removes a task like Dequeue, blocking the calling goroutine until there is a task of either
+// priority to dequeue or the timeout elapses. It returns false on timeout along with the sentinel value,
+// or along with the closed value if the queue has been closed and there are no tasks left.
+func (pq *priorityQueue) DequeueWait(timeout time.Duration) ([]byte, bool) {
+    return dequeueWait(pq.cond, timeout, pq.dequeue, &pq.closed)
+}
+
+// dequeue removes a high priority task, or a low priority task if there are none, and returns false
+// when there are no tasks of either priority.
+func (pq *priorityQueue) dequeue() ([]byte, bool) {
+    if dequeued, ok := pq.high.dequeue(); ok {
+        return dequeued, true
+    }
+    return pq.low.dequeue()
+}
+
+// Wait blocks the calling goroutine until there is a task of either priority to dequeue or
+// the queue has been closed.
+func (pq *priorityQueue) Wait() {
+    pq.cond.L.Lock()
+    for pq.high.empty() && pq.low.empty() && atomic.LoadInt32(&pq.closed) == 0 {
+        pq.cond.Wait()
+    }
+    pq.cond.L.Unlock()
+}
+
+// Len returns the number of tasks of either priority in the queue.
+func (pq *priorityQueue) Len() int {
+    return pq.high.Len() + pq.low.Len()
+}
+
+// IsEmpty indicates if there is no task of either priority to dequeue, without removing anything.
+func (pq *priorityQueue) IsEmpty() bool {
+    return pq.high.empty() && pq.low.empty()
+}
+
+// Snapshot returns a copy of the tasks in the queue without removing them, high priority tasks first,
+// in the order they would be dequeued. Like the snapshot of a queue it is only best-effort.
+func (pq *priorityQueue) Snapshot() [][]byte {
+    return append(pq.high.Snapshot(), pq.low.Snapshot()...)
+}
+
+// Close marks the queue as closed and wakes up every goroutine blocked in Wait.
+// Tasks already in the queue can still be dequeued, high priority first.
+func (pq *priorityQueue) Close() {
+    pq.cond.L.Lock()
+    atomic.StoreInt32(&pq.closed, 1)
+    pq.high.Close()
+    pq.low.Close()
+    pq.cond.Broadcast()
+    pq.cond.L.Unlock()
+}
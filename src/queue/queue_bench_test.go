@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"runtime/metrics"
+	"testing"
+	"time"
+)
+
+// benchBackoffs are the backoffs the contention benchmark compares, from a tight spin to backing off
+// after a few retries.
+var benchBackoffs = []struct {
+	name    string
+	backoff Backoff
+}{
+	{"spin", Backoff{}},
+	{"yield", Backoff{Spins: 8}},
+	{"default", DefaultBackoff},
+}
+
+// BenchmarkContention has many more goroutines than processors enqueue and dequeue on one queue, so
+// that most CAS attempts fail. The CPU time spent running Go code per operation is reported alongside
+// the wall time, since a goroutine that backs off leaves its processor idle.
+func BenchmarkContention(b *testing.B) {
+	task := []byte(`{"command":"ADD","id":1,"body":"contended","timestamp":1}`)
+	for _, bench := range benchBackoffs {
+		b.Run(bench.name, func(b *testing.B) {
+			q := NewQueueWithBackoff(bench.backoff)
+			b.SetParallelism(16)
+			start := cpuTime()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					q.Enqueue(task)
+					q.Dequeue()
+				}
+			})
+			b.StopTimer()
+			if cpu := cpuTime() - start; cpu > 0 {
+				b.ReportMetric(float64(cpu.Nanoseconds())/float64(b.N), "cpu-ns/op")
+			}
+		})
+	}
+}
+
+// cpuTime returns the runtime's estimate of the CPU time spent running Go code so far, or 0 if the
+// runtime does not have one.
+func cpuTime() time.Duration {
+	sample := []metrics.Sample{{Name: "/cpu/classes/user:cpu-seconds"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return time.Duration(sample[0].Value.Float64() * float64(time.Second))
+}
@@ -0,0 +1,464 @@
+package queue
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitGoroutine(queue Queue, wg *sync.WaitGroup) {
+	queue.Wait()
+	wg.Done()
+}
+
+func dequeueValue(t *testing.T, queue Queue) Data {
+	var d Data
+	if err := json.Unmarshal(queue.Dequeue(), &d); err != nil {
+		t.Fatalf("Could not unmarshal dequeued task: %v", err)
+	}
+	return d
+}
+
+func TestCloseWakesWaiters(t *testing.T) {
+
+	const threadCount = 50
+	queue := NewQueue()
+
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go waitGoroutine(queue, &wg)
+	}
+	// Give the goroutines a chance to block in Wait before closing.
+	time.Sleep(100 * time.Millisecond)
+	queue.Close()
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Closed the queue but not all %v blocked goroutines returned from Wait", threadCount)
+	}
+}
+
+func TestCloseDrainsRemainingTasks(t *testing.T) {
+
+	queue := NewQueue()
+	queue.Enqueue([]byte(`{"command":"ADD","id":1}`))
+	queue.Close()
+
+	// The task enqueued before closing can still be dequeued.
+	if d := dequeueValue(t, queue); d.Command != "ADD" || d.Id != 1 {
+		t.Errorf("Expected the task enqueued before Close. Got:%v", d)
+	}
+	// Afterwards the closed value is returned instead of the sentinel value.
+	if d := dequeueValue(t, queue); d.Value != "closed" {
+		t.Errorf("Expected the closed value from an empty closed queue. Got:%v", d.Value)
+	}
+}
+
+func TestEnqueueAfterClosePanics(t *testing.T) {
+
+	queue := NewQueue()
+	queue.Close()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Enqueue on a closed queue should panic")
+		}
+	}()
+	queue.Enqueue([]byte(`{"command":"ADD","id":1}`))
+}
+
+func TestPriorityQueueDrainsHighFirst(t *testing.T) {
+
+	queue := NewPriorityQueue()
+
+	// Interleave a single FEED with many ADDs.
+	for i := 0; i < 100; i++ {
+		queue.Enqueue([]byte(`{"command":"ADD","id":` + strconv.Itoa(i) + `}`))
+	}
+	queue.EnqueueHigh([]byte(`{"command":"FEED","id":100}`))
+	for i := 101; i < 200; i++ {
+		queue.Enqueue([]byte(`{"command":"ADD","id":` + strconv.Itoa(i) + `}`))
+	}
+
+	// The FEED is dequeued first, then the ADDs in the order they were enqueued.
+	if d := dequeueValue(t, queue); d.Command != "FEED" || d.Id != 100 {
+		t.Errorf("Expected the FEED task to be dequeued first. Got:%v", d)
+	}
+	for i := 0; i < 200; i++ {
+		if i == 100 {
+			continue
+		}
+		if d := dequeueValue(t, queue); d.Command != "ADD" || d.Id != i {
+			t.Errorf("Expected ADD task %v. Got:%v", i, d)
+		}
+	}
+	if d := dequeueValue(t, queue); d.Value != "sentinel" {
+		t.Errorf("Expected the sentinel value from an empty queue. Got:%v", d)
+	}
+}
+
+func TestPriorityQueueCloseWakesWaiters(t *testing.T) {
+
+	const threadCount = 50
+	queue := NewPriorityQueue()
+
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go waitGoroutine(queue, &wg)
+	}
+	time.Sleep(100 * time.Millisecond)
+	queue.EnqueueHigh([]byte(`{"command":"FEED","id":1}`))
+	queue.Close()
+	wg.Wait()
+
+	if d := dequeueValue(t, queue); d.Command != "FEED" {
+		t.Errorf("Expected the FEED task enqueued before Close. Got:%v", d)
+	}
+	if d := dequeueValue(t, queue); d.Value != "closed" {
+		t.Errorf("Expected the closed value from an empty closed queue. Got:%v", d.Value)
+	}
+}
+
+func TestLen(t *testing.T) {
+
+	for _, queue := range []Queue{NewQueue(), NewPriorityQueue()} {
+		if queue.Len() != 0 {
+			t.Errorf("Expected an empty queue to have length 0. Got:%v", queue.Len())
+		}
+		for i := 1; i <= 10; i++ {
+			queue.Enqueue([]byte(`{"command":"ADD","id":` + strconv.Itoa(i) + `}`))
+			if queue.Len() != i {
+				t.Errorf("Expected length %v after %v enqueues. Got:%v", i, i, queue.Len())
+			}
+		}
+		for i := 9; i >= 0; i-- {
+			queue.Dequeue()
+			if queue.Len() != i {
+				t.Errorf("Expected length %v after a dequeue. Got:%v", i, queue.Len())
+			}
+		}
+		// Dequeuing from an empty queue leaves the length at 0.
+		queue.Dequeue()
+		if queue.Len() != 0 {
+			t.Errorf("Expected length 0 after dequeuing from an empty queue. Got:%v", queue.Len())
+		}
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+
+	for _, queue := range []Queue{NewQueue(), NewPriorityQueue()} {
+		if !queue.IsEmpty() {
+			t.Errorf("Expected a new queue to be empty")
+		}
+		queue.Enqueue([]byte(`{"command":"ADD","id":1}`))
+		if queue.IsEmpty() {
+			t.Errorf("Expected a queue with a task not to be empty")
+		}
+		// Checking does not remove the task.
+		if queue.IsEmpty() || queue.Len() != 1 {
+			t.Errorf("Expected IsEmpty to leave the task in the queue. Got:%v tasks", queue.Len())
+		}
+		if pq, ok := queue.(PriorityQueue); ok {
+			pq.EnqueueHigh([]byte(`{"command":"FEED","id":2}`))
+			queue.Dequeue()
+			if queue.IsEmpty() {
+				t.Errorf("Expected a queue with a low priority task left not to be empty")
+			}
+		}
+		queue.Dequeue()
+		if !queue.IsEmpty() {
+			t.Errorf("Expected the queue to be empty once its tasks are dequeued")
+		}
+		queue.Close()
+		if !queue.IsEmpty() {
+			t.Errorf("Expected a closed queue with no tasks to be empty")
+		}
+	}
+
+	// A task added to the front of the queue, and the skipped task it leaves behind once it is dequeued.
+	queue := NewQueue()
+	queue.EnqueueFront([]byte(`{"command":"ADD","id":1}`))
+	if queue.IsEmpty() {
+		t.Errorf("Expected a queue with a task added to the front not to be empty")
+	}
+	queue.Dequeue()
+	if !queue.IsEmpty() {
+		t.Errorf("Expected the queue to be empty once the task added to the front is dequeued")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+
+	for _, queue := range []Queue{NewQueue(), NewPriorityQueue()} {
+		if snapshot := queue.Snapshot(); len(snapshot) != 0 {
+			t.Errorf("Expected an empty snapshot of an empty queue. Got:%s", snapshot)
+		}
+		for i := 0; i < 5; i++ {
+			queue.Enqueue([]byte(`{"command":"ADD","id":` + strconv.Itoa(i) + `}`))
+		}
+		if pq, ok := queue.(PriorityQueue); ok {
+			pq.EnqueueHigh([]byte(`{"command":"FEED","id":5}`))
+		}
+		queue.Dequeue()
+
+		// The snapshot has the tasks still pending, in the order they would be dequeued, and leaves them in the queue.
+		expected := []string{`{"command":"ADD","id":1}`, `{"command":"ADD","id":2}`, `{"command":"ADD","id":3}`, `{"command":"ADD","id":4}`}
+		if _, ok := queue.(PriorityQueue); ok {
+			expected = []string{`{"command":"ADD","id":0}`, `{"command":"ADD","id":1}`, `{"command":"ADD","id":2}`, `{"command":"ADD","id":3}`, `{"command":"ADD","id":4}`}
+		}
+		snapshot := queue.Snapshot()
+		if len(snapshot) != len(expected) {
+			t.Fatalf("Expected %v pending tasks in the snapshot. Got:%s", len(expected), snapshot)
+		}
+		for i, task := range snapshot {
+			if string(task) != expected[i] {
+				t.Errorf("Expected task %v in the snapshot. Got:%s", expected[i], task)
+			}
+		}
+		if queue.Len() != len(expected) {
+			t.Errorf("Expected the snapshot to leave %v tasks in the queue. Got:%v", len(expected), queue.Len())
+		}
+
+		// The snapshot is a copy so changing it does not change the queue.
+		snapshot[0][0] = 'x'
+		if d := dequeueValue(t, queue); d.Command != "ADD" {
+			t.Errorf("Expected changing the snapshot to leave the queue unchanged. Got:%v", d)
+		}
+	}
+}
+
+func TestEnqueueFront(t *testing.T) {
+
+	queue := NewQueue()
+	enqueue := func(front bool, id int) {
+		task := []byte(`{"command":"ADD","id":` + strconv.Itoa(id) + `}`)
+		if front {
+			queue.EnqueueFront(task)
+		} else {
+			queue.Enqueue(task)
+		}
+	}
+	expectIds := func(ids ...int) {
+		t.Helper()
+		for _, id := range ids {
+			if d := dequeueValue(t, queue); d.Command != "ADD" || d.Id != id {
+				t.Errorf("Expected task %v to be dequeued. Got:%v", id, d)
+			}
+		}
+	}
+
+	// A task added to the front of an empty queue, then tasks added to the back after it.
+	enqueue(true, 1)
+	enqueue(false, 2)
+	enqueue(false, 3)
+	enqueue(true, 0)
+	if queue.Len() != 4 {
+		t.Errorf("Expected length 4. Got:%v", queue.Len())
+	}
+	expectIds(0, 1)
+
+	// Interleave front and back enqueues with dequeues.
+	enqueue(true, 10)
+	enqueue(false, 4)
+	enqueue(true, 11)
+	expectIds(11, 10, 2)
+	enqueue(true, 12)
+	expectIds(12, 3, 4)
+
+	// The skipped tasks left behind do not count as tasks.
+	if d := dequeueValue(t, queue); d.Value != "sentinel" {
+		t.Errorf("Expected the sentinel value from an empty queue. Got:%v", d)
+	}
+	if queue.Len() != 0 || len(queue.Snapshot()) != 0 || !queue.empty() {
+		t.Errorf("Expected the queue to be empty. Got:%v tasks", queue.Len())
+	}
+
+	// Tasks added to the back of the queue after the front are still found.
+	enqueue(true, 20)
+	enqueue(false, 21)
+	if snapshot := queue.Snapshot(); len(snapshot) != 2 {
+		t.Errorf("Expected 2 tasks in the snapshot. Got:%s", snapshot)
+	}
+	expectIds(20, 21)
+}
+
+func TestParallelEnqueueFront(t *testing.T) {
+
+	const threadCount = 8
+	const tasksPerThread = 1000
+	queue := NewQueue()
+
+	// Half of the goroutines add to the front and half to the back while all of them also dequeue.
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[int]bool)
+	total := 0
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var dequeued []int
+			for j := 0; j < tasksPerThread; j++ {
+				task := []byte(`{"command":"ADD","id":` + strconv.Itoa(i*tasksPerThread+j) + `}`)
+				if i%2 == 0 {
+					queue.EnqueueFront(task)
+				} else {
+					queue.Enqueue(task)
+				}
+				var d Data
+				json.Unmarshal(queue.Dequeue(), &d)
+				if d.Value == "" {
+					dequeued = append(dequeued, d.Id)
+				}
+			}
+			mutex.Lock()
+			for _, id := range dequeued {
+				seen[id] = true
+			}
+			total += len(dequeued)
+			mutex.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	// Every task is dequeued exactly once.
+	for {
+		d := dequeueValue(t, queue)
+		if d.Value == "sentinel" {
+			break
+		}
+		if seen[d.Id] {
+			t.Fatalf("Task %v was dequeued twice", d.Id)
+		}
+		seen[d.Id] = true
+		total++
+	}
+	if len(seen) != threadCount*tasksPerThread || total != len(seen) || queue.Len() != 0 {
+		t.Errorf("Expected all %v tasks to be dequeued. Got:%v", threadCount*tasksPerThread, len(seen))
+	}
+}
+
+func TestDequeueWait(t *testing.T) {
+
+	for _, queue := range []Queue{NewQueue(), NewPriorityQueue()} {
+		// A task that is already queued is returned right away.
+		queue.Enqueue([]byte(`{"command":"ADD","id":1}`))
+		byteTask, ok := queue.DequeueWait(time.Second)
+		var d Data
+		if err := json.Unmarshal(byteTask, &d); !ok || err != nil || d.Id != 1 {
+			t.Errorf("Expected the queued ADD task 1. Got:%v %v", d, ok)
+		}
+
+		// A task enqueued while waiting wakes the waiting goroutine.
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			queue.Enqueue([]byte(`{"command":"ADD","id":2}`))
+		}()
+		byteTask, ok = queue.DequeueWait(5 * time.Second)
+		d = Data{}
+		if err := json.Unmarshal(byteTask, &d); !ok || err != nil || d.Id != 2 {
+			t.Errorf("Expected the ADD task 2 enqueued while waiting. Got:%v %v", d, ok)
+		}
+
+		// Nothing arrives before the timeout so the sentinel value is returned.
+		start := time.Now()
+		byteTask, ok = queue.DequeueWait(50 * time.Millisecond)
+		d = Data{}
+		json.Unmarshal(byteTask, &d)
+		if ok || d.Value != "sentinel" {
+			t.Errorf("Expected the sentinel value after the timeout. Got:%v %v", d, ok)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Expected DequeueWait to wait for the timeout. Got:%v", elapsed)
+		}
+
+		// A timeout of zero does not wait.
+		byteTask, ok = queue.DequeueWait(0)
+		d = Data{}
+		json.Unmarshal(byteTask, &d)
+		if ok || d.Value != "sentinel" {
+			t.Errorf("Expected the sentinel value from an empty queue. Got:%v %v", d, ok)
+		}
+
+		// Closing the queue wakes the goroutine waiting forever.
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			queue.Close()
+		}()
+		byteTask, ok = queue.DequeueWait(Forever)
+		d = Data{}
+		json.Unmarshal(byteTask, &d)
+		if ok || d.Value != "closed" {
+			t.Errorf("Expected the closed value from a closed queue. Got:%v %v", d, ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+
+	// The sleeps double from MinSleep up to MaxSleep, after yielding once.
+	backoff := Backoff{Spins: 2, MinSleep: time.Microsecond, MaxSleep: 4 * time.Microsecond}
+	expected := []time.Duration{0, time.Microsecond, 2 * time.Microsecond, 4 * time.Microsecond, 4 * time.Microsecond}
+	for i, sleep := range expected {
+		if got := backoff.sleep(i + 1); got != sleep {
+			t.Errorf("Expected backing off for the %vth time to sleep %v. Got:%v", i+1, sleep, got)
+		}
+	}
+	if got := (Backoff{Spins: 2, MinSleep: time.Microsecond}).sleep(5); got != 0 {
+		t.Errorf("Expected a backoff without a MaxSleep to only yield. Got:%v", got)
+	}
+
+	// Every task is dequeued exactly once whether goroutines spin or back off right away.
+	const threadCount = 8
+	const tasksPerThread = 1000
+	for _, backoff := range []Backoff{{}, {Spins: 1, MinSleep: time.Microsecond, MaxSleep: 10 * time.Microsecond}} {
+		queue := NewQueueWithBackoff(backoff)
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		seen := make(map[int]bool)
+		for i := 0; i < threadCount; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var dequeued []int
+				for j := 0; j < tasksPerThread; j++ {
+					queue.Enqueue([]byte(`{"command":"ADD","id":` + strconv.Itoa(i*tasksPerThread+j) + `}`))
+					var d Data
+					json.Unmarshal(queue.Dequeue(), &d)
+					if d.Value == "" {
+						dequeued = append(dequeued, d.Id)
+					}
+				}
+				mutex.Lock()
+				for _, id := range dequeued {
+					if seen[id] {
+						t.Errorf("Task %v was dequeued twice with backoff %+v", id, backoff)
+					}
+					seen[id] = true
+				}
+				mutex.Unlock()
+			}(i)
+		}
+		wg.Wait()
+		for d := dequeueValue(t, queue); d.Value != "sentinel"; d = dequeueValue(t, queue) {
+			if seen[d.Id] {
+				t.Errorf("Task %v was dequeued twice with backoff %+v", d.Id, backoff)
+			}
+			seen[d.Id] = true
+		}
+		if len(seen) != threadCount*tasksPerThread || queue.Len() != 0 {
+			t.Errorf("Expected all %v tasks to be dequeued with backoff %+v. Got:%v", threadCount*tasksPerThread, backoff, len(seen))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// AuditLog records every task that changes the feed along with its result.
+type AuditLog interface {
+	Record(task ClientMessage, response []byte) error
+	Close() error
+}
+
+// mutatingCommands are the commands whose tasks can change the feed, which are the tasks audited.
+var mutatingCommands = map[string]bool{
+	"ADD":         true,
+	"REMOVE":      true,
+	"MOVE":        true,
+	"LIKE":        true,
+	"UPSERT":      true,
+	"SWAP":        true,
+	"REMOVEIF":    true,
+	"REMOVERANGE": true,
+	"POPOLDEST":   true,
+	"POPNEWEST":   true,
+	"POP":         true,
+	"TRIM":        true,
+	"COMPACT":     true,
+	"REPLACE":     true,
+}
+
+// auditEntry is one line of the audit log. It is the task followed by the response to the task,
+// so a line of the audit log is also a valid line of input and the log can be replayed by
+// giving it to the program as input to reconstruct the feed.
+type auditEntry struct {
+	ClientMessage
+	Result json.RawMessage `json:"result"`
+}
+
+// fileAuditLog is an AuditLog that appends to a file. Each task is written with a single call
+// to Write so the log is complete up to the last task recorded even if the program crashes.
+type fileAuditLog struct {
+	mutex sync.Mutex // orders the writes of tasks recorded by different goroutines
+	file  *os.File
+}
+
+// NewFileAuditLog opens the file at path to append tasks to, creating it if it does not exist.
+func NewFileAuditLog(path string) (AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditLog{file: file}, nil
+}
+
+// Record appends the task and its response to the file as one line of JSON.
+// Tasks are written in the order they finish, which with several goroutines is not
+// always the order they were read in.
+func (l *fileAuditLog) Record(task ClientMessage, response []byte) error {
+	task.Conn, task.Line = 0, 0 // Where a task came from does not matter for replaying it.
+	entry, err := json.Marshal(auditEntry{ClientMessage: task, Result: response})
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.file.Write(append(entry, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (l *fileAuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
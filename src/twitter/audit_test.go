@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"src/feed"
+	"testing"
+)
+
+// This test performs tasks with an audit log, reads back the log and replays it into a fresh feed
+// to check that the replayed feed is the same as the original one.
+func TestAuditLogReplay(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatalf("Could not open the audit log: %v", err)
+	}
+	cfg := newConfig()
+	cfg.audit = log
+
+	tasks := []string{
+		`{"command":"ADD","id":0,"body":"first","timestamp":1}`,
+		`{"command":"ADD","id":1,"body":"second","timestamp":2}`,
+		`{"command":"ADD","id":2,"body":"third","timestamp":3}`,
+		`{"command":"FEED","id":3}`,
+		`{"command":"MOVE","id":4,"timestamp":3,"newTimestamp":4}`,
+		`{"command":"LIKE","id":5,"timestamp":2}`,
+		`{"command":"REMOVE","id":6,"timestamp":1}`,
+		`{"command":"REMOVE","id":7,"timestamp":1}`,
+		`{"command":"CONTAINS","id":8,"timestamp":2}`,
+		`{"command":"UPSERT","id":9,"body":"edited","timestamp":2}`,
+		`{"command":"SWAP","id":10,"body":"swapped","timestamp":4}`,
+	}
+	original := feed.NewFeed()
+	for _, task := range tasks {
+		if _, err := handleLine(original, []byte(task), cfg); err != nil {
+			t.Errorf("Could not perform task %v: %v", task, err)
+		}
+	}
+	log.Close()
+
+	// Read back the log. Only the tasks that can change the feed are recorded, each with its result.
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not read the audit log: %v", err)
+	}
+	defer file.Close()
+	var lines [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	expectedIds := []int{0, 1, 2, 4, 5, 6, 7, 9, 10}
+	if len(lines) != len(expectedIds) {
+		t.Fatalf("Expected %v tasks in the audit log. Got:%v", len(expectedIds), len(lines))
+	}
+	for i, line := range lines {
+		var entry struct {
+			Id     int `json:"id"`
+			Result struct {
+				Success bool `json:"success"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Id != expectedIds[i] {
+			t.Errorf("Expected task %v in the audit log. Got:%s", expectedIds[i], line)
+		}
+		if expected := entry.Id != 7; entry.Result.Success != expected {
+			t.Errorf("Expected the result of task %v to be %v. Got:%s", entry.Id, expected, line)
+		}
+	}
+
+	// Replay the log into a fresh feed.
+	replayed := feed.NewFeed()
+	for _, line := range lines {
+		if _, err := handleLine(replayed, line, newConfig()); err != nil {
+			t.Errorf("Could not replay %s: %v", line, err)
+		}
+	}
+	if !reflect.DeepEqual(original.ShowFeed(), replayed.ShowFeed()) || original.Stats() != replayed.Stats() {
+		t.Errorf("Expected the replayed feed to be the same as the original feed")
+	}
+}
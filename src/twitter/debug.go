@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"src/queue"
+	"syscall"
+)
+
+// notifySnapshot writes the tasks pending in the queue to w each time the program receives SIGUSR1,
+// e.g. from kill -USR1 <pid>, to see what is left in the queue when a run hangs. The stop function
+// stops listening for SIGUSR1.
+func notifySnapshot(w io.Writer, q queue.Queue) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			printSnapshot(w, q)
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"src/queue"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// This test sends the program SIGUSR1 and checks that the tasks pending in the queue are written out.
+func TestSnapshotSignal(t *testing.T) {
+
+	q := queue.NewQueue()
+	q.Enqueue([]byte(`{"command":"ADD","id":0,"body":"first","timestamp":1}`))
+	q.Enqueue([]byte(`{"command":"FEED","id":1}`))
+
+	r, w := io.Pipe()
+	notifySnapshot(w, q)
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Could not send SIGUSR1: %v", err)
+	}
+
+	lines := make(chan []string)
+	go func() {
+		var read []string
+		scanner := bufio.NewScanner(r)
+		for len(read) < 3 && scanner.Scan() {
+			read = append(read, scanner.Text())
+		}
+		lines <- read
+	}()
+	expected := []string{"pending tasks: 2", `{"command":"ADD","id":0,"body":"first","timestamp":1}`, `{"command":"FEED","id":1}`}
+	select {
+	case read := <-lines:
+		for i := range expected {
+			if i >= len(read) || read[i] != expected[i] {
+				t.Errorf("Expected the snapshot line %q. Got:%q", expected[i], read)
+				break
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Sent SIGUSR1 but no snapshot was written")
+	}
+}
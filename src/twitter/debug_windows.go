@@ -0,0 +1,11 @@
+package main
+
+import (
+	"io"
+	"src/queue"
+)
+
+// notifySnapshot does nothing on Windows, which has no SIGUSR1.
+func notifySnapshot(w io.Writer, q queue.Queue) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// flushWriter buffers the responses written to Stdout so that they are not each a system call.
+// The buffer is flushed periodically so responses still show up for interactive use, and it is
+// flushed for the last time by Close.
+// A flushWriter is shared by all consumers so the buffer is guarded by a mutex. Each response is
+// written with a single call to Write so responses are never interleaved.
+type flushWriter struct {
+	mutex  sync.Mutex
+	out    io.Writer     // the writer the buffer is flushed to
+	buffer *bufio.Writer // responses not yet flushed, nil once closed
+	stop   chan struct{} // stops the periodic flush, nil if there is none
+}
+
+// newFlushWriter creates a writer that buffers writes to out and flushes them every interval. An
+// interval of 0 or less flushes after every write, so nothing is held in the buffer.
+func newFlushWriter(out io.Writer, interval time.Duration) *flushWriter {
+	fw := &flushWriter{out: out, buffer: bufio.NewWriter(out)}
+	if interval > 0 {
+		fw.stop = make(chan struct{})
+		ticker := time.NewTicker(interval)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					fw.Flush()
+				case <-fw.stop:
+					return
+				}
+			}
+		}()
+	}
+	return fw
+}
+
+// Write adds p to the buffer. Once the writer is closed p is written straight through instead.
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.buffer == nil {
+		return fw.out.Write(p)
+	}
+	n, err := fw.buffer.Write(p)
+	if err == nil && fw.stop == nil {
+		err = fw.buffer.Flush()
+	}
+	return n, err
+}
+
+// Flush writes everything in the buffer to the underlying writer.
+func (fw *flushWriter) Flush() error {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.buffer == nil {
+		return nil
+	}
+	return fw.buffer.Flush()
+}
+
+// Close stops the periodic flush and flushes the buffer for the last time. Only the first call
+// flushes, so the final flush happens exactly once however many times the program tries to close,
+// e.g. on DONE and on SIGINT at the same time.
+func (fw *flushWriter) Close() error {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.buffer == nil {
+		return nil
+	}
+	if fw.stop != nil {
+		close(fw.stop)
+	}
+	err := fw.buffer.Flush()
+	fw.buffer = nil
+	return err
+}
+
+// notifyInterrupt returns a channel that is closed when the program receives SIGINT, e.g. from Ctrl-C,
+// so that run can stop, flush the responses still in the buffer and close its inputs and audit log
+// itself. Only the first SIGINT is caught: a second one ends the program right away. The stop function
+// stops catching SIGINT and must be called once run returns, so a run does not leave anything behind.
+func notifyInterrupt() (interrupted <-chan struct{}, stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	caught := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			close(caught)
+		case <-done:
+		}
+	}()
+	return caught, func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"src/feed"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingWriter records each write made to it. It is safe to use from several goroutines.
+type recordingWriter struct {
+	mutex  sync.Mutex
+	writes []string
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+// output returns everything written so far and the number of writes it took.
+func (w *recordingWriter) output() (string, int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return strings.Join(w.writes, ""), len(w.writes)
+}
+
+// This test has a consumer perform tasks with its responses buffered and checks that nothing is written
+// until the buffer is flushed, that a flush writes every response at once and that the final flush on Close
+// happens exactly once.
+func TestFlushWriter(t *testing.T) {
+
+	out := &recordingWriter{}
+	stdout := newFlushWriter(out, time.Hour)
+
+	f := feed.NewFeed()
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, out: stdout}
+	q.Enqueue([]byte(`{"command":"ADD","id":0,"body":"first","timestamp":1}`))
+	q.Enqueue([]byte(`{"command":"CONTAINS","id":1,"timestamp":1}`))
+	q.Close()
+	wg.Add(1)
+	consumer(0, 2, f, q, &ctx)
+
+	if output, writes := out.output(); writes != 0 {
+		t.Errorf("Expected the responses to be buffered until a flush. Got:%q", output)
+	}
+	stdout.Flush()
+	expected := "{\n  \"success\": true,\n  \"id\": 0,\n  \"postId\": 1\n}\n{\n  \"success\": true,\n  \"id\": 1\n}\n"
+	if output, writes := out.output(); output != expected || writes != 1 {
+		t.Errorf("Expected the flush to write both responses at once. Got %v writes:%q", writes, output)
+	}
+
+	// Close flushes what is left once, however many times it is called, and later writes go straight through.
+	stdout.Write([]byte("last\n"))
+	stdout.Close()
+	stdout.Close()
+	if output, writes := out.output(); output != expected+"last\n" || writes != 2 {
+		t.Errorf("Expected Close to flush the last response once. Got %v writes:%q", writes, output)
+	}
+	stdout.Write([]byte("after\n"))
+	if output, _ := out.output(); !strings.HasSuffix(output, "last\nafter\n") {
+		t.Errorf("Expected a write after Close to be written right away. Got:%q", output)
+	}
+}
+
+// This test writes to buffered output that is flushed periodically and checks that the output appears
+// without an explicit flush, and that with no interval every write appears right away.
+func TestPeriodicFlush(t *testing.T) {
+
+	out := &recordingWriter{}
+	stdout := newFlushWriter(out, 10*time.Millisecond)
+	defer stdout.Close()
+	stdout.Write([]byte("response\n"))
+	deadline := time.Now().Add(5 * time.Second)
+	for output, _ := out.output(); output != "response\n"; output, _ = out.output() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the response to be flushed within 5s. Got:%q", output)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var unbuffered bytes.Buffer
+	stdout = newFlushWriter(&unbuffered, 0)
+	stdout.Write([]byte("response\n"))
+	if unbuffered.String() != "response\n" {
+		t.Errorf("Expected the response to be written right away with no interval. Got:%q", unbuffered.String())
+	}
+}
+
+// This test interrupts a sequential run that is waiting for its next task and checks that it returns the
+// exit code for SIGINT, having written the response to the task before, rather than exiting the program.
+func TestInterruptSequential(t *testing.T) {
+
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Could not find the test process: %v", err)
+	}
+	input, tasks := io.Pipe()
+	defer tasks.Close()
+	out := &recordingWriter{}
+	code := make(chan int, 1)
+	go func() {
+		code <- run([]string{"-flushInterval", "0"}, input, out)
+	}()
+	tasks.Write([]byte(`{"command":"ADD","id":1,"body":"first","timestamp":1}` + "\n"))
+	deadline := time.Now().Add(5 * time.Second)
+	for output, _ := out.output(); !strings.Contains(output, `"id": 1`); output, _ = out.output() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the response to the ADD task within 5s. Got:%q", output)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := self.Signal(os.Interrupt); err != nil {
+		t.Skipf("Could not send SIGINT: %v", err)
+	}
+	select {
+	case c := <-code:
+		if c != exitInterrupted {
+			t.Errorf("Expected exit code %v. Got:%v", exitInterrupted, c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the run to return once interrupted")
+	}
+}
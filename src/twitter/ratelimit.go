@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errRateLimited is reported instead of the response of a task that changes the feed when the
+// rate limit has been reached.
+var errRateLimited = errors.New("rate limited")
+
+// rateLimiter is a token bucket. The bucket holds up to burst tokens and is refilled at rate tokens
+// per second. Each task allowed takes a token, so bursts of up to burst tasks are allowed while over
+// a longer time tasks are allowed at rate per second.
+// A rateLimiter is shared by all consumers so the bucket is guarded by a mutex.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64          // tokens added to the bucket per second
+	burst  float64          // the most tokens the bucket holds
+	tokens float64          // tokens in the bucket as of last
+	last   time.Time        // when the bucket was last refilled
+	now    func() time.Time // the clock, replaced in tests
+}
+
+// newRateLimiter creates a rate limiter allowing perSec tasks per second, with bursts of up to perSec
+// tasks. The bucket starts full.
+func newRateLimiter(perSec int) *rateLimiter {
+	return newRateLimiterWithClock(perSec, time.Now)
+}
+
+// newRateLimiterWithClock creates a rate limiter like newRateLimiter that reads the time from now.
+func newRateLimiterWithClock(perSec int, now func() time.Time) *rateLimiter {
+	return &rateLimiter{rate: float64(perSec), burst: float64(perSec), tokens: float64(perSec), last: now(), now: now}
+}
+
+// allow takes a token from the bucket and returns true, or returns false without waiting if the
+// bucket is empty.
+func (l *rateLimiter) allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Refill the bucket for the time since it was last refilled.
+	now := l.now()
+	if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens += elapsed * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"src/feed"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This test checks that a rate limiter allows a burst, refills over time and never holds more than a burst.
+func TestRateLimiter(t *testing.T) {
+
+	clock := time.Unix(0, 0)
+	limiter := newRateLimiterWithClock(10, func() time.Time { return clock })
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if limiter.allow() {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("Expected a burst of 10 tasks to be allowed. Got:%v", allowed)
+	}
+
+	// Half a second refills 5 tokens.
+	clock = clock.Add(500 * time.Millisecond)
+	allowed = 0
+	for i := 0; i < 20; i++ {
+		if limiter.allow() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected 5 tasks to be allowed after half a second. Got:%v", allowed)
+	}
+
+	// A long pause does not let more than a burst through.
+	clock = clock.Add(time.Hour)
+	allowed = 0
+	for i := 0; i < 20; i++ {
+		if limiter.allow() {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("Expected the bucket to hold at most 10 tokens. Got:%v", allowed)
+	}
+}
+
+// This test takes tokens from one rate limiter in many goroutines and checks that exactly a burst is allowed.
+func TestRateLimiterConcurrent(t *testing.T) {
+
+	clock := time.Unix(0, 0)
+	limiter := newRateLimiterWithClock(100, func() time.Time { return clock })
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	allowed := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if limiter.allow() {
+					mutex.Lock()
+					allowed++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 100 {
+		t.Errorf("Expected 100 tasks to be allowed across goroutines. Got:%v", allowed)
+	}
+}
+
+// This test floods the feed with ADD tasks under a rate limit and checks that some are rejected with an
+// error while CONTAINS and FEED tasks are still performed.
+func TestRateLimitedDispatch(t *testing.T) {
+
+	cfg := newConfig()
+	cfg.limiter = newRateLimiter(10)
+
+	f := feed.NewFeed()
+	added, limited := 0, 0
+	for i := 0; i < 100; i++ {
+		var response struct {
+			Success *bool  `json:"success"`
+			Error   string `json:"error"`
+		}
+		json.Unmarshal(configResponse(f, ClientMessage{Command: "ADD", Id: i, Body: "spam", Timestamp: float64(i)}, cfg), &response)
+		if response.Error == errRateLimited.Error() {
+			limited++
+		} else if response.Success != nil && *response.Success {
+			added++
+		}
+	}
+	if added == 0 || limited == 0 || added+limited != 100 {
+		t.Errorf("Expected some ADD tasks to be added and the rest rate limited. Got:%v added and %v limited", added, limited)
+	}
+
+	for i := 0; i < 100; i++ {
+		var response ServerSuccessMessage
+		json.Unmarshal(configResponse(f, ClientMessage{Command: "CONTAINS", Id: i, Timestamp: 0}, cfg), &response)
+		if response.Success == nil || !*response.Success {
+			t.Fatalf("Expected CONTAINS tasks not to be rate limited. Got:%+v", response)
+		}
+	}
+	var feedResponse ServerFeedMessage
+	json.Unmarshal(configResponse(f, ClientMessage{Command: "FEED", Id: 100}, cfg), &feedResponse)
+	if len(feedResponse.Feed) != added {
+		t.Errorf("Expected the feed to have the %v posts added. Got:%v", added, len(feedResponse.Feed))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"src/feed"
+	"sync"
+)
+
+// subscription streams the changes to a feed to a client that sent SUBSCRIBE.
+type subscription struct {
+	events <-chan feed.FeedEvent
+	done   chan struct{} // closed once every event received has been written
+}
+
+// subscriptions keeps track of the SUBSCRIBE streams of a feed so they can be stopped, e.g. when a TCP
+// client disconnects or once every task has been processed.
+type subscriptions struct {
+	feed   feed.Feed
+	mutex  sync.Mutex
+	active map[*subscription]struct{}
+}
+
+// newSubscriptions creates an empty set of streams of the changes to f.
+func newSubscriptions(f feed.Feed) *subscriptions {
+	return &subscriptions{feed: f, active: make(map[*subscription]struct{})}
+}
+
+// start subscribes to the feed, confirms the subscription to w with a success response for the task
+// with the given id and then writes each change to the feed to w as a ServerEventMessage with the same
+// id until the subscription is stopped. Changes are sent as they happen, so they may be written before
+// the responses to the tasks that made them. Changes made while w cannot keep up are missed.
+func (ss *subscriptions) start(w io.Writer, id int) *subscription {
+	s := &subscription{events: ss.feed.Subscribe(), done: make(chan struct{})}
+	ss.mutex.Lock()
+	ss.active[s] = struct{}{}
+	ss.mutex.Unlock()
+
+	success := true
+	printResponse(w, ServerSuccessMessage{Success: &success, Id: id})
+	go func() {
+		defer close(s.done)
+		for event := range s.events {
+			printResponse(w, ServerEventMessage{Id: id, Event: event.Kind.String(), Post: postData([][]byte{event.Post})[0]})
+		}
+	}()
+	return s
+}
+
+// stop unsubscribes from the feed and waits until the events already received have been written.
+// Stopping a subscription more than once does nothing.
+func (ss *subscriptions) stop(s *subscription) {
+	ss.mutex.Lock()
+	delete(ss.active, s)
+	ss.mutex.Unlock()
+	ss.feed.Unsubscribe(s.events)
+	<-s.done
+}
+
+// stopAll stops every subscription.
+func (ss *subscriptions) stopAll() {
+	ss.mutex.Lock()
+	active := make([]*subscription, 0, len(ss.active))
+	for s := range ss.active {
+		active = append(active, s)
+	}
+	ss.mutex.Unlock()
+	for _, s := range active {
+		ss.stop(s)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"src/feed"
+	"strings"
+	"testing"
+)
+
+// _TestEventResponse is a response to a SUBSCRIBE task, either its confirmation or one of its events.
+type _TestEventResponse struct {
+	Id      int64
+	Success bool
+	Event   string
+	Post    _TestPostData
+}
+
+// decodeEvents decodes every response in output.
+func decodeEvents(t *testing.T, output string) []_TestEventResponse {
+	var responses []_TestEventResponse
+	decoder := json.NewDecoder(strings.NewReader(output))
+	for decoder.More() {
+		var response _TestEventResponse
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatalf("Could not decode the responses %v: %v", output, err)
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+// This test subscribes to a feed, changes it and checks that the subscription is confirmed and then streams every
+// change until it is stopped.
+func TestSubscriptions(t *testing.T) {
+
+	f := feed.NewFeed()
+	ss := newSubscriptions(f)
+	out := &recordingWriter{}
+	s := ss.start(out, 7)
+	f.Add("post", 1)
+	f.Like(1)
+	f.Remove(1)
+	ss.stop(s)
+	f.Add("after", 2)
+	ss.stop(s)
+
+	output, _ := out.output()
+	responses := decodeEvents(t, output)
+	expected := []_TestEventResponse{
+		{Id: 7, Success: true},
+		{Id: 7, Event: "added", Post: _TestPostData{"post", 1}},
+		{Id: 7, Event: "edited", Post: _TestPostData{"post", 1}},
+		{Id: 7, Event: "removed", Post: _TestPostData{"post", 1}},
+	}
+	if len(responses) != len(expected) {
+		t.Fatalf("Expected %v responses. Got:%v", len(expected), output)
+	}
+	for i := range expected {
+		if responses[i] != expected[i] {
+			t.Errorf("Expected response %v to be %v. Got:%v", i, expected[i], responses[i])
+		}
+	}
+
+	// Every subscription is stopped at once.
+	ss.start(out, 8)
+	ss.start(out, 9)
+	ss.stopAll()
+	f.Add("stopped", 3)
+	if output, _ := out.output(); strings.Contains(output, "stopped") {
+		t.Errorf("Expected no events once every subscription is stopped. Got:%v", output)
+	}
+}
+
+// This test subscribes from Stdin and checks that the changes made by the tasks read after SUBSCRIBE are streamed
+// before the program exits.
+func TestSubscribe(t *testing.T) {
+
+	input := `{"command": "SUBSCRIBE", "id": 1}
+{"command": "ADD", "id": 2, "body": "post", "timestamp": 10}
+{"command": "REMOVE", "id": 3, "timestamp": 10}
+{"command": "DONE"}
+`
+	events := map[string]_TestEventResponse{}
+	for _, response := range decodeEvents(t, runTwitterOutput(t, input, "2", "1")) {
+		if response.Event != "" {
+			events[response.Event] = response
+		}
+	}
+	for _, event := range []string{"added", "removed"} {
+		if response := events[event]; response.Id != 1 || response.Post != (_TestPostData{"post", 10}) {
+			t.Errorf("Expected a %v event for the post. Got:%v", event, response)
+		}
+	}
+}
+
+// This test subscribes from a TCP client and checks that it is streamed the changes to the feed until it is done.
+func TestTCPSubscribe(t *testing.T) {
+
+	addr, stop := startTCPServer(t, 2)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect to the server: %v", err)
+	}
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	encoder.Encode(_TestFeedRequest{"SUBSCRIBE", 1})
+	encoder.Encode(_TestAddRequest{"ADD", 2, 10, "post"})
+	encoder.Encode(_TestDoneRequest{"DONE"})
+
+	var added bool
+	decoder := json.NewDecoder(conn)
+	for {
+		var response _TestEventResponse
+		if err := decoder.Decode(&response); err != nil {
+			break
+		}
+		if response.Event == "added" && response.Id == 1 && response.Post == (_TestPostData{"post", 10}) {
+			added = true
+		}
+	}
+	if !added {
+		t.Errorf("Expected the TCP client to be sent an added event for the post")
+	}
+}
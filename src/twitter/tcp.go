@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"src/lock"
+	"src/queue"
+	"sync"
+	"sync/atomic"
+)
+
+// client is a TCP connection that tasks are read from and responses are written back to.
+type client struct {
+	conn    net.Conn
+	pending sync.WaitGroup // tasks from this client that have been enqueued but not yet processed
+}
+
+// clients keeps track of the connected TCP clients by id so a consumer can find the client
+// a task came from. Ids start at 1 since 0 means the task came from Stdin.
+type clients struct {
+	lock   lock.RWMutex
+	byId   map[int]*client
+	lastId int
+}
+
+// newClients initializes an empty set of TCP clients.
+func newClients() *clients {
+	return &clients{lock: lock.NewRWMutex(), byId: make(map[int]*client)}
+}
+
+// add gives a new connection an id and keeps track of it until it is removed.
+func (cs *clients) add(conn net.Conn) (int, *client) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.lastId++
+	c := &client{conn: conn}
+	cs.byId[cs.lastId] = c
+	return cs.lastId, c
+}
+
+// remove stops keeping track of the client with the given id.
+func (cs *clients) remove(id int) {
+	cs.lock.Lock()
+	delete(cs.byId, id)
+	cs.lock.Unlock()
+}
+
+// get returns the client with the given id, or nil if there is no such client.
+// It is safe to call on a nil set of clients, which happens when tasks only come from Stdin.
+func (cs *clients) get(id int) *client {
+	if cs == nil || id == 0 {
+		return nil
+	}
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	return cs.byId[id]
+}
+
+// serveTCP accepts TCP clients on listener and starts a goroutine to read each client's tasks
+// into the queue. serveTCP returns once the listener is closed and every client has disconnected,
+// so the caller can then close the queue without a client enqueuing on it. Once group is stopped
+// the clients stop at their next task.
+func serveTCP(listener net.Listener, queue queue.Queue, ctx *SharedContext, maxLine int, group *producerGroup) {
+	var wg sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			handleClient(conn, queue, ctx, maxLine, group)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// queueClientTasks adds the tasks read from a line sent by client to the queue for handleClient: the tasks
+// of a batch as one entry, so one consumer performs them in order, otherwise the one task. It returns false
+// without queueing anything if group has been stopped. Once the tasks are queued it pauses while the queue
+// is over the high mark.
+func queueClientTasks(queue queue.Queue, ctx *SharedContext, client *client, queued []pendingTask, batch bool, group *producerGroup) bool {
+	if len(queued) == 0 {
+		return true
+	}
+	group.mutex.Lock()
+	if group.isClosed() {
+		group.mutex.Unlock()
+		return false
+	}
+	client.pending.Add(len(queued))
+	atomic.AddInt64(ctx.numOfTasks, int64(len(queued)))
+	atomic.AddInt64(&ctx.queued, int64(len(queued)))
+	enqueuePending(queue, queued, batch)
+	group.mutex.Unlock()
+	ctx.waitForSpace(queue)
+	return true
+}
+
+// handleClient reads newline-delimited tasks from a TCP client and adds them to the queue tagged
+// with the client's id so the consumers write the responses back to the client. The responses to a
+// line with a batch of tasks are written back in the order of the tasks.
+// A client that sends SUBSCRIBE is streamed the changes to the feed until it is done. A client that sends
+// BARRIER is answered once every task it sent before has been processed, and nothing more is read from it
+// until then.
+// A client is done when it sends the DONE task or disconnects. Either way the client is only
+// closed and forgotten once every task it sent has been processed. Once group is stopped nothing more
+// is read from the client. If the client disconnected mid-stream, writing those responses fails and they are dropped without affecting other clients.
+func handleClient(conn net.Conn, queue queue.Queue, ctx *SharedContext, maxLine int, group *producerGroup) {
+	id, client := ctx.clients.add(conn)
+	w := ctx.cfg.writer(conn) // The responses written back to the client have the settings of the run.
+	var subscribed []*subscription
+
+	scanner := newScanner(conn, maxLine)
+	done := false
+	for lineNumber := 1; !done && scanner.Scan(); lineNumber++ {
+		elements, batch, err := splitTasks(scanner.Bytes())
+		var tasks []ClientMessage
+		if err == nil {
+			tasks, err = decodeElements(elements, batch, ctx.cfg.int64Timestamps)
+		}
+		if err != nil {
+			lineErrorTask(w, err, lineNumber)
+			continue
+		}
+		var queued []pendingTask
+		for i, cm := range tasks {
+			if cm.Command == "DONE" {
+				done = true
+				break
+			}
+			if cm.Command == "STATUS" {
+				printResponse(w, ServerStatusMessage{Id: cm.Id, PoolStatus: ctx.Status()})
+				continue
+			}
+			if cm.Command == "SUBSCRIBE" && ctx.subscriptions != nil {
+				subscribed = append(subscribed, ctx.subscriptions.start(w, cm.Id))
+				continue
+			}
+			if cm.Command == "BARRIER" { // Wait for the client's earlier tasks, including those earlier in the batch.
+				if !queueClientTasks(queue, ctx, client, queued, batch, group) {
+					done = true
+					break
+				}
+				queued = nil
+				client.pending.Wait()
+				barrierTask(w, cm)
+				continue
+			}
+			cm.Conn, cm.Line = id, lineNumber
+			queued = append(queued, pendingTask{cm: cm, raw: withField(withField(elements[i], "conn", id), "line", lineNumber)})
+		}
+		if !queueClientTasks(queue, ctx, client, queued, batch, group) {
+			break
+		}
+	}
+
+	client.pending.Wait()
+	for _, s := range subscribed {
+		ctx.subscriptions.stop(s)
+	}
+	ctx.clients.remove(id)
+	conn.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"src/feed"
+	"sync"
+	"testing"
+)
+
+// startTCPServer serves TCP clients on a random local port with a shared feed and queue. It returns the
+// address clients connect to and a function that stops the server and waits for the consumers to exit.
+func startTCPServer(t *testing.T, threads int) (string, func()) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen on a local port: %v", err)
+	}
+	f := feed.NewFeed()
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, clients: newClients(), subscriptions: newSubscriptions(f)}
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go consumer(int64(i), 2, f, q, &ctx)
+	}
+
+	served := make(chan bool)
+	go func() {
+		group := newProducerGroup(1)
+		serveTCP(listener, q, &ctx, 1024*1024, group)
+		group.stop(q, &ctx)
+		served <- true
+	}()
+	return listener.Addr().String(), func() {
+		listener.Close()
+		<-served
+		wg.Wait()
+	}
+}
+
+// sendAdds connects to the server, sends an ADD for every id in [from, to) and a DONE, and returns the ids of
+// the responses read back before the server closed the connection.
+func sendAdds(t *testing.T, addr string, from int, to int) map[int64]bool {
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Errorf("Could not connect to the server: %v", err)
+		return nil
+	}
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	for i := from; i < to; i++ {
+		encoder.Encode(_TestAddRequest{"ADD", int64(i), float64(i), "post"})
+	}
+	encoder.Encode(_TestDoneRequest{"DONE"})
+
+	ids := make(map[int64]bool)
+	decoder := json.NewDecoder(conn)
+	for {
+		var response _TestNormalResponse
+		if err := decoder.Decode(&response); err != nil {
+			break
+		}
+		if !response.Success {
+			t.Errorf("ADD %v was not successful", response.Id)
+		}
+		ids[response.Id] = true
+	}
+	return ids
+}
+
+// This test connects several clients at once and checks that each client gets back the responses to its own
+// requests and only those.
+func TestTCPMultipleClients(t *testing.T) {
+
+	addr, stop := startTCPServer(t, 4)
+	defer stop()
+
+	const clientCount = 5
+	const perClient = 100
+	results := make([]map[int64]bool, clientCount)
+	var wg sync.WaitGroup
+	for i := 0; i < clientCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			results[i] = sendAdds(t, addr, i*perClient, (i+1)*perClient)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, ids := range results {
+		if len(ids) != perClient {
+			t.Errorf("Client %v expected %v responses. Got:%v", i, perClient, len(ids))
+		}
+		for id := range ids {
+			if id < int64(i*perClient) || id >= int64((i+1)*perClient) {
+				t.Errorf("Client %v got the response to another client's request:%v", i, id)
+			}
+		}
+	}
+}
+
+// This test disconnects a client mid-stream and checks that the server keeps serving other clients with the
+// same feed.
+func TestTCPClientDisconnect(t *testing.T) {
+
+	addr, stop := startTCPServer(t, 2)
+	defer stop()
+
+	// Send some ADD requests and hang up without reading the responses or sending DONE.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect to the server: %v", err)
+	}
+	encoder := json.NewEncoder(conn)
+	for i := 0; i < 50; i++ {
+		encoder.Encode(_TestAddRequest{"ADD", int64(i), float64(i), "post"})
+	}
+	conn.Close()
+
+	// Another client is still served and sees the same feed.
+	if ids := sendAdds(t, addr, 50, 60); len(ids) != 10 {
+		t.Errorf("Expected 10 responses after another client disconnected. Got:%v", len(ids))
+	}
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect to the server: %v", err)
+	}
+	defer conn.Close()
+	encoder = json.NewEncoder(conn)
+	encoder.Encode(_TestFeedRequest{"FEED", 60})
+	encoder.Encode(_TestDoneRequest{"DONE"})
+	var response _TestFeedResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil || response.Id != 60 || len(response.Feed) < 10 {
+		t.Errorf("Expected a FEED response with at least the 10 posts of the second client. Got:%v", response)
+	}
+}
@@ -3,26 +3,357 @@ package main
 import (
 	"os"
 	"fmt"
+	"flag"
 	"strconv"
+	"strings"
+	"math"
 	"sync"
 	"sync/atomic"
 	"src/queue"
 	"src/feed"
 	"encoding/json"
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+	"unicode/utf8"
 )
 
-func printUsage() {
-	fmt.Println("Usage: twitter <number of goroutines> <block size>\n<number of goroutines> = the number of goroutines to be part of the queue\n<block size> = the maximum number of tasks a goroutine can process at any given point in time)")
+func printUsage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "Usage: twitter [flags] <number of goroutines> <block size>\n<number of goroutines> = the number of goroutines to be part of the queue\n<block size> = the maximum number of tasks a goroutine can process at any given point in time)")
+	flags.PrintDefaults()
+}
+
+// maxBlockSize is the largest number of tasks a goroutine can be told to grab at a time. A larger
+// block size is capped to it.
+const maxBlockSize = 1 << 16
+
+// parseArgs parses the number of goroutines and the block size from the command line arguments.
+// An error is returned if either is not a positive integer. A block size over maxBlockSize is capped.
+func parseArgs(args []string) (threads int64, block int64, err error) {
+	if len(args) != 2 {
+		return 0, 0, fmt.Errorf("expected 2 arguments. Got:%v", len(args))
+	}
+	threads, err = strconv.ParseInt(args[0], 10, 64)
+	if err != nil || threads <= 0 {
+		return 0, 0, fmt.Errorf("the number of goroutines must be a positive integer. Got:%q", args[0])
+	}
+	block, err = strconv.ParseInt(args[1], 10, 64)
+	if err != nil || block <= 0 {
+		return 0, 0, fmt.Errorf("the block size must be a positive integer. Got:%q", args[1])
+	}
+	if block > maxBlockSize {
+		block = maxBlockSize
+	}
+	return threads, block, nil
+}
+
+// inputFiles are the files tasks are read from, given by repeating the -input flag.
+type inputFiles []string
+
+// String returns the files joined by commas.
+func (files *inputFiles) String() string {
+	return strings.Join(*files, ",")
+}
+
+// Set adds another file to read tasks from.
+func (files *inputFiles) Set(path string) error {
+	*files = append(*files, path)
+	return nil
+}
+
+// openInputs opens the files tasks are read from, or returns stdin if there are none. If a file cannot
+// be opened the files already opened are closed and the error is returned.
+func openInputs(files inputFiles, stdin io.Reader) ([]io.Reader, func(), error) {
+	if len(files) == 0 {
+		return []io.Reader{stdin}, func() {}, nil
+	}
+	var opened []*os.File
+	closeAll := func() {
+		for _, file := range opened {
+			file.Close()
+		}
+	}
+	readers := make([]io.Reader, 0, len(files))
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		opened = append(opened, file)
+		readers = append(readers, file)
+	}
+	return readers, closeAll, nil
+}
+
+// config is the settings of a run, which run builds from its flags, and the state that goes with them. It
+// is passed to dispatch and, through the SharedContext, to the goroutines that read and perform tasks, so
+// each run starts from a fresh config.
+type config struct {
+	compact         bool            // print responses as single-line JSON instead of indented JSON
+	traceWorkers    bool            // include the id of the consumer that performed a task in its response and log each task
+	strict          bool            // stop at the first task that cannot be decoded or fails checkTask instead of going on
+	maxBodyLen      int             // the most characters (runes, not bytes) the body of a post can have, 0 for no limit
+	precision       int             // the decimal places of a second timestamps are rounded to, negative to use them as they are
+	int64Timestamps bool            // tasks are decoded with exact int64 timestamps, see decodeTasks
+	limiter         *rateLimiter    // limits the rate of tasks that change the feed, nil for no limit
+	store           *feed.FeedStore // the feed of each user, whose ADD tasks are checked against a quota, nil for a single feed
+	audit           AuditLog        // the log the tasks that change the feed are recorded to, nil if they are not audited
+	queue           queue.Queue     // the queue tasks wait in for the consumers, which a SelfTest task checks, nil if tasks are performed sequentially
+	counts          commandCounts   // the number of tasks dispatch has processed for each command
+	errors          int64           // the number of error messages written by errorTask and lineErrorTask, only accessed atomically
+}
+
+// newConfig creates the config of a run with every flag at its default.
+func newConfig() *config {
+	return &config{precision: -1}
+}
+
+// responseWriter is a writer that responses are printed to with the settings of a run: printResponse
+// prints them as single-line JSON if the run is compact, and errorTask and lineErrorTask count the errors
+// they write in the run's tally. Responses printed to any other writer are indented and not counted.
+type responseWriter struct {
+	io.Writer
+	cfg *config
+}
+
+// writer returns w wrapped so the responses printed to it use the settings of cfg.
+func (cfg *config) writer(w io.Writer) io.Writer {
+	if rw, ok := w.(responseWriter); ok && rw.cfg == cfg {
+		return w
+	}
+	return responseWriter{Writer: w, cfg: cfg}
+}
+
+// errBodyTooLong is reported instead of the response of a task whose body is longer than the run's maximum.
+var errBodyTooLong = errors.New("body too long")
+
+// bodyCommands are the commands whose body becomes the body of a post, so it is limited by cfg.maxBodyLen.
+var bodyCommands = map[string]bool{"ADD": true, "UPSERT": true, "SWAP": true}
+
+// bodyTooLong reports whether the task would put a body longer than cfg.maxBodyLen in the feed.
+func (cfg *config) bodyTooLong(cm ClientMessage) bool {
+	return cfg.tooLong(cm.Body) && bodyCommands[cm.Command]
+}
+
+// controlCommands are the commands handled before dispatch, e.g. by the producers, instead of being performed
+// on the feed.
+var controlCommands = map[string]bool{"DONE": true, "STATUS": true, "SUBSCRIBE": true, "BARRIER": true}
+
+// checkTask returns the error dispatch reports for a task before performing it: an unknown command, or
+// errBodyTooLong for a body longer than cfg.maxBodyLen. A task handled before dispatch passes. Strict mode
+// checks every task of a line with it before any of them is performed.
+func (cfg *config) checkTask(cm ClientMessage) error {
+	if controlCommands[cm.Command] {
+		return nil
+	}
+	if lookupHandler(cm.Command) == nil {
+		if _, err := parseCommand(cm.Command); err != nil {
+			return err
+		}
+	}
+	if cfg.bodyTooLong(cm) {
+		return errBodyTooLong
+	}
+	return nil
+}
+
+// tooLong reports whether body is longer than cfg.maxBodyLen.
+func (cfg *config) tooLong(body string) bool {
+	return cfg.maxBodyLen > 0 && utf8.RuneCountInString(body) > cfg.maxBodyLen
+}
+
+// normalize rounds timestamp to cfg.precision decimal places, so that timestamps that differ only by
+// how a client computed or printed them, e.g. 0.1+0.2 and 0.3, are the same timestamp in the feed. A
+// timestamp too big to have that many decimal places in a float64, including an infinite one, is returned
+// as it is. With a negative precision, the default, timestamps are returned exactly as they are read.
+func (cfg *config) normalize(timestamp float64) float64 {
+	if cfg.precision < 0 {
+		return timestamp
+	}
+	scale := math.Pow10(cfg.precision)
+	scaled := timestamp * scale
+	if math.Abs(scaled) >= 1<<53 || math.IsNaN(scaled) {
+		return timestamp
+	}
+	return math.Round(scaled) / scale
+}
+
+// normalizeTask returns the task with each of its timestamps normalized.
+func (cfg *config) normalizeTask(cm ClientMessage) ClientMessage {
+	cm.Timestamp = cfg.normalize(cm.Timestamp)
+	cm.NewTimestamp = cfg.normalize(cm.NewTimestamp)
+	if cm.Since != nil {
+		since := cfg.normalize(*cm.Since)
+		cm.Since = &since
+	}
+	if cm.Cursor != nil {
+		cursor := cfg.normalize(*cm.Cursor)
+		cm.Cursor = &cursor
+	}
+	cm.From = cfg.normalize(cm.From)
+	cm.To = cfg.normalize(cm.To)
+	return cm
 }
 
 // SharedContext houses variables shared by all goroutines.
 type SharedContext struct {
-	mutex            *sync.Mutex
-	cond             *sync.Cond
 	wg               *sync.WaitGroup
 	numOfTasks       *int64 		// current number of tasks in the queue
-	doneBool         *bool   	    // a boolean value to indicate if the DONE task has been read by the producer    
+	processed        *int64 		// total number of tasks processed by all goroutines
+	queued           int64  		// total number of tasks ever queued, so a BARRIER knows which tasks to wait for
+	barrierMutex     sync.Mutex 	// guards barrier
+	barrier          *sync.Cond 	// wakes up producers waiting in waitForProcessed, nil until a producer first waits
+	clients          *clients 		// TCP clients that tasks came from, nil if tasks only come from Stdin
+	workers          int64  		// number of goroutines still consuming tasks
+	busy             int64  		// number of goroutines currently processing a block of tasks
+	done             int32  		// set to 1 once the DONE task has been read by the producer
+	aborted          int32  		// set to 1 once a bad task has stopped the run in strict mode
+	stopped          int32  		// set to 1 once the program has been interrupted, so consumers stop performing tasks
+	skippedMutex     sync.Mutex 	// guards skipped
+	skipped          []ClientMessage // tasks dequeued by consumers but not performed because the program was interrupted
+	highMark         int    		// producers pause once more than this many tasks are queued, 0 for no limit
+	lowMark          int    		// paused producers resume once this many or fewer tasks are queued
+	space            *sync.Cond 	// wakes up producers paused by the high mark, nil if there is no limit
+	taskTimeout      time.Duration 	// how long a consumer waits for a task before reporting a timeout, 0 for no limit
+	idleTimeout      time.Duration 	// the producers close the queue once no task has been read for this long, 0 to wait forever
+	sequencer        *sequencer 	// writes Stdin responses in the order their tasks were read, nil to write them as tasks finish
+	out              io.Writer 	// where responses to tasks from Stdin are written, os.Stdout if nil
+	subscriptions    *subscriptions // the SUBSCRIBE streams of the feed, nil if SUBSCRIBE is not supported
+	cfg              *config 		// the settings of the run
+}
+
+// output returns the writer responses to tasks from Stdin are written to, with the settings of the run.
+// Consumers write to it at the same time so each response is written with a single call to Write.
+func (ctx *SharedContext) output() io.Writer {
+	if ctx.out == nil {
+		return ctx.cfg.writer(os.Stdout)
+	}
+	return ctx.cfg.writer(ctx.out)
+}
+
+// PoolStatus represents the health of the goroutines consuming tasks.
+type PoolStatus struct {
+	Workers     	int64           `json:"workers"`    // goroutines still consuming tasks
+	Busy        	int64           `json:"busy"`       // goroutines currently processing a block of tasks
+	QueueDepth  	int64           `json:"queueDepth"` // tasks in the queue waiting to be processed
+	Done        	bool            `json:"done"`       // whether the DONE task has been read
+}
+
+// Status reports the health of the goroutines consuming tasks. It only reads counters atomically,
+// so it returns quickly and never waits on the feed's lock even if every goroutine is stuck.
+func (ctx *SharedContext) Status() PoolStatus {
+	return PoolStatus{
+		Workers:    atomic.LoadInt64(&ctx.workers),
+		Busy:       atomic.LoadInt64(&ctx.busy),
+		QueueDepth: atomic.LoadInt64(ctx.numOfTasks),
+		Done:       atomic.LoadInt32(&ctx.done) == 1,
+	}
+}
+
+// waitForSpace pauses the calling producer once more than highMark tasks are in the queue and
+// resumes it once the consumers have brought the queue down to lowMark, so that a slow pool of
+// consumers cannot make the queue grow without bound. It returns right away if there is no limit.
+func (ctx *SharedContext) waitForSpace(queue queue.Queue) {
+	if ctx.space == nil || queue.Len() <= ctx.highMark {
+		return
+	}
+	ctx.space.L.Lock()
+	for queue.Len() > ctx.lowMark {
+		ctx.space.Wait()
+	}
+	ctx.space.L.Unlock()
+}
+
+// waitForProcessed blocks until at least n tasks have been processed, e.g. every task queued before a
+// BARRIER. It returns early if the program has been interrupted, since the tasks left are never processed.
+func (ctx *SharedContext) waitForProcessed(n int64) {
+	ctx.barrierMutex.Lock()
+	defer ctx.barrierMutex.Unlock()
+	if ctx.barrier == nil {
+		ctx.barrier = sync.NewCond(&ctx.barrierMutex)
+	}
+	for atomic.LoadInt64(ctx.processed) < n && atomic.LoadInt32(&ctx.stopped) == 0 {
+		ctx.barrier.Wait()
+	}
+}
+
+// signalProcessed wakes up the producers waiting in waitForProcessed once a consumer has processed tasks.
+// The mutex is taken to signal so that a producer cannot miss the wake up between checking the count and
+// going to sleep.
+func (ctx *SharedContext) signalProcessed() {
+	ctx.barrierMutex.Lock()
+	if ctx.barrier != nil {
+		ctx.barrier.Broadcast()
+	}
+	ctx.barrierMutex.Unlock()
+}
+
+// signalSpace wakes up the producers paused in waitForSpace once the queue is at or below lowMark.
+// The mutex is taken to signal so that a producer cannot miss the wake up between checking the
+// queue and going to sleep.
+func (ctx *SharedContext) signalSpace(queue queue.Queue) {
+	if ctx.space == nil || queue.Len() > ctx.lowMark {
+		return
+	}
+	ctx.space.L.Lock()
+	ctx.space.Broadcast()
+	ctx.space.L.Unlock()
+}
+
+// sequencer buffers responses so that they are written in the order their tasks were read instead of
+// the order the tasks finish in. The producer calls expect with the id of each task it reads and the
+// consumers give the response to each task to put. A response is written once the responses to all
+// the tasks read before it have been written, so when clients number their tasks in order the
+// responses are written in increasing id order. Only the responses behind the oldest unfinished
+// task are buffered, but that can be many if one task is slow.
+type sequencer struct {
+	mutex   sync.Mutex       // protects order and pending and orders the writes to w
+	w       io.Writer
+	order   []int            // ids of the tasks read whose responses have not been written, in the order they were read
+	pending map[int][][]byte // responses waiting for earlier responses to be written, by task id
+}
+
+// newSequencer creates a sequencer that writes responses to w.
+func newSequencer(w io.Writer) *sequencer {
+	return &sequencer{w: w, pending: make(map[int][][]byte)}
+}
+
+// expect records that the task with the given id has been read. It must be called before the task
+// is queued so that its response is never put before it is expected.
+func (s *sequencer) expect(id int) {
+	s.mutex.Lock()
+	s.order = append(s.order, id)
+	s.mutex.Unlock()
+}
+
+// put hands over the response to the task with the given id, which is nil if the task has no
+// response, and writes every response that is no longer waiting for an earlier one. If several
+// tasks have the same id their responses are written in the order they are put.
+func (s *sequencer) put(id int, response []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pending[id] = append(s.pending[id], response)
+	for len(s.order) > 0 {
+		next := s.order[0]
+		responses, ok := s.pending[next]
+		if !ok {
+			break
+		}
+		s.w.Write(responses[0])
+		if len(responses) == 1 {
+			delete(s.pending, next)
+		} else {
+			s.pending[next] = responses[1:]
+		}
+		s.order = s.order[1:]
+	}
 }
 
 // ClientMessage represents the possible JSON input from the Client (producer tasks).
@@ -30,135 +361,920 @@ type ClientMessage struct {
 	Command   	string  `json:"command"`
 	Id		  	int     `json:"id"`  
 	Body      	string  `json:"body,omitempty"`
+	Author    	string  `json:"author,omitempty"` // Author is who wrote the post in an Add task.
+	Score     	float64 `json:"score,omitempty"` // Score ranks the post in an Add task when the feed is ordered by score.
 	Timestamp 	float64 `json:"timestamp,omitempty"`
+	NewTimestamp	float64 `json:"newTimestamp,omitempty"` // NewTimestamp is where a Move task moves a post to.
+	Limit     	int     `json:"limit,omitempty"` // Limit is how many posts a Top task returns, or the size of a page of a Feed task.
+	N         	int     `json:"n,omitempty"` // N is the position, counting from the newest post, of the post a GetNth task returns, or the number of posts a Trim task keeps.
+	Since     	*float64 `json:"since,omitempty"` // Since limits a Feed task to posts with a later timestamp, in either order and with or without a limit. Nil means every post, so any timestamp, 0 too, can be a since.
+	Cursor    	*float64 `json:"cursor,omitempty"` // Cursor is where a page of a Feed task continues from, the nextCursor of the page before. Nil means the first page.
+	Order     	string  `json:"order,omitempty"` // Order is "desc", newest first, or "asc", oldest first, for a Feed task. Empty means "desc".
+	IfVersionNewerThan	*uint64 `json:"ifVersionNewerThan,omitempty"` // IfVersionNewerThan is the version of the feed a Feed task's client already has, so the posts are only sent if the feed has changed since.
+	From      	float64 `json:"from,omitempty"` // From is the oldest timestamp a RemoveRange task removes.
+	To        	float64 `json:"to,omitempty"` // To is the newest timestamp a RemoveRange task removes.
+	ExpectedBody	string  `json:"expectedBody,omitempty"` // ExpectedBody is the body a post must still have for a RemoveIf task to remove it.
+	Query     	string  `json:"query,omitempty"` // Query is the text a CountMatch task looks for in post bodies.
+	Bucket    	float64 `json:"bucket,omitempty"` // Bucket is the width in seconds of the time buckets of a Histogram task.
+	WithIndex 	bool    `json:"withIndex,omitempty"` // WithIndex asks a Contains task for the position of the post.
+	Epsilon   	float64 `json:"epsilon,omitempty"` // Epsilon is how far from the timestamp a ContainsApprox task looks for a post.
+	Timeout   	int     `json:"timeout,omitempty"` // Timeout is how many milliseconds a Wait task waits for the post.
+	Key       	string  `json:"key,omitempty"` // Key identifies an Add task so a retried Add is only applied once.
 	Value 	  	string  `json:"value,omitempty"` // Value indicates if we have gotten to the sentinel value.
+	Conn 	  	int     `json:"conn,omitempty"` // Conn is the id of the TCP client that sent the task, 0 for Stdin.
+	Line      	int     `json:"line,omitempty"` // Line is the line of the input the task was read on, for its errors, 0 if it is not known.
+	User      	int     `json:"user,omitempty"` // User is the user whose feed the task acts on when each user has a feed, see -quota.
+	Nanos     	int64   `json:"-"` // Nanos is the exact timestamp of a task decoded with int64 timestamps, see decodeTasks.
 }
 
 // ServerSuccessMessage represents the possible JSON response returned from the Server after completing an Add, Remove, or Contains task.
 type ServerSuccessMessage struct {
 	Success 	*bool           `json:"success"`
 	Id      	int             `json:"id"` 
+	PostId  	*uint64         `json:"postId,omitempty"` // PostId is the id the feed gave the post in an Add task.
+	Created 	*bool           `json:"created,omitempty"` // Created indicates if an Upsert task created a post rather than updating one.
+	Evicted 	bool            `json:"evicted,omitempty"` // Evicted indicates if an Add task made a bounded feed evict its oldest post.
+	Index   	*int            `json:"index,omitempty"` // Index is the position, counting from the newest post, of the post a Contains task found.
+	OldBody 	*string         `json:"oldBody,omitempty"` // OldBody is the body a Swap task replaced.
+}
+
+// ServerPostMessage represents the JSON response returned from the Server after a task that returns one post, e.g. PopOldest.
+type ServerPostMessage struct {
+	Success 	*bool           `json:"success"`
+	Id      	int             `json:"id"`
+	Post    	*PostData       `json:"post,omitempty"` // Post is nil if there was no post to return.
+}
+
+// ServerCountMessage represents the JSON response returned from the Server after a task that counts posts, e.g. RemoveRange.
+type ServerCountMessage struct {
+	Id      	int             `json:"id"`
+	Count   	int             `json:"count"`
 }
 
 // ServerFeedMessage represents the JSON response returned from the Server after completing a Feed task.
 type ServerFeedMessage struct {
 	Id      	int             `json:"id"`
 	Feed    	[]PostData      `json:"feed"`  
+	Version 	uint64          `json:"version,omitempty"` // Version is the version of the feed a Feed task read, see feed.Feed.Version.
+	Cached  	bool            `json:"cached,omitempty"`  // Cached is set if the posts came from the feed's snapshot, see -snapshotRefresh.
+	CachedAge 	*int64          `json:"cachedAgeMs,omitempty"` // CachedAge is how many milliseconds old the snapshot was, set with Cached.
+}
+
+// ServerUnchangedMessage represents the JSON response returned from the Server after a Feed task whose
+// client already has the current version of the feed.
+type ServerUnchangedMessage struct {
+	Id        	int             `json:"id"`
+	Unchanged 	bool            `json:"unchanged"`
+}
+
+// ServerFeedPageMessage represents the JSON response returned from the Server after completing a Feed task with a limit.
+type ServerFeedPageMessage struct {
+	Id         	int             `json:"id"`
+	Feed       	[]PostData      `json:"feed"`
+	NextCursor 	*float64        `json:"nextCursor"` // NextCursor is the cursor of the next page, the timestamp of the last post of this one, null once the page reaches the end of the feed.
+	Version    	uint64          `json:"version,omitempty"` // Version is the version of the feed a Feed task read, see feed.Feed.Version.
+	Cached     	bool            `json:"cached,omitempty"`  // Cached is set if the posts came from the feed's snapshot, see -snapshotRefresh.
+	CachedAge  	*int64          `json:"cachedAgeMs,omitempty"` // CachedAge is how many milliseconds old the snapshot was, set with Cached.
+}
+
+// ServerDiffMessage represents the JSON response returned from the Server after completing a Diff task.
+type ServerDiffMessage struct {
+	Id      	int             `json:"id"`
+	Added   	[]PostData      `json:"added"`
+	Removed 	[]PostData      `json:"removed"`
+}
+
+// ServerBodiesMessage represents the JSON response returned from the Server after completing a ContainsMany task.
+type ServerBodiesMessage struct {
+	Id      	int             `json:"id"`
+	Found   	map[string]bool `json:"found"` // Found has an entry for each body asked about, true if a post has it.
+}
+
+// ServerTimestampsMessage represents the JSON response returned from the Server after completing a ContainsAll task.
+type ServerTimestampsMessage struct {
+	Id      	int             `json:"id"`
+	Found   	map[string]bool `json:"found"` // Found has an entry for each timestamp asked about, written as in the request, true if a post has it.
+}
+
+// ServerHistogramMessage represents the JSON response returned from the Server after completing a Histogram task.
+type ServerHistogramMessage struct {
+	Id      	int             `json:"id"`
+	Buckets 	map[int64]int   `json:"buckets"` // Buckets has the number of posts in each time bucket with posts, keyed by floor(timestamp/bucket).
+}
+
+// ServerEmptyMessage represents the JSON response returned from the Server after completing an Empty task.
+type ServerEmptyMessage struct {
+	Id      	int             `json:"id"`
+	Empty   	bool            `json:"empty"`
+}
+
+// ServerSizeMessage represents the JSON response returned from the Server after completing a Size task.
+type ServerSizeMessage struct {
+	Id      	int             `json:"id"`
+	Bytes   	int64           `json:"bytes"` // Bytes is the total length in bytes of the bodies of the posts, see feed.Feed.TotalBodyBytes.
+}
+
+// ServerUnprocessedMessage represents the report written to Stderr when the program is interrupted.
+type ServerUnprocessedMessage struct {
+	Unprocessed 	int               `json:"unprocessed"` // Unprocessed is the number of tasks never processed.
+	Tasks       	[]json.RawMessage `json:"tasks"` // Tasks are the tasks never processed, in the order they were read.
+}
+
+// ServerErrorMessage represents the JSON response returned from the Server when input could not be processed.
+type ServerErrorMessage struct {
+	Error   	string          `json:"error"`
+	Line    	int             `json:"line,omitempty"` // Line is the line of the input, counting from 1, of a task that could not be parsed or performed.
+}
+
+// ServerDoneMessage represents the JSON response returned from the Server once the DONE task has been read and
+// all other tasks have been processed.
+type ServerDoneMessage struct {
+	Command 	string          `json:"command"`
+	Status  	string          `json:"status"`
+	Processed	int64           `json:"processed"`
+}
+
+// ServerBarrierMessage represents the JSON response returned from the Server once a Barrier task has passed.
+type ServerBarrierMessage struct {
+	Command 	string          `json:"command"`
+	Id      	int             `json:"id"`
+	Status  	string          `json:"status"`
+}
+
+// ServerStatusMessage represents the JSON response returned from the Server after a Status task.
+type ServerStatusMessage struct {
+	Id      	int             `json:"id"`
+	PoolStatus
+}
+
+// ServerStatsMessage represents the JSON response returned from the Server after a Stats task.
+type ServerStatsMessage struct {
+	Id      	int             `json:"id"`
+	feed.FeedStats
+}
+
+// ServerSelfTestMessage represents the JSON response returned from the Server after a SelfTest task.
+type ServerSelfTestMessage struct {
+	Id         	int             `json:"id"`
+	FeedSorted 	bool            `json:"feed_sorted"` // FeedSorted indicates if the feed passed Validate.
+	FeedError  	string          `json:"feed_error,omitempty"` // FeedError is why the feed failed Validate.
+	QueueLen   	int             `json:"queue_len"` // QueueLen is the number of tasks waiting in the queue.
+	QueueEmpty 	bool            `json:"queue_empty"` // QueueEmpty is whether the queue reports it has no tasks, which should agree with QueueLen.
+}
+
+// ServerSummaryMessage represents the JSON response returned from the Server once all tasks have been processed
+// when a summary is asked for. Summary has the number of tasks processed for each command.
+type ServerSummaryMessage struct {
+	Summary 	map[string]int64 `json:"summary"`
+}
+
+// ServerEventMessage represents a change to the feed streamed to a client after a Subscribe task. It has the id
+// of the Subscribe task.
+type ServerEventMessage struct {
+	Id      	int             `json:"id"`
+	Event   	string          `json:"event"` // Event is added, removed or edited.
+	Post    	PostData        `json:"post"` // Post is the post as it is after the change, or as it was before it was removed.
 }
 
 // PostData represents the JSON response for one Feed post.
 type PostData struct {
 	Body      	string  `json:"body"`
-	Timestamp 	float64 `json:"timestamp"`
+	Timestamp 	json.Number `json:"timestamp"` // Timestamp is written exactly as the feed wrote it, whether a float64 or an int64.
+	Likes     	int     `json:"likes,omitempty"`
+	Author    	string  `json:"author,omitempty"`
+	Score     	float64 `json:"score,omitempty"`
+}
+
+// printResponse marshals a response to JSON and writes it to w followed by a newline.
+// All responses go through printResponse so they are printed in the same way: as single-line JSON if w is
+// the responseWriter of a compact run, otherwise indented.
+// The response is written with a single call to w.Write so responses from different goroutines do not interleave.
+func printResponse(w io.Writer, response interface{}) {
+	var sm []byte
+	if rw, ok := w.(responseWriter); ok && rw.cfg.compact {
+		sm, _ = json.Marshal(response)
+	} else {
+		sm, _ = json.MarshalIndent(response, "", "  ")
+	}
+	w.Write(append(sm, '\n'))
+}
+
+// withWorker returns the response of a task with a worker field, the id of the consumer that performed
+// the task, added at the start. The response is printed as single-line JSON if compact is set, otherwise
+// indented. A response that is not a JSON object is returned as it is.
+func withWorker(response []byte, worker int64, compact bool) []byte {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, response); err != nil || compacted.Len() < 2 || compacted.Bytes()[0] != '{' {
+		return response
+	}
+	fields := compacted.Bytes()[1:]
+	traced := []byte(`{"worker":` + strconv.FormatInt(worker, 10))
+	if fields[0] != '}' {
+		traced = append(traced, ',')
+	}
+	traced = append(traced, fields...)
+	if compact {
+		return append(traced, '\n')
+	}
+	var indented bytes.Buffer
+	json.Indent(&indented, traced, "", "  ")
+	return append(indented.Bytes(), '\n')
+}
+
+// addPostTask adds a post to the feed by calling the feed's AddWithAuthor method, or AddWithScore if the
+// feed keeps scores. A success message with the id given to the post is written to w, which says if the
+// oldest post was evicted.
+// If the task has a key the feed's AddIdempotent method is called instead and a failure message
+// with the id of the post first added with the key is written to w if the key was already used.
+func addPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	if task.Key != "" {
+		postId, addedBool := feed.AddIdempotent(task.Body, task.Author, task.Timestamp, task.Key)
+		printResponse(w, ServerSuccessMessage{Success: &addedBool, Id: task.Id, PostId: &postId})
+		return
+	}
+	postId, evicted := addPost(feed, task)
+	trueBool := true
+	printResponse(w, ServerSuccessMessage{Success: &trueBool, Id: task.Id, PostId: &postId, Evicted: evicted})
+}
+
+// addPost adds the post of an Add task to the feed with its score if the feed keeps scores, otherwise
+// without it. It returns the id of the post and whether the oldest post was evicted.
+func addPost(f feed.Feed, task ClientMessage) (uint64, bool) {
+	if exact, ok := f.(feed.Int64Feed); ok {
+		return exact.AddInt64(task.Body, task.Author, task.Nanos)
+	}
+	if ranked, ok := f.(feed.RankedFeed); ok {
+		return ranked.AddWithScore(task.Body, task.Author, task.Score, task.Timestamp)
+	}
+	return f.AddWithAuthor(task.Body, task.Author, task.Timestamp)
+}
+
+// addUserPostTask adds a post to the feed of the task's user by calling the store's Add method, or its
+// AddIdempotent method if the task has a key, both of which check the user's quota. A success message with
+// the id given to the post is written to w like addPostTask, or an error message if the user already has as
+// many posts as they may have.
+func addUserPostTask(w io.Writer, store *feed.FeedStore, task ClientMessage) {
+	var postId uint64
+	addedBool := true
+	var err error
+	if task.Key != "" {
+		postId, addedBool, err = store.AddIdempotent(task.User, task.Body, task.Author, task.Timestamp, task.Key)
+	} else {
+		postId, err = store.Add(task.User, task.Body, task.Author, task.Timestamp)
+	}
+	if err != nil {
+		lineErrorTask(w, err, task.Line)
+		return
+	}
+	printResponse(w, ServerSuccessMessage{Success: &addedBool, Id: task.Id, PostId: &postId})
+}
+
+// upsertPostTask adds a post to the feed or updates the body of the post with the same timestamp by
+// calling the feed's Upsert method. A success message saying whether a post was created is written to w.
+func upsertPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	createdBool := feed.Upsert(task.Body, task.Author, task.Timestamp)
+	trueBool := true
+	printResponse(w, ServerSuccessMessage{Success: &trueBool, Id: task.Id, Created: &createdBool})
+}
+
+// removePostTask removes a post frome the feed by calling the feed's Remove method.
+// A success or failure message is written to w.
+func removePostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	removedBool := removePost(feed, task)
+	printResponse(w, ServerSuccessMessage{Success: &removedBool, Id: task.Id})
+}
+
+// removePost removes the post of a Remove task from the feed, by its exact timestamp if the feed has int64
+// timestamps. Return true if the post was removed.
+func removePost(f feed.Feed, task ClientMessage) bool {
+	if exact, ok := f.(feed.Int64Feed); ok {
+		return exact.RemoveInt64(task.Nanos)
+	}
+	return f.Remove(task.Timestamp)
+}
+
+// swapBodyTask replaces the body of a post in the feed with task.Body by calling the feed's SwapBody method.
+// A success message with the body the post had, or a failure message if there is no post with the
+// timestamp, is written to w.
+func swapBodyTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	old, swappedBool := feed.SwapBody(task.Timestamp, task.Body)
+	response := ServerSuccessMessage{Success: &swappedBool, Id: task.Id}
+	if swappedBool {
+		response.OldBody = &old
+	}
+	printResponse(w, response)
+}
+
+// removeIfPostTask removes a post from the feed by calling the feed's RemoveIf method, which only removes
+// the post if its body is still task.ExpectedBody. A success or failure message is written to w.
+func removeIfPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	removedBool := feed.RemoveIf(task.Timestamp, task.ExpectedBody)
+	printResponse(w, ServerSuccessMessage{Success: &removedBool, Id: task.Id})
+}
+
+// popPostTask removes the oldest post from the feed for a PopOldest task, the post with task.Timestamp for
+// a Pop task, otherwise the newest post, by calling the feed's RemoveOldest, Pop or RemoveNewest method.
+// The removed post is written to w, or a failure message if there is no post to remove.
+func popPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	var postByte []byte
+	var removedBool bool
+	if task.Command == "POPOLDEST" {
+		postByte, removedBool = feed.RemoveOldest()
+	} else if task.Command == "POP" {
+		postByte, removedBool = feed.Pop(task.Timestamp)
+	} else {
+		postByte, removedBool = feed.RemoveNewest()
+	}
+	response := ServerPostMessage{Success: &removedBool, Id: task.Id}
+	if removedBool {
+		response.Post = &postData([][]byte{postByte})[0]
+	}
+	printResponse(w, response)
+}
+
+// getNthPostTask finds the task.N-th most recent post by calling the feed's GetNthRecent method.
+// The post is written to w, or a failure message if the feed does not have that many posts.
+func getNthPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	postByte, foundBool := feed.GetNthRecent(task.N)
+	response := ServerPostMessage{Success: &foundBool, Id: task.Id}
+	if foundBool {
+		response.Post = &postData([][]byte{postByte})[0]
+	}
+	printResponse(w, response)
+}
+
+// adjacentPostTask finds the post after task.Timestamp for a Next task, otherwise the post before it,
+// by calling the feed's Successor or Predecessor method. The post is written to w, or a failure message
+// if there is no newer or older post.
+func adjacentPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	var postByte []byte
+	var foundBool bool
+	if task.Command == "NEXT" {
+		postByte, foundBool = feed.Successor(task.Timestamp)
+	} else {
+		postByte, foundBool = feed.Predecessor(task.Timestamp)
+	}
+	response := ServerPostMessage{Success: &foundBool, Id: task.Id}
+	if foundBool {
+		response.Post = &postData([][]byte{postByte})[0]
+	}
+	printResponse(w, response)
+}
+
+// closestPostTask finds the post nearest to task.Timestamp by calling the feed's Closest method. The post
+// is written to w, or a failure message if the feed is empty.
+func closestPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	postByte, foundBool := feed.Closest(task.Timestamp)
+	response := ServerPostMessage{Success: &foundBool, Id: task.Id}
+	if foundBool {
+		response.Post = &postData([][]byte{postByte})[0]
+	}
+	printResponse(w, response)
+}
+
+// removeRangePostTask removes the posts with timestamps from task.From to task.To by calling the feed's
+// RemoveRange method. The number of posts removed is written to w.
+func removeRangePostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	printResponse(w, ServerCountMessage{Id: task.Id, Count: feed.RemoveRange(task.From, task.To)})
+}
+
+// diffTask compares a feed with an earlier feed, given in the body of the task as the JSON array of
+// posts a Feed task returned, by calling the feed's Diff method. The posts added and removed since are
+// written to w, or an error message if the body is not an array of posts.
+func diffTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	var posts []json.RawMessage
+	if err := json.Unmarshal([]byte(task.Body), &posts); err != nil {
+		lineErrorTask(w, fmt.Errorf("the body of a DIFF task must be the feed to compare with: %v", err), task.Line)
+		return
+	}
+	old := make([][]byte, len(posts))
+	for i, post := range posts {
+		old[i] = post
+	}
+	added, removed := feed.Diff(old)
+	printResponse(w, ServerDiffMessage{Id: task.Id, Added: postData(added), Removed: postData(removed)})
+}
+
+// replaceTask replaces every post of a feed with the posts given in the body of the task, as a JSON array
+// of posts in the form a Feed task returns, by calling the feed's ReplaceAll method, e.g. for a full sync
+// from an authoritative source. The timestamps of the posts are normalized like the timestamp of a task.
+// The number of posts the feed now has is written to w, or an error message if the body is not an array of
+// posts, one of them has a body longer than cfg.maxBodyLen or the feed cannot replace its posts, in which
+// case the feed is not changed.
+func replaceTask(w io.Writer, feed feed.Feed, task ClientMessage, cfg *config) {
+	var posts []PostData
+	err := json.Unmarshal([]byte(task.Body), &posts)
+	if err != nil {
+		lineErrorTask(w, fmt.Errorf("the body of a REPLACE task must be an array of posts: %v", err), task.Line)
+		return
+	}
+	views, err := feedViews(posts, cfg)
+	if err == errBodyTooLong {
+		lineErrorTask(w, err, task.Line)
+		return
+	} else if err != nil {
+		lineErrorTask(w, fmt.Errorf("the body of a REPLACE task must be an array of posts: %v", err), task.Line)
+		return
+	}
+	if err := feed.ReplaceAll(views); err != nil {
+		lineErrorTask(w, err, task.Line)
+		return
+	}
+	printResponse(w, ServerCountMessage{Id: task.Id, Count: len(views)})
+}
+
+// trimPostTask keeps only the newest posts of a feed by calling the feed's TrimToNewest method.
+// The number of posts removed is written to w.
+func trimPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	printResponse(w, ServerCountMessage{Id: task.Id, Count: feed.TrimToNewest(task.N)})
+}
+
+// compactTask collapses the runs of posts with the same body in a feed by calling the feed's Compact method.
+// The number of posts removed is written to w.
+func compactTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	printResponse(w, ServerCountMessage{Id: task.Id, Count: feed.Compact()})
+}
+
+// containsPostTask indicates if a feed contains a given post by calling the feed's Contains method.
+// A success or failure message is written to w. If the task asks for the position of the post then
+// the feed's IndexOf method is called instead and the position is included when the post is found.
+func containsPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	if task.WithIndex {
+		index, containsBool := feed.IndexOf(task.Timestamp)
+		response := ServerSuccessMessage{Success: &containsBool, Id: task.Id}
+		if containsBool {
+			response.Index = &index
+		}
+		printResponse(w, response)
+		return
+	}
+	containsBool := containsPost(feed, task)
+	printResponse(w, ServerSuccessMessage{Success: &containsBool, Id: task.Id})
+}
+
+// containsPost reports whether the feed has the post of a Contains task, by its exact timestamp if the feed
+// has int64 timestamps.
+func containsPost(f feed.Feed, task ClientMessage) bool {
+	if exact, ok := f.(feed.Int64Feed); ok {
+		return exact.ContainsInt64(task.Nanos)
+	}
+	return f.Contains(task.Timestamp)
+}
+
+// waitForPostTask waits for a feed to contain a given post by calling the feed's WaitFor method with the
+// task's timeout in milliseconds. A success message is written to w if the post is added in time and a
+// failure message otherwise. The consumer performing the task is blocked while it waits.
+func waitForPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	foundBool := feed.WaitFor(task.Timestamp, time.Duration(task.Timeout)*time.Millisecond)
+	printResponse(w, ServerSuccessMessage{Success: &foundBool, Id: task.Id})
+}
+
+// containsApproxPostTask indicates if a feed contains a post with a timestamp within the task's epsilon of
+// its timestamp by calling the feed's ContainsApprox method. A success or failure message is written to w.
+func containsApproxPostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	containsBool := feed.ContainsApprox(task.Timestamp, task.Epsilon)
+	printResponse(w, ServerSuccessMessage{Success: &containsBool, Id: task.Id})
+}
+
+// containsManyTask indicates for each of the bodies given in the body of the task, as a JSON array of
+// strings, if a feed contains a post with that body by calling the feed's ContainsBodies method. Which
+// bodies were found is written to w, or an error message if the body is not an array of strings.
+func containsManyTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	var bodies []string
+	if err := json.Unmarshal([]byte(task.Body), &bodies); err != nil {
+		lineErrorTask(w, fmt.Errorf("the body of a CONTAINSMANY task must be an array of bodies: %v", err), task.Line)
+		return
+	}
+	printResponse(w, ServerBodiesMessage{Id: task.Id, Found: feed.ContainsBodies(bodies)})
+}
+
+// histogramTask counts the posts in each time bucket of task.Bucket seconds by calling the feed's
+// BucketCounts method. The counts are written to w, or an error message if the bucket is not positive.
+func histogramTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	if !(task.Bucket > 0) {
+		lineErrorTask(w, fmt.Errorf("the bucket of a HISTOGRAM task must be a positive number of seconds. Got:%v", task.Bucket), task.Line)
+		return
+	}
+	printResponse(w, ServerHistogramMessage{Id: task.Id, Buckets: feed.BucketCounts(task.Bucket)})
+}
+
+// emptyTask indicates whether a feed has no posts by calling the feed's IsEmpty method, which is
+// cheaper than a FEED task when the posts themselves are not needed.
+func emptyTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	printResponse(w, ServerEmptyMessage{Id: task.Id, Empty: feed.IsEmpty()})
+}
+
+// sizeTask reports the total length in bytes of the bodies of the posts in a feed by calling the feed's
+// TotalBodyBytes method, e.g. for storage accounting.
+func sizeTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	printResponse(w, ServerSizeMessage{Id: task.Id, Bytes: feed.TotalBodyBytes()})
+}
+
+// containsAllTask indicates for each of the timestamps given in the body of the task, as a JSON array of
+// numbers, if a feed contains a post with that timestamp by calling the feed's ContainsAll method. The
+// timestamps are normalized like the timestamps of every other task. Which timestamps were found is
+// written to w, each normalized timestamp written the way JSON writes the number, or an error message if
+// the body is not an array of numbers.
+func containsAllTask(w io.Writer, feed feed.Feed, task ClientMessage, cfg *config) {
+	var timestamps []float64
+	if err := json.Unmarshal([]byte(task.Body), &timestamps); err != nil {
+		lineErrorTask(w, fmt.Errorf("the body of a CONTAINSALL task must be an array of timestamps: %v", err), task.Line)
+		return
+	}
+	for i, timestamp := range timestamps {
+		timestamps[i] = cfg.normalize(timestamp)
+	}
+	found := make(map[string]bool, len(timestamps))
+	for timestamp, contains := range feed.ContainsAll(timestamps) {
+		key, _ := json.Marshal(timestamp)
+		found[string(key)] = contains
+	}
+	printResponse(w, ServerTimestampsMessage{Id: task.Id, Found: found})
+}
+
+// movePostTask moves a post to a new timestamp by calling the feed's Reschedule method.
+// A success or failure message is written to w.
+func movePostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	movedBool := feed.Reschedule(task.Timestamp, task.NewTimestamp)
+	printResponse(w, ServerSuccessMessage{Success: &movedBool, Id: task.Id})
+}
+
+// likePostTask likes a post by calling the feed's Like method.
+// A success or failure message is written to w.
+func likePostTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	likedBool := feed.Like(task.Timestamp)
+	printResponse(w, ServerSuccessMessage{Success: &likedBool, Id: task.Id})
+}
+
+// postData unmarshals the post byte data returned by the feed in to the PostData of a response.
+func postData(postByteArray [][]byte) []PostData {
+	feedArray := []PostData{}
+	for _, post := range(postByteArray) {
+		var pd PostData
+		err := json.Unmarshal(post, &pd)
+		if err != nil {
+			fmt.Println("error: ", err)
+		}
+		feedArray = append(feedArray, pd)
+	}
+	return feedArray
+}
+
+// feedViews copies the PostData of a task in to posts for the feed, the other way around from postViews.
+// The timestamps are normalized. An error is returned if a timestamp is not a number, or errBodyTooLong if a
+// body is longer than cfg.maxBodyLen.
+func feedViews(posts []PostData, cfg *config) ([]feed.PostView, error) {
+	views := make([]feed.PostView, len(posts))
+	for i, post := range posts {
+		timestamp, err := post.Timestamp.Float64()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.tooLong(post.Body) {
+			return nil, errBodyTooLong
+		}
+		views[i] = feed.PostView{Body: post.Body, Timestamp: cfg.normalize(timestamp), Likes: post.Likes, Author: post.Author, Score: post.Score}
+	}
+	return views, nil
+}
+
+// postViews copies the posts returned by the feed's ShowFeedPosts method in to the PostData of a response.
+// Each timestamp is written the way JSON writes the number, as it is in the byte data ShowFeed returns.
+func postViews(views []feed.PostView) []PostData {
+	posts := make([]PostData, len(views))
+	for i, view := range views {
+		posts[i] = PostData{Body: view.Body, Timestamp: jsonNumber(view.Timestamp), Likes: view.Likes, Author: view.Author, Score: view.Score}
+		if view.Exact {
+			posts[i].Timestamp = json.Number(strconv.FormatInt(view.Nanos, 10))
+		}
+	}
+	return posts
+}
+
+// jsonNumber formats f exactly like encoding/json marshals a float64: without an exponent unless f is
+// very small or very large, and then with the exponent written as short as it can be, e.g. 1e-7.
+func jsonNumber(f float64) json.Number {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b := strconv.AppendFloat(nil, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9.
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return json.Number(b)
+}
+
+// showFeedTask writes to w all the posts in a feed with the most recent post first, or the oldest post
+// first if the task's order is asc. Each post displays the post's body and timestamp. If the task has
+// a since only the posts with a later timestamp are written, whatever the order and limit. If the task
+// has a limit only a page of the posts is written, along with the cursor to pass for the next page; a
+// task with a cursor continues after it in the task's order, so with the newest post first it has older
+// posts. The posts are taken from the feed's ShowFeedOldestFirst method for the asc order and its
+// ShowFeedSince method for a since, otherwise from its ShowFeedPosts method so the response is only
+// marshalled once.
+// If the task has the version the client already has and the feed's version is no newer, no posts are
+// read and only that the feed is unchanged is written.
+func showFeedTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	if task.Order != "" && task.Order != "desc" && task.Order != "asc" {
+		lineErrorTask(w, fmt.Errorf("the order of a FEED task must be asc or desc. Got:%q", task.Order), task.Line)
+		return
+	}
+	version := feed.Version() // Read before the posts, so a change made in between gives a later version.
+	if task.IfVersionNewerThan != nil && version <= *task.IfVersionNewerThan {
+		printResponse(w, ServerUnchangedMessage{Id: task.Id, Unchanged: true})
+		return
+	}
+	var posts []PostData
+	var cachedAge *int64
+	switch {
+	case task.Order == "asc":
+		posts = postData(feed.ShowFeedOldestFirst(0))
+	case task.Since != nil:
+		posts = postData(feed.ShowFeedSince(*task.Since))
+	default:
+		views, age := showFeedPosts(feed, &version)
+		if age != nil && task.IfVersionNewerThan != nil && version <= *task.IfVersionNewerThan { // The snapshot may be older than the feed.
+			printResponse(w, ServerUnchangedMessage{Id: task.Id, Unchanged: true})
+			return
+		}
+		posts, cachedAge = postViews(views), age
+	}
+	if task.Since != nil && task.Order == "asc" {
+		posts = postsPast(posts, *task.Since, false)
+	}
+	if task.Cursor != nil {
+		posts = postsPast(posts, *task.Cursor, task.Order != "asc")
+	}
+	cached := cachedAge != nil
+	if task.Limit <= 0 {
+		printResponse(w, ServerFeedMessage{Id: task.Id, Feed: posts, Version: version, Cached: cached, CachedAge: cachedAge})
+		return
+	}
+	page, nextCursor := feedPage(posts, task.Limit)
+	printResponse(w, ServerFeedPageMessage{Id: task.Id, Feed: page, NextCursor: nextCursor, Version: version, Cached: cached, CachedAge: cachedAge})
+}
+
+// showFeedPosts returns the posts of f newest first. If f has a snapshot turned on, see -snapshotRefresh,
+// the posts are read without waiting for a busy lock: they may come from the snapshot, in which case
+// cachedAge is how many milliseconds old the snapshot is, and version is set to the version they are from.
+// cachedAge is nil if the posts were read from the feed.
+func showFeedPosts(f feed.Feed, version *uint64) (posts []feed.PostView, cachedAge *int64) {
+	if snapshotFeed, ok := f.(feed.SnapshotFeed); ok {
+		posts, v, cached, age := snapshotFeed.ShowFeedPostsNow()
+		*version = v
+		if cached {
+			ms := age.Milliseconds()
+			cachedAge = &ms
+		}
+		return posts, cachedAge
+	}
+	return f.ShowFeedPosts(), nil
+}
+
+// postsPast returns the posts after cursor in a walk of the feed: the posts with an earlier timestamp if
+// older is set, otherwise the posts with a later timestamp. The posts keep their order.
+func postsPast(posts []PostData, cursor float64, older bool) []PostData {
+	past := []PostData{}
+	for _, post := range posts {
+		timestamp, _ := post.Timestamp.Float64()
+		if older && timestamp < cursor || !older && timestamp > cursor {
+			past = append(past, post)
+		}
+	}
+	return past
+}
+
+// feedPage returns the first limit posts, in the order they are in posts, and the timestamp of the last
+// of them as the cursor for the next page. Since the next page only has posts past the cursor, a page also
+// has the posts right after it with the cursor's timestamp, so it can have more than limit posts. The cursor
+// is nil if the page has every post.
+func feedPage(posts []PostData, limit int) ([]PostData, *float64) {
+	if limit >= len(posts) {
+		return posts, nil
+	}
+	cursor, _ := posts[limit-1].Timestamp.Float64()
+	end := limit
+	for end < len(posts) {
+		if timestamp, _ := posts[end].Timestamp.Float64(); timestamp != cursor {
+			break
+		}
+		end++
+	}
+	if end == len(posts) {
+		return posts, nil
+	}
+	return posts[:end], &cursor
+}
+
+// topLikedTask writes to w the <limit> most liked posts in a feed with the most liked post first.
+func topLikedTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	printResponse(w, ServerFeedMessage{Id: task.Id, Feed: postData(feed.TopLiked(task.Limit))})
+}
+
+// selfTestTask writes to w whether the feed passes Validate and how many tasks are waiting in the
+// queue, so that a client can check a long-running program for corruption or a queue that is not
+// being drained. Tasks performed sequentially have no queue, q is nil, so the queue is reported empty.
+func selfTestTask(w io.Writer, feed feed.Feed, task ClientMessage, q queue.Queue) {
+	response := ServerSelfTestMessage{Id: task.Id, FeedSorted: true, QueueEmpty: true}
+	if err := feed.Validate(); err != nil {
+		response.FeedSorted, response.FeedError = false, err.Error()
+	}
+	if q != nil {
+		response.QueueLen, response.QueueEmpty = q.Len(), q.IsEmpty()
+	}
+	printResponse(w, response)
+}
+
+// statsTask writes to w the number of posts, the oldest and newest timestamps and the total likes of a feed.
+func statsTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	printResponse(w, ServerStatsMessage{Id: task.Id, FeedStats: feed.Stats()})
+}
+
+// countMatchingTask writes to w the number of posts in a feed whose body contains task.Query.
+func countMatchingTask(w io.Writer, feed feed.Feed, task ClientMessage) {
+	printResponse(w, ServerCountMessage{Id: task.Id, Count: feed.CountMatching(task.Query)})
+}
+
+// barrierTask writes to w that a BARRIER task has passed, i.e. every task read before it has been performed.
+func barrierTask(w io.Writer, task ClientMessage) {
+	printResponse(w, ServerBarrierMessage{Command: "BARRIER", Id: task.Id, Status: "passed"})
 }
 
-// addPostTask adds a post to the feed by calling the feed's Add method.
-// A success message is printed to Stdout.
-func addPostTask(feed feed.Feed, task ClientMessage) {
-	feed.Add(task.Body, task.Timestamp)
-	trueBool := true
-	sm, _ := json.MarshalIndent(ServerSuccessMessage{Success: &trueBool, Id: task.Id}, "", "  ")	
-	fmt.Printf("%s\n", sm)
+// errorTask writes to w an error message describing why input could not be processed. If w is the
+// responseWriter of a run the error is counted for the exit code of the run.
+func errorTask(w io.Writer, err error) {
+	lineErrorTask(w, err, 0)
 }
 
-// removePostTask removes a post frome the feed by calling the feed's Remove method.
-// A success or failure message is printed to Stdout.
-func removePostTask(feed feed.Feed, task ClientMessage) {
-	removedBool := feed.Remove(task.Timestamp)
-	sm, _ := json.MarshalIndent(ServerSuccessMessage{Success: &removedBool, Id: task.Id}, "", "   ")
-	fmt.Printf("%s\n", sm)
+// lineErrorTask writes to w an error message like errorTask that also says which line of the input the
+// task is on, so a bad task can be found in a large input. A line of 0 is not written.
+func lineErrorTask(w io.Writer, err error, line int) {
+	if rw, ok := w.(responseWriter); ok {
+		atomic.AddInt64(&rw.cfg.errors, 1)
+	}
+	printResponse(w, ServerErrorMessage{Error: err.Error(), Line: line})
 }
 
-// containsPostTask indicates if a feed contains a given post by calling the feed's Contains method.
-// A success or failure message is printed to Stdout.
-func containsPostTask(feed feed.Feed, task ClientMessage) {
-	containsBool := feed.Contains(task.Timestamp)
-	sm, _ := json.MarshalIndent(ServerSuccessMessage{Success: &containsBool, Id: task.Id}, "", "   ")
-	fmt.Printf("%s\n", sm)
+// printSnapshot writes to w the number of tasks pending in the queue followed by the tasks, one per line,
+// in the order they would be dequeued. The queue is not changed.
+func printSnapshot(w io.Writer, q queue.Queue) {
+	var out bytes.Buffer
+	pending := q.Snapshot()
+	fmt.Fprintf(&out, "pending tasks: %v\n", len(pending))
+	for _, task := range pending {
+		out.Write(append(task, '\n'))
+	}
+	w.Write(out.Bytes())
 }
 
-// showFeedTask prints to Stdout all the posts in a feed with the most recent post first.
-// Each post displays the post's body and timestamp.
-func showFeedTask(feed feed.Feed, task ClientMessage) {
-	postByteArray := feed.ShowFeed()
-	feedArray := []PostData{}
-	for _, post := range(postByteArray) {
-		var pd PostData
-		err := json.Unmarshal(post, &pd)
-		if err != nil {
-			fmt.Println("error: ", err)
+// skip records tasks a consumer dequeued but did not perform because the program was interrupted.
+// Their TCP clients are not waited on any more.
+func (ctx *SharedContext) skip(tasks []ClientMessage) {
+	ctx.skippedMutex.Lock()
+	ctx.skipped = append(ctx.skipped, tasks...)
+	ctx.skippedMutex.Unlock()
+	for _, task := range tasks {
+		if client := ctx.clients.get(task.Conn); client != nil {
+			client.pending.Done()
 		}
-		feedArray = append(feedArray, pd)
 	}
-	sm, _ := json.MarshalIndent(ServerFeedMessage{Id: task.Id, Feed: feedArray}, "", "   ")
-	fmt.Printf("%s\n", sm)
 }
 
+// unprocessedTask writes to w the tasks that were never processed once the program has been interrupted
+// and the consumers have stopped, so that they can be sent again: first the tasks the consumers dequeued
+// but skipped, then the tasks left in the queue in the order they would have been dequeued. The queue
+// must be closed, so that nothing is added to it while it is drained. The tasks of a batch are listed
+// one by one.
+func unprocessedTask(w io.Writer, q queue.Queue, ctx *SharedContext) {
+	tasks := []json.RawMessage{}
+	ctx.skippedMutex.Lock()
+	for _, task := range ctx.skipped {
+		taskJSONBytes, _ := json.Marshal(task)
+		tasks = append(tasks, taskJSONBytes)
+	}
+	ctx.skippedMutex.Unlock()
+	for entry, ok := q.DequeueWait(0); ok; entry, ok = q.DequeueWait(0) {
+		elements, _, err := splitTasks(entry)
+		if err != nil || !json.Valid(entry) { // Not a task, so there is nothing to send again.
+			continue
+		}
+		tasks = append(tasks, elements...)
+	}
+	printResponse(w, ServerUnprocessedMessage{Unprocessed: len(tasks), Tasks: tasks})
+}
+
+// doneTask writes to w the acknowledgement that all tasks have been processed, including the number of tasks.
+func doneTask(w io.Writer, processed int64) {
+	printResponse(w, ServerDoneMessage{Command: "DONE", Status: "complete", Processed: processed})
+}
+
+// summaryTask writes to w the number of tasks processed for each command.
+func summaryTask(w io.Writer, counts *commandCounts) {
+	printResponse(w, ServerSummaryMessage{Summary: counts.summary()})
+}
+
+// newScanner returns a scanner that reads tasks line by line from r.
+// The scanner's buffer grows as needed for lines up to maxLine bytes long.
+func newScanner(r io.Reader, maxLine int) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLine)
+	return scanner
+}
+
+// consumerWait is how long an idle consumer waits for a task: until one is enqueued or the queue is closed.
+const consumerWait = queue.Forever
+
 // The consumer() function dequeues tasks and processes them.
 // A goroutine will wait until there are tasks to process.
 // Once there are tasks in the queue, a single goroutine is woken up to grab up to <block> amount
 // of tasks and process those tasks.
 // When the goroutine finishes those tasks it goes back to waiting for tasks to be added to the 
 // queue with the other goroutines.
-// When the DONE task is processed the remainder of tasks in the queue are processed and the goroutine returns.
+// When the queue is closed the remainder of tasks in the queue are processed and the goroutine returns.
+// If there is a sequencer the responses to tasks from Stdin are handed to it instead of written right away.
 func consumer(id int64, block int64, feed feed.Feed, queue queue.Queue, ctx *SharedContext) {
-	// While there are more tasks
-	for true{
+	atomic.AddInt64(&ctx.workers, 1)
+	logger := slog.With("worker", id) // Diagnostics say which consumer performed a task.
+
+	// While there are more tasks, and the program has not been interrupted
+	for atomic.LoadInt32(&ctx.stopped) == 0 {
 
 		// Local flag for whether this should be this goroutine's last iteration.
-		// It is always initially set to false and updated based on whether the DONE task has been read and if 
-		// there are more tasks to process.
+		// It is always initially set to false and updated based on whether the queue has been closed
+		// and emptied.
 		exit := false
 
-		// Lock to make sure we have an accurate read on the condition var.
-		ctx.mutex.Lock()
-
-		// Wait until there are tasks to consume.
-		// If we have read the DONE task, though, just go because producer not signaling anymore.
-		if atomic.LoadInt64(ctx.numOfTasks) == 0 && !*ctx.doneBool {
-			ctx.cond.Wait()
-		}
-
-		ctx.mutex.Unlock() // Unlocks because dequeuing is done with a lock free queue so there should not be any issues with overlapping goroutines.
-
-		// When you wake up grab block amount of tasks or all the tasks if there are < block amount.
+		// Wait for a task, then grab up to block amount of tasks or all the tasks if there are < block amount.
+		// The goroutine sleeps until a task is enqueued or the queue is closed; if the closed value is returned
+		// there are no more tasks to consume ever so the goroutine exits when it completes its tasks.
 		var blockOfTasks []ClientMessage
-		for i := int64(0); i < block; i++ {
-			var cm ClientMessage
-			err := json.Unmarshal(queue.Dequeue(), &cm)
+		wait := consumerWait
+		for int64(len(blockOfTasks)) < block {
+			byteTask, ok := queue.DequeueWait(wait)
+			tasks, _, err := decodeTasks(byteTask, ctx.cfg.int64Timestamps) // A batch of tasks is taken whole, even past block.
 			if err != nil {
-				fmt.Println("error: ", err)
+				fmt.Fprintln(ctx.output(), "error: ", err)
 				break
 			}
-			// If sentinel value is returned there are no more tasks to consume.
-			if cm.Value == "sentinel" {
+			if !ok {
+				exit = tasks[0].Value == "closed"
 				break
-			} else {
-				blockOfTasks = append(blockOfTasks, cm)
-				atomic.AddInt64(ctx.numOfTasks, -1) // Do this atomically as to not have to lock down the entire lock.
-			}
-		}
-
-		// If there are no more tasks when the DONE task is read then the go routine exits when it completes its tasks.
-		if *ctx.doneBool {
-			if atomic.LoadInt64(ctx.numOfTasks) == 0 { 
-				exit = true
 			}
+			blockOfTasks = append(blockOfTasks, tasks...)
+			atomic.AddInt64(ctx.numOfTasks, -int64(len(tasks))) // Do this atomically as to not have to lock down the entire lock.
+			ctx.signalSpace(queue) // Let a paused producer continue if the queue has drained.
+			wait = 0 // Only take the rest of the block from tasks that are already queued.
 		}
 
 		// Perform tasks
 		if len(blockOfTasks) != 0 {
+			atomic.AddInt64(&ctx.busy, 1)
+			performed := 0
 			for _, task := range(blockOfTasks) {
-				if task.Command == "ADD" { // Add a post.
-					addPostTask(feed, task)
-				} else if task.Command == "REMOVE" { // Remove a post.
-					removePostTask(feed, task)
-				} else if task.Command == "CONTAINS" { // See if feed contains a post.
-					containsPostTask(feed, task)
-				} else if task.Command == "FEED" { // Visualize the feed.
-					showFeedTask(feed, task)
-				} 
+				if atomic.LoadInt32(&ctx.stopped) == 1 { // Leave the rest of the block for the unprocessed report.
+					ctx.skip(blockOfTasks[performed:])
+					break
+				}
+				// Write the response back to the TCP client that sent the task, otherwise to the output.
+				w := ctx.output()
+				client := ctx.clients.get(task.Conn)
+				if client != nil {
+					w = ctx.cfg.writer(client.conn)
+				}
+
+				var response []byte
+				err := errAborted // Tasks queued before a bad task stopped the run are answered without being performed.
+				if atomic.LoadInt32(&ctx.aborted) == 0 {
+					logger.Debug("task", "id", task.Id, "command", task.Command)
+					response, err = dispatchWithTimeout(context.Background(), feed, task, ctx.cfg, ctx.taskTimeout, logger)
+				}
+				if err != nil {
+					var errorResponse bytes.Buffer
+					lineErrorTask(ctx.cfg.writer(&errorResponse), err, task.Line)
+					response = errorResponse.Bytes()
+				}
+				if ctx.cfg.traceWorkers && response != nil {
+					response = withWorker(response, id, ctx.cfg.compact)
+				}
+				if client == nil && ctx.sequencer != nil {
+					ctx.sequencer.put(task.Id, response)
+				} else if response != nil {
+					w.Write(response)
+				}
+
+				if client != nil {
+					client.pending.Done()
+				}
+				performed++
 			}
+			atomic.AddInt64(ctx.processed, int64(performed))
+			atomic.AddInt64(&ctx.busy, -1)
+			ctx.signalProcessed()
 		}
 
 		if exit {
@@ -166,36 +1282,792 @@ func consumer(id int64, block int64, feed feed.Feed, queue queue.Queue, ctx *Sha
 		}
 	}
 
+	atomic.AddInt64(&ctx.workers, -1)
 	ctx.wg.Done()
 }
 
-// producer reads in tasks from os.Stdin and adds these tasks to the queue.
+// errTaskTimeout is reported instead of the response of a task that takes longer than the task timeout.
+var errTaskTimeout = errors.New("task timeout")
+
+// errAborted is reported instead of the response of a task queued before a bad task stopped the run in
+// strict mode.
+var errAborted = errors.New("not performed: a bad task stopped the run")
+
+// errTaskPanicked is reported instead of the response of a task that panicked.
+var errTaskPanicked = errors.New("task panicked")
+
+// safeDispatch performs a task like dispatch but recovers if the task panics, so that one bad task
+// cannot take down the goroutine performing it. The panic is logged to logger, which says which
+// consumer performed the task, and errTaskPanicked is returned.
+func safeDispatch(f feed.Feed, cm ClientMessage, cfg *config, logger *slog.Logger) (response []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("task panicked", "id", cm.Id, "command", cm.Command, "panic", r)
+			response, err = nil, errTaskPanicked
+		}
+	}()
+	return dispatch(f, cm, cfg)
+}
+
+// dispatchWithTimeout performs a task like safeDispatch but stops waiting for it once timeout has passed
+// and returns errTaskTimeout, so that a task that blocks cannot hold up a consumer forever. It also stops
+// waiting once ctx is done and returns the context's error. The task keeps running in its own goroutine and
+// its response is dropped. A timeout of 0 waits for the task however long it takes. A panic is logged to
+// logger like in safeDispatch.
+func dispatchWithTimeout(ctx context.Context, f feed.Feed, cm ClientMessage, cfg *config, timeout time.Duration, logger *slog.Logger) ([]byte, error) {
+	if timeout <= 0 {
+		return safeDispatch(f, cm, cfg, logger)
+	}
+
+	// The channel is buffered so the goroutine can hand over a response nobody waits for any more and exit.
+	finished := make(chan dispatchResult, 1)
+	go func() {
+		response, err := safeDispatch(f, cm, cfg, logger)
+		finished <- dispatchResult{response: response, err: err}
+	}()
+
+	select {
+	case result := <-finished:
+		return result.response, result.err
+	case <-time.After(timeout):
+		return nil, errTaskTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatchResult is the response to a task performed by dispatchWithTimeout, or the error it failed with.
+type dispatchResult struct {
+	response []byte
+	err      error
+}
+
+// spawnConsumers starts threads goroutines consuming tasks from the queue. It returns a channel
+// that is closed once every consumer has returned, so a caller can wait for the tasks to be
+// processed in a select alongside a timeout or a signal.
+func spawnConsumers(threads int64, block int64, feed feed.Feed, queue queue.Queue, ctx *SharedContext) <-chan struct{} {
+	for i := int64(0); i < threads; i++ {
+		ctx.wg.Add(1)
+		go consumer(i, block, feed, queue, ctx)
+	}
+
+	completed := make(chan struct{})
+	go func() {
+		ctx.wg.Wait()
+		close(completed)
+	}()
+	return completed
+}
+
+// newQueue initializes the queue shared by the producer and the consumers.
+// If priority is set a priority queue is used so that reads are not stuck behind writes.
+func newQueue(priority bool) queue.Queue {
+	if priority {
+		return queue.NewPriorityQueue()
+	}
+	return queue.NewQueue()
+}
+
+// isHighPriority indicates if a task is latency-sensitive. FEED and CONTAINS tasks are reads a
+// client is waiting on, so they are high priority. ADD and REMOVE tasks are low priority.
+func isHighPriority(task ClientMessage) bool {
+	return task.Command == "FEED" || task.Command == "CONTAINS"
+}
+
+// enqueueTask adds a task to the queue. If the queue is a priority queue then high priority
+// tasks are added ahead of the low priority tasks.
+func enqueueTask(q queue.Queue, task ClientMessage, taskJSONBytes []byte) {
+	if pq, ok := q.(queue.PriorityQueue); ok && isHighPriority(task) {
+		pq.EnqueueHigh(taskJSONBytes)
+	} else {
+		q.Enqueue(taskJSONBytes)
+	}
+}
+
+// enqueuePending adds tasks read from a line to the queue as the bytes they were read as: the tasks of a
+// batch as one entry, a JSON array of them, which is never high priority, otherwise the one task.
+func enqueuePending(q queue.Queue, queued []pendingTask, batch bool) {
+	if !batch {
+		enqueueTask(q, queued[0].cm, queued[0].raw)
+		return
+	}
+	elements := make([]json.RawMessage, len(queued))
+	for i, task := range queued {
+		elements[i] = task.raw
+	}
+	entry, _ := json.Marshal(elements)
+	q.Enqueue(entry)
+}
+
+// withField returns the JSON object task with the field name set to value, e.g. to tag a task with the TCP
+// client it came from. A field the task already has by that name, in any case, is replaced, since it would
+// be decoded in to the same field of ClientMessage. The other fields are kept exactly as they were read.
+// A task that is not a JSON object is returned as it is.
+func withField(task json.RawMessage, name string, value interface{}) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(task, &fields); err != nil || fields == nil {
+		return task
+	}
+	for key := range fields {
+		if strings.EqualFold(key, name) {
+			delete(fields, key)
+		}
+	}
+	fields[name], _ = json.Marshal(value)
+	tagged, _ := json.Marshal(fields)
+	return tagged
+}
+
+// errDone is returned by handleLine for the DONE task, which has no response.
+var errDone = errors.New("done")
+
+// Command is a built-in command of a task. Its value is its slot in summaryCommands and a commandCounts.
+type Command int
+
+// The built-in commands.
+const (
+	CmdAdd Command = iota
+	CmdRemove
+	CmdContains
+	CmdFeed
+	CmdMove
+	CmdLike
+	CmdTop
+	CmdStats
+	CmdRemoveRange
+	CmdUpsert
+	CmdRemoveIf
+	CmdCountMatch
+	CmdPopOldest
+	CmdPopNewest
+	CmdGetNth
+	CmdWait
+	CmdTrim
+	CmdDiff
+	CmdContainsApprox
+	CmdContainsMany
+	CmdSwap
+	CmdSelfTest
+	CmdContainsAll
+	CmdCompact
+	CmdNext
+	CmdPrev
+	CmdHistogram
+	CmdEmpty
+	CmdPop
+	CmdSize
+	CmdClosest
+	CmdReplace
+)
+
+// summaryCommands are the names of the built-in commands, indexed by Command. They are the commands
+// counted for the summary. Each name is keyed by its command, so reordering the constants cannot give a
+// command the wrong name.
+var summaryCommands = [...]string{
+	CmdAdd:            "ADD",
+	CmdRemove:         "REMOVE",
+	CmdContains:       "CONTAINS",
+	CmdFeed:           "FEED",
+	CmdMove:           "MOVE",
+	CmdLike:           "LIKE",
+	CmdTop:            "TOP",
+	CmdStats:          "STATS",
+	CmdRemoveRange:    "REMOVERANGE",
+	CmdUpsert:         "UPSERT",
+	CmdRemoveIf:       "REMOVEIF",
+	CmdCountMatch:     "COUNTMATCH",
+	CmdPopOldest:      "POPOLDEST",
+	CmdPopNewest:      "POPNEWEST",
+	CmdGetNth:         "GETNTH",
+	CmdWait:           "WAIT",
+	CmdTrim:           "TRIM",
+	CmdDiff:           "DIFF",
+	CmdContainsApprox: "CONTAINSAPPROX",
+	CmdContainsMany:   "CONTAINSMANY",
+	CmdSwap:           "SWAP",
+	CmdSelfTest:       "SELFTEST",
+	CmdContainsAll:    "CONTAINSALL",
+	CmdCompact:        "COMPACT",
+	CmdNext:           "NEXT",
+	CmdPrev:           "PREV",
+	CmdHistogram:      "HISTOGRAM",
+	CmdEmpty:          "EMPTY",
+	CmdPop:            "POP",
+	CmdSize:           "SIZE",
+	CmdClosest:        "CLOSEST",
+	CmdReplace:        "REPLACE",
+}
+
+// String returns the name of the command as it is written in a task, e.g. ADD.
+func (c Command) String() string {
+	if c < 0 || int(c) >= len(summaryCommands) {
+		return fmt.Sprintf("Command(%d)", int(c))
+	}
+	return summaryCommands[c]
+}
+
+// parseCommand returns the built-in command with the given name. Names are case sensitive, so an error
+// is returned for add as well as for a name that is not a command at all. DONE, STATUS and SUBSCRIBE
+// are not built-in commands since they are handled before dispatch.
+func parseCommand(name string) (Command, error) {
+	for i, command := range summaryCommands {
+		if command == name {
+			return Command(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown command %q", name)
+}
+
+// commandCounts counts the tasks processed for each command, indexed like summaryCommands.
+// The counts are only changed atomically so consumers can count tasks without a lock.
+type commandCounts [len(summaryCommands)]int64
+
+// add counts a task with the given command.
+func (c *commandCounts) add(command Command) {
+	atomic.AddInt64(&c[command], 1)
+}
+
+// summary returns the count of each command by name, including the commands with no tasks.
+func (c *commandCounts) summary() map[string]int64 {
+	summary := make(map[string]int64, len(summaryCommands))
+	for i, name := range summaryCommands {
+		summary[name] = atomic.LoadInt64(&c[i])
+	}
+	return summary
+}
+
+// Handler performs a task with a custom command on the feed and returns the response for the client, e.g.
+// written with printResponse. Returning nil treats the task like one with an unknown command.
+type Handler func(feed.Feed, ClientMessage) []byte
+
+// handlers are the handlers registered with registerHandler by command. They are looked up by every consumer
+// so they are guarded by handlersMutex.
+var handlers = map[string]Handler{}
+var handlersMutex sync.RWMutex
+
+// registerHandler registers fn to perform the tasks with the given command, so that another file of the program can
+// extend the protocol without changing dispatch. A registered handler is used instead of a built-in command with
+// the same name, e.g. to replace STATS, and a task it performs is counted and audited like the built-in
+// one. DONE, STATUS and SUBSCRIBE are handled before dispatch so they cannot be replaced. A nil fn removes the
+// handler for the command.
+func registerHandler(command string, fn Handler) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	if fn == nil {
+		delete(handlers, command)
+	} else {
+		handlers[command] = fn
+	}
+}
+
+// lookupHandler returns the handler registered for the command, or nil if there is none.
+func lookupHandler(command string) Handler {
+	handlersMutex.RLock()
+	defer handlersMutex.RUnlock()
+	return handlers[command]
+}
+
+// handleLine parses one line of input as a task, performs the task on the feed and returns the response.
+// An error is returned instead if the line is not a valid task, including if it has an unknown command,
+// or if the task panicked. A line with a batch of tasks returns the responses of its tasks in order.
+// The tasks are performed with the settings of cfg.
+func handleLine(feed feed.Feed, line []byte, cfg *config) ([]byte, error) {
+	var responses bytes.Buffer
+	_, err := performLine(cfg.writer(&responses), feed, line, 0, cfg)
+	return responses.Bytes(), err
+}
+
+// performLine parses one line of input as a task or a batch of tasks, performs the tasks on the feed in
+// order and writes their responses to w. An error stops the line and is returned, except that in a batch
+// the error of a task is written to w in place of its response and the rest of the batch is performed,
+// unless the run is strict. A DONE task stops the line and errDone is returned. performLine returns
+// the number of tasks handled, counting a task that failed and a line that could not be parsed but not DONE.
+// lineNumber is the line's number in the input, written with the errors of a batch, or 0 if it is not known.
+func performLine(w io.Writer, feed feed.Feed, line []byte, lineNumber int, cfg *config) (int, error) {
+	tasks, batch, err := decodeTasks(line, hasInt64Timestamps(feed))
+	if err != nil {
+		return 1, err
+	}
+	for i := 0; cfg.strict && i < len(tasks); i++ { // No task of the line is performed if one is bad.
+		if err := cfg.checkTask(tasks[i]); err != nil {
+			return i + 1, err
+		}
+	}
+	for i, cm := range tasks {
+		cm.Line = lineNumber
+		response, err := handleTask(feed, cm, cfg)
+		if err == errDone {
+			return i, err
+		} else if err != nil && (!batch || cfg.strict) {
+			return i + 1, err
+		} else if err != nil {
+			lineErrorTask(w, err, lineNumber)
+		} else {
+			w.Write(response)
+		}
+	}
+	return len(tasks), nil
+}
+
+// handleTask performs a task on the feed and returns the response, or an error if the task has an unknown
+// command or panicked. errDone is returned for the DONE task. Tasks are performed one at a time so a
+// BARRIER passes right away.
+func handleTask(feed feed.Feed, cm ClientMessage, cfg *config) ([]byte, error) {
+	if cm.Command == "DONE" { // Stop reading tasks.
+		return nil, errDone
+	}
+	if cm.Command == "BARRIER" { // Every earlier task has already been performed.
+		var response bytes.Buffer
+		barrierTask(&response, cm)
+		return response.Bytes(), nil
+	}
+	return safeDispatch(feed, cm, cfg, slog.Default())
+}
+
+// errEmptyBatch is reported for a line with a batch of no tasks.
+var errEmptyBatch = errors.New("a batch must have at least one task")
+
+// isCommentLine reports whether line is only whitespace or a comment starting with #, after any leading whitespace.
+func isCommentLine(line []byte) bool {
+	trimmed := bytes.TrimSpace(line)
+	return len(trimmed) == 0 || trimmed[0] == '#'
+}
+
+// decodeTasks decodes a line of input. A line starting with [ is a batch of tasks in a JSON array, e.g.
+// [{"command":"ADD",...},{"command":"FEED",...}], which are returned in order along with true. Any other
+// line is a single task, which is returned even if it could not be decoded, along with the error.
+// A blank line or a comment, i.e. a line starting with #, has no tasks, so hand-written inputs can use them.
+// If int64Timestamps is set the timestamps of the tasks are also decoded exactly, see decodeTask.
+func decodeTasks(line []byte, int64Timestamps bool) ([]ClientMessage, bool, error) {
+	elements, batch, err := splitTasks(line)
+	if err != nil {
+		return nil, batch, err
+	}
+	tasks, err := decodeElements(elements, batch, int64Timestamps)
+	return tasks, batch, err
+}
+
+// splitTasks splits a line of input in to the bytes of its tasks without decoding them: the elements of a
+// batch, otherwise the line itself. The bytes are kept as they were read, so a task queued as them is
+// decoded by the consumer exactly as it was sent, e.g. with an int64 timestamp past 2^53.
+func splitTasks(line []byte) ([]json.RawMessage, bool, error) {
+	if isCommentLine(line) {
+		return nil, false, nil
+	}
+	if trimmed := bytes.TrimLeft(line, " \t\r"); len(trimmed) > 0 && trimmed[0] == '[' {
+		var elements []json.RawMessage
+		if err := json.Unmarshal(trimmed, &elements); err != nil {
+			return nil, true, err
+		}
+		if len(elements) == 0 {
+			return nil, true, errEmptyBatch
+		}
+		return elements, true, nil
+	}
+	return []json.RawMessage{line}, false, nil
+}
+
+// decodeElements decodes the tasks split from a line by splitTasks, see decodeTasks.
+func decodeElements(elements []json.RawMessage, batch bool, int64Timestamps bool) ([]ClientMessage, error) {
+	tasks := make([]ClientMessage, len(elements))
+	for i, element := range elements {
+		var err error
+		if tasks[i], err = decodeTask(element, int64Timestamps); err != nil && batch {
+			return nil, err
+		} else if err != nil {
+			return tasks, err
+		}
+	}
+	return tasks, nil
+}
+
+// pendingTask is a task read by a producer that has not been queued yet: the decoded task, and the bytes it
+// was read as, which are what is queued.
+type pendingTask struct {
+	cm  ClientMessage   // the task as it was decoded
+	raw json.RawMessage // the task as it was read
+}
+
+// decodeTask decodes one task. If int64Timestamps is set the timestamp is also decoded exactly in to
+// Nanos, since a float64 cannot tell apart integers past 2^53, and a timestamp that is not an integer
+// is an error.
+func decodeTask(data []byte, int64Timestamps bool) (ClientMessage, error) {
+	var cm ClientMessage
+	if err := json.Unmarshal(data, &cm); err != nil || !int64Timestamps {
+		return cm, err
+	}
+	var exact struct {
+		Timestamp json.Number `json:"timestamp"`
+	}
+	if err := json.Unmarshal(data, &exact); err != nil {
+		return cm, err
+	}
+	if exact.Timestamp != "" {
+		nanos, err := exact.Timestamp.Int64()
+		if err != nil {
+			return cm, fmt.Errorf("timestamp %v is not an int64", exact.Timestamp)
+		}
+		cm.Nanos = nanos
+	}
+	return cm, nil
+}
+
+// hasInt64Timestamps reports whether the posts of f have exact int64 timestamps, so the tasks performed on
+// it are decoded with them.
+func hasInt64Timestamps(f feed.Feed) bool {
+	_, ok := f.(feed.Int64Feed)
+	return ok
+}
+
+// dispatch performs a task on the feed with the settings of cfg and returns the response for the client.
+// The task is counted in cfg for the summary. If there is an audit log then the tasks that can change
+// the feed are recorded to it. An error is returned instead if the command is unknown, see parseCommand.
+// If there is a rate limit and it has been reached, a task that can change the feed is not performed and
+// an error is returned as the response instead, and counted in cfg's tally of errors. So is a task whose
+// body is longer than cfg.maxBodyLen, which does not count toward the rate limit.
+// A command with a handler registered by registerHandler is performed by the handler.
+// The timestamps of the task are normalized before it is performed, and it is audited normalized.
+func dispatch(f feed.Feed, cm ClientMessage, cfg *config) ([]byte, error) {
+	var response bytes.Buffer
+	w := cfg.writer(&response)
+	if err := cfg.checkTask(cm); err == errBodyTooLong {
+		lineErrorTask(w, err, cm.Line)
+		return response.Bytes(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if cfg.limiter != nil && mutatingCommands[cm.Command] && !cfg.limiter.allow() {
+		lineErrorTask(w, errRateLimited, cm.Line)
+		return response.Bytes(), nil
+	}
+	cm = cfg.normalizeTask(cm)
+	if cfg.store != nil { // Each user has a feed of their own.
+		f = cfg.store.Get(cm.User)
+	}
+	command, err := parseCommand(cm.Command)
+	if handler := lookupHandler(cm.Command); handler != nil { // Perform a custom command.
+		handled := handler(f, cm)
+		if handled == nil {
+			return nil, fmt.Errorf("unknown command %q", cm.Command)
+		}
+		response.Write(handled)
+		if err != nil { // Only the built-in commands are counted.
+			return response.Bytes(), nil
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		switch command {
+		case CmdAdd: // Add a post.
+			if cfg.store != nil {
+				addUserPostTask(w, cfg.store, cm)
+			} else {
+				addPostTask(w, f, cm)
+			}
+		case CmdRemove: // Remove a post.
+			removePostTask(w, f, cm)
+		case CmdContains: // See if feed contains a post.
+			containsPostTask(w, f, cm)
+		case CmdFeed: // Visualize the feed.
+			showFeedTask(w, f, cm)
+		case CmdMove: // Move a post to a new timestamp.
+			movePostTask(w, f, cm)
+		case CmdLike: // Like a post.
+			likePostTask(w, f, cm)
+		case CmdTop: // Show the most liked posts.
+			topLikedTask(w, f, cm)
+		case CmdStats: // Summarize the feed.
+			statsTask(w, f, cm)
+		case CmdSelfTest: // Check the feed and the queue.
+			selfTestTask(w, f, cm, cfg.queue)
+		case CmdRemoveRange: // Remove a range of posts.
+			removeRangePostTask(w, f, cm)
+		case CmdUpsert: // Add a post or update its body.
+			upsertPostTask(w, f, cm)
+		case CmdSwap: // Replace the body of a post and get the old body back.
+			swapBodyTask(w, f, cm)
+		case CmdRemoveIf: // Remove a post if its body has not changed.
+			removeIfPostTask(w, f, cm)
+		case CmdCountMatch: // Count the posts containing some text.
+			countMatchingTask(w, f, cm)
+		case CmdPopOldest, CmdPopNewest, CmdPop: // Remove the oldest or newest post, or the post at a timestamp.
+			popPostTask(w, f, cm)
+		case CmdGetNth: // Get a post by its position from the newest.
+			getNthPostTask(w, f, cm)
+		case CmdNext, CmdPrev: // Get the post after or before a timestamp.
+			adjacentPostTask(w, f, cm)
+		case CmdClosest: // Get the post nearest to a timestamp.
+			closestPostTask(w, f, cm)
+		case CmdHistogram: // Count the posts in each time bucket.
+			histogramTask(w, f, cm)
+		case CmdEmpty: // See if the feed has no posts.
+			emptyTask(w, f, cm)
+		case CmdSize: // Total the bytes of the post bodies.
+			sizeTask(w, f, cm)
+		case CmdWait: // Wait for a post to be added.
+			waitForPostTask(w, f, cm)
+		case CmdTrim: // Keep only the newest posts.
+			trimPostTask(w, f, cm)
+		case CmdReplace: // Replace every post.
+			replaceTask(w, f, cm, cfg)
+		case CmdCompact: // Collapse runs of posts with the same body.
+			compactTask(w, f, cm)
+		case CmdDiff: // Compare the feed with an earlier feed.
+			diffTask(w, f, cm)
+		case CmdContainsApprox: // See if feed contains a post near a timestamp.
+			containsApproxPostTask(w, f, cm)
+		case CmdContainsMany: // See which of several bodies the feed contains.
+			containsManyTask(w, f, cm)
+		case CmdContainsAll: // See which of several timestamps the feed contains.
+			containsAllTask(w, f, cm, cfg)
+		default:
+			return nil, fmt.Errorf("unknown command %q", cm.Command)
+		}
+	}
+	cfg.counts.add(command)
+
+	// Record the tasks that can change the feed so the feed can be reconstructed.
+	if cfg.audit != nil && mutatingCommands[cm.Command] {
+		if err := cfg.audit.Record(cm, response.Bytes()); err != nil {
+			fmt.Fprintln(os.Stderr, "error: ", err)
+		}
+	}
+	return response.Bytes(), nil
+}
+
+// producer reads in tasks from r and adds these tasks to the queue. When the DONE task is read or r
+// ends, or no task has been read for the idle timeout, the producer closes the queue, which wakes up
+// all the waiting goroutines.
+func producer(r io.Reader, queue queue.Queue, ctx *SharedContext, maxLine int) {
+	producers([]io.Reader{r}, queue, ctx, maxLine)
+}
+
+// producerGroup is the producers reading tasks for the same queue. The queue is closed once, either by
+// the last producer to stop or by the idle watchdog, and no task is added to it once it is closed.
+type producerGroup struct {
+	mutex     sync.Mutex    // guards remaining and closing the queue
+	remaining int           // number of producers still reading
+	closed    chan struct{} // closed along with the queue
+	lastTask  int64         // when the last task was read in Unix nanoseconds, only accessed atomically
+}
+
+// isClosed reports whether the queue has been closed.
+func (g *producerGroup) isClosed() bool {
+	select {
+	case <-g.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeQueue marks the tasks as done and closes the queue, which wakes up all the waiting goroutines,
+// unless it is already closed. The caller must hold the mutex.
+func (g *producerGroup) closeQueue(queue queue.Queue, ctx *SharedContext) {
+	if !g.isClosed() {
+		atomic.StoreInt32(&ctx.done, 1)
+		queue.Close()
+		close(g.closed)
+	}
+}
+
+// newProducerGroup returns the group for count producers reading tasks for the same queue.
+func newProducerGroup(count int) *producerGroup {
+	return &producerGroup{remaining: count, closed: make(chan struct{}), lastTask: time.Now().UnixNano()}
+}
+
+// stop closes the queue unless it is already closed. Once stop returns nothing more is added to the
+// queue: the producers and TCP clients stop at their next task.
+func (g *producerGroup) stop(queue queue.Queue, ctx *SharedContext) {
+	g.mutex.Lock()
+	g.closeQueue(queue, ctx)
+	g.mutex.Unlock()
+}
+
+// abort stops the run at a bad task in strict mode. The queue is closed so the producers stop reading,
+// and the consumers answer the tasks still queued with errAborted, without performing them, and exit.
+func (g *producerGroup) abort(queue queue.Queue, ctx *SharedContext) {
+	atomic.StoreInt32(&ctx.aborted, 1)
+	g.stop(queue, ctx)
+}
+
+// watch closes the queue once no task has been read for ctx.idleTimeout, e.g. because whatever writes
+// the input hung without closing it, so that the consumers can exit instead of waiting forever. It
+// returns once the queue is closed.
+func (g *producerGroup) watch(queue queue.Queue, ctx *SharedContext) {
+	wait := ctx.idleTimeout
+	for {
+		select {
+		case <-g.closed:
+			return
+		case <-time.After(wait):
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&g.lastTask)))
+		if idle >= ctx.idleTimeout {
+			g.mutex.Lock()
+			if !g.isClosed() {
+				slog.Warn("no task read within the idle timeout, closing the queue", "idle", idle, "producers", g.remaining)
+				g.closeQueue(queue, ctx)
+			}
+			g.mutex.Unlock()
+			return
+		}
+		wait = ctx.idleTimeout - idle
+	}
+}
+
+// producers runs a producer goroutine for each reader, all adding tasks to the same queue. Each reader
+// stops being read once its DONE task has been read or it ends. The producers count down as they stop
+// and the last one to stop marks the tasks as done and closes the queue, so the consumers only finish
+// once every reader has been read. A reader that ends without a DONE task is logged as a warning, since
+// whatever wrote it may have crashed. If there is an idle timeout the queue is also closed once no task
+// has been read for that long, and producers still waiting on a reader stop at their next task.
+// producers returns once the queue is closed.
+func producers(readers []io.Reader, queue queue.Queue, ctx *SharedContext, maxLine int) {
+	newProducerGroup(len(readers)).read(readers, queue, ctx, maxLine)
+}
+
+// read runs the producers of the group, one for each reader, like producers. The caller keeps the group
+// so that it can stop the producers, e.g. on SIGINT.
+func (group *producerGroup) read(readers []io.Reader, queue queue.Queue, ctx *SharedContext, maxLine int) {
+	for i, r := range readers {
+		go func(i int, r io.Reader) {
+			if readTasks(r, queue, ctx, maxLine, group) {
+				slog.Debug("input finished with DONE", "input", i)
+			} else if !group.isClosed() {
+				slog.Warn("input ended without DONE", "input", i)
+			}
+			group.mutex.Lock()
+			group.remaining--
+			if group.remaining == 0 {
+				group.closeQueue(queue, ctx)
+			}
+			group.mutex.Unlock()
+		}(i, r)
+	}
+	if ctx.idleTimeout > 0 {
+		go group.watch(queue, ctx)
+	}
+	<-group.closed
+}
+
+// readTasks reads in tasks from r and adds them to the queue until the DONE task has been read or r ends.
 // When a producers adds a task, if there are goroutines waiting on tasks to consume,
-// the producer will wake one of these goroutine up to grab tasks.
-func producer(queue queue.Queue, ctx *SharedContext) {
+// the queue will wake one of these goroutine up to grab tasks.
+// If the queue goes over the high mark the producer stops reading until it drains to the low mark.
+// If there is a sequencer each task is expected by it before the task is queued.
+// STATUS and SUBSCRIBE tasks are handled right away instead of being queued.
+// The tasks of a line with a batch of tasks are queued as one entry, so that one consumer performs them
+// in order and their responses come out in order. STATUS and SUBSCRIBE tasks in a batch are still
+// handled right away, and a DONE task in a batch stops the producer after the tasks before it.
+// A line that cannot be decoded is reported with its line number in r.
+// If a line cannot be read (e.g. it is longer than maxLine bytes) an error message is printed and the
+// producer stops reading so that the tasks already read are still processed.
+// If the queue has been closed by the idle watchdog the producer stops reading at its next task.
+// In strict mode a task that cannot be decoded or fails checkTask, e.g. with an unknown command or a body
+// that is too long, is reported and aborts the run.
+// Return true if the DONE task was read.
+func readTasks(r io.Reader, queue queue.Queue, ctx *SharedContext, maxLine int, group *producerGroup) bool {
 
 	// Read in tasks and add to the queue
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		task := scanner.Text()
-		taskJSONBytes := []byte(task)
-		var cm ClientMessage
-		err := json.Unmarshal(taskJSONBytes, &cm)
-		if err != nil {
-			fmt.Println("error: ", err)
+	scanner := newScanner(r, maxLine)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		elements, batch, err := splitTasks([]byte(scanner.Text()))
+		var tasks []ClientMessage
+		if err == nil {
+			tasks, err = decodeElements(elements, batch, ctx.cfg.int64Timestamps)
 		}
-		if cm.Command != "DONE" {	
-			queue.Enqueue(taskJSONBytes)
-			atomic.AddInt64(ctx.numOfTasks, 1) // Atomically adding so that the entire context does not need to be locked.
-			ctx.cond.Signal() // Signal to a waiting task it can go.
-		} else { // Stop producing if DONE task has been read.
-			ctx.mutex.Lock()
-			*ctx.doneBool = true
-			ctx.cond.Broadcast() // Signal to waiting tasks they can go.
-			ctx.mutex.Unlock()
-			break
+		for i := 0; err == nil && ctx.cfg.strict && i < len(tasks); i++ {
+			err = ctx.cfg.checkTask(tasks[i])
+		}
+		atomic.StoreInt64(&group.lastTask, time.Now().UnixNano())
+		if err != nil && ctx.cfg.strict { // Stop everything at the first bad task.
+			lineErrorTask(ctx.output(), err, lineNumber)
+			group.abort(queue, ctx)
+			return false
+		} else if err != nil { // The line is reported here, so it is not queued for a consumer to fail on again.
+			lineErrorTask(ctx.output(), err, lineNumber)
+			continue
+		}
+
+		// The tasks of a batch, up to a DONE task, are queued together so one consumer performs them in order.
+		// A BARRIER splits a batch, since the tasks before it are queued and performed before reading on.
+		var queued []pendingTask
+		done := false
+		for i, cm := range tasks {
+			if cm.Command == "STATUS" { // Report the health of the consumers right away instead of queueing behind other tasks.
+				printResponse(ctx.output(), ServerStatusMessage{Id: cm.Id, PoolStatus: ctx.Status()})
+			} else if cm.Command == "SUBSCRIBE" && ctx.subscriptions != nil { // Stream the changes to the feed until all tasks are done.
+				ctx.subscriptions.start(ctx.output(), cm.Id)
+			} else if cm.Command == "BARRIER" { // Wait for every task queued so far before reading on.
+				if !queueTasks(queue, ctx, group, queued, batch) {
+					return false
+				}
+				queued = nil
+				ctx.waitForProcessed(atomic.LoadInt64(&ctx.queued))
+				barrierTask(ctx.output(), cm)
+			} else if cm.Command != "DONE" { // The task is tagged with its line for the errors the consumers report.
+				cm.Line = lineNumber
+				queued = append(queued, pendingTask{cm: cm, raw: withField(elements[i], "line", lineNumber)})
+			} else { // Stop producing if DONE task has been read.
+				done = true
+				break
+			}
+		}
+		if !queueTasks(queue, ctx, group, queued, batch) {
+			return false
+		}
+		if done {
+			return true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errorTask(ctx.output(), err)
+	}
+	return false
+}
+
+// queueTasks adds the tasks read from a line to the queue for readTasks: the tasks of a batch as one entry,
+// otherwise the one task, each as it was read. It returns false without queueing anything if the watchdog
+// has given up on the input. Once the tasks are queued it pauses while the queue is over the high mark.
+func queueTasks(queue queue.Queue, ctx *SharedContext, group *producerGroup, queued []pendingTask, batch bool) bool {
+	if len(queued) == 0 {
+		return true
+	}
+	group.mutex.Lock()
+	if group.isClosed() { // The watchdog gave up on the input.
+		group.mutex.Unlock()
+		return false
+	}
+	atomic.AddInt64(ctx.numOfTasks, int64(len(queued))) // Atomically adding so that the entire context does not need to be locked.
+	atomic.AddInt64(&ctx.queued, int64(len(queued)))
+	for _, task := range queued {
+		if ctx.sequencer != nil {
+			ctx.sequencer.expect(task.cm.Id)
 		}
 	}
+	enqueuePending(queue, queued, batch) // Enqueue wakes up a waiting goroutine.
+	group.mutex.Unlock()
+	ctx.waitForSpace(queue)
+	return true
+}
+
+// newTwitterFeed creates the feed tasks are performed on. A feed ranked by score shows the post with the
+// highest score first, otherwise posts are shown newest first with posts with the same timestamp in the
+// order of tieBreak. With int64Timestamps the posts keep exact int64 timestamps, see feed.NewFeedInt64.
+// A positive snapshotRefresh turns on the feed's snapshot, refreshed that often, for FEED tasks to read
+// while the lock is busy.
+func newTwitterFeed(rank string, tieBreak feed.TieBreak, int64Timestamps bool, snapshotRefresh time.Duration) feed.Feed {
+	f := feed.NewFeedWithTieBreak(tieBreak)
+	if rank == "score" {
+		f = feed.NewFeedWithComparator(feed.ByScore)
+	} else if int64Timestamps {
+		f = feed.NewFeedInt64(tieBreak)
+	}
+	if snapshotRefresh > 0 {
+		f.(feed.SnapshotFeed).SetSnapshotRefresh(snapshotRefresh)
+	}
+	return f
 }
 
 // main reads in the number of threads and the maximum number of tasks a given thread can process at once.
@@ -203,63 +2075,281 @@ func producer(queue queue.Queue, ctx *SharedContext) {
 // consume. 
 // main goroutine exits when all tasks in the queue are completed and the DONE task has been read.
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout))
+}
+
+// The exit codes of run.
+const (
+	exitOK          = 0   // every task was processed without an error
+	exitTaskErrors  = 1   // at least one error message was written, e.g. for a task with an unknown command
+	exitFatal       = 2   // the program could not run, e.g. because of a bad argument or an input that cannot be opened
+	exitInterrupted = 130 // the program was stopped by SIGINT
+)
+
+// performSequentially performs the tasks of each reader in turn, writing the responses to w, and returns
+// the number of tasks processed. It stops before the next task once interrupted is closed, and at the
+// first bad task in strict mode, in which case it returns false.
+func performSequentially(w io.Writer, feed feed.Feed, readers []io.Reader, maxLine int, cfg *config, interrupted <-chan struct{}) (int64, bool) {
+	var processed int64
+	for _, r := range readers { // Read the inputs one after another.
+		scanner := newScanner(r, maxLine)
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			select {
+			case <-interrupted:
+				return processed, true
+			default:
+			}
+			handled, err := performLine(w, feed, scanner.Bytes(), lineNumber, cfg)
+			processed += int64(handled)
+			if err == errDone { // Stop reading from this input.
+				break
+			} else if err != nil {
+				lineErrorTask(w, err, lineNumber)
+				if cfg.strict { // Stop at the first bad task.
+					return processed, false
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			errorTask(w, err)
+		}
+	}
+	return processed, true
+}
+
+// run is the program: it parses the flags and arguments in arguments, performs the tasks read from stdin,
+// or from the input files or TCP clients, and writes the responses to stdout. It returns the exit code:
+// exitOK if every task was processed cleanly, exitTaskErrors if an error message was written for any task,
+// exitFatal if the flags or arguments are bad or the program could not start, and exitInterrupted on SIGINT.
+// The settings of the run and the counts that go with them are kept in a config of its own, so run can be
+// called more than once.
+func run(arguments []string, stdin io.Reader, stdout io.Writer) int {
+	cfg := newConfig()
+
+	// Read in flags.
+	flags := flag.NewFlagSet("twitter", flag.ContinueOnError)
+	priority := flags.Bool("priority", false, "process FEED and CONTAINS tasks before ADD and REMOVE tasks")
+	maxLine := flags.Int("maxline", 1024*1024, "the maximum length in bytes of an input line")
+	flags.BoolVar(&cfg.compact, "compact", false, "print each response as single-line JSON")
+	flags.BoolVar(&cfg.strict, "strict", false, "exit with an error at the first request that cannot be decoded, has an unknown command or a body longer than -maxBodyLen")
+	flags.IntVar(&cfg.precision, "precision", -1, "round timestamps to this many decimal places of a second (e.g. 6 for microseconds), negative to use timestamps exactly as given")
+	tcpAddr := flags.String("tcp", "", "serve TCP clients on this address (e.g. :9000) instead of reading Stdin")
+	highMark := flags.Int("highmark", 0, "pause reading tasks once more than this many are queued (0 for no limit)")
+	lowMark := flags.Int("lowmark", 0, "resume reading tasks once this many or fewer are queued")
+	taskTimeout := flags.Duration("taskTimeout", 0, "report a timeout for a task that takes longer than this (e.g. 5s), 0 for no limit")
+	idleTimeout := flags.Duration("idleTimeout", 0, "finish once no task has been read for this long (e.g. 1m) even without DONE, 0 to wait forever (parallel version only)")
+	snapshotRefresh := flags.Duration("snapshotRefresh", 0, "serve FEED tasks from a snapshot of the feed refreshed this often (e.g. 100ms) while its lock is busy, 0 to always wait for the lock")
+	flushInterval := flags.Duration("flushInterval", 100*time.Millisecond, "how often responses buffered for Stdout are flushed, 0 to write each response right away")
+	auditPath := flags.String("audit", "", "append every task that changes the feed and its result to this file")
+	ordered := flags.Bool("ordered", false, "print responses in the order their tasks were read instead of the order they finish (parallel version only)")
+	summary := flags.Bool("summary", false, "print the number of tasks processed for each command once all tasks have been processed")
+	flags.IntVar(&cfg.maxBodyLen, "maxBodyLen", 0, "report an error for ADD, UPSERT and SWAP tasks whose body is longer than this many characters (runes, not bytes), 0 for no limit")
+	quota := flags.Int("quota", 0, "give each user (the user field of a task) a feed of their own holding at most this many posts, 0 for a single feed without a limit")
+	maxAddsPerSec := flags.Int("maxAddsPerSec", 0, "report an error for tasks that change the feed once more than this many are performed per second (0 for no limit)")
+	flags.BoolVar(&cfg.int64Timestamps, "int64", false, "treat timestamps as exact int64s (e.g. Unix nanoseconds): ADD, REMOVE and CONTAINS use them exactly, the other tasks as float64s, which are exact up to 2^53")
+	rank := flags.String("rank", "time", "order of the feed: time (newest first) or score (highest score first, for a ranked timeline)")
+	flags.BoolVar(&cfg.traceWorkers, "traceWorkers", false, "include the id of the goroutine that performed a task in its response and log each task performed to Stderr (parallel version only)")
+	var inputs inputFiles
+	flags.Var(&inputs, "input", "read tasks from this file instead of Stdin, repeat to read several files at once (parallel version only reads them concurrently)")
+	tieBreak := flags.String("tiebreak", "id", "order of posts with the same timestamp: id (most recently added first) or body (lexicographic)")
+	flags.Usage = func() { printUsage(stdout, flags) }
+	if err := flags.Parse(arguments); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitFatal
+	}
+	args := flags.Args()
+	if *highMark > 0 && (*lowMark < 0 || *lowMark >= *highMark) {
+		fmt.Fprintln(stdout, "error: the low mark must be at least 0 and less than the high mark")
+		flags.Usage()
+		return exitFatal
+	}
+	tieBreaks := map[string]feed.TieBreak{"id": feed.TieBreakID, "body": feed.TieBreakBody}
+	if _, ok := tieBreaks[*tieBreak]; !ok {
+		fmt.Fprintln(stdout, "error: the tie-break must be id or body")
+		flags.Usage()
+		return exitFatal
+	}
+
+	if *rank != "time" && *rank != "score" {
+		fmt.Fprintln(stdout, "error: the rank must be time or score")
+		flags.Usage()
+		return exitFatal
+	}
+	if cfg.int64Timestamps && *rank == "score" {
+		fmt.Fprintln(stdout, "error: a feed with int64 timestamps is ordered by time, not by score")
+		flags.Usage()
+		return exitFatal
+	}
+	if *quota > 0 && (cfg.int64Timestamps || *rank == "score") {
+		fmt.Fprintln(stdout, "error: the feeds of users with a quota have float64 timestamps and are ordered by time")
+		flags.Usage()
+		return exitFatal
+	}
+	if len(inputs) > 0 && *tcpAddr != "" {
+		fmt.Fprintln(stdout, "error: tasks are read either from input files or from TCP clients, not both")
+		flags.Usage()
+		return exitFatal
+	}
+	if cfg.traceWorkers {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+
+	// Open the audit log.
+	if *auditPath != "" {
+		var err error
+		if cfg.audit, err = NewFileAuditLog(*auditPath); err != nil {
+			errorTask(stdout, err)
+			return exitFatal
+		}
+		defer cfg.audit.Close()
+	}
+
+	// Open the files tasks are read from.
+	readers, closeInputs, err := openInputs(inputs, stdin)
+	if err != nil {
+		errorTask(stdout, err)
+		return exitFatal
+	}
+	defer closeInputs()
+
+	// Buffer the responses written to Stdout. They are flushed periodically, on SIGINT and once all tasks are done.
+	out := newFlushWriter(stdout, *flushInterval)
 
 	// Create a new feed.
-	feed := feed.NewFeed()
+	if *maxAddsPerSec > 0 {
+		cfg.limiter = newRateLimiter(*maxAddsPerSec)
+	}
+	if *quota > 0 {
+		cfg.store = feed.NewFeedStore(func() feed.Feed {
+			return newTwitterFeed(*rank, tieBreaks[*tieBreak], false, *snapshotRefresh)
+		}, *quota)
+	}
+	feed := newTwitterFeed(*rank, tieBreaks[*tieBreak], cfg.int64Timestamps, *snapshotRefresh)
+	if cfg.store != nil { // Tasks without a user, and the subscriptions, are for user 0.
+		feed = cfg.store.Get(0)
+	}
 
 	// Initialize a new queue.
-	queue := queue.NewQueue()
+	queue := newQueue(*priority)
+
+	// On SIGINT stop performing tasks, write what is left in the buffer and return.
+	interrupted, stopInterrupt := notifyInterrupt()
+	defer stopInterrupt()
 
 	// If command line arguments are not given, then run the tasks sequentially
-	if len(os.Args) != 3 {
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			task := scanner.Text()
-			taskJSONBytes := []byte(task)
-			var cm ClientMessage
-			err := json.Unmarshal(taskJSONBytes, &cm)
-			if err != nil {
-				fmt.Println("error: ", err)
-			}
-			if cm.Command == "ADD" { // Add a post.
-				addPostTask(feed, cm)
-			} else if cm.Command == "REMOVE" { // Remove a post.
-				removePostTask(feed, cm)
-			} else if cm.Command == "CONTAINS" { // See if feed contains a post.
-				containsPostTask(feed, cm)
-			} else if cm.Command == "FEED" { // Visualize the feed.
-				showFeedTask(feed, cm)
-			} else if cm.Command == "DONE" { // Stop reading from stdin.
-				break
-			}
+	if len(args) != 2 && *tcpAddr == "" {
+		w := cfg.writer(out)
+		var processed int64
+		var clean bool
+		finished := make(chan struct{})
+		go func() { // Read on another goroutine, so a SIGINT is handled while waiting for a line.
+			processed, clean = performSequentially(w, feed, readers, *maxLine, cfg, interrupted)
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-interrupted:
+			out.Close()
+			return exitInterrupted
+		}
+		if !clean { // A bad task stopped the run in strict mode.
+			out.Close()
+			return exitTaskErrors
+		}
+		if *summary {
+			summaryTask(w, &cfg.counts)
 		}
+		doneTask(w, processed)
+		out.Close()
 
 	} else { // Otherwise spawn threads as consumers and produce tasks to queue
+		cfg.queue = queue
 
-		// Read in command line arguments.
-		threads, _ := strconv.ParseInt(os.Args[1], 10, 64)
-		block, _ := strconv.ParseInt(os.Args[2], 10, 64)
+		// Read in command line arguments. Serving TCP clients without them uses a single goroutine.
+		threads, block := int64(1), int64(1)
+		if len(args) == 2 {
+			var err error
+			if threads, block, err = parseArgs(args); err != nil {
+				fmt.Fprintln(stdout, "error:", err)
+				flags.Usage()
+				return exitFatal
+			}
+		}
 
 		// Initialize sync mechanisms.
 		var wg            sync.WaitGroup
-		var mtx           sync.Mutex
 		var numOfTasks    int64
-		doneBool := false
+		var processed     int64
 
-		condVar := sync.NewCond(&mtx)
-		context := SharedContext{wg: &wg, cond: condVar, mutex: &mtx, numOfTasks: &numOfTasks, doneBool: &doneBool}
-
-		// Spawn goroutines
-		for i := int64(0); i < threads; i++ {
-			wg.Add(1)
-			go consumer(i, block, feed, queue, &context)
+		context := SharedContext{wg: &wg, numOfTasks: &numOfTasks, processed: &processed, taskTimeout: *taskTimeout, idleTimeout: *idleTimeout, out: out, cfg: cfg}
+		context.subscriptions = newSubscriptions(feed)
+		if *highMark > 0 {
+			context.highMark, context.lowMark = *highMark, *lowMark
+			context.space = sync.NewCond(new(sync.Mutex))
 		}
+		if *ordered {
+			context.sequencer = newSequencer(context.out)
+		}
+
+		// Print the pending tasks to Stderr on SIGUSR1.
+		stopSnapshot := notifySnapshot(os.Stderr, queue)
+		defer stopSnapshot()
 
-		// Start producing tasks.
-		producer(queue, &context)
+		// Spawn goroutines
+		completed := spawnConsumers(threads, block, feed, queue, &context)
 
-		wg.Wait()
+		// Start producing tasks, either from Stdin, from the input files or from TCP clients.
+		var listener net.Listener
+		if *tcpAddr != "" {
+			var err error
+			if listener, err = net.Listen("tcp", *tcpAddr); err != nil {
+				errorTask(context.output(), err)
+				out.Close()
+				return exitFatal
+			}
+			context.clients = newClients()
+		}
+		group := newProducerGroup(len(readers))
+		go func() {
+			if listener != nil {
+				serveTCP(listener, queue, &context, *maxLine, group)
+				group.stop(queue, &context)
+			} else {
+				group.read(readers, queue, &context, *maxLine)
+			}
+		}()
 
+		select {
+		case <-completed:
+		case <-interrupted:
+			// Stop the consumers and report the tasks that were never processed to Stderr.
+			// Stop reading and close the queue before the consumers, so nothing is queued behind the report.
+			atomic.StoreInt32(&context.stopped, 1)
+			group.stop(queue, &context)
+			if listener != nil {
+				listener.Close()
+			}
+			<-completed
+			unprocessedTask(cfg.writer(os.Stderr), queue, &context)
+			out.Close()
+			return exitInterrupted
+		}
+		context.subscriptions.stopAll()
+		if atomic.LoadInt32(&context.aborted) == 1 { // A bad task stopped the run in strict mode.
+			out.Close()
+			return exitTaskErrors
+		}
 
+		// All task output has been printed so the summary and the acknowledgement are the last things printed.
+		if *summary {
+			summaryTask(context.output(), &cfg.counts)
+		}
+		doneTask(context.output(), atomic.LoadInt64(&processed))
+		out.Close()
+	}
+	if atomic.LoadInt64(&cfg.errors) > 0 {
+		return exitTaskErrors
 	}
+	return exitOK
 }
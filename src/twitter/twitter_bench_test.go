@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"src/feed"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkShowFeed compares building the posts of a FEED response from the byte data ShowFeed returns,
+// which unmarshals every post only to marshal it again, with copying them from ShowFeedPosts.
+func BenchmarkShowFeed(b *testing.B) {
+	f := feed.NewFeed()
+	for i := 1; i <= 1000; i++ {
+		f.AddWithAuthor("post number "+strconv.Itoa(i), "author", float64(i)+0.25)
+	}
+	b.Run("bytes", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			printResponse(io.Discard, ServerFeedMessage{Id: i, Feed: postData(f.ShowFeed())})
+		}
+	})
+	b.Run("posts", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			printResponse(io.Discard, ServerFeedMessage{Id: i, Feed: postViews(f.ShowFeedPosts())})
+		}
+	})
+}
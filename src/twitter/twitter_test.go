@@ -1,12 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"fmt"
+	"log/slog"
+	"math"
 	"math/rand"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"src/feed"
+	"src/lock"
+	"src/queue"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -116,6 +129,55 @@ func createFeed(numbers []int, idx int) (_TestFeedRequest, _TestFeedResponse, in
 	return request, response, idx + 1
 }
 
+// runTwitterOutput runs the twitter program with the given arguments, writes input to its stdin and returns everything it
+// printed to stdout. Exiting with exitTaskErrors because some of the tasks reported errors still counts as exiting cleanly.
+func runTwitterOutput(t *testing.T, input string, args ...string) string {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "go", append([]string{"run", "."}, args...)...)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == exitTaskErrors) {
+		t.Fatalf("<runTwitter>: twitter %v did not exit cleanly: %v", args, err)
+	}
+	return string(out)
+}
+
+// doneAck returns the DONE acknowledgement printed by -compact once processed tasks have been processed.
+func doneAck(processed int) string {
+	return fmt.Sprintf(`{"command":"DONE","status":"complete","processed":%v}`, processed) + "\n"
+}
+
+// withoutDoneAck returns a reader over the responses read from r without the DONE acknowledgement printed
+// after them, for the tests that count the responses to their tasks. The responses are passed on as they
+// are read, so a test that reads slowly still makes the program wait for it.
+func withoutDoneAck(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		decoder := json.NewDecoder(r)
+		encoder := json.NewEncoder(pw)
+		for {
+			var response json.RawMessage
+			if err := decoder.Decode(&response); err != nil {
+				pw.Close()
+				return
+			}
+			var ack ServerDoneMessage
+			if json.Unmarshal(response, &ack) == nil && ack.Command == "DONE" {
+				continue
+			}
+			encoder.Encode(response)
+		}
+	}()
+	return pr
+}
+
+// runTwitter runs the twitter program like runTwitterOutput but returns a decoder over everything it printed to stdout.
+func runTwitter(t *testing.T, input string, args ...string) *json.Decoder {
+	return json.NewDecoder(strings.NewReader(runTwitterOutput(t, input, args...)))
+}
 
 // This test only provides a "DONE" Command, which should cause the program to exit immediately.
 func TestSimpleDone(t *testing.T) {
@@ -125,7 +187,7 @@ func TestSimpleDone(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 
 	stdin, errIn := cmd.StdinPipe()
 	if errIn != nil {
@@ -165,7 +227,7 @@ func TestSimpleWaitDone(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	/*stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -208,7 +270,7 @@ func TestAddRequests(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -242,7 +304,7 @@ func TestAddRequests(t *testing.T) {
 	}()
 
 	go func() {
-		decoder := json.NewDecoder(stdout)
+		decoder := json.NewDecoder(withoutDoneAck(stdout))
 		var count int
 		for {
 			var response _TestNormalResponse
@@ -284,7 +346,7 @@ func TestSimpleAddRequest(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -319,7 +381,7 @@ func TestSimpleAddRequest(t *testing.T) {
 	}()
 
 	go func() {
-		decoder := json.NewDecoder(stdout)
+		decoder := json.NewDecoder(withoutDoneAck(stdout))
 		var count int
 		for {
 			var response _TestNormalResponse
@@ -363,7 +425,7 @@ func TestSimpleContainsRequest(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -399,7 +461,7 @@ func TestSimpleContainsRequest(t *testing.T) {
 	}()
 
 	go func() {
-		decoder := json.NewDecoder(stdout)
+		decoder := json.NewDecoder(withoutDoneAck(stdout))
 		var count int
 		for {
 			var response _TestNormalResponse
@@ -441,7 +503,7 @@ func TestAddWithContainsRequest(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -484,7 +546,7 @@ func TestAddWithContainsRequest(t *testing.T) {
 	}()
 
 	go func() {
-		decoder := json.NewDecoder(stdout)
+		decoder := json.NewDecoder(withoutDoneAck(stdout))
 		var count int
 		for {
 			var response _TestNormalResponse
@@ -530,7 +592,7 @@ func TestSimpleFeedRequest(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -565,7 +627,7 @@ func TestSimpleFeedRequest(t *testing.T) {
 	}()
 
 	go func() {
-		decoder := json.NewDecoder(stdout)
+		decoder := json.NewDecoder(withoutDoneAck(stdout))
 		var count int
 		for {
 			var response _TestFeedResponse
@@ -607,7 +669,7 @@ func TestSimpleAddAndFeedRequest(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -649,7 +711,7 @@ func TestSimpleAddAndFeedRequest(t *testing.T) {
 	}()
 
 	go func() {
-		decoder := json.NewDecoder(stdout)
+		decoder := json.NewDecoder(withoutDoneAck(stdout))
 		var count int
 		for {
 			var response _TestNormalResponse
@@ -710,7 +772,7 @@ func TestSimpleRemoveRequest(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -747,7 +809,7 @@ func TestSimpleRemoveRequest(t *testing.T) {
 	}()
 
 	go func() {
-		decoder := json.NewDecoder(stdout)
+		decoder := json.NewDecoder(withoutDoneAck(stdout))
 		var count int
 		for {
 			var response _TestNormalResponse
@@ -789,7 +851,7 @@ func TestAllRequests(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "go",  "run" , "twitter.go", numOfThreadsStr, blockSizeStr)
+	cmd := exec.CommandContext(ctx, "go", "run", ".", numOfThreadsStr, blockSizeStr)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		t.Fatal("<runTwitter>: Error in Getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -888,7 +950,7 @@ func TestAllRequests(t *testing.T) {
 	}()
 
 	go func() {
-		decoder := json.NewDecoder(stdout)
+		decoder := json.NewDecoder(withoutDoneAck(stdout))
 		var count int
 		for {
 			var response _TestNormalResponse
@@ -979,4 +1041,2234 @@ func TestAllRequests(t *testing.T) {
 		t.Errorf("The automated test timed out. You may have a deadlock, starvation issue and/or you did not implement" +
 			" the necessary code for passing this test.")
 	}
-}
\ No newline at end of file
+}
+
+// This test interleaves many ADD commands with a single FEED command on a priority queue and checks that the
+// FEED command is processed before the remaining ADD commands.
+func TestPriorityFeedBeforeAdds(t *testing.T) {
+
+	q := newQueue(true)
+	numbers := generateSlice(100)
+	requests, _, idx := createAdds(numbers, 0)
+	requestFeed, _, _ := createFeed([]int{}, idx)
+
+	for i := 0; i < len(numbers); i++ {
+		if i == len(numbers)/2 {
+			feedBytes, _ := json.Marshal(requestFeed)
+			enqueueTask(q, ClientMessage{Command: requestFeed.Command, Id: int(requestFeed.Id)}, feedBytes)
+		}
+		request := requests[i]
+		addBytes, _ := json.Marshal(request)
+		enqueueTask(q, ClientMessage{Command: request.Command, Id: int(request.Id)}, addBytes)
+	}
+
+	var cm ClientMessage
+	json.Unmarshal(q.Dequeue(), &cm)
+	if cm.Command != "FEED" || int64(cm.Id) != requestFeed.Id {
+		t.Errorf("Expected the FEED command to be processed first. Got(%v,%v)", cm.Command, cm.Id)
+	}
+	for i := 0; i < len(numbers); i++ {
+		var cm ClientMessage
+		json.Unmarshal(q.Dequeue(), &cm)
+		if cm.Command != "ADD" || cm.Id != i {
+			t.Errorf("Expected the ADD commands in order after the FEED. Got(%v,%v), Expected(ADD,%v)", cm.Command, cm.Id, i)
+		}
+	}
+
+	// Without priority the FEED command waits behind the ADD commands enqueued before it.
+	if _, ok := newQueue(false).(queue.PriorityQueue); ok {
+		t.Errorf("The default queue should not be a priority queue")
+	}
+}
+
+// This test adds a post with a body longer than the default 64KB scanner buffer and checks that it shows up in
+// the feed, then checks that a line longer than -maxline is reported with an error instead of being dropped.
+func TestOversizedLine(t *testing.T) {
+
+	body := strings.Repeat("a", 100*1024)
+	add, _ := json.Marshal(_TestAddRequest{"ADD", 1, 1, body})
+	feed, _ := json.Marshal(_TestFeedRequest{"FEED", 2})
+	input := string(add) + "\n" + string(feed) + "\n" + `{"command":"DONE"}` + "\n"
+
+	for _, args := range [][]string{{}, {"1", "1"}} {
+		decoder := runTwitter(t, input, args...)
+		var addResponse _TestNormalResponse
+		var feedResponse _TestFeedResponse
+		if err := decoder.Decode(&addResponse); err != nil || !addResponse.Success {
+			t.Errorf("%v: Expected the ADD with a long body to succeed. Got:%v", args, addResponse)
+		}
+		if err := decoder.Decode(&feedResponse); err != nil || len(feedResponse.Feed) != 1 || feedResponse.Feed[0].Body != body {
+			t.Errorf("%v: Expected the FEED to contain the long body. Got %v posts", args, len(feedResponse.Feed))
+		}
+	}
+
+	for _, args := range [][]string{{"-maxline", "1000"}, {"-maxline", "1000", "1", "1"}} {
+		decoder := runTwitter(t, input, args...)
+		var errorResponse struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&errorResponse); err != nil || errorResponse.Error == "" {
+			t.Errorf("%v: Expected an error for a line longer than -maxline. Got:%v", args, errorResponse)
+		}
+	}
+}
+
+// This test runs a mix of commands with -ack and checks that the DONE acknowledgement is printed exactly once, after
+// every other response, with the number of commands processed.
+func TestDoneAcknowledgement(t *testing.T) {
+
+	numbers := generateSlice(50)
+	requests, _, idx := createAdds(numbers, 0)
+	requestFeed, _, _ := createFeed(numbers, idx)
+	var input strings.Builder
+	encoder := json.NewEncoder(&input)
+	for i := 0; i < len(numbers); i++ {
+		encoder.Encode(requests[i])
+	}
+	encoder.Encode(requestFeed)
+	encoder.Encode(_TestDoneRequest{"DONE"})
+
+	for _, args := range [][]string{{}, {"8", "3"}} {
+		decoder := runTwitter(t, input.String(), args...)
+		var responses []map[string]interface{}
+		for {
+			var response map[string]interface{}
+			if err := decoder.Decode(&response); err != nil {
+				break
+			}
+			responses = append(responses, response)
+		}
+		if len(responses) != len(numbers)+2 {
+			t.Fatalf("%v: Expected %v responses, %v plus the DONE acknowledgement. Got:%v", args, len(numbers)+2, len(numbers)+1, len(responses))
+		}
+		for _, response := range responses[:len(responses)-1] {
+			if response["command"] == "DONE" {
+				t.Errorf("%v: The DONE acknowledgement was printed before the last response", args)
+			}
+		}
+		last := responses[len(responses)-1]
+		if last["command"] != "DONE" || last["status"] != "complete" || last["processed"] != float64(len(numbers)+1) {
+			t.Errorf("%v: Expected the DONE acknowledgement last with processed:%v. Got:%v", args, len(numbers)+1, last)
+		}
+	}
+}
+
+// This test moves posts with MOVE requests and checks the responses and that the feed is ordered by the new timestamps.
+func TestMoveRequest(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":1}
+{"command":"ADD","id":1,"body":"second","timestamp":2}
+{"command":"MOVE","id":2,"timestamp":1,"newTimestamp":3}
+{"command":"MOVE","id":3,"timestamp":9,"newTimestamp":10}
+{"command":"MOVE","id":4,"timestamp":2,"newTimestamp":3}
+{"command":"FEED","id":5}
+{"command":"DONE"}
+`
+	decoder := runTwitter(t, input)
+	expected := []bool{true, true, true, false, false}
+	for i, success := range expected {
+		var response _TestNormalResponse
+		if err := decoder.Decode(&response); err != nil || response.Id != int64(i) || response.Success != success {
+			t.Errorf("Expected response (%v,%v). Got(%v,%v)", i, success, response.Id, response.Success)
+		}
+	}
+	var feedResponse _TestFeedResponse
+	decoder.Decode(&feedResponse)
+	order := []_TestPostData{{"first", 3}, {"second", 2}}
+	if len(feedResponse.Feed) != len(order) || feedResponse.Feed[0] != order[0] || feedResponse.Feed[1] != order[1] {
+		t.Errorf("Expected the feed:%v. Got:%v", order, feedResponse.Feed)
+	}
+}
+
+// This test runs a mix of commands with -compact and checks that every response is valid JSON on a single line.
+func TestCompactOutput(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":1}
+{"command":"ADD","id":1,"body":"second","timestamp":2}
+{"command":"CONTAINS","id":2,"timestamp":1}
+{"command":"REMOVE","id":3,"timestamp":2}
+{"command":"FEED","id":4}
+{"command":"DONE"}
+`
+	for _, args := range [][]string{{"-compact"}, {"-compact", "1", "1"}} {
+		lines := strings.Split(strings.TrimSuffix(runTwitterOutput(t, input, args...), "\n"), "\n")
+		if len(lines) != 6 {
+			t.Fatalf("%v: Expected 5 single-line responses and the DONE acknowledgement. Got %v lines:\n%v", args, len(lines), strings.Join(lines, "\n"))
+		}
+		for _, line := range lines {
+			var response map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &response); err != nil {
+				t.Errorf("%v: Response is not valid JSON:%v", args, line)
+			}
+		}
+		if lines[4] != `{"id":4,"feed":[{"body":"first","timestamp":1}],"version":3}` {
+			t.Errorf("%v: Unexpected FEED response:%v", args, lines[4])
+		}
+	}
+}
+
+// This test sends a batch of tasks of several commands on one line and checks that every task is performed
+// and the responses come out in the order of the tasks, both sequentially and in parallel, and that the
+// tasks of a batch before a DONE task are still performed.
+func TestBatchLine(t *testing.T) {
+
+	batch := `[{"command":"ADD","id":0,"body":"first","timestamp":1},{"command":"ADD","id":1,"body":"second","timestamp":2},` +
+		`{"command":"CONTAINS","id":2,"timestamp":1},{"command":"REMOVE","id":3,"timestamp":1},` +
+		`{"command":"FEED","id":4},{"command":"COUNTMATCH","id":5}]` + "\n"
+	expected := `{"success":true,"id":0,"postId":1}
+{"success":true,"id":1,"postId":2}
+{"success":true,"id":2}
+{"success":true,"id":3}
+{"id":4,"feed":[{"body":"second","timestamp":2}],"version":3}
+{"id":5,"count":1}
+`
+	// Several consumers with a block size smaller than the batch still perform it in order.
+	for _, args := range [][]string{{"-compact"}, {"-compact", "4", "1"}} {
+		if output := runTwitterOutput(t, batch+`{"command":"DONE"}`+"\n", args...); output != expected+doneAck(6) {
+			t.Errorf("%v: Expected the responses of the batch in order:\n%v\nGot:\n%v", args, expected, output)
+		}
+	}
+
+	// A DONE task in a batch stops reading after the tasks before it.
+	done := `[{"command":"STATS","id":6},{"command":"DONE"},{"command":"ADD","id":7,"body":"after done","timestamp":3}]
+{"command":"ADD","id":8,"body":"after done","timestamp":4}
+`
+	expected += `{"id":6,"count":1,"oldest":2,"newest":2,"totalLikes":0}` + "\n"
+	for _, args := range [][]string{{"-compact"}, {"-compact", "1", "1"}} {
+		if output := runTwitterOutput(t, batch+done, args...); output != expected+doneAck(7) {
+			t.Errorf("%v: Expected the tasks before DONE to be performed:\n%v\nGot:\n%v", args, expected, output)
+		}
+	}
+
+	// A bad task in a batch gets an error in place of its response and the rest of the batch is performed.
+	f := feed.NewFeed()
+	response, err := handleLine(f, []byte(`[{"command":"UNKNOWN","id":9},{"command":"ADD","id":10,"body":"first","timestamp":1}]`), newConfig())
+	if err != nil || !strings.Contains(string(response), "unknown command") || !f.Contains(1) {
+		t.Errorf("Expected an error for the unknown task and the ADD to be performed. Got:%q %v", response, err)
+	}
+	if _, err := handleLine(f, []byte(`[]`), newConfig()); err != errEmptyBatch {
+		t.Errorf("Expected an empty batch to be an error. Got:%v", err)
+	}
+}
+
+// This test likes posts with LIKE requests and checks that a TOP request returns the most liked posts first.
+func TestLikeAndTopRequests(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":1}
+{"command":"ADD","id":1,"body":"second","timestamp":2}
+{"command":"ADD","id":2,"body":"third","timestamp":3}
+{"command":"LIKE","id":3,"timestamp":1}
+{"command":"LIKE","id":4,"timestamp":1}
+{"command":"LIKE","id":5,"timestamp":3}
+{"command":"LIKE","id":6,"timestamp":4}
+{"command":"TOP","id":7,"limit":2}
+{"command":"DONE"}
+`
+	decoder := runTwitter(t, input)
+	expected := []bool{true, true, true, true, true, true, false}
+	for i, success := range expected {
+		var response _TestNormalResponse
+		if err := decoder.Decode(&response); err != nil || response.Id != int64(i) || response.Success != success {
+			t.Errorf("Expected response (%v,%v). Got(%v,%v)", i, success, response.Id, response.Success)
+		}
+	}
+	var topResponse struct {
+		Id   int64 `json:"id"`
+		Feed []struct {
+			Body  string `json:"body"`
+			Likes int    `json:"likes"`
+		} `json:"feed"`
+	}
+	decoder.Decode(&topResponse)
+	if topResponse.Id != 7 || len(topResponse.Feed) != 2 ||
+		topResponse.Feed[0].Body != "first" || topResponse.Feed[0].Likes != 2 ||
+		topResponse.Feed[1].Body != "third" || topResponse.Feed[1].Likes != 1 {
+		t.Errorf("Expected the two most liked posts. Got:%v", topResponse)
+	}
+}
+
+func TestFeedSinceRequest(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":1}
+{"command":"ADD","id":1,"body":"second","timestamp":2}
+{"command":"ADD","id":2,"body":"third","timestamp":3}
+{"command":"FEED","id":3,"since":1}
+{"command":"FEED","id":4}
+{"command":"DONE"}
+`
+	decoder := runTwitter(t, input)
+	for i := 0; i < 3; i++ {
+		var response _TestNormalResponse
+		if err := decoder.Decode(&response); err != nil || response.Id != int64(i) || !response.Success {
+			t.Errorf("Expected response (%v,true). Got(%v,%v)", i, response.Id, response.Success)
+		}
+	}
+	expected := map[int64][]string{3: {"third", "second"}, 4: {"third", "second", "first"}}
+	for i := int64(3); i <= 4; i++ {
+		var response _TestFeedResponse
+		decoder.Decode(&response)
+		if response.Id != i || len(response.Feed) != len(expected[i]) {
+			t.Errorf("Expected feed response %v with %v posts. Got:%v", i, len(expected[i]), response)
+			continue
+		}
+		for j, post := range response.Feed {
+			if post.Body != expected[i][j] {
+				t.Errorf("Expected post:%v at position:%v of feed response %v. Got:%v", expected[i][j], j, i, post.Body)
+			}
+		}
+	}
+}
+
+// This test walks a feed page by page in both orders, passing the cursor of each page back in the task for
+// the next, and checks that every post is returned exactly once, including posts with the same timestamp that
+// would otherwise be split across two pages, and that the cursor is the timestamp of the last post of a page.
+func TestFeedPagination(t *testing.T) {
+
+	f := feed.NewFeed()
+	for _, ts := range []float64{1, 2, 3, 3, 3, 4, 5, 6.5, 7} {
+		f.Add(strconv.FormatFloat(ts, 'f', -1, 64), ts)
+	}
+	walkPages(t, f, "desc", [][]string{{"7", "6.5"}, {"5", "4"}, {"3", "3", "3"}, {"2", "1"}})
+	walkPages(t, f, "asc", [][]string{{"1", "2"}, {"3", "3", "3"}, {"4", "5"}, {"6.5", "7"}})
+
+	// A page that reaches the end of the feed, or a limit bigger than the feed, has no cursor.
+	var response ServerFeedPageMessage
+	cursor := 3.0
+	json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 4, Cursor: &cursor, Limit: 2}), &response)
+	if len(response.Feed) != 2 || response.NextCursor != nil {
+		t.Errorf("Expected the oldest 2 posts and no cursor. Got:%v, %v", response.Feed, response.NextCursor)
+	}
+	json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 5, Limit: 100}), &response)
+	if len(response.Feed) != 9 || response.NextCursor != nil {
+		t.Errorf("Expected every post and no cursor. Got:%v, %v", response.Feed, response.NextCursor)
+	}
+}
+
+// This test checks that since keeps meaning the posts newer than it with a limit, in both orders, and that
+// a page of those posts continues from its cursor.
+func TestFeedPaginationSince(t *testing.T) {
+
+	f := feed.NewFeed()
+	for _, ts := range []float64{1, 2, 3, 4, 5} {
+		f.Add(strconv.FormatFloat(ts, 'f', -1, 64), ts)
+	}
+	since := 2.0
+	var response ServerFeedPageMessage
+	json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 1, Since: &since, Limit: 2}), &response)
+	if len(response.Feed) != 2 || response.Feed[0].Body != "5" || response.Feed[1].Body != "4" || response.NextCursor == nil || *response.NextCursor != 4 {
+		t.Errorf("Expected the newest 2 posts after timestamp 2 and cursor 4. Got:%v, %v", response.Feed, response.NextCursor)
+	}
+	json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 2, Since: &since, Cursor: response.NextCursor, Limit: 2}), &response)
+	if len(response.Feed) != 1 || response.Feed[0].Body != "3" || response.NextCursor != nil {
+		t.Errorf("Expected the last post after timestamp 2 and no cursor. Got:%v, %v", response.Feed, response.NextCursor)
+	}
+	json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 3, Since: &since, Order: "asc", Limit: 2}), &response)
+	if len(response.Feed) != 2 || response.Feed[0].Body != "3" || response.Feed[1].Body != "4" || response.NextCursor == nil || *response.NextCursor != 4 {
+		t.Errorf("Expected the oldest 2 posts after timestamp 2 and cursor 4. Got:%v, %v", response.Feed, response.NextCursor)
+	}
+}
+
+// This test pages across timestamp 0 and negative timestamps, which are cursors like any other, and checks
+// that a since of 0 is not taken to mean the whole feed.
+func TestFeedPaginationAcrossZero(t *testing.T) {
+
+	f := feed.NewFeed()
+	for _, ts := range []float64{-2.5, -1, 0, 0, 1, 2} {
+		f.Add(strconv.FormatFloat(ts, 'f', -1, 64), ts)
+	}
+	walkPages(t, f, "desc", [][]string{{"2", "1"}, {"0", "0"}, {"-1", "-2.5"}})
+	walkPages(t, f, "asc", [][]string{{"-2.5", "-1"}, {"0", "0"}, {"1", "2"}})
+
+	// Polling since 0 only returns the posts after it.
+	var response ServerFeedMessage
+	since := 0.0
+	json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 1, Since: &since}), &response)
+	if len(response.Feed) != 2 || response.Feed[0].Body != "2" || response.Feed[1].Body != "1" {
+		t.Errorf("Expected the 2 posts after timestamp 0. Got:%v", response.Feed)
+	}
+}
+
+// walkPages reads f with FEED tasks of limit 2 in order, starting without a cursor and then passing the cursor
+// of each page back in the task for the next, and checks that the pages have the expected bodies and that the
+// cursor of each page is the timestamp of its last post.
+func walkPages(t *testing.T, f feed.Feed, order string, expected [][]string) {
+	t.Helper()
+	var cursor *float64
+	for page := 0; ; page++ {
+		var response ServerFeedPageMessage
+		if err := json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: page, Cursor: cursor, Order: order, Limit: 2}), &response); err != nil {
+			t.Fatalf("%v: Could not unmarshal page %v: %v", order, page, err)
+		}
+		if page >= len(expected) {
+			t.Fatalf("%v: Expected %v pages. Got another:%v", order, len(expected), response.Feed)
+		}
+		bodies := []string{}
+		for _, post := range response.Feed {
+			bodies = append(bodies, post.Body)
+		}
+		if fmt.Sprint(bodies) != fmt.Sprint(expected[page]) {
+			t.Errorf("%v: Expected page %v to have posts:%v. Got:%v", order, page, expected[page], bodies)
+		}
+		if response.NextCursor == nil {
+			if page != len(expected)-1 {
+				t.Errorf("%v: Expected a cursor after page %v of %v", order, page, len(expected))
+			}
+			return
+		}
+		if last := response.Feed[len(response.Feed)-1].Timestamp.String(); strconv.FormatFloat(*response.NextCursor, 'f', -1, 64) != last {
+			t.Errorf("%v: Expected the cursor of page %v to be the timestamp of its last post:%v. Got:%v", order, page, last, *response.NextCursor)
+		}
+		cursor = response.NextCursor
+	}
+}
+
+// This test checks that FEED responses carry the version of the feed, which only changes when the feed does.
+func TestFeedVersion(t *testing.T) {
+
+	f := feed.NewFeed()
+	version := func(id int) uint64 {
+		var response struct{ Version uint64 }
+		json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: id}), &response)
+		return response.Version
+	}
+
+	if v := version(1); v != 0 {
+		t.Errorf("Expected an empty feed to have version 0. Got:%v", v)
+	}
+	dispatchResponse(f, ClientMessage{Command: "ADD", Id: 2, Body: "first", Timestamp: 1})
+	added := version(3)
+	if added == 0 || version(4) != added {
+		t.Errorf("Expected the version to go up once and stay the same across reads. Got:%v", added)
+	}
+	dispatchResponse(f, ClientMessage{Command: "LIKE", Id: 5, Timestamp: 1})
+	if liked := version(6); liked <= added {
+		t.Errorf("Expected a like to raise the version above %v. Got:%v", added, liked)
+	}
+}
+
+func TestStatsRequest(t *testing.T) {
+
+	input := `{"command":"STATS","id":0}
+{"command":"ADD","id":1,"body":"first","timestamp":1}
+{"command":"ADD","id":2,"body":"second","timestamp":2}
+{"command":"LIKE","id":3,"timestamp":2}
+{"command":"STATS","id":4}
+{"command":"DONE"}
+`
+	var stats struct {
+		Id         int64   `json:"id"`
+		Count      int     `json:"count"`
+		Oldest     float64 `json:"oldest"`
+		Newest     float64 `json:"newest"`
+		TotalLikes int     `json:"totalLikes"`
+	}
+	decoder := runTwitter(t, input)
+	decoder.Decode(&stats)
+	if stats.Id != 0 || stats.Count != 0 || stats.Oldest != 0 || stats.Newest != 0 || stats.TotalLikes != 0 {
+		t.Errorf("Expected the stats of an empty feed. Got:%v", stats)
+	}
+	for i := 1; i <= 3; i++ {
+		var response _TestNormalResponse
+		if err := decoder.Decode(&response); err != nil || response.Id != int64(i) || !response.Success {
+			t.Errorf("Expected response (%v,true). Got(%v,%v)", i, response.Id, response.Success)
+		}
+	}
+	decoder.Decode(&stats)
+	if stats.Id != 4 || stats.Count != 2 || stats.Oldest != 1 || stats.Newest != 2 || stats.TotalLikes != 1 {
+		t.Errorf("Expected the stats of a feed with two posts and one like. Got:%v", stats)
+	}
+}
+
+func TestRemoveRangeRequest(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":1}
+{"command":"ADD","id":1,"body":"second","timestamp":2}
+{"command":"ADD","id":2,"body":"third","timestamp":3}
+{"command":"REMOVERANGE","id":3,"from":1,"to":2}
+{"command":"REMOVERANGE","id":4,"from":1,"to":2}
+{"command":"FEED","id":5}
+{"command":"DONE"}
+`
+	decoder := runTwitter(t, input)
+	for i := 0; i < 3; i++ {
+		var response _TestNormalResponse
+		if err := decoder.Decode(&response); err != nil || response.Id != int64(i) || !response.Success {
+			t.Errorf("Expected response (%v,true). Got(%v,%v)", i, response.Id, response.Success)
+		}
+	}
+	for i, count := range []int{2, 0} {
+		var response struct {
+			Id    int64 `json:"id"`
+			Count int   `json:"count"`
+		}
+		if err := decoder.Decode(&response); err != nil || response.Id != int64(i+3) || response.Count != count {
+			t.Errorf("Expected response (%v,%v). Got(%v,%v)", i+3, count, response.Id, response.Count)
+		}
+	}
+	var feedResponse _TestFeedResponse
+	decoder.Decode(&feedResponse)
+	if len(feedResponse.Feed) != 1 || feedResponse.Feed[0].Body != "third" {
+		t.Errorf("Expected only the third post to remain. Got:%v", feedResponse.Feed)
+	}
+}
+
+func TestAuthorRequest(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","author":"alice","timestamp":1}
+{"command":"ADD","id":1,"body":"second","timestamp":2}
+{"command":"UPSERT","id":2,"body":"third","author":"bob","timestamp":3}
+{"command":"UPSERT","id":3,"body":"first edited","author":"carol","timestamp":1}
+{"command":"FEED","id":4}
+{"command":"DONE"}
+`
+	decoder := runTwitter(t, input)
+	for i := 0; i < 4; i++ {
+		var response _TestNormalResponse
+		if err := decoder.Decode(&response); err != nil || response.Id != int64(i) || !response.Success {
+			t.Errorf("Expected response (%v,true). Got(%v,%v)", i, response.Id, response.Success)
+		}
+	}
+	var feedResponse struct {
+		Id   int64 `json:"id"`
+		Feed []struct {
+			Body   string `json:"body"`
+			Author string `json:"author"`
+		} `json:"feed"`
+	}
+	decoder.Decode(&feedResponse)
+	//An upsert that creates a post gives it the author, one that updates a post keeps its author
+	if len(feedResponse.Feed) != 3 || feedResponse.Feed[0].Author != "bob" || feedResponse.Feed[1].Author != "" ||
+		feedResponse.Feed[2].Body != "first edited" || feedResponse.Feed[2].Author != "alice" {
+		t.Errorf("Expected the first and third posts to have an author. Got:%v", feedResponse.Feed)
+	}
+}
+
+// This test processes a known mix of tasks with -summary, sequentially and with several consumers,
+// and checks the number of tasks counted for each command.
+func TestSummary(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":1}
+{"command":"ADD","id":1,"body":"second","timestamp":2}
+{"command":"ADD","id":2,"body":"third","timestamp":3}
+{"command":"REMOVE","id":3,"timestamp":1}
+{"command":"REMOVE","id":4,"timestamp":1}
+{"command":"CONTAINS","id":5,"timestamp":2}
+{"command":"LIKE","id":6,"timestamp":2}
+{"command":"FEED","id":7}
+{"command":"FEED","id":8}
+{"command":"BOGUS","id":9}
+{"command":"DONE"}
+`
+	expected := map[string]int64{"ADD": 3, "REMOVE": 2, "CONTAINS": 1, "FEED": 2, "LIKE": 1}
+	for _, args := range [][]string{{"-summary", "-compact"}, {"-summary", "-compact", "4", "2"}} {
+		var summary map[string]int64
+		for _, line := range strings.Split(strings.TrimSpace(runTwitterOutput(t, input, args...)), "\n") {
+			var response ServerSummaryMessage
+			if json.Unmarshal([]byte(line), &response) == nil && response.Summary != nil {
+				summary = response.Summary
+			}
+		}
+		if len(summary) != len(summaryCommands) {
+			t.Errorf("Expected a count for each of the %v commands with args %v. Got:%v", len(summaryCommands), args, summary)
+		}
+		for _, command := range summaryCommands {
+			if summary[command] != expected[command] {
+				t.Errorf("Expected %v %v tasks with args %v. Got:%v", expected[command], command, args, summary[command])
+			}
+		}
+	}
+}
+
+// This test adds posts with scores to a feed ranked by score and checks that FEED shows the highest score first,
+// both sequentially and with a goroutine, while posts are still found by timestamp.
+func TestRankedFeed(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"low","timestamp":1,"score":1}
+{"command":"ADD","id":1,"body":"high","timestamp":2,"score":30}
+{"command":"ADD","id":2,"body":"middle","timestamp":3,"score":20}
+{"command":"ADD","id":3,"body":"unscored","timestamp":4}
+{"command":"REMOVE","id":4,"timestamp":3}
+{"command":"FEED","id":5}
+{"command":"DONE"}
+`
+	expected := `{"success":true,"id":0,"postId":1}
+{"success":true,"id":1,"postId":2}
+{"success":true,"id":2,"postId":3}
+{"success":true,"id":3,"postId":4}
+{"success":true,"id":4}
+{"id":5,"feed":[{"body":"high","timestamp":2,"score":30},{"body":"low","timestamp":1,"score":1},{"body":"unscored","timestamp":4}],"version":5}
+` + doneAck(6)
+	for _, args := range [][]string{{"-rank", "score", "-compact"}, {"-rank", "score", "-compact", "1", "1"}} {
+		if out := runTwitterOutput(t, input, args...); out != expected {
+			t.Errorf("Expected the posts in order of score with args %v. Got:\n%v", args, out)
+		}
+	}
+}
+
+// This test adds two posts with timestamps that are the same as a float64 but not as an int64 and checks that
+// with -int64 they are separate posts, both sequentially and with a goroutine, that their timestamps are
+// printed exactly and that the other commands work on the same feed.
+func TestInt64Timestamps(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":9007199254740992}
+{"command":"ADD","id":1,"body":"second","timestamp":9007199254740993}
+{"command":"CONTAINS","id":2,"timestamp":9007199254740993}
+{"command":"REMOVE","id":3,"timestamp":9007199254740992}
+{"command":"CONTAINS","id":4,"timestamp":9007199254740992}
+{"command":"FEED","id":5}
+{"command":"ADD","id":6,"body":"small","timestamp":5}
+{"command":"LIKE","id":7,"timestamp":5}
+{"command":"EMPTY","id":8}
+{"command":"GETNTH","id":9,"n":0}
+{"command":"DONE"}
+`
+	expected := `{"success":true,"id":0,"postId":1}
+{"success":true,"id":1,"postId":2}
+{"success":true,"id":2}
+{"success":true,"id":3}
+{"success":false,"id":4}
+{"id":5,"feed":[{"body":"second","timestamp":9007199254740993}],"version":3}
+{"success":true,"id":6,"postId":3}
+{"success":true,"id":7}
+{"id":8,"empty":false}
+{"success":true,"id":9,"post":{"body":"second","timestamp":9007199254740993}}
+` + doneAck(10)
+	for _, args := range [][]string{{"-int64", "-compact"}, {"-int64", "-compact", "1", "1"}} {
+		if out := runTwitterOutput(t, input, args...); out != expected {
+			t.Errorf("Expected the posts to be kept apart with args %v. Got:\n%v", args, out)
+		}
+	}
+
+	// The tasks of a batch are queued as they were read, so their timestamps past 2^53 stay exact too.
+	input = `[{"command":"ADD","id":0,"body":"first","timestamp":9007199254740992},{"command":"ADD","id":1,"body":"second","timestamp":9007199254740993}]
+[{"command":"CONTAINS","id":2,"timestamp":9007199254740993},{"command":"REMOVE","id":3,"timestamp":9007199254740993},{"command":"FEED","id":4}]
+{"command":"DONE"}
+`
+	expected = `{"success":true,"id":0,"postId":1}
+{"success":true,"id":1,"postId":2}
+{"success":true,"id":2}
+{"success":true,"id":3}
+{"id":4,"feed":[{"body":"first","timestamp":9007199254740992}],"version":3}
+` + doneAck(5)
+	for _, args := range [][]string{{"-int64", "-compact"}, {"-int64", "-compact", "1", "1"}, {"-int64", "-compact", "2", "1"}} {
+		if out := runTwitterOutput(t, input, args...); out != expected {
+			t.Errorf("Expected the batched posts to keep their exact timestamps with args %v. Got:\n%v", args, out)
+		}
+	}
+
+	// A timestamp that is not an integer is an error.
+	input = `{"command":"ADD","id":0,"body":"fraction","timestamp":1.5}
+{"command":"DONE"}
+`
+	if out := runTwitterOutput(t, input, "-int64", "-compact"); out != `{"error":"timestamp 1.5 is not an int64","line":1}`+"\n"+doneAck(1) {
+		t.Errorf("Expected an error for a timestamp that is not an integer. Got:%v", out)
+	}
+}
+
+// This test puts responses into a sequencer out of order and checks that they are written in the order
+// their tasks were read, including tasks without a response and tasks with the same id.
+func TestSequencer(t *testing.T) {
+
+	var out bytes.Buffer
+	s := newSequencer(&out)
+	for _, id := range []int{0, 1, 2, 2, 3} {
+		s.expect(id)
+	}
+
+	s.put(2, []byte("2a "))
+	s.put(1, nil)
+	if out.Len() != 0 {
+		t.Errorf("Expected nothing to be written before the first response is put. Got:%q", out.String())
+	}
+	s.put(0, []byte("0 "))
+	if out.String() != "0 2a " {
+		t.Errorf("Expected the responses up to the first unfinished task. Got:%q", out.String())
+	}
+	s.put(3, []byte("3 "))
+	s.put(2, []byte("2b "))
+	if out.String() != "0 2a 2b 3 " || len(s.pending) != 0 || len(s.order) != 0 {
+		t.Errorf("Expected every response in order with nothing left buffered. Got:%q", out.String())
+	}
+}
+
+// This test runs many consumers with -ordered and checks that the responses are printed in increasing id order.
+func TestOrderedOutput(t *testing.T) {
+
+	const taskCount = 1000
+	var input strings.Builder
+	for i := 0; i < taskCount; i++ {
+		switch i % 4 {
+		case 0, 1:
+			fmt.Fprintf(&input, `{"command":"ADD","id":%v,"body":"post","timestamp":%v}`+"\n", i, i)
+		case 2:
+			fmt.Fprintf(&input, `{"command":"CONTAINS","id":%v,"timestamp":%v}`+"\n", i, i-1)
+		default:
+			fmt.Fprintf(&input, `{"command":"FEED","id":%v}`+"\n", i)
+		}
+	}
+	input.WriteString(`{"command":"DONE"}` + "\n")
+
+	decoder := runTwitter(t, input.String(), "-ordered", "-compact", "16", "1")
+	for i := 0; i < taskCount; i++ {
+		var response struct {
+			Id int `json:"id"`
+		}
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatalf("Expected %v responses. Got:%v (%v)", taskCount, i, err)
+		}
+		if response.Id != i {
+			t.Fatalf("Expected the response to task %v. Got:%v", i, response.Id)
+		}
+	}
+}
+
+// blockingFeed is a feed whose ShowFeedPosts blocks until it is released, which keeps a consumer busy on a FEED task.
+type blockingFeed struct {
+	feed.Feed
+	release chan bool
+}
+
+func (f *blockingFeed) ShowFeedPosts() []feed.PostView {
+	<-f.release
+	return f.Feed.ShowFeedPosts()
+}
+
+// waitForStatus polls the status of the pool until ready returns true or a few seconds have passed.
+func waitForStatus(ctx *SharedContext, ready func(PoolStatus) bool) PoolStatus {
+	status := ctx.Status()
+	for i := 0; i < 500 && !ready(status); i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = ctx.Status()
+	}
+	return status
+}
+
+// This test starts a pool of consumers, keeps them busy on FEED tasks and checks that the status shows the
+// queued work, then checks the status after the DONE task once every consumer has exited.
+func TestPoolStatus(t *testing.T) {
+
+	const threads = 2
+	const tasks = 10
+	f := &blockingFeed{feed.NewFeed(), make(chan bool)}
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed}
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go consumer(int64(i), 1, f, q, &ctx)
+	}
+	status := waitForStatus(&ctx, func(s PoolStatus) bool { return s.Workers == threads })
+	if status.Workers != threads || status.Busy != 0 || status.QueueDepth != 0 || status.Done {
+		t.Errorf("Expected %v idle workers before any work. Got:%+v", threads, status)
+	}
+
+	for i := 0; i < tasks; i++ {
+		atomic.AddInt64(&numOfTasks, 1)
+		q.Enqueue([]byte(`{"command":"FEED","id":` + strconv.Itoa(i) + `}`))
+	}
+	status = waitForStatus(&ctx, func(s PoolStatus) bool { return s.Busy == threads })
+	if status.Workers != threads || status.Busy != threads || status.QueueDepth != tasks-threads {
+		t.Errorf("Expected %v busy workers and %v queued tasks. Got:%+v", threads, tasks-threads, status)
+	}
+
+	atomic.StoreInt32(&ctx.done, 1)
+	q.Close()
+	close(f.release)
+	wg.Wait()
+	status = ctx.Status()
+	if status.Workers != 0 || status.Busy != 0 || status.QueueDepth != 0 || !status.Done {
+		t.Errorf("Expected no workers or queued tasks after DONE. Got:%+v", status)
+	}
+}
+
+// slowFeed is a feed whose Add sleeps first, which makes the consumers slower than the producer.
+// This test registers a custom ECHO command and a handler that replaces STATS and checks that dispatch
+// performs them with the handlers, and that removing a handler brings back the built-in command.
+func TestRegisterHandler(t *testing.T) {
+
+	f := feed.NewFeed()
+	f.Add("first", 1)
+	var echoed []ClientMessage
+	registerHandler("ECHO", func(handled feed.Feed, cm ClientMessage) []byte {
+		if handled != f {
+			t.Errorf("Expected the handler to be given the feed")
+		}
+		echoed = append(echoed, cm)
+		return []byte(cm.Body + "\n")
+	})
+	registerHandler("STATS", func(feed.Feed, ClientMessage) []byte { return []byte("replaced\n") })
+	defer registerHandler("ECHO", nil)
+	defer registerHandler("STATS", nil)
+
+	response, err := handleLine(f, []byte(`{"command":"ECHO","id":1,"body":"hello"}`), newConfig())
+	if err != nil || string(response) != "hello\n" || len(echoed) != 1 || echoed[0].Body != "hello" {
+		t.Errorf("Expected the ECHO handler to be invoked with the task. Got:%q, %v, %v", response, err, echoed)
+	}
+	if response := string(dispatchResponse(f, ClientMessage{Command: "STATS", Id: 2})); response != "replaced\n" {
+		t.Errorf("Expected the STATS handler to replace the built-in command. Got:%q", response)
+	}
+
+	// Once the handlers are removed ECHO is unknown again and STATS is the built-in command.
+	registerHandler("ECHO", nil)
+	registerHandler("STATS", nil)
+	if _, err := handleLine(f, []byte(`{"command":"ECHO","id":3}`), newConfig()); err == nil || len(echoed) != 1 {
+		t.Errorf("Expected ECHO to be an unknown command once its handler is removed. Got:%v", err)
+	}
+	if response := string(dispatchResponse(f, ClientMessage{Command: "STATS", Id: 4})); !strings.Contains(response, `"count": 1`) {
+		t.Errorf("Expected the built-in STATS once its handler is removed. Got:%q", response)
+	}
+}
+
+// This test adds posts and then looks them up with timestamps that differ only below the precision, and
+// checks that they match once normalized but not when timestamps are used exactly.
+func TestTimestampNormalization(t *testing.T) {
+
+	tenth, fifth := 0.1, 0.2
+	sum := tenth + fifth // 0.30000000000000004, as a client computing the timestamp would send it
+	tests := []struct {
+		name      string
+		added     float64
+		looked    float64
+		precision int
+		matches   bool
+	}{
+		{"computed", sum, 0.3, 6, true},
+		{"below a microsecond", 43242420.0000001, 43242420.0000004, 6, true},
+		{"a microsecond apart", 43242420.000001, 43242420.000002, 6, false},
+		{"below a second", 1595636181.2, 1595636180.9, 0, true},
+		{"exact", sum, 0.3, -1, false},
+		{"too big to round", 1e300, 1e300, 6, true},
+	}
+	for _, test := range tests {
+		cfg := newConfig()
+		cfg.precision = test.precision
+		f := feed.NewFeed()
+		configResponse(f, ClientMessage{Command: "ADD", Id: 1, Body: "post", Timestamp: test.added}, cfg)
+		contains := strings.Contains(string(configResponse(f, ClientMessage{Command: "CONTAINS", Id: 2, Timestamp: test.looked}, cfg)), `"success": true`)
+		all := strings.Contains(string(configResponse(f, ClientMessage{Command: "CONTAINSALL", Id: 3, Body: "[" + strconv.FormatFloat(test.looked, 'g', -1, 64) + "]"}, cfg)), ": true")
+		removed := strings.Contains(string(configResponse(f, ClientMessage{Command: "REMOVE", Id: 4, Timestamp: test.looked}, cfg)), `"success": true`)
+		if contains != test.matches || all != test.matches || removed != test.matches {
+			t.Errorf("Expected the %v timestamps to match:%v. Got contains:%v, contains all:%v, removed:%v", test.name, test.matches, contains, all, removed)
+		}
+	}
+
+	// The feed shows the normalized timestamp.
+	cfg := newConfig()
+	cfg.precision = 6
+	f := feed.NewFeed()
+	configResponse(f, ClientMessage{Command: "ADD", Id: 1, Body: "post", Timestamp: sum}, cfg)
+	expected := "{\n  \"id\": 2,\n  \"feed\": [\n    {\n      \"body\": \"post\",\n      \"timestamp\": 0.3\n    }\n  ],\n  \"version\": 1\n}\n"
+	if response := string(configResponse(f, ClientMessage{Command: "FEED", Id: 2}, cfg)); response != expected {
+		t.Errorf("Expected the feed to show the normalized timestamp. Got:%q", response)
+	}
+
+	// Without -precision timestamps are used exactly as given.
+	var out bytes.Buffer
+	input := `{"command":"ADD","id":1,"body":"post","timestamp":0.30000000000000004}` + "\n" + `{"command":"FEED","id":2}` + "\n"
+	if code := run(nil, strings.NewReader(input), &out); code != exitOK || !strings.Contains(out.String(), `"timestamp": 0.30000000000000004`) {
+		t.Errorf("Expected the timestamp to be used exactly as given by default. Got:%v %q", code, out.String())
+	}
+}
+
+// This test performs SELFTEST tasks on a healthy feed, with and without a queue, and on a feed whose posts
+// were put out of order through the feed package's test hook, and checks that the response reports the
+// state of each.
+func TestSelfTest(t *testing.T) {
+
+	f := feed.NewFeed()
+	f.Add("first", 1)
+	f.Add("second", 2)
+
+	// Tasks performed sequentially have no queue.
+	expected := "{\n  \"id\": 1,\n  \"feed_sorted\": true,\n  \"queue_len\": 0,\n  \"queue_empty\": true\n}\n"
+	if response := string(dispatchResponse(f, ClientMessage{Command: "SELFTEST", Id: 1})); response != expected {
+		t.Errorf("Expected response:%q. Got:%q", expected, response)
+	}
+
+	// The tasks still waiting in the queue are reported.
+	cfg := newConfig()
+	cfg.queue = newQueue(false)
+	cfg.queue.Enqueue([]byte(`{"command":"ADD","id":2,"body":"third","timestamp":3}`))
+	cfg.queue.Enqueue([]byte(`{"command":"FEED","id":3}`))
+	expected = "{\n  \"id\": 4,\n  \"feed_sorted\": true,\n  \"queue_len\": 2,\n  \"queue_empty\": false\n}\n"
+	if response := string(configResponse(f, ClientMessage{Command: "SELFTEST", Id: 4}, cfg)); response != expected {
+		t.Errorf("Expected response:%q. Got:%q", expected, response)
+	}
+
+	// A corrupt feed is reported along with why it failed.
+	cfg.queue.Dequeue()
+	cfg.queue.Dequeue()
+	expected = "{\n  \"id\": 5,\n  \"feed_sorted\": false,\n  \"feed_error\": \"feed: post id:1 with timestamp:2 is before post id:2 with timestamp:1\",\n  \"queue_len\": 0,\n  \"queue_empty\": true\n}\n"
+	if response := string(configResponse(corruptFeed{f}, ClientMessage{Command: "SELFTEST", Id: 5}, cfg)); response != expected {
+		t.Errorf("Expected response:%q. Got:%q", expected, response)
+	}
+}
+
+// corruptFeed is a feed whose Validate fails as if a concurrency bug had put its posts out of order.
+type corruptFeed struct {
+	feed.Feed
+}
+
+func (f corruptFeed) Validate() error {
+	return errors.New("feed: post id:1 with timestamp:2 is before post id:2 with timestamp:1")
+}
+
+type slowFeed struct {
+	feed.Feed
+}
+
+func (f slowFeed) Add(body string, timestamp float64) uint64 {
+	time.Sleep(time.Millisecond)
+	return f.Feed.Add(body, timestamp)
+}
+
+// This test produces ADD tasks much faster than the consumers can process them and checks that the
+// producer pauses at the high mark so that the queue depth stays bounded.
+func TestProducerBackpressure(t *testing.T) {
+
+	const threads = 2
+	const tasks = 200
+	const highMark, lowMark = 10, 5
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed,
+		highMark: highMark, lowMark: lowMark, space: sync.NewCond(new(sync.Mutex))}
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go consumer(int64(i), 1, slowFeed{feed.NewFeed()}, q, &ctx)
+	}
+
+	// Sample the queue depth while the producer runs.
+	var maxDepth, stop int32
+	sampled := make(chan bool)
+	go func() {
+		for atomic.LoadInt32(&stop) == 0 {
+			if depth := int32(q.Len()); depth > atomic.LoadInt32(&maxDepth) {
+				atomic.StoreInt32(&maxDepth, depth)
+			}
+			time.Sleep(50 * time.Microsecond)
+		}
+		sampled <- true
+	}()
+
+	var input strings.Builder
+	for i := 0; i < tasks; i++ {
+		input.WriteString(`{"command":"ADD","id":` + strconv.Itoa(i) + `,"body":"post","timestamp":` + strconv.Itoa(i) + "}\n")
+	}
+	input.WriteString(`{"command":"DONE"}` + "\n")
+	producer(strings.NewReader(input.String()), q, &ctx, 1024)
+	wg.Wait()
+	atomic.StoreInt32(&stop, 1)
+	<-sampled
+
+	if depth := atomic.LoadInt32(&maxDepth); depth > highMark+1 {
+		t.Errorf("Expected the queue depth to stay at most %v. Got:%v", highMark+1, depth)
+	}
+	if processed != tasks {
+		t.Errorf("Expected all %v tasks to be processed. Got:%v", tasks, processed)
+	}
+}
+
+// This test has two producers read ADD tasks with disjoint ids at the same time, one ending with DONE and
+// the other just ending, and checks that every task from both is processed before the consumers finish.
+func TestProducers(t *testing.T) {
+
+	const threads = 4
+	const tasksPerReader = 500
+	f := feed.NewFeed()
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, out: io.Discard}
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go consumer(int64(i), 1, f, q, &ctx)
+	}
+
+	var first, second strings.Builder
+	for i := 0; i < tasksPerReader; i++ {
+		first.WriteString(`{"command":"ADD","id":` + strconv.Itoa(i) + `,"body":"first","timestamp":` + strconv.Itoa(i) + "}\n")
+		id := tasksPerReader + i
+		second.WriteString(`{"command":"ADD","id":` + strconv.Itoa(id) + `,"body":"second","timestamp":` + strconv.Itoa(id) + "}\n")
+	}
+	first.WriteString(`{"command":"DONE"}` + "\n")
+	producers([]io.Reader{strings.NewReader(first.String()), strings.NewReader(second.String())}, q, &ctx, 1024)
+	if atomic.LoadInt32(&ctx.done) != 1 {
+		t.Errorf("Expected the tasks to be done once both producers have stopped")
+	}
+	wg.Wait()
+
+	if processed != 2*tasksPerReader {
+		t.Errorf("Expected all %v tasks to be processed. Got:%v", 2*tasksPerReader, processed)
+	}
+	for i := 0; i < 2*tasksPerReader; i++ {
+		if !f.Contains(float64(i)) {
+			t.Errorf("Expected the post added by task %v to be in the feed", i)
+		}
+	}
+}
+
+// This test sends a line that is not valid JSON and then a task with an unknown command in strict mode, sequentially
+// and in parallel, and checks that the program reports the error and exits with an error before performing the
+// tasks after it.
+func TestStrict(t *testing.T) {
+
+	for _, bad := range []string{`{"command": "ADD", "id": 2,`, `{"command": "SHOUT", "id": 2}`, `{"command": "ADD", "id": 2, "body": "far too long", "timestamp": 2}`} {
+		for _, args := range [][]string{{"-strict", "-maxBodyLen", "5"}, {"-strict", "-maxBodyLen", "5", "2", "1"}} {
+			input := `{"command": "ADD", "id": 1, "body": "first", "timestamp": 1}` + "\n" + bad + "\n" +
+				`{"command": "ADD", "id": 3, "body": "never", "timestamp": 3}` + "\n" + `{"command": "DONE"}` + "\n"
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+			cmd := exec.CommandContext(ctx, "go", append([]string{"run", "."}, args...)...)
+			cmd.Stdin = strings.NewReader(input)
+			out, err := cmd.Output()
+			cancel()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Errorf("Expected twitter %v to exit with an error for %v. Got:%v", args, bad, err)
+			}
+			if !strings.Contains(string(out), `"error"`) {
+				t.Errorf("Expected twitter %v to report the error for %v. Got:%s", args, bad, out)
+			}
+			if strings.Contains(string(out), `"id": 3`) {
+				t.Errorf("Expected twitter %v to stop before the task after %v. Got:%s", args, bad, out)
+			}
+		}
+	}
+
+	// The same input without -strict is processed to the end.
+	input := `{"command": "SHOUT", "id": 2}` + "\n" + `{"command": "ADD", "id": 3, "body": "kept", "timestamp": 3}` + "\n" + `{"command": "DONE"}` + "\n"
+	if out := runTwitterOutput(t, input, "2", "1"); !strings.Contains(out, `"id": 3`) {
+		t.Errorf("Expected the task after an unknown command to be performed without -strict. Got:%s", out)
+	}
+}
+
+// This test queues tasks, stops the run as a bad task does in strict mode and checks that the consumers
+// answer every queued task with an error instead of performing it before they exit.
+func TestStrictAbortAnswersQueuedTasks(t *testing.T) {
+
+	const taskCount = 10
+	f := feed.NewFeed()
+	q := newQueue(false)
+	var out bytes.Buffer
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, out: &out}
+	for i := 0; i < taskCount; i++ {
+		q.Enqueue([]byte(fmt.Sprintf(`{"command":"ADD","id":%v,"body":"queued","timestamp":%v,"line":%v}`, i, i, i+1)))
+	}
+	newProducerGroup(1).abort(q, &ctx)
+	<-spawnConsumers(2, 3, f, q, &ctx)
+
+	answered := make(map[int]bool)
+	decoder := json.NewDecoder(&out)
+	for {
+		var response ServerErrorMessage
+		if err := decoder.Decode(&response); err != nil {
+			break
+		}
+		if response.Error != errAborted.Error() || answered[response.Line] {
+			t.Errorf("Expected one aborted error for each queued task. Got:%+v", response)
+		}
+		answered[response.Line] = true
+	}
+	if len(answered) != taskCount || f.Count() != 0 || processed != taskCount {
+		t.Errorf("Expected the %v queued tasks to be answered without being performed. Got:%v answered, %v posts, %v processed", taskCount, len(answered), f.Count(), processed)
+	}
+}
+
+// This test sets a maximum body length and checks that ADD, UPSERT and SWAP tasks with a body at or below
+// the limit are performed while longer ones are reported as too long and leave the feed unchanged. The
+// length is counted in characters, so a body with a multibyte character at the limit is allowed.
+func TestMaxBodyLen(t *testing.T) {
+
+	cfg := newConfig()
+	cfg.maxBodyLen = 5
+
+	tooLong := "{\n  \"error\": \"body too long\"\n}\n"
+	f := feed.NewFeed()
+	for i, test := range []struct {
+		task    ClientMessage
+		allowed bool
+	}{
+		{ClientMessage{Command: "ADD", Body: "four", Timestamp: 1}, true},
+		{ClientMessage{Command: "ADD", Body: "five!", Timestamp: 2}, true},
+		{ClientMessage{Command: "ADD", Body: "six!!!", Timestamp: 3}, false},
+		{ClientMessage{Command: "ADD", Body: "héllo", Timestamp: 4}, true}, // 5 characters but 6 bytes
+		{ClientMessage{Command: "ADD", Body: "héllo!", Timestamp: 5}, false},
+		{ClientMessage{Command: "ADD", Body: "日本語です", Timestamp: 6}, true},
+		{ClientMessage{Command: "UPSERT", Body: "toolong", Timestamp: 1}, false},
+		{ClientMessage{Command: "SWAP", Body: "toolong", Timestamp: 2}, false},
+		{ClientMessage{Command: "SWAP", Body: "short", Timestamp: 2}, true},
+	} {
+		test.task.Id = i
+		response := string(configResponse(f, test.task, cfg))
+		if (response != tooLong) != test.allowed {
+			t.Errorf("Expected %v with a %v byte body to be allowed:%v. Got:%q", test.task.Command, len(test.task.Body), test.allowed, response)
+		}
+	}
+	for _, timestamp := range []float64{3, 5} {
+		if f.Contains(timestamp) {
+			t.Errorf("Expected the post with a body too long at %v not to be added", timestamp)
+		}
+	}
+	if !f.Contains(4) || !f.Contains(6) || f.Count() != 4 {
+		t.Errorf("Expected the 4 posts with a short enough body to be added. Got:%v", f.Count())
+	}
+}
+
+// This test runs the program with a quota of posts per user and checks that a user over the quota is
+// answered with an error while another user still posts to their own feed, that removing a post frees
+// up the quota again, and that an ADD with a key is checked the same way while its retry is answered.
+func TestQuota(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":1,"user":1}
+{"command":"ADD","id":1,"body":"second","timestamp":2,"user":1}
+{"command":"ADD","id":2,"body":"third","timestamp":3,"user":1}
+{"command":"ADD","id":3,"body":"hello","timestamp":3,"user":2}
+{"command":"FEED","id":4,"user":1}
+{"command":"REMOVE","id":5,"timestamp":1,"user":1}
+{"command":"ADD","id":6,"body":"third","timestamp":3,"user":1}
+{"command":"FEED","id":7,"user":2}
+{"command":"ADD","id":8,"body":"fourth","timestamp":4,"user":1,"key":"k"}
+{"command":"ADD","id":9,"body":"fifth","timestamp":5,"user":2,"key":"k"}
+{"command":"ADD","id":10,"body":"fifth","timestamp":5,"user":2,"key":"k"}
+{"command":"DONE"}
+`
+	expected := `{"success":true,"id":0,"postId":1}
+{"success":true,"id":1,"postId":2}
+{"error":"quota exceeded","line":3}
+{"success":true,"id":3,"postId":1}
+{"id":4,"feed":[{"body":"second","timestamp":2},{"body":"first","timestamp":1}],"version":2}
+{"success":true,"id":5}
+{"success":true,"id":6,"postId":3}
+{"id":7,"feed":[{"body":"hello","timestamp":3}],"version":1}
+{"error":"quota exceeded","line":9}
+{"success":true,"id":9,"postId":2}
+{"success":false,"id":10,"postId":2}
+`
+	for _, args := range [][]string{{"-compact", "-quota", "2"}, {"-compact", "-quota", "2", "1", "1"}} {
+		if output := runTwitterOutput(t, input, args...); output != expected+doneAck(11) {
+			t.Errorf("%v: Expected user 1 to be stopped at the quota:\n%v\nGot:\n%v", args, expected, output)
+		}
+	}
+}
+
+// This test has a producer read inputs with and without a DONE task and checks that the pool of consumers
+// exits either way and that the log tells the two apart.
+func TestProducerWithoutDone(t *testing.T) {
+
+	logOutput := &recordingWriter{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(defaultLogger)
+
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{`{"command":"ADD","id":0,"body":"first","timestamp":1}` + "\n" + `{"command":"DONE"}` + "\n", `level=DEBUG msg="input finished with DONE" input=0`},
+		{`{"command":"ADD","id":0,"body":"first","timestamp":1}` + "\n", `level=WARN msg="input ended without DONE" input=0`},
+	} {
+		q := newQueue(false)
+		var wg sync.WaitGroup
+		var numOfTasks, processed int64
+		ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, out: io.Discard}
+		completed := spawnConsumers(100, 1, feed.NewFeed(), q, &ctx)
+		producer(strings.NewReader(test.input), q, &ctx, 1024)
+		select {
+		case <-completed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the consumers to exit once the input of %q ended", test.input)
+		}
+		if output, _ := logOutput.output(); !strings.Contains(output, test.expected) || processed != 1 {
+			t.Errorf("Expected 1 task to be processed and the log to contain %q. Got %v tasks:%q", test.expected, processed, output)
+		}
+	}
+}
+
+// This test runs the program on an empty input, with no tasks and no DONE task, and checks that it exits
+// cleanly, printing only the DONE acknowledgement, instead of its consumers waiting forever for tasks.
+func TestEmptyInput(t *testing.T) {
+
+	for _, args := range [][]string{{"4", "1"}, {}} {
+		if output := runTwitterOutput(t, "", append([]string{"-compact"}, args...)...); output != doneAck(0) {
+			t.Errorf("%v: Expected only the DONE acknowledgement for an empty input. Got:%q", args, output)
+		}
+	}
+}
+
+// This test stops the consumers mid-stream, as SIGINT does, while tasks are still queued and checks that
+// the report of unprocessed tasks lists exactly the tasks that did not get a response, including the tasks
+// of a batch one by one.
+func TestUnprocessedReport(t *testing.T) {
+
+	const taskCount = 20
+	q := newQueue(false)
+	output := &recordingWriter{}
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, out: output}
+	completed := spawnConsumers(2, 3, feed.NewFeed(), q, &ctx)
+
+	// Each WAIT task waits for a post that never comes, so the tasks are performed slowly.
+	for i := 0; i < taskCount-2; i++ {
+		q.Enqueue([]byte(fmt.Sprintf(`{"command":"WAIT","id":%v,"timestamp":1,"timeout":20}`, i)))
+	}
+	q.Enqueue([]byte(fmt.Sprintf(`[{"command":"WAIT","id":%v,"timestamp":1,"timeout":20},{"command":"WAIT","id":%v,"timestamp":1,"timeout":20}]`, taskCount-2, taskCount-1)))
+	ctx.waitForProcessed(1)
+	atomic.StoreInt32(&ctx.stopped, 1)
+	q.Close() // Nothing is queued once the program has been interrupted.
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the consumers to stop once the program was interrupted")
+	}
+
+	var report bytes.Buffer
+	unprocessedTask(&report, q, &ctx)
+	var unprocessed struct {
+		Unprocessed int
+		Tasks       []ClientMessage
+	}
+	if err := json.Unmarshal(report.Bytes(), &unprocessed); err != nil {
+		t.Fatalf("Expected the report to be JSON. Got:%q", report.String())
+	}
+	if unprocessed.Unprocessed != len(unprocessed.Tasks) || unprocessed.Unprocessed+int(processed) != taskCount {
+		t.Errorf("Expected %v tasks between the unprocessed and the %v processed. Got:%v unprocessed and %v listed",
+			taskCount, processed, unprocessed.Unprocessed, len(unprocessed.Tasks))
+	}
+	if processed == 0 || unprocessed.Unprocessed == 0 {
+		t.Errorf("Expected the consumers to stop mid-stream. Got:%v processed", processed)
+	}
+
+	// Every task either got a response or is listed as unprocessed, never both.
+	seen := make(map[int]int)
+	responses, _ := output.output()
+	decoder := json.NewDecoder(strings.NewReader(responses))
+	for {
+		var response ServerSuccessMessage
+		if err := decoder.Decode(&response); err != nil {
+			break
+		}
+		seen[response.Id]++
+	}
+	for _, task := range unprocessed.Tasks {
+		seen[task.Id]++
+	}
+	for i := 0; i < taskCount; i++ {
+		if seen[i] != 1 {
+			t.Errorf("Expected task %v to be processed or unprocessed exactly once. Got:%v times", i, seen[i])
+		}
+	}
+}
+
+// This test has a producer read an input that stops sending tasks without ending, as if whatever wrote it
+// hung, and checks that the idle watchdog closes the queue so the consumers exit, and that a task read
+// after that is not added to the closed queue.
+func TestIdleTimeout(t *testing.T) {
+
+	logOutput := &recordingWriter{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logOutput, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go func() {
+		io.WriteString(writer, `{"command":"ADD","id":0,"body":"first","timestamp":1}`+"\n")
+		io.WriteString(writer, `{"command":"ADD","id":1,"body":"second","timestamp":2}`+"\n")
+	}()
+
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, idleTimeout: 50 * time.Millisecond, out: io.Discard}
+	completed := spawnConsumers(4, 1, feed.NewFeed(), q, &ctx)
+	start := time.Now()
+	producer(reader, q, &ctx, 1024)
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the consumers to exit once the input was idle for the idle timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the queue to stay open for the idle timeout. Closed after:%v", elapsed)
+	}
+	if output, _ := logOutput.output(); processed != 2 || !strings.Contains(output, "no task read within the idle timeout") {
+		t.Errorf("Expected 2 tasks to be processed and the idle timeout to be logged. Got %v tasks:%q", processed, output)
+	}
+
+	// The producer is still waiting on the input. The next task it reads is dropped rather than added to the
+	// closed queue, which would panic.
+	io.WriteString(writer, `{"command":"ADD","id":2,"body":"late","timestamp":3}`+"\n")
+	if numOfTasks != 0 || q.Len() != 0 {
+		t.Errorf("Expected the late task not to be queued. Got:%v tasks", q.Len())
+	}
+}
+
+// This test dispatches a FEED task to a feed that blocks for longer than the task timeout and checks
+// that a timeout is reported and the consumer moves on to the next task.
+func TestTaskTimeout(t *testing.T) {
+
+	f := &blockingFeed{feed.NewFeed(), make(chan bool)}
+	defer close(f.release)
+
+	// A task that finishes in time gets its response.
+	response, err := dispatchWithTimeout(context.Background(), f, ClientMessage{Command: "ADD", Id: 0, Body: "first", Timestamp: 1}, newConfig(), time.Second, slog.Default())
+	if err != nil || !json.Valid(response) {
+		t.Errorf("Expected the ADD task to finish before the timeout. Got:%q, %v", response, err)
+	}
+
+	// A task that blocks times out.
+	start := time.Now()
+	response, err = dispatchWithTimeout(context.Background(), f, ClientMessage{Command: "FEED", Id: 1}, newConfig(), 50*time.Millisecond, slog.Default())
+	if err != errTaskTimeout || response != nil {
+		t.Errorf("Expected the FEED task to time out. Got:%q, %v", response, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the FEED task to time out after 50ms. Got:%v", elapsed)
+	}
+
+	// A task that blocks stops being waited for once its context is cancelled.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	response, err = dispatchWithTimeout(cancelled, f, ClientMessage{Command: "FEED", Id: 2}, newConfig(), time.Minute, slog.Default())
+	if err != context.Canceled || response != nil {
+		t.Errorf("Expected the FEED task to stop being waited for once cancelled. Got:%q, %v", response, err)
+	}
+
+	// A consumer stuck on the blocking task carries on with the tasks after it.
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, taskTimeout: 50 * time.Millisecond}
+	wg.Add(1)
+	go consumer(0, 1, f, q, &ctx)
+	q.Enqueue([]byte(`{"command":"FEED","id":2}`))
+	q.Enqueue([]byte(`{"command":"ADD","id":3,"body":"second","timestamp":2}`))
+	q.Close()
+	wg.Wait()
+	if processed != 2 || !f.Contains(2) {
+		t.Errorf("Expected the consumer to process the ADD task after the FEED task timed out. Got:%v processed", processed)
+	}
+}
+
+// panickingFeed is a feed whose AddWithAuthor panics for a post with the body "panic", like a handler with a bug.
+type panickingFeed struct {
+	feed.Feed
+}
+
+func (f *panickingFeed) AddWithAuthor(body string, author string, timestamp float64) (uint64, bool) {
+	if body == "panic" {
+		panic("bad post")
+	}
+	return f.Feed.AddWithAuthor(body, author, timestamp)
+}
+
+// This test has consumers perform tasks, some of which panic, and checks that every task is still processed,
+// the pool completes and the tasks that panicked get an error, with and without a task timeout.
+func TestConsumerRecoversFromPanic(t *testing.T) {
+
+	response, err := safeDispatch(&panickingFeed{feed.NewFeed()}, ClientMessage{Command: "ADD", Id: 0, Body: "panic", Timestamp: 1}, newConfig(), slog.Default())
+	if err != errTaskPanicked || response != nil {
+		t.Errorf("Expected the panic to be recovered. Got:%q, %v", response, err)
+	}
+
+	const tasks = 20
+	for _, timeout := range []time.Duration{0, time.Second} {
+		f := &panickingFeed{feed.NewFeed()}
+		q := newQueue(false)
+		var wg sync.WaitGroup
+		var numOfTasks, processed int64
+		ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, taskTimeout: timeout}
+		completed := spawnConsumers(2, 2, f, q, &ctx)
+
+		for i := 0; i < tasks; i++ {
+			body := "post"
+			if i%4 == 0 {
+				body = "panic"
+			}
+			q.Enqueue([]byte(`{"command":"ADD","id":` + strconv.Itoa(i) + `,"body":"` + body + `","timestamp":` + strconv.Itoa(i) + `}`))
+		}
+		q.Close()
+		select {
+		case <-completed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The consumers did not complete after tasks panicked with timeout %v", timeout)
+		}
+		if processed != tasks || len(f.ShowFeed()) != tasks-tasks/4 {
+			t.Errorf("Expected all %v tasks to be processed and the ones that did not panic added with timeout %v. Got:%v processed",
+				tasks, timeout, processed)
+		}
+	}
+}
+
+// This test selects on the channel returned by spawnConsumers with a timeout to check that it is only
+// closed once the queue has been closed and every task has been processed.
+func TestConsumersCompleted(t *testing.T) {
+
+	const threads = 4
+	const tasks = 100
+	f := feed.NewFeed()
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed}
+	completed := spawnConsumers(threads, 2, f, q, &ctx)
+
+	for i := 0; i < tasks; i++ {
+		atomic.AddInt64(&numOfTasks, 1)
+		q.Enqueue([]byte(`{"command":"ADD","id":` + strconv.Itoa(i) + `,"body":"post","timestamp":` + strconv.Itoa(i) + `}`))
+	}
+	select {
+	case <-completed:
+		t.Errorf("The consumers completed before the queue was closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	q.Close()
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The consumers did not complete within 5s of the queue being closed")
+	}
+	if processed != tasks || len(f.ShowFeed()) != tasks {
+		t.Errorf("Expected all %v tasks to be processed once the consumers completed. Got:%v", tasks, processed)
+	}
+}
+
+// This test has a consumer perform tasks with its output set to a buffer and checks the exact bytes written
+// for each task, so that the responses can be checked without running the program and capturing Stdout.
+func TestConsumerOutput(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		task     string
+		expected string
+	}{
+		{"add", `{"command":"ADD","id":0,"body":"third","timestamp":3}`,
+			"{\n  \"success\": true,\n  \"id\": 0,\n  \"postId\": 3\n}\n"},
+		{"remove", `{"command":"REMOVE","id":1,"timestamp":1}`,
+			"{\n  \"success\": true,\n  \"id\": 1\n}\n"},
+		{"contains", `{"command":"CONTAINS","id":2,"timestamp":3}`,
+			"{\n  \"success\": false,\n  \"id\": 2\n}\n"},
+		{"feed", `{"command":"FEED","id":3}`,
+			"{\n  \"id\": 3,\n  \"feed\": [\n    {\n      \"body\": \"second\",\n      \"timestamp\": 2\n    },\n" +
+				"    {\n      \"body\": \"first\",\n      \"timestamp\": 1\n    }\n  ],\n  \"version\": 2\n}\n"},
+		{"trim", `{"command":"TRIM","id":4,"n":1}`,
+			"{\n  \"id\": 4,\n  \"count\": 1\n}\n"},
+		{"unknown", `{"command":"UNKNOWN","id":5}`, "{\n  \"error\": \"unknown command \\\"UNKNOWN\\\"\"\n}\n"},
+	}
+	for _, test := range tests {
+		f := feed.NewFeed()
+		f.Add("first", 1)
+		f.Add("second", 2)
+		q := newQueue(false)
+		var wg sync.WaitGroup
+		var numOfTasks, processed int64
+		var out bytes.Buffer
+		ctx := SharedContext{cfg: newConfig(), wg: &wg, numOfTasks: &numOfTasks, processed: &processed, out: &out}
+		q.Enqueue([]byte(test.task))
+		q.Close()
+		wg.Add(1)
+		consumer(0, 1, f, q, &ctx)
+		if out.String() != test.expected {
+			t.Errorf("Performing the %v task expected output:%q. Got:%q", test.name, test.expected, out.String())
+		}
+	}
+}
+
+// This test has a consumer perform tasks, one of which panics, while tracing workers and checks that the
+// consumer's id is in the log lines for the tasks and in their responses.
+func TestTraceWorkers(t *testing.T) {
+
+	var logOutput bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logOutput, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(defaultLogger)
+
+	f := &panickingFeed{feed.NewFeed()}
+	q := newQueue(false)
+	var wg sync.WaitGroup
+	var numOfTasks, processed int64
+	var out bytes.Buffer
+	cfg := newConfig()
+	cfg.traceWorkers = true
+	ctx := SharedContext{cfg: cfg, wg: &wg, numOfTasks: &numOfTasks, processed: &processed, out: &out}
+	q.Enqueue([]byte(`{"command":"ADD","id":42,"body":"first","timestamp":1}`))
+	q.Enqueue([]byte(`{"command":"ADD","id":43,"body":"panic","timestamp":2}`))
+	q.Close()
+	wg.Add(1)
+	consumer(3, 1, f, q, &ctx)
+
+	for _, expected := range []string{"msg=task worker=3 id=42 command=ADD", "msg=task worker=3 id=43 command=ADD",
+		`msg="task panicked" worker=3 id=43 command=ADD`} {
+		if !strings.Contains(logOutput.String(), expected) {
+			t.Errorf("Expected the log to contain %q. Got:%q", expected, logOutput.String())
+		}
+	}
+	expected := "{\n  \"worker\": 3,\n  \"success\": true,\n  \"id\": 42,\n  \"postId\": 1\n}\n" +
+		"{\n  \"worker\": 3,\n  \"error\": \"task panicked\"\n}\n"
+	if out.String() != expected {
+		t.Errorf("Expected the responses to include the worker. Got:%q", out.String())
+	}
+
+	// Compact responses and responses with no fields get the worker too, anything else is left as it is.
+	for _, test := range []struct {
+		response string
+		expected string
+	}{
+		{"{\"id\":1}\n", "{\"worker\":7,\"id\":1}\n"},
+		{"{}\n", "{\"worker\":7}\n"},
+		{"not json\n", "not json\n"},
+		{"[1]\n", "[1]\n"},
+	} {
+		if traced := string(withWorker([]byte(test.response), 7, true)); traced != test.expected {
+			t.Errorf("Expected %q with the worker added. Got:%q", test.expected, traced)
+		}
+	}
+}
+
+// This test parses valid and invalid command line arguments and checks that only positive integers are
+// accepted and that a huge block size is capped.
+func TestParseArgs(t *testing.T) {
+
+	tests := []struct {
+		args    []string
+		threads int64
+		block   int64
+		valid   bool
+	}{
+		{[]string{"4", "2"}, 4, 2, true},
+		{[]string{"1", "1"}, 1, 1, true},
+		{[]string{"2", "1000000000"}, 2, maxBlockSize, true},
+		{[]string{"4", "abc"}, 0, 0, false},
+		{[]string{"abc", "2"}, 0, 0, false},
+		{[]string{"4", "0"}, 0, 0, false},
+		{[]string{"0", "2"}, 0, 0, false},
+		{[]string{"4", "-2"}, 0, 0, false},
+		{[]string{"-4", "2"}, 0, 0, false},
+		{[]string{"4", "2.5"}, 0, 0, false},
+		{[]string{"4", "99999999999999999999"}, 0, 0, false},
+		{[]string{"4"}, 0, 0, false},
+	}
+	for _, test := range tests {
+		threads, block, err := parseArgs(test.args)
+		if (err == nil) != test.valid {
+			t.Errorf("Expected parsing %v to be valid:%v. Got error:%v", test.args, test.valid, err)
+		}
+		if threads != test.threads || block != test.block {
+			t.Errorf("Expected parsing %v to give %v goroutines and block size %v. Got:%v, %v", test.args, test.threads, test.block, threads, block)
+		}
+	}
+}
+
+// This test sends the same ADD request with a key twice and checks that only the first one adds a post
+// and that the retry is given the id of the first post.
+func TestIdempotentAddRequest(t *testing.T) {
+
+	input := `{"command":"ADD","id":0,"body":"first","timestamp":1,"key":"abc"}
+{"command":"ADD","id":1,"body":"first","timestamp":1,"key":"abc"}
+{"command":"ADD","id":2,"body":"second","timestamp":2,"key":"def"}
+{"command":"FEED","id":3}
+{"command":"DONE"}
+`
+	decoder := runTwitter(t, input)
+	expected := []struct {
+		success bool
+		postId  uint64
+	}{{true, 1}, {false, 1}, {true, 2}}
+	for i, test := range expected {
+		var response struct {
+			_TestNormalResponse
+			PostId *uint64 `json:"postId"`
+		}
+		if err := decoder.Decode(&response); err != nil || response.Id != int64(i) || response.Success != test.success ||
+			response.PostId == nil || *response.PostId != test.postId {
+			t.Errorf("Expected response (%v,%v,%v). Got(%v,%v,%v)", i, test.success, test.postId, response.Id, response.Success, response.PostId)
+		}
+	}
+	var feedResponse _TestFeedResponse
+	decoder.Decode(&feedResponse)
+	if len(feedResponse.Feed) != 2 {
+		t.Errorf("Expected 2 posts after a retried ADD. Got:%v", feedResponse.Feed)
+	}
+}
+
+// This test dispatches each command to a feed with two posts and checks the exact response bytes.
+func TestDispatch(t *testing.T) {
+
+	one, two := 1.0, 2.0
+	tests := []struct {
+		name     string
+		task     ClientMessage
+		expected string
+	}{
+		{"add", ClientMessage{Command: "ADD", Id: 1, Body: "third", Timestamp: 3},
+			"{\n  \"success\": true,\n  \"id\": 1,\n  \"postId\": 3\n}\n"},
+		{"add with key", ClientMessage{Command: "ADD", Id: 2, Body: "third", Timestamp: 3, Key: "abc"},
+			"{\n  \"success\": true,\n  \"id\": 2,\n  \"postId\": 3\n}\n"},
+		{"remove", ClientMessage{Command: "REMOVE", Id: 3, Timestamp: 1},
+			"{\n  \"success\": true,\n  \"id\": 3\n}\n"},
+		{"remove missing", ClientMessage{Command: "REMOVE", Id: 4, Timestamp: 5},
+			"{\n  \"success\": false,\n  \"id\": 4\n}\n"},
+		{"contains", ClientMessage{Command: "CONTAINS", Id: 5, Timestamp: 2},
+			"{\n  \"success\": true,\n  \"id\": 5\n}\n"},
+		{"contains missing", ClientMessage{Command: "CONTAINS", Id: 6, Timestamp: 5},
+			"{\n  \"success\": false,\n  \"id\": 6\n}\n"},
+		{"feed", ClientMessage{Command: "FEED", Id: 7},
+			"{\n  \"id\": 7,\n  \"feed\": [\n    {\n      \"body\": \"second\",\n      \"timestamp\": 2\n    },\n    {\n      \"body\": \"first\",\n      \"timestamp\": 1\n    }\n  ],\n  \"version\": 2\n}\n"},
+		{"feed since", ClientMessage{Command: "FEED", Id: 8, Since: &two},
+			"{\n  \"id\": 8,\n  \"feed\": [],\n  \"version\": 2\n}\n"},
+		{"feed page", ClientMessage{Command: "FEED", Id: 43, Limit: 1},
+			"{\n  \"id\": 43,\n  \"feed\": [\n    {\n      \"body\": \"second\",\n      \"timestamp\": 2\n    }\n  ],\n  \"nextCursor\": 2,\n  \"version\": 2\n}\n"},
+		{"feed last page", ClientMessage{Command: "FEED", Id: 44, Cursor: &two, Limit: 1},
+			"{\n  \"id\": 44,\n  \"feed\": [\n    {\n      \"body\": \"first\",\n      \"timestamp\": 1\n    }\n  ],\n  \"nextCursor\": null,\n  \"version\": 2\n}\n"},
+		{"feed oldest first", ClientMessage{Command: "FEED", Id: 51, Order: "asc"},
+			"{\n  \"id\": 51,\n  \"feed\": [\n    {\n      \"body\": \"first\",\n      \"timestamp\": 1\n    },\n    {\n      \"body\": \"second\",\n      \"timestamp\": 2\n    }\n  ],\n  \"version\": 2\n}\n"},
+		{"feed oldest first page", ClientMessage{Command: "FEED", Id: 52, Order: "asc", Limit: 1},
+			"{\n  \"id\": 52,\n  \"feed\": [\n    {\n      \"body\": \"first\",\n      \"timestamp\": 1\n    }\n  ],\n  \"nextCursor\": 1,\n  \"version\": 2\n}\n"},
+		{"feed oldest first since", ClientMessage{Command: "FEED", Id: 53, Order: "asc", Since: &one},
+			"{\n  \"id\": 53,\n  \"feed\": [\n    {\n      \"body\": \"second\",\n      \"timestamp\": 2\n    }\n  ],\n  \"version\": 2\n}\n"},
+		{"feed bad order", ClientMessage{Command: "FEED", Id: 54, Order: "up"},
+			"{\n  \"error\": \"the order of a FEED task must be asc or desc. Got:\\\"up\\\"\"\n}\n"},
+		{"move", ClientMessage{Command: "MOVE", Id: 9, Timestamp: 1, NewTimestamp: 4},
+			"{\n  \"success\": true,\n  \"id\": 9\n}\n"},
+		{"like", ClientMessage{Command: "LIKE", Id: 10, Timestamp: 2},
+			"{\n  \"success\": true,\n  \"id\": 10\n}\n"},
+		{"top", ClientMessage{Command: "TOP", Id: 11, Limit: 1},
+			"{\n  \"id\": 11,\n  \"feed\": [\n    {\n      \"body\": \"first\",\n      \"timestamp\": 1,\n      \"likes\": 1\n    }\n  ]\n}\n"},
+		{"stats", ClientMessage{Command: "STATS", Id: 12},
+			"{\n  \"id\": 12,\n  \"count\": 2,\n  \"oldest\": 1,\n  \"newest\": 2,\n  \"totalLikes\": 0\n}\n"},
+		{"remove range", ClientMessage{Command: "REMOVERANGE", Id: 13, From: 1, To: 2},
+			"{\n  \"id\": 13,\n  \"count\": 2\n}\n"},
+		{"upsert create", ClientMessage{Command: "UPSERT", Id: 14, Body: "third", Timestamp: 3},
+			"{\n  \"success\": true,\n  \"id\": 14,\n  \"created\": true\n}\n"},
+		{"upsert update", ClientMessage{Command: "UPSERT", Id: 15, Body: "updated", Timestamp: 1},
+			"{\n  \"success\": true,\n  \"id\": 15,\n  \"created\": false\n}\n"},
+		{"swap", ClientMessage{Command: "SWAP", Id: 45, Body: "edited", Timestamp: 1},
+			"{\n  \"success\": true,\n  \"id\": 45,\n  \"oldBody\": \"first\"\n}\n"},
+		{"swap missing", ClientMessage{Command: "SWAP", Id: 46, Body: "edited", Timestamp: 3},
+			"{\n  \"success\": false,\n  \"id\": 46\n}\n"},
+		{"remove if", ClientMessage{Command: "REMOVEIF", Id: 16, Timestamp: 1, ExpectedBody: "first"},
+			"{\n  \"success\": true,\n  \"id\": 16\n}\n"},
+		{"remove if changed", ClientMessage{Command: "REMOVEIF", Id: 17, Timestamp: 1, ExpectedBody: "edited"},
+			"{\n  \"success\": false,\n  \"id\": 17\n}\n"},
+		{"count matching", ClientMessage{Command: "COUNTMATCH", Id: 18, Query: "ir"},
+			"{\n  \"id\": 18,\n  \"count\": 1\n}\n"},
+		{"count matching all", ClientMessage{Command: "COUNTMATCH", Id: 19},
+			"{\n  \"id\": 19,\n  \"count\": 2\n}\n"},
+		{"pop oldest", ClientMessage{Command: "POPOLDEST", Id: 20},
+			"{\n  \"success\": true,\n  \"id\": 20,\n  \"post\": {\n    \"body\": \"first\",\n    \"timestamp\": 1\n  }\n}\n"},
+		{"pop newest", ClientMessage{Command: "POPNEWEST", Id: 21},
+			"{\n  \"success\": true,\n  \"id\": 21,\n  \"post\": {\n    \"body\": \"second\",\n    \"timestamp\": 2\n  }\n}\n"},
+		{"pop", ClientMessage{Command: "POP", Id: 63, Timestamp: 1},
+			"{\n  \"success\": true,\n  \"id\": 63,\n  \"post\": {\n    \"body\": \"first\",\n    \"timestamp\": 1\n  }\n}\n"},
+		{"pop missing", ClientMessage{Command: "POP", Id: 64, Timestamp: 5},
+			"{\n  \"success\": false,\n  \"id\": 64\n}\n"},
+		{"get nth", ClientMessage{Command: "GETNTH", Id: 25, N: 1},
+			"{\n  \"success\": true,\n  \"id\": 25,\n  \"post\": {\n    \"body\": \"first\",\n    \"timestamp\": 1\n  }\n}\n"},
+		{"get nth out of range", ClientMessage{Command: "GETNTH", Id: 26, N: 2},
+			"{\n  \"success\": false,\n  \"id\": 26\n}\n"},
+		{"next", ClientMessage{Command: "NEXT", Id: 55, Timestamp: 1},
+			"{\n  \"success\": true,\n  \"id\": 55,\n  \"post\": {\n    \"body\": \"second\",\n    \"timestamp\": 2\n  }\n}\n"},
+		{"next after newest", ClientMessage{Command: "NEXT", Id: 56, Timestamp: 2},
+			"{\n  \"success\": false,\n  \"id\": 56\n}\n"},
+		{"prev", ClientMessage{Command: "PREV", Id: 57, Timestamp: 1.5},
+			"{\n  \"success\": true,\n  \"id\": 57,\n  \"post\": {\n    \"body\": \"first\",\n    \"timestamp\": 1\n  }\n}\n"},
+		{"prev before oldest", ClientMessage{Command: "PREV", Id: 58, Timestamp: 1},
+			"{\n  \"success\": false,\n  \"id\": 58\n}\n"},
+		{"closest", ClientMessage{Command: "CLOSEST", Id: 66, Timestamp: 1.4},
+			"{\n  \"success\": true,\n  \"id\": 66,\n  \"post\": {\n    \"body\": \"first\",\n    \"timestamp\": 1\n  }\n}\n"},
+		{"closest tie", ClientMessage{Command: "CLOSEST", Id: 67, Timestamp: 1.5},
+			"{\n  \"success\": true,\n  \"id\": 67,\n  \"post\": {\n    \"body\": \"second\",\n    \"timestamp\": 2\n  }\n}\n"},
+		{"histogram", ClientMessage{Command: "HISTOGRAM", Id: 59, Bucket: 2},
+			"{\n  \"id\": 59,\n  \"buckets\": {\n    \"0\": 1,\n    \"1\": 1\n  }\n}\n"},
+		{"histogram zero bucket", ClientMessage{Command: "HISTOGRAM", Id: 60},
+			"{\n  \"error\": \"the bucket of a HISTOGRAM task must be a positive number of seconds. Got:0\"\n}\n"},
+		{"empty", ClientMessage{Command: "EMPTY", Id: 61},
+			"{\n  \"id\": 61,\n  \"empty\": false\n}\n"},
+		{"size", ClientMessage{Command: "SIZE", Id: 65},
+			"{\n  \"id\": 65,\n  \"bytes\": 11\n}\n"},
+		{"contains with index", ClientMessage{Command: "CONTAINS", Id: 27, Timestamp: 1, WithIndex: true},
+			"{\n  \"success\": true,\n  \"id\": 27,\n  \"index\": 1\n}\n"},
+		{"contains newest with index", ClientMessage{Command: "CONTAINS", Id: 28, Timestamp: 2, WithIndex: true},
+			"{\n  \"success\": true,\n  \"id\": 28,\n  \"index\": 0\n}\n"},
+		{"contains absent with index", ClientMessage{Command: "CONTAINS", Id: 29, Timestamp: 3, WithIndex: true},
+			"{\n  \"success\": false,\n  \"id\": 29\n}\n"},
+		{"wait", ClientMessage{Command: "WAIT", Id: 30, Timestamp: 2},
+			"{\n  \"success\": true,\n  \"id\": 30\n}\n"},
+		{"wait timeout", ClientMessage{Command: "WAIT", Id: 31, Timestamp: 3, Timeout: 10},
+			"{\n  \"success\": false,\n  \"id\": 31\n}\n"},
+		{"trim", ClientMessage{Command: "TRIM", Id: 32, N: 1},
+			"{\n  \"id\": 32,\n  \"count\": 1\n}\n"},
+		{"trim all", ClientMessage{Command: "TRIM", Id: 33},
+			"{\n  \"id\": 33,\n  \"count\": 2\n}\n"},
+		{"trim none", ClientMessage{Command: "TRIM", Id: 34, N: 5},
+			"{\n  \"id\": 34,\n  \"count\": 0\n}\n"},
+		{"diff", ClientMessage{Command: "DIFF", Id: 35, Body: `[{"body":"first","timestamp":1},{"body":"old","timestamp":0.5}]`},
+			"{\n  \"id\": 35,\n  \"added\": [\n    {\n      \"body\": \"second\",\n      \"timestamp\": 2\n    }\n  ],\n" +
+				"  \"removed\": [\n    {\n      \"body\": \"old\",\n      \"timestamp\": 0.5\n    }\n  ]\n}\n"},
+		{"diff unchanged", ClientMessage{Command: "DIFF", Id: 36, Body: `[{"body":"second","timestamp":2},{"body":"first","timestamp":1}]`},
+			"{\n  \"id\": 36,\n  \"added\": [],\n  \"removed\": []\n}\n"},
+		{"contains approx", ClientMessage{Command: "CONTAINSAPPROX", Id: 38, Timestamp: 1.0000001, Epsilon: 0.001},
+			"{\n  \"success\": true,\n  \"id\": 38\n}\n"},
+		{"contains approx outside epsilon", ClientMessage{Command: "CONTAINSAPPROX", Id: 39, Timestamp: 1.5, Epsilon: 0.25},
+			"{\n  \"success\": false,\n  \"id\": 39\n}\n"},
+		{"contains many", ClientMessage{Command: "CONTAINSMANY", Id: 40, Body: `["second","third","first"]`},
+			"{\n  \"id\": 40,\n  \"found\": {\n    \"first\": true,\n    \"second\": true,\n    \"third\": false\n  }\n}\n"},
+		{"contains many none", ClientMessage{Command: "CONTAINSMANY", Id: 41, Body: `[]`},
+			"{\n  \"id\": 41,\n  \"found\": {}\n}\n"},
+		{"contains many bad body", ClientMessage{Command: "CONTAINSMANY", Id: 42, Body: `["first"`},
+			"{\n  \"error\": \"the body of a CONTAINSMANY task must be an array of bodies: unexpected end of JSON input\"\n}\n"},
+		{"contains all", ClientMessage{Command: "CONTAINSALL", Id: 47, Body: `[2, 0.5, 1, 1e21]`},
+			"{\n  \"id\": 47,\n  \"found\": {\n    \"0.5\": false,\n    \"1\": true,\n    \"1e+21\": false,\n    \"2\": true\n  }\n}\n"},
+		{"contains all none", ClientMessage{Command: "CONTAINSALL", Id: 48, Body: `[]`},
+			"{\n  \"id\": 48,\n  \"found\": {}\n}\n"},
+		{"contains all bad body", ClientMessage{Command: "CONTAINSALL", Id: 49, Body: `[1,`},
+			"{\n  \"error\": \"the body of a CONTAINSALL task must be an array of timestamps: unexpected end of JSON input\"\n}\n"},
+		{"compact", ClientMessage{Command: "COMPACT", Id: 50},
+			"{\n  \"id\": 50,\n  \"count\": 0\n}\n"},
+		{"diff bad body", ClientMessage{Command: "DIFF", Id: 37, Body: "first"},
+			"{\n  \"error\": \"the body of a DIFF task must be the feed to compare with: invalid character 'i' in literal false (expecting 'a')\"\n}\n"},
+		{"replace", ClientMessage{Command: "REPLACE", Id: 69, Body: `[{"body":"new","timestamp":5,"likes":2},{"body":"older","timestamp":4}]`},
+			"{\n  \"id\": 69,\n  \"count\": 2\n}\n"},
+		{"replace bad body", ClientMessage{Command: "REPLACE", Id: 70, Body: `{"body":"new","timestamp":1}`},
+			"{\n  \"error\": \"the body of a REPLACE task must be an array of posts: json: cannot unmarshal object into Go value of type []main.PostData\"\n}\n"},
+		{"done", ClientMessage{Command: "DONE"}, ""},
+		{"unknown", ClientMessage{Command: "UNKNOWN", Id: 22}, ""},
+	}
+	for _, test := range tests {
+		f := feed.NewFeed()
+		f.Add("first", 1)
+		f.Add("second", 2)
+		if test.task.Command == "TOP" {
+			f.Like(1)
+		}
+		if response := string(dispatchResponse(f, test.task)); response != test.expected {
+			t.Errorf("Dispatching %v expected response:%q. Got:%q", test.name, test.expected, response)
+		}
+	}
+
+	// An ADD to a full bounded feed reports that the oldest post was evicted.
+	f := feed.NewBoundedFeed(2)
+	f.Add("first", 1)
+	f.Add("second", 2)
+	expected := "{\n  \"success\": true,\n  \"id\": 23,\n  \"postId\": 3,\n  \"evicted\": true\n}\n"
+	if response := string(dispatchResponse(f, ClientMessage{Command: "ADD", Id: 23, Body: "third", Timestamp: 3})); response != expected {
+		t.Errorf("Dispatching an add to a full bounded feed expected response:%q. Got:%q", expected, response)
+	}
+
+	// A POPOLDEST on an empty feed fails without a post.
+	expected = "{\n  \"success\": false,\n  \"id\": 24\n}\n"
+	if response := string(dispatchResponse(feed.NewFeed(), ClientMessage{Command: "POPOLDEST", Id: 24})); response != expected {
+		t.Errorf("Dispatching a pop on an empty feed expected response:%q. Got:%q", expected, response)
+	}
+
+	// An EMPTY on a feed whose only post was removed finds it empty.
+	f = feed.NewFeed()
+	f.Add("only", 1)
+	f.Remove(1)
+	expected = "{\n  \"id\": 62,\n  \"empty\": true\n}\n"
+	if response := string(dispatchResponse(f, ClientMessage{Command: "EMPTY", Id: 62})); response != expected {
+		t.Errorf("Dispatching an empty check on an emptied feed expected response:%q. Got:%q", expected, response)
+	}
+
+	// A CLOSEST on an empty feed fails without a post.
+	expected = "{\n  \"success\": false,\n  \"id\": 68\n}\n"
+	if response := string(dispatchResponse(feed.NewFeed(), ClientMessage{Command: "CLOSEST", Id: 68, Timestamp: 1})); response != expected {
+		t.Errorf("Dispatching a closest on an empty feed expected response:%q. Got:%q", expected, response)
+	}
+}
+
+// dispatchResponse performs a task with dispatch and returns its response, which is nil if the command is unknown.
+func dispatchResponse(f feed.Feed, cm ClientMessage) []byte {
+	return configResponse(f, cm, newConfig())
+}
+
+// configResponse performs a task with the settings of cfg and returns the response, or nil if the command is unknown.
+func configResponse(f feed.Feed, cm ClientMessage, cfg *config) []byte {
+	response, _ := dispatch(f, cm, cfg)
+	return response
+}
+
+// This test parses the name of every built-in command and several names that are not commands, and checks
+// that dispatch returns an error for a task with an unknown command.
+func TestParseCommand(t *testing.T) {
+
+	for i, name := range summaryCommands {
+		command, err := parseCommand(name)
+		if err != nil || command != Command(i) || command.String() != name {
+			t.Errorf("Expected %v to parse as command %v. Got:%v %v", name, i, int(command), err)
+		}
+	}
+	if CmdAdd.String() != "ADD" || CmdHistogram.String() != "HISTOGRAM" || Command(len(summaryCommands)).String() == "" {
+		t.Errorf("Expected the commands to be named like summaryCommands. Got:%v %v", CmdAdd, CmdHistogram)
+	}
+	for _, name := range []string{"", "add", "REMVOE", " ADD", "ADD ", "DONE", "STATUS", "SUBSCRIBE", "UNKNOWN"} {
+		if _, err := parseCommand(name); err == nil || !strings.Contains(err.Error(), "unknown command") {
+			t.Errorf("Expected %q to be an unknown command. Got:%v", name, err)
+		}
+		response, err := dispatch(feed.NewFeed(), ClientMessage{Command: name, Id: 1}, newConfig())
+		if response != nil || err == nil {
+			t.Errorf("Expected dispatching %q to return an error. Got:%q %v", name, response, err)
+		}
+	}
+}
+
+// FuzzClientMessage feeds arbitrary lines through handleLine and checks that it never panics and
+// that every line gets either valid JSON responses or an error to report back to the client.
+func FuzzClientMessage(f *testing.F) {
+
+	seeds := []string{
+		`{"command":"ADD","id":0,"body":"just posted","timestamp":1}`,
+		`{"command":"ADD","id":0,"body":"just posted","timestamp":1,"key":"abc"}`,
+		`{"command":"REMOVE","id":1,"timestamp":1}`,
+		`{"command":"CONTAINS","id":2,"timestamp":1}`,
+		`{"command":"FEED","id":3,"since":1}`,
+		`{"command":"MOVE","id":4,"timestamp":1,"newTimestamp":2}`,
+		`{"command":"LIKE","id":5,"timestamp":2}`,
+		`{"command":"TOP","id":6,"limit":-1}`,
+		`{"command":"STATS","id":7}`,
+		`{"command":"REMOVERANGE","id":8,"from":2,"to":1}`,
+		`{"command":"UPSERT","id":9,"body":"updated","timestamp":1}`,
+		`{"command":"REMOVEIF","id":10,"timestamp":1,"expectedBody":"first"}`,
+		`{"command":"COUNTMATCH","id":11,"query":"st"}`,
+		`{"command":"POPOLDEST","id":12}`,
+		`{"command":"POPNEWEST","id":13}`,
+		`{"command":"GETNTH","id":14,"n":-1}`,
+		`{"command":"CONTAINS","id":15,"timestamp":1,"withIndex":true}`,
+		`{"command":"ADD","id":16,"body":"ranked","timestamp":1,"score":-2.5}`,
+		`{"command":"WAIT","id":17,"timestamp":1,"timeout":1}`,
+		`{"command":"TRIM","id":18,"n":-1}`,
+		`{"command":"CONTAINSAPPROX","id":20,"timestamp":1,"epsilon":-0.5}`,
+		`{"command":"CONTAINSMANY","id":21,"body":"[\"just posted\",\"\"]"}`,
+		`{"command":"FEED","id":22,"since":1,"limit":1}`,
+		`{"command":"FEED","id":30,"since":-1,"cursor":1,"limit":1}`,
+		`{"command":"SWAP","id":23,"body":"","timestamp":1}`,
+		`{"command":"SELFTEST","id":24}`,
+		`{"command":"CONTAINSALL","id":25,"body":"[1,-0,1e308,\"2\"]"}`,
+		`{"command":"COMPACT","id":26}`,
+		`{"command":"FEED","id":27,"order":"asc","limit":1}`,
+		`{"command":"NEXT","id":28,"timestamp":-1}`,
+		`{"command":"PREV","id":29,"timestamp":1e300}`,
+		`{"command":"HISTOGRAM","id":32,"bucket":1e-300}`,
+		`{"command":"EMPTY","id":33}`,
+		`{"command":"BARRIER","id":34}`,
+		`{"command":"POP","id":35,"timestamp":1}`,
+		`{"command":"FEED","id":36,"ifVersionNewerThan":18446744073709551615}`,
+		`{"command":"SIZE","id":37}`,
+		`{"command":"CLOSEST","id":38,"timestamp":-1e308}`,
+		`{"command":"REPLACE","id":39,"body":"[{\"body\":\"new\",\"timestamp\":1e308},{\"timestamp\":-0}]"}`,
+		`# a comment`,
+		`   `,
+		`{"command":"DIFF","id":19,"body":"[{\"body\":\"old\",\"timestamp\":3},null,5]"}`,
+		`{"command":"DONE"}`,
+		`{"command":"ADD","id":"0","timestamp":"1"}`,
+		`{"command":"ADD","id":1e40,"timestamp":1e400}`,
+		`{"command":null}`,
+		`{"command":"UNKNOWN"}`,
+		`[]`,
+		`[{"command":"ADD","id":30,"body":"batched","timestamp":3},{"command":"UNKNOWN"},{"command":"FEED","id":31},{"command":"DONE"}]`,
+		`[{"command":"FEED"},5]`,
+		`null`,
+		``,
+		`{`,
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		feed := feed.NewFeed()
+		feed.Add("first", 1)
+		feed.Add("second", 2)
+		response, err := handleLine(feed, line, newConfig())
+		if err == errDone {
+			return
+		}
+		if err != nil {
+			if err.Error() == "" {
+				t.Errorf("Line %q returned an error without a message", line)
+			}
+			return
+		}
+		// A batch has a response for each of its tasks.
+		decoder := json.NewDecoder(bytes.NewReader(response))
+		for {
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("Line %q returned a response that is not valid JSON:%q", line, response)
+				break
+			}
+		}
+		// A blank line or comment is skipped, any other line is answered.
+		if isCommentLine(line) && len(response) != 0 {
+			t.Errorf("Line %q is skipped but returned a response:%q", line, response)
+		} else if len(response) == 0 && !isCommentLine(line) {
+			t.Errorf("Line %q returned neither a response nor an error", line)
+		}
+	})
+}
+
+// This test checks that jsonNumber writes timestamps exactly like encoding/json, so a FEED response is the
+// same whether its posts were unmarshalled from ShowFeed or copied from ShowFeedPosts.
+func TestJSONNumber(t *testing.T) {
+
+	for _, f := range []float64{0, math.Copysign(0, -1), 1, -1, 0.5, 43242423, 1.5e9, 123456789.123, 1e-6, 1e-7, -1.25e-9,
+		1e20, 1e21, 1.5e300, -1e21, 5e-324, math.MaxFloat64} {
+		expected, _ := json.Marshal(f)
+		if got := jsonNumber(f); string(got) != string(expected) {
+			t.Errorf("Expected %v to be written as %s. Got:%s", f, expected, got)
+		}
+	}
+}
+
+// This test interleaves ADDs, BARRIERs and FEEDs, some of them in a batch, and checks that each BARRIER
+// passes after the response to every task before it and that the FEED after it shows every ADD before it,
+// in the parallel version with many goroutines and sequentially.
+func TestBarrier(t *testing.T) {
+
+	const addCount = 100
+	var input strings.Builder
+	for i := 1; i <= addCount; i++ {
+		fmt.Fprintf(&input, `{"command":"ADD","id":%v,"body":"post","timestamp":%v}`+"\n", i, i)
+	}
+	input.WriteString(`{"command":"BARRIER","id":1000}` + "\n")
+	input.WriteString(`{"command":"FEED","id":1001}` + "\n")
+	fmt.Fprintf(&input, `[{"command":"ADD","id":%v,"body":"batched","timestamp":%v},{"command":"BARRIER","id":1002},{"command":"FEED","id":1003}]`+"\n", addCount+1, addCount+1)
+	input.WriteString(`{"command":"DONE"}` + "\n")
+
+	for _, args := range [][]string{{"8", "1"}, {"3", "4"}, {}} {
+		dec := runTwitter(t, input.String(), args...)
+		added := 0
+		feeds := map[int]int{}
+		for {
+			var response map[string]interface{}
+			if err := dec.Decode(&response); err != nil {
+				break
+			}
+			if response["command"] == "DONE" { // The acknowledgement has no id.
+				continue
+			}
+			id := int(response["id"].(float64))
+			if _, ok := response["postId"]; ok {
+				added++
+			} else if response["status"] == "passed" {
+				if expected := map[int]int{1000: addCount, 1002: addCount + 1}[id]; added != expected || response["command"] != "BARRIER" {
+					t.Errorf("%v: Expected BARRIER %v to pass after %v ADDs. Got:%v after %v ADDs", args, id, expected, response, added)
+				}
+			} else if feed, ok := response["feed"].([]interface{}); ok {
+				feeds[id] = len(feed)
+			}
+		}
+		if feeds[1001] != addCount || feeds[1003] != addCount+1 {
+			t.Errorf("%v: Expected the FEEDs after each BARRIER to show every ADD before it. Got:%v", args, feeds)
+		}
+	}
+}
+
+// This test reads tasks from a file with a line that cannot be parsed in the middle and checks that the
+// error reports the line it is on, sequentially and in the parallel version, and so do the errors of a
+// task with an unknown command and of a task whose body is too long, which are reported once the task
+// is performed.
+func TestErrorLine(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tasks.txt")
+	input := `{"command": "ADD", "id": 1, "body": "first", "timestamp": 1}` + "\n" +
+		`{"command": "ADD", "id": 2, "body": "second", "timestamp": 2}` + "\n" +
+		`{"command": "ADD", "id": 3,` + "\n" +
+		`{"command": "SHOUT", "id": 4}` + "\n" +
+		`[{"command": "ADD", "id": 5, "body": "ok", "timestamp": 5}, {"command": "ADD", "id": 6, "body": "far too long", "timestamp": 6}]` + "\n" +
+		`{"command": "DONE"}` + "\n"
+	if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{{"-maxBodyLen", "5", "-input", path}, {"-maxBodyLen", "5", "-input", path, "2", "1"}} {
+		dec := runTwitter(t, "", args...)
+		lines := map[int]bool{}
+		for {
+			var response ServerErrorMessage
+			if err := dec.Decode(&response); err != nil {
+				break
+			}
+			if response.Error != "" {
+				lines[response.Line] = true
+			}
+		}
+		for _, line := range []int{3, 4, 5} {
+			if !lines[line] {
+				t.Errorf("%v: Expected an error on line %v. Got errors on lines:%v", args, line, lines)
+			}
+		}
+		if lines[0] {
+			t.Errorf("%v: Expected every error to have its line. Got errors on lines:%v", args, lines)
+		}
+	}
+}
+
+// This test sends FEED tasks with the version the client already has and checks that only an unchanged
+// response is written while the version is not stale, and the whole feed once the feed has changed.
+func TestFeedIfVersionNewerThan(t *testing.T) {
+
+	f := feed.NewFeed()
+	f.Add("first", 1)
+	f.Add("second", 2)
+	unchanged := "{\n  \"id\": 1,\n  \"unchanged\": true\n}\n"
+	for _, version := range []uint64{2, 3} {
+		if response := string(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 1, IfVersionNewerThan: &version})); response != unchanged {
+			t.Errorf("Expected an unchanged response for a client with version %v. Got:%q", version, response)
+		}
+	}
+
+	// A stale version, including 0 for a client that has never seen the feed, gets the feed.
+	for _, version := range []uint64{0, 1} {
+		var response ServerFeedMessage
+		json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 2, IfVersionNewerThan: &version}), &response)
+		if len(response.Feed) != 2 || response.Version != 2 {
+			t.Errorf("Expected the feed at version 2 for a client with version %v. Got:%+v", version, response)
+		}
+	}
+
+	// Once the feed changes the version the client has is stale.
+	f.Remove(1)
+	version := uint64(2)
+	var response ServerFeedMessage
+	json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 3, IfVersionNewerThan: &version}), &response)
+	if len(response.Feed) != 1 || response.Version != 3 {
+		t.Errorf("Expected the changed feed at version 3. Got:%+v", response)
+	}
+
+	// The field is decoded from a task and left out when it is not given.
+	var cm ClientMessage
+	if err := json.Unmarshal([]byte(`{"command":"FEED","id":4,"ifVersionNewerThan":0}`), &cm); err != nil || cm.IfVersionNewerThan == nil || *cm.IfVersionNewerThan != 0 {
+		t.Errorf("Expected ifVersionNewerThan 0 to be decoded. Got:%v %v", cm.IfVersionNewerThan, err)
+	}
+	if encoded, _ := json.Marshal(ClientMessage{Command: "FEED", Id: 5}); strings.Contains(string(encoded), "ifVersionNewerThan") {
+		t.Errorf("Expected no ifVersionNewerThan when it is not given. Got:%s", encoded)
+	}
+}
+
+// This test saturates the readers of the feed's lock and checks that FEED tasks still return promptly,
+// from the snapshot, with the version the snapshot is from.
+func TestFeedSnapshotUnderReaderLoad(t *testing.T) {
+
+	rw := lock.NewRWMutex()
+	f := feed.NewFeedWithLock(rw)
+	f.Add("first", 1)
+	f.Add("second", 2)
+	f.(feed.SnapshotFeed).SetSnapshotRefresh(10 * time.Millisecond)
+	defer f.(feed.SnapshotFeed).SetSnapshotRefresh(0)
+
+	// Take every read slot the lock has, so one more reader would wait.
+	const readers = 65
+	for i := 0; i < readers; i++ {
+		rw.RLock()
+	}
+	start := time.Now()
+	for id := 1; id <= 100; id++ {
+		done := make(chan []byte, 1)
+		saturated := time.Since(start)
+		go func() { done <- dispatchResponse(f, ClientMessage{Command: "FEED", Id: id}) }()
+		select {
+		case response := <-done:
+			var feedResponse ServerFeedMessage
+			json.Unmarshal(response, &feedResponse)
+			if !feedResponse.Cached || len(feedResponse.Feed) != 2 || feedResponse.Version != f.Version() {
+				t.Fatalf("Expected the 2 posts of version %v from the snapshot. Got:%s", f.Version(), response)
+			}
+			// The refresh cannot take the read lock either, so the snapshot only gets older.
+			if feedResponse.CachedAge == nil || *feedResponse.CachedAge < saturated.Milliseconds() {
+				t.Fatalf("Expected the age of a snapshot taken before the readers were saturated. Got:%s", response)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("FEED task %v did not return while the readers were saturated", id)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the FEED tasks to return promptly. Took:%v", elapsed)
+	}
+
+	// A client that already has the snapshot's version is told the feed is unchanged.
+	version := f.Version()
+	if response := string(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 101, IfVersionNewerThan: &version})); !strings.Contains(response, "unchanged") {
+		t.Errorf("Expected an unchanged response. Got:%q", response)
+	}
+	for i := 0; i < readers; i++ {
+		rw.RUnlock()
+	}
+
+	// Once the lock is free the posts are read from the feed, so the response is not cached.
+	var response ServerFeedMessage
+	json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: 102}), &response)
+	if response.Cached || response.CachedAge != nil || len(response.Feed) != 2 {
+		t.Errorf("Expected the posts read under the lock. Got:%+v", response)
+	}
+}
+
+// This test intersperses comments and blank lines with the tasks of a hand-written input and checks that
+// only the tasks are performed and no errors are reported, even with -strict, and that a bad task after
+// them is still reported with its own line number.
+func TestCommentAndBlankLines(t *testing.T) {
+
+	input := "# Add two posts.\n" +
+		"\n" +
+		`{"command": "ADD", "id": 1, "body": "first", "timestamp": 1}` + "\n" +
+		"   \t\n" +
+		`  # An indented comment {"command": "ADD", "id": 9, "body": "ignored", "timestamp": 9}` + "\n" +
+		`{"command": "ADD", "id": 2, "body": "second", "timestamp": 2}` + "\n" +
+		"\r\n" +
+		`{"command": "BARRIER", "id": 3}` + "\n" +
+		"# Then read them back.\n" +
+		`{"command": "FEED", "id": 4}` + "\n"
+	for _, args := range [][]string{{}, {"-strict"}, {"2", "1"}, {"-strict", "2", "1"}} {
+		output := runTwitterOutput(t, input+`{"command": "DONE"}`+"\n", args...)
+		dec := json.NewDecoder(withoutDoneAck(strings.NewReader(output)))
+		ids := map[int]bool{}
+		for {
+			var response struct {
+				Id    int        `json:"id"`
+				Error string     `json:"error"`
+				Feed  []PostData `json:"feed"`
+			}
+			if err := dec.Decode(&response); err != nil {
+				break
+			}
+			if response.Error != "" {
+				t.Errorf("%v: Expected no errors. Got:%q", args, output)
+			}
+			ids[response.Id] = true
+			if response.Id == 4 && len(response.Feed) != 2 {
+				t.Errorf("%v: Expected the feed to have the 2 posts added. Got:%v", args, response.Feed)
+			}
+		}
+		if len(ids) != 4 || !ids[1] || !ids[2] || !ids[3] || !ids[4] {
+			t.Errorf("%v: Expected responses to tasks 1 to 4 only. Got:%q", args, output)
+		}
+	}
+
+	// Skipped lines still count toward the line number of an error.
+	dec := runTwitter(t, input+`{"command": "ADD", "id": 5,`+"\n"+`{"command": "DONE"}`+"\n")
+	for {
+		var response ServerErrorMessage
+		if err := dec.Decode(&response); err != nil {
+			t.Errorf("Expected an error for the bad task")
+			break
+		}
+		if response.Error != "" {
+			if response.Line != 11 {
+				t.Errorf("Expected the error on line 11. Got:%+v", response)
+			}
+			break
+		}
+	}
+}
+
+// This test replaces the feed with REPLACE tasks while other goroutines read it with FEED tasks and checks
+// that every FEED response has all of the old posts or all of the new posts, never some of each.
+func TestReplaceAtomic(t *testing.T) {
+
+	const postCount = 20
+	generations := make([]string, 2)
+	for g := range generations {
+		posts := make([]PostData, postCount)
+		for i := range posts {
+			posts[i] = PostData{Body: strconv.Itoa(g), Timestamp: json.Number(strconv.Itoa(i + 1))}
+		}
+		body, _ := json.Marshal(posts)
+		generations[g] = string(body)
+	}
+	for _, f := range []feed.Feed{feed.NewFeed(), feed.NewRCUFeed()} {
+		dispatchResponse(f, ClientMessage{Command: "REPLACE", Id: 1, Body: generations[0]})
+
+		var stop int32
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for id := 2; atomic.LoadInt32(&stop) == 0; id++ {
+					var response ServerFeedMessage
+					json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "FEED", Id: id}), &response)
+					if len(response.Feed) != postCount {
+						t.Errorf("Expected the %v posts of one generation. Got:%+v", postCount, response.Feed)
+						return
+					}
+					for _, post := range response.Feed {
+						if post.Body != response.Feed[0].Body {
+							t.Errorf("Expected the posts of one generation. Got:%+v", response.Feed)
+							return
+						}
+					}
+				}
+			}()
+		}
+		for i := 0; i < 200; i++ {
+			var response ServerCountMessage
+			json.Unmarshal(dispatchResponse(f, ClientMessage{Command: "REPLACE", Id: 1, Body: generations[i%2]}), &response)
+			if response.Count != postCount {
+				t.Errorf("Expected a REPLACE to report %v posts. Got:%v", postCount, response.Count)
+			}
+		}
+		atomic.StoreInt32(&stop, 1)
+		wg.Wait()
+	}
+
+	//A lock-free feed cannot replace its posts in one step, so REPLACE is an error
+	expected := "{\n  \"error\": \"" + feed.ErrReplaceUnsupported.Error() + "\"\n}\n"
+	if response := string(dispatchResponse(feed.NewLockFreeFeed(), ClientMessage{Command: "REPLACE", Id: 1, Body: generations[0]})); response != expected {
+		t.Errorf("Expected REPLACE to fail on a lock-free feed. Got:%v Expected:%v", response, expected)
+	}
+}
+
+// This test calls run with clean inputs, inputs with tasks that fail and bad arguments, sequentially and in
+// parallel, and checks the exit code it returns for each.
+func TestRunExitCode(t *testing.T) {
+
+	clean := `{"command": "ADD", "id": 1, "body": "first", "timestamp": 1}` + "\n" +
+		`{"command": "CONTAINS", "id": 2, "timestamp": 1}` + "\n" + `{"command": "DONE"}` + "\n"
+	unknown := `{"command": "ADD", "id": 1, "body": "first", "timestamp": 1}` + "\n" +
+		`{"command": "SHOUT", "id": 2}` + "\n" + `{"command": "DONE"}` + "\n"
+	badLine := `{"command": "ADD", "id": 1,` + "\n" + `{"command": "DONE"}` + "\n"
+	badBucket := `{"command": "HISTOGRAM", "id": 1, "bucket": 0}` + "\n" + `{"command": "DONE"}` + "\n"
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	tests := []struct {
+		name     string
+		args     []string
+		input    string
+		expected int
+	}{
+		{"clean", nil, clean, exitOK},
+		{"clean parallel", []string{"2", "1"}, clean, exitOK},
+		{"empty", nil, "", exitOK},
+		{"unknown command", nil, unknown, exitTaskErrors},
+		{"unknown command parallel", []string{"2", "1"}, unknown, exitTaskErrors},
+		{"bad line", nil, badLine, exitTaskErrors},
+		{"bad line parallel", []string{"2", "1"}, badLine, exitTaskErrors},
+		{"failed task", nil, badBucket, exitTaskErrors},
+		{"strict", []string{"-strict"}, unknown, exitTaskErrors},
+		{"strict parallel", []string{"-strict", "2", "1"}, unknown, exitTaskErrors},
+		{"help", []string{"-help"}, clean, exitOK},
+		{"unknown flag", []string{"-nope"}, clean, exitFatal},
+		{"bad rank", []string{"-rank", "random"}, clean, exitFatal},
+		{"bad goroutines", []string{"0", "1"}, clean, exitFatal},
+		{"missing input", []string{"-input", missing}, clean, exitFatal},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if code := run(test.args, strings.NewReader(test.input), &out); code != test.expected {
+			t.Errorf("%v: Expected exit code %v. Got:%v, output:%q", test.name, test.expected, code, out.String())
+		}
+	}
+
+	// A clean run after a run with errors exits cleanly, since the errors are counted per run.
+	var out bytes.Buffer
+	run(nil, strings.NewReader(unknown), &out)
+	if code := run(nil, strings.NewReader(clean), &out); code != exitOK {
+		t.Errorf("Expected a clean run after a run with errors to exit with %v. Got:%v", exitOK, code)
+	}
+}